@@ -0,0 +1,123 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+const accessLogObjectType = "accessLog"
+
+// ReadIdentityAudited appends an entry to the access log of the identity for a read for
+// purpose, and adds the use of the consents for purpose to the consent ledger. It must be
+// submitted for the entry to be committed, so it returns the entry rather than the identity,
+// which clients evaluate with ReadIdentityForPurpose to keep it out of the blocks.
+func (s *SmartContract) ReadIdentityAudited(ctx contractapi.TransactionContextInterface, id string, purpose string) (*model.AccessLogEntry, error) {
+	if isEmptyField(id) {
+		return nil, model.NewError(model.CodeInvalidArgument, "identity id is not provided")
+	}
+
+	if isEmptyField(purpose) {
+		return nil, model.NewError(model.CodeInvalidArgument, "read purpose is not provided")
+	}
+
+	_, fields, consents, err := s.readIdentityWithConsent(ctx, id, purpose)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.recordConsentUses(ctx, consents); err != nil {
+		return nil, err
+	}
+
+	caller, err := s.getCallerInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := model.AccessLogEntry{
+		TxID:        ctx.GetStub().GetTxID(),
+		IdentityID:  id,
+		Reader:      caller.ClientID,
+		ReaderMSPID: caller.MSPID,
+		Purpose:     purpose,
+		Fields:      fields,
+		Timestamp:   now.Format(timestampLayout),
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(accessLogObjectType, []string{id, entry.Timestamp, entry.TxID})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonByte, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("put identity access log to world state")
+	if err = ctx.GetStub().PutState(key, jsonByte); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// ReadIdentityForPurpose returns the identity like ReadIdentity, with the fields of the
+// consents of the caller for purpose only. It is evaluated after ReadIdentityAudited.
+func (s *SmartContract) ReadIdentityForPurpose(ctx contractapi.TransactionContextInterface, id string, purpose string) (*model.Identity, error) {
+	if isEmptyField(id) {
+		return nil, model.NewError(model.CodeInvalidArgument, "identity id is not provided")
+	}
+
+	if isEmptyField(purpose) {
+		return nil, model.NewError(model.CodeInvalidArgument, "read purpose is not provided")
+	}
+
+	idnty, _, _, err := s.readIdentityWithConsent(ctx, id, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	return idnty, nil
+}
+
+// ListAccessLog returns the audited reads of an identity. Only the owner can list them.
+func (s *SmartContract) ListAccessLog(ctx contractapi.TransactionContextInterface, id string) ([]*model.AccessLogEntry, error) {
+	if err := s.assertOwner(ctx, id); err != nil {
+		return nil, err
+	}
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(accessLogObjectType, []string{id})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer iterator.Close()
+
+	entries := []*model.AccessLogEntry{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var entry model.AccessLogEntry
+		if err = json.Unmarshal(kv.Value, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp < entries[j].Timestamp
+	})
+
+	return entries, nil
+}
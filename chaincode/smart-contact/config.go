@@ -0,0 +1,84 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+	"github.com/nyaruka/phonenumbers"
+)
+
+const (
+	configObjectType = "config"
+	configKeyID      = "contract"
+
+	defaultRetentionDays = 30
+)
+
+// ContractConfig holds the settings admins can change without upgrading the chaincode.
+// It is kept in the world state so that every endorser applies the same values.
+type ContractConfig struct {
+	RetentionDays int    `json:"retentionDays"`
+	DefaultRegion string `json:"defaultRegion"`
+}
+
+// SetConfig replaces the contract configuration. Only admins can change it.
+func (s *SmartContract) SetConfig(ctx contractapi.TransactionContextInterface, config ContractConfig) error {
+	admin, err := s.isAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return model.NewError(model.CodeForbidden, "submitting client not authorized to change configuration, does not have admin role")
+	}
+
+	if config.RetentionDays <= 0 {
+		return model.NewError(model.CodeInvalidArgument, "config retentionDays must be positive")
+	}
+
+	config.DefaultRegion = strings.ToUpper(config.DefaultRegion)
+	if !phonenumbers.GetSupportedRegions()[config.DefaultRegion] {
+		return model.Errorf(model.CodeInvalidArgument, "config defaultRegion %s is not a supported region", config.DefaultRegion)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{configKeyID})
+	if err != nil {
+		return err
+	}
+
+	jsonByte, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(key, jsonByte)
+}
+
+// GetConfig returns the contract configuration, falling back to the defaults when none was set.
+func (s *SmartContract) GetConfig(ctx contractapi.TransactionContextInterface) (*ContractConfig, error) {
+	config := ContractConfig{
+		RetentionDays: defaultRetentionDays,
+		DefaultRegion: model.DefaultRegion,
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{configKeyID})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonByte, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if jsonByte == nil {
+		return &config, nil
+	}
+
+	if err = json.Unmarshal(jsonByte, &config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
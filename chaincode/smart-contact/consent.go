@@ -0,0 +1,468 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+const (
+	consentObjectType       = "consent"
+	consentLedgerObjectType = "consentLedger"
+
+	consentActionGrant  = "grant"
+	consentActionUse    = "use"
+	consentActionRevoke = "revoke"
+
+	// roleAttribute is the certificate attribute used to match role based consents.
+	roleAttribute = "identity.role"
+	// adminRole is the roleAttribute value of identity administrators.
+	adminRole = model.RoleAdmin
+	// auditorRole is the roleAttribute value of auditors, who list identities with direct identifiers redacted.
+	auditorRole = model.RoleAuditor
+
+	timestampLayout = "2006-01-02T15:04:05.000000000Z07:00"
+)
+
+// GrantConsent records a consent from the identity owner to a relying party.
+func (s *SmartContract) GrantConsent(ctx contractapi.TransactionContextInterface, request model.ConsentRequest) (*model.Consent, error) {
+	if isEmptyField(request.IdentityID) {
+		return nil, model.NewError(model.CodeInvalidArgument, "identity id is not provided")
+	}
+
+	if isEmptyField(request.MSPID) {
+		return nil, model.NewError(model.CodeInvalidArgument, "consent mspID is not provided")
+	}
+
+	if isEmptyField(request.ClientID) && isEmptyField(request.Role) {
+		return nil, model.NewError(model.CodeInvalidArgument, "consent clientID or role must be provided")
+	}
+
+	if isEmptyField(request.Purpose) {
+		return nil, model.NewError(model.CodeInvalidArgument, "consent purpose is not provided")
+	}
+
+	if len(request.Fields) == 0 {
+		return nil, model.NewError(model.CodeInvalidArgument, "consent fields are not provided")
+	}
+	for _, field := range request.Fields {
+		if !model.IsPIIField(field) {
+			return nil, model.Errorf(model.CodeInvalidArgument, "field %s can not be shared", field)
+		}
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, request.ExpiresAt)
+	if err != nil {
+		return nil, model.Errorf(model.CodeInvalidArgument, "consent expiresAt is not a valid RFC3339 timestamp: %v", err)
+	}
+	if !expiresAt.After(now) {
+		return nil, model.NewError(model.CodeInvalidArgument, "consent expiresAt must be in the future")
+	}
+
+	idnty, err := s.readIdentity(ctx, request.IdentityID)
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := s.getCallerInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if caller.ClientID != idnty.Owner {
+		return nil, model.NewError(model.CodeForbidden, "submitting client not authorized to grant consent, does not own identity")
+	}
+
+	consent := model.Consent{
+		ConsentID:  ctx.GetStub().GetTxID(),
+		IdentityID: request.IdentityID,
+		MSPID:      request.MSPID,
+		ClientID:   request.ClientID,
+		Role:       request.Role,
+		Fields:     request.Fields,
+		Purpose:    request.Purpose,
+		GrantedAt:  now.Format(time.RFC3339),
+		ExpiresAt:  expiresAt.UTC().Format(time.RFC3339),
+	}
+
+	if err = s.putConsent(ctx, &consent); err != nil {
+		return nil, err
+	}
+
+	if err = s.recordConsentEvent(ctx, &consent, consentActionGrant, caller, consent.Fields); err != nil {
+		return nil, err
+	}
+
+	if err = emitEvent(ctx, model.EventConsentGranted, consent.IdentityID, consent.ConsentID); err != nil {
+		return nil, err
+	}
+
+	return &consent, nil
+}
+
+// RevokeConsent withdraws a consent previously granted by the identity owner.
+func (s *SmartContract) RevokeConsent(ctx contractapi.TransactionContextInterface, identityID string, consentID string) error {
+	if isEmptyField(identityID) {
+		return model.NewError(model.CodeInvalidArgument, "identity id is not provided")
+	}
+
+	if isEmptyField(consentID) {
+		return model.NewError(model.CodeInvalidArgument, "consent id is not provided")
+	}
+
+	idnty, err := s.readIdentity(ctx, identityID)
+	if err != nil {
+		return err
+	}
+
+	caller, err := s.getCallerInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	if caller.ClientID != idnty.Owner {
+		return model.NewError(model.CodeForbidden, "submitting client not authorized to revoke consent, does not own identity")
+	}
+
+	consent, err := s.getConsent(ctx, identityID, consentID)
+	if err != nil {
+		return err
+	}
+
+	if !isEmptyField(consent.RevokedAt) {
+		return model.Errorf(model.CodeFailedPrecondition, "the consent %s is already revoked", consentID)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	consent.RevokedAt = now.Format(time.RFC3339)
+
+	if err = s.putConsent(ctx, consent); err != nil {
+		return err
+	}
+
+	if err = s.recordConsentEvent(ctx, consent, consentActionRevoke, caller, consent.Fields); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, model.EventConsentRevoked, consent.IdentityID, consent.ConsentID)
+}
+
+// ListConsents returns every consent granted for the identity. Only the owner can list them.
+func (s *SmartContract) ListConsents(ctx contractapi.TransactionContextInterface, identityID string) ([]*model.Consent, error) {
+	if err := s.assertOwner(ctx, identityID); err != nil {
+		return nil, err
+	}
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(consentObjectType, []string{identityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer iterator.Close()
+
+	consents := []*model.Consent{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var consent model.Consent
+		if err = json.Unmarshal(kv.Value, &consent); err != nil {
+			return nil, err
+		}
+		consents = append(consents, &consent)
+	}
+
+	return consents, nil
+}
+
+// GetConsentLedger returns the grant, use and revocation history of the identity's consents.
+func (s *SmartContract) GetConsentLedger(ctx contractapi.TransactionContextInterface, identityID string) ([]*model.ConsentEvent, error) {
+	if err := s.assertOwner(ctx, identityID); err != nil {
+		return nil, err
+	}
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(consentLedgerObjectType, []string{identityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer iterator.Close()
+
+	events := []*model.ConsentEvent{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var event model.ConsentEvent
+		if err = json.Unmarshal(kv.Value, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp < events[j].Timestamp
+	})
+
+	return events, nil
+}
+
+// activeConsents returns the unrevoked, unexpired consents of the identity that match the caller.
+func (s *SmartContract) activeConsents(ctx contractapi.TransactionContextInterface, identityID string, caller *model.Caller) ([]*model.Consent, error) {
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(consentObjectType, []string{identityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer iterator.Close()
+
+	var consents []*model.Consent
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var consent model.Consent
+		if err = json.Unmarshal(kv.Value, &consent); err != nil {
+			return nil, err
+		}
+
+		if !isEmptyField(consent.RevokedAt) || !consentMatches(&consent, caller) {
+			continue
+		}
+
+		expiresAt, err := time.Parse(time.RFC3339, consent.ExpiresAt)
+		if err != nil || !expiresAt.After(now) {
+			continue
+		}
+
+		consents = append(consents, &consent)
+	}
+
+	return consents, nil
+}
+
+// readIdentityWithConsent returns the identity filtered down to the fields the caller may see,
+// with those fields and the consents that allow them. The owner sees the full record without
+// consents, relying parties only the fields of their active consents for purpose, or of all
+// their active consents when purpose is empty.
+func (s *SmartContract) readIdentityWithConsent(ctx contractapi.TransactionContextInterface, id string, purpose string) (*model.Identity, []string, []*model.Consent, error) {
+	idnty, err := s.readIdentity(ctx, id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	caller, err := s.getCallerInfo(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if caller.ClientID == idnty.Owner {
+		return idnty, model.PIIFields, nil, nil
+	}
+
+	consents, err := s.activeConsents(ctx, id, caller)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(consents) == 0 {
+		return nil, nil, nil, model.Errorf(model.CodeForbidden, "submitting client not authorized to read identity %s, no active consent", id)
+	}
+
+	allowed := make(map[string]bool)
+	var used []*model.Consent
+	for _, consent := range consents {
+		if !isEmptyField(purpose) && consent.Purpose != purpose {
+			continue
+		}
+		for _, field := range consent.Fields {
+			allowed[field] = true
+		}
+		used = append(used, consent)
+	}
+	if len(allowed) == 0 {
+		return nil, nil, nil, model.Errorf(model.CodeForbidden, "submitting client not authorized to read identity %s for purpose %s", id, purpose)
+	}
+
+	var fields []string
+	for _, field := range model.PIIFields {
+		if allowed[field] {
+			fields = append(fields, field)
+		}
+	}
+
+	return idnty.Filter(allowed), fields, used, nil
+}
+
+// recordConsentUses adds the use of consents by the submitting client to the consent ledger.
+func (s *SmartContract) recordConsentUses(ctx contractapi.TransactionContextInterface, consents []*model.Consent) error {
+	if len(consents) == 0 {
+		return nil
+	}
+
+	caller, err := s.getCallerInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, consent := range consents {
+		if err = s.recordConsentEvent(ctx, consent, consentActionUse, caller, consent.Fields); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SmartContract) getConsent(ctx contractapi.TransactionContextInterface, identityID string, consentID string) (*model.Consent, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(consentObjectType, []string{identityID, consentID})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonByte, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if jsonByte == nil {
+		return nil, model.Errorf(model.CodeNotFound, "the consent %s does not exist", consentID)
+	}
+
+	var consent model.Consent
+	if err = json.Unmarshal(jsonByte, &consent); err != nil {
+		return nil, err
+	}
+
+	return &consent, nil
+}
+
+func (s *SmartContract) putConsent(ctx contractapi.TransactionContextInterface, consent *model.Consent) error {
+	key, err := ctx.GetStub().CreateCompositeKey(consentObjectType, []string{consent.IdentityID, consent.ConsentID})
+	if err != nil {
+		return err
+	}
+
+	jsonByte, err := json.Marshal(consent)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(key, jsonByte)
+}
+
+func (s *SmartContract) recordConsentEvent(ctx contractapi.TransactionContextInterface, consent *model.Consent, action string, caller *model.Caller, fields []string) error {
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	event := model.ConsentEvent{
+		EventID:    ctx.GetStub().GetTxID(),
+		ConsentID:  consent.ConsentID,
+		IdentityID: consent.IdentityID,
+		Action:     action,
+		Actor:      caller.ClientID,
+		ActorMSPID: caller.MSPID,
+		Fields:     fields,
+		Purpose:    consent.Purpose,
+		Timestamp:  now.Format(timestampLayout),
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(consentLedgerObjectType, []string{consent.IdentityID, event.Timestamp, event.EventID, consent.ConsentID, action})
+	if err != nil {
+		return err
+	}
+
+	jsonByte, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(key, jsonByte)
+}
+
+// assertOwner returns an error unless the submitting client owns the identity.
+func (s *SmartContract) assertOwner(ctx contractapi.TransactionContextInterface, identityID string) error {
+	if isEmptyField(identityID) {
+		return model.NewError(model.CodeInvalidArgument, "identity id is not provided")
+	}
+
+	idnty, err := s.readIdentity(ctx, identityID)
+	if err != nil {
+		return err
+	}
+
+	clientID, err := s.GetSubmittingClientIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	if clientID != idnty.Owner {
+		return model.NewError(model.CodeForbidden, "submitting client not authorized, does not own identity")
+	}
+
+	return nil
+}
+
+// GetCaller returns the id, MSP and role of the submitting client. Off-chain services
+// evaluate it to authenticate their clients against the channel MSPs.
+func (s *SmartContract) GetCaller(ctx contractapi.TransactionContextInterface) (*model.Caller, error) {
+	return s.getCallerInfo(ctx)
+}
+
+func (s *SmartContract) getCallerInfo(ctx contractapi.TransactionContextInterface) (*model.Caller, error) {
+	clientID, err := s.GetSubmittingClientIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client mspID: %v", err)
+	}
+
+	role, _, err := ctx.GetClientIdentity().GetAttributeValue(roleAttribute)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client role: %v", err)
+	}
+
+	return &model.Caller{ClientID: clientID, MSPID: mspID, Role: role}, nil
+}
+
+func consentMatches(consent *model.Consent, caller *model.Caller) bool {
+	if consent.MSPID != caller.MSPID {
+		return false
+	}
+	if !isEmptyField(consent.ClientID) && consent.ClientID == caller.ClientID {
+		return true
+	}
+	return !isEmptyField(consent.Role) && consent.Role == caller.Role
+}
+
+// txTime returns the transaction timestamp so that every endorser computes the same time.
+func txTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	ts, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+	return ts.AsTime().UTC(), nil
+}
@@ -0,0 +1,256 @@
+package identity
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
+)
+
+// grantTestConsent grants a consent on the identity and returns it.
+func grantTestConsent(t *testing.T, ledger *testLedger, owner *testClient, request model.ConsentRequest) *model.Consent {
+	t.Helper()
+	consent, err := (&SmartContract{}).GrantConsent(ledger.tx(owner), request)
+	if err != nil {
+		t.Fatalf("grant consent: %v", err)
+	}
+	return consent
+}
+
+// visibleFields returns the PII fields set on the identity.
+func visibleFields(idnty *model.Identity) []string {
+	var fields []string
+	values := idnty.Fields()
+	for _, field := range model.PIIFields {
+		if *values[field] != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func TestConsentFiltering(t *testing.T) {
+	s := &SmartContract{}
+	ledger := newTestLedger()
+	owner := newTestClient("owner", "")
+	createTestIdentity(t, ledger, owner, "id1")
+
+	bank := newTestClient("bank", "")
+	bank.mspID = "Org2MSP"
+	teller := newTestClient("teller", "teller")
+	teller.mspID = "Org2MSP"
+	otherOrgTeller := newTestClient("teller", "teller")
+	otherOrgTeller.mspID = "Org3MSP"
+
+	grantTestConsent(t, ledger, owner, model.ConsentRequest{IdentityID: "id1", MSPID: "Org2MSP", ClientID: bank.id,
+		Fields: []string{"phone", "firstName"}, Purpose: "kyc", ExpiresAt: "2030-01-01T00:00:00Z"})
+	grantTestConsent(t, ledger, owner, model.ConsentRequest{IdentityID: "id1", MSPID: "Org2MSP", ClientID: bank.id,
+		Fields: []string{"dob"}, Purpose: "loan", ExpiresAt: "2030-01-01T00:00:00Z"})
+	grantTestConsent(t, ledger, owner, model.ConsentRequest{IdentityID: "id1", MSPID: "Org2MSP", Role: "teller",
+		Fields: []string{"lastName"}, Purpose: "kyc", ExpiresAt: "2030-01-01T00:00:00Z"})
+
+	tests := []struct {
+		name    string
+		client  *testClient
+		purpose string
+		want    []string
+	}{
+		{"owner", owner, "", model.PIIFields},
+		{"client consents", bank, "", []string{"firstName", "phone", "dob"}},
+		{"client consent for purpose", bank, "kyc", []string{"firstName", "phone"}},
+		{"role consent", teller, "", []string{"lastName"}},
+	}
+	for _, test := range tests {
+		var idnty *model.Identity
+		var err error
+		if test.purpose == "" {
+			idnty, err = s.ReadIdentity(ledger.tx(test.client), "id1")
+		} else {
+			idnty, err = s.ReadIdentityForPurpose(ledger.tx(test.client), "id1", test.purpose)
+		}
+		if err != nil {
+			t.Errorf("%s: read: %v", test.name, err)
+			continue
+		}
+		if fields := visibleFields(idnty); !reflect.DeepEqual(fields, test.want) {
+			t.Errorf("%s: read fields %v, want %v", test.name, fields, test.want)
+		}
+		if idnty.Id != "id1" || (test.client != owner && idnty.Owner != "") {
+			t.Errorf("%s: read identity %s owned by %q", test.name, idnty.Id, idnty.Owner)
+		}
+	}
+
+	forbidden := []struct {
+		name    string
+		client  *testClient
+		purpose string
+	}{
+		{"no consent", newTestClient("stranger", ""), ""},
+		{"role consent of another MSP", otherOrgTeller, ""},
+		{"no consent for purpose", bank, "marketing"},
+	}
+	for _, test := range forbidden {
+		var err error
+		if test.purpose == "" {
+			_, err = s.ReadIdentity(ledger.tx(test.client), "id1")
+		} else {
+			_, err = s.ReadIdentityForPurpose(ledger.tx(test.client), "id1", test.purpose)
+		}
+		assertCode(t, test.name, err, model.CodeForbidden)
+	}
+
+	// Evaluated reads record nothing, the uses are recorded by RecordIdentityRead and
+	// audited reads
+	before := len(ledger.compositeKeys(t, consentLedgerObjectType, "id1"))
+	if _, err := s.ReadIdentity(ledger.tx(bank), "id1"); err != nil {
+		t.Fatal(err)
+	}
+	if after := len(ledger.compositeKeys(t, consentLedgerObjectType, "id1")); after != before {
+		t.Errorf("read recorded %d consent ledger entries", after-before)
+	}
+	if err := s.RecordIdentityRead(ledger.tx(bank), "id1"); err != nil {
+		t.Fatal(err)
+	}
+	ledger.now = ledger.now.Add(time.Second)
+	entry, err := s.ReadIdentityAudited(ledger.tx(bank), "id1", "kyc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entry.Fields, []string{"firstName", "phone"}) || entry.Reader != bank.id || entry.ReaderMSPID != "Org2MSP" {
+		t.Errorf("access log entry %+v", entry)
+	}
+
+	events, err := s.GetConsentLedger(ledger.tx(owner), "id1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uses := map[string]int{}
+	for _, event := range events {
+		if event.Action == consentActionUse && event.Actor == bank.id {
+			uses[event.Purpose]++
+		}
+	}
+	// RecordIdentityRead uses both consents of the bank, the audited read the kyc one
+	if !reflect.DeepEqual(uses, map[string]int{"kyc": 2, "loan": 1}) {
+		t.Errorf("consent uses by purpose %v, want kyc 2 and loan 1", uses)
+	}
+	if log, err := s.ListAccessLog(ledger.tx(owner), "id1"); err != nil || len(log) != 1 {
+		t.Errorf("access log %v: %v, want one entry", log, err)
+	}
+	_, err = s.ListAccessLog(ledger.tx(bank), "id1")
+	assertCode(t, "access log of a relying party", err, model.CodeForbidden)
+}
+
+func TestConsentExpiry(t *testing.T) {
+	s := &SmartContract{}
+	ledger := newTestLedger()
+	owner, bank := newTestClient("owner", ""), newTestClient("bank", "")
+	createTestIdentity(t, ledger, owner, "id1")
+
+	request := model.ConsentRequest{IdentityID: "id1", MSPID: "Org1MSP", ClientID: bank.id, Fields: []string{"firstName"}, Purpose: "kyc"}
+	invalid := []struct {
+		name      string
+		expiresAt string
+	}{
+		{"past", "2024-04-30T10:00:00Z"},
+		{"now", "2024-05-01T10:00:00Z"},
+		{"not a timestamp", "2024-06-01"},
+	}
+	for _, test := range invalid {
+		request.ExpiresAt = test.expiresAt
+		_, err := s.GrantConsent(ledger.tx(owner), request)
+		assertCode(t, test.name+" expiry", err, model.CodeInvalidArgument)
+	}
+
+	// The expiry is stored in UTC
+	request.ExpiresAt = "2024-05-01T13:00:00+02:00"
+	consent := grantTestConsent(t, ledger, owner, request)
+	if consent.ExpiresAt != "2024-05-01T11:00:00Z" || consent.GrantedAt != "2024-05-01T10:00:00Z" {
+		t.Errorf("consent granted at %s expires at %s", consent.GrantedAt, consent.ExpiresAt)
+	}
+	grantTestConsent(t, ledger, owner, model.ConsentRequest{IdentityID: "id1", MSPID: "Org1MSP", ClientID: bank.id,
+		Fields: []string{"dob"}, Purpose: "loan", ExpiresAt: "2030-01-01T00:00:00Z"})
+
+	start := ledger.now
+	tests := []struct {
+		name  string
+		after time.Duration
+		want  []string
+	}{
+		{"before expiry", 59 * time.Minute, []string{"firstName", "dob"}},
+		{"at expiry", time.Hour, []string{"dob"}},
+		{"after expiry", 2 * time.Hour, []string{"dob"}},
+	}
+	for _, test := range tests {
+		ledger.now = start.Add(test.after)
+		idnty, err := s.ReadIdentity(ledger.tx(bank), "id1")
+		if err != nil {
+			t.Errorf("%s: read: %v", test.name, err)
+			continue
+		}
+		if fields := visibleFields(idnty); !reflect.DeepEqual(fields, test.want) {
+			t.Errorf("%s: read fields %v, want %v", test.name, fields, test.want)
+		}
+	}
+	_, err := s.ReadIdentityForPurpose(ledger.tx(bank), "id1", "kyc")
+	assertCode(t, "read for the purpose of an expired consent", err, model.CodeForbidden)
+
+	// Expired consents stay listed for the owner
+	consents, err := s.ListConsents(ledger.tx(owner), "id1")
+	if err != nil || len(consents) != 2 {
+		t.Errorf("consents %v: %v, want 2", consents, err)
+	}
+}
+
+func TestConsentRevocation(t *testing.T) {
+	s := &SmartContract{}
+	ledger := newTestLedger()
+	owner, bank := newTestClient("owner", ""), newTestClient("bank", "")
+	createTestIdentity(t, ledger, owner, "id1")
+	consent := grantTestConsent(t, ledger, owner, model.ConsentRequest{IdentityID: "id1", MSPID: "Org1MSP", ClientID: bank.id,
+		Fields: []string{"firstName"}, Purpose: "kyc", ExpiresAt: "2030-01-01T00:00:00Z"})
+	if event := ledger.lastEvent(); event.Type != model.EventConsentGranted || event.ConsentID != consent.ConsentID {
+		t.Errorf("grant event %+v", event)
+	}
+	if _, err := s.ReadIdentity(ledger.tx(bank), "id1"); err != nil {
+		t.Fatalf("read with the consent: %v", err)
+	}
+
+	assertCode(t, "revoke by the relying party", s.RevokeConsent(ledger.tx(bank), "id1", consent.ConsentID), model.CodeForbidden)
+	assertCode(t, "revoke of an unknown consent", s.RevokeConsent(ledger.tx(owner), "id1", "tx0"), model.CodeNotFound)
+
+	ledger.now = ledger.now.Add(time.Hour)
+	if err := s.RevokeConsent(ledger.tx(owner), "id1", consent.ConsentID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if event := ledger.lastEvent(); event.Type != model.EventConsentRevoked || event.ConsentID != consent.ConsentID {
+		t.Errorf("revoke event %+v", event)
+	}
+	assertCode(t, "second revoke", s.RevokeConsent(ledger.tx(owner), "id1", consent.ConsentID), model.CodeFailedPrecondition)
+
+	_, err := s.ReadIdentity(ledger.tx(bank), "id1")
+	assertCode(t, "read after revocation", err, model.CodeForbidden)
+	_, err = s.ReadIdentityAudited(ledger.tx(bank), "id1", "kyc")
+	assertCode(t, "audited read after revocation", err, model.CodeForbidden)
+
+	consents, err := s.ListConsents(ledger.tx(owner), "id1")
+	if err != nil || len(consents) != 1 || consents[0].RevokedAt != "2024-05-01T11:00:00Z" {
+		t.Errorf("consents after revocation %+v: %v", consents, err)
+	}
+
+	events, err := s.GetConsentLedger(ledger.tx(owner), "id1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, event := range events {
+		actions = append(actions, event.Action)
+	}
+	if !reflect.DeepEqual(actions, []string{consentActionGrant, consentActionRevoke}) {
+		t.Errorf("consent ledger actions %v, want grant then revoke", actions)
+	}
+	if events[1].Actor != owner.id || events[1].ConsentID != consent.ConsentID {
+		t.Errorf("revoke ledger entry %+v", events[1])
+	}
+}
@@ -0,0 +1,204 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+const (
+	erasureRequestObjectType = "erasureRequest"
+	tombstoneObjectType      = "tombstone"
+
+	erasureStatusPending = "pending"
+	erasureStatusErased  = "erased"
+)
+
+// RequestErasure records the owner's request to erase the identity.
+func (s *SmartContract) RequestErasure(ctx contractapi.TransactionContextInterface, id string, reason string) error {
+	if isEmptyField(reason) {
+		return model.NewError(model.CodeInvalidArgument, "erasure reason is not provided")
+	}
+
+	if err := s.assertOwner(ctx, id); err != nil {
+		return err
+	}
+
+	clientID, err := s.GetSubmittingClientIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	request := model.ErasureRequest{
+		IdentityID:  id,
+		Reason:      reason,
+		RequestedBy: clientID,
+		RequestedAt: now.Format(time.RFC3339),
+		Status:      erasureStatusPending,
+	}
+
+	return s.putErasureRequest(ctx, &request)
+}
+
+// GetErasureRequest returns the erasure request of the identity.
+func (s *SmartContract) GetErasureRequest(ctx contractapi.TransactionContextInterface, id string) (*model.ErasureRequest, error) {
+	if isEmptyField(id) {
+		return nil, model.NewError(model.CodeInvalidArgument, "identity id is not provided")
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(erasureRequestObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonByte, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if jsonByte == nil {
+		return nil, model.Errorf(model.CodeNotFound, "no erasure request exists for identity %s", id)
+	}
+
+	var request model.ErasureRequest
+	if err = json.Unmarshal(jsonByte, &request); err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// EraseIdentity approves a pending erasure request. The identity PII is purged from the
+// private data collection on every peer, the identity is removed from its owner's index, its
+// consents, consent ledger and access log are deleted and only a tombstone and the erasure
+// request are kept in the world state.
+func (s *SmartContract) EraseIdentity(ctx contractapi.TransactionContextInterface, id string) (*model.Tombstone, error) {
+	admin, err := s.isAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !admin {
+		return nil, model.NewError(model.CodeForbidden, "submitting client not authorized to erase identity, does not have admin role")
+	}
+
+	request, err := s.GetErasureRequest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if request.Status != erasureStatusPending {
+		return nil, model.Errorf(model.CodeFailedPrecondition, "the erasure request for identity %s is already %s", id, request.Status)
+	}
+
+	clientID, err := s.GetSubmittingClientIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	idnty, err := s.readStoredIdentity(ctx, id)
+	if err != nil && model.CodeOf(err) != model.CodeNotFound {
+		return nil, err
+	}
+	if idnty != nil {
+		if err = s.deleteOwnerIndex(ctx, idnty.Owner, id); err != nil {
+			return nil, err
+		}
+	}
+	if err = s.deleteIdentityTrail(ctx, id); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("purge identity data from private data collection")
+	if err = ctx.GetStub().PurgePrivateData(identityCollection, id); err != nil {
+		return nil, fmt.Errorf("failed to purge private data: %v", err)
+	}
+	if err = ctx.GetStub().DelState(id); err != nil {
+		return nil, err
+	}
+
+	tombstone := model.Tombstone{
+		IdentityID:  id,
+		Reason:      request.Reason,
+		RequestedAt: request.RequestedAt,
+		ErasedAt:    now.Format(time.RFC3339),
+		ErasedBy:    clientID,
+		TxID:        ctx.GetStub().GetTxID(),
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(tombstoneObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonByte, err := json.Marshal(tombstone)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ctx.GetStub().PutState(key, jsonByte); err != nil {
+		return nil, err
+	}
+
+	request.Status = erasureStatusErased
+	if err = s.putErasureRequest(ctx, request); err != nil {
+		return nil, err
+	}
+
+	if err = emitEvent(ctx, model.EventIdentityErased, id, ""); err != nil {
+		return nil, err
+	}
+
+	return &tombstone, nil
+}
+
+// GetTombstone returns the tombstone of an erased identity.
+func (s *SmartContract) GetTombstone(ctx contractapi.TransactionContextInterface, id string) (*model.Tombstone, error) {
+	if isEmptyField(id) {
+		return nil, model.NewError(model.CodeInvalidArgument, "identity id is not provided")
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(tombstoneObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonByte, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if jsonByte == nil {
+		return nil, model.Errorf(model.CodeNotFound, "the identity %s has not been erased", id)
+	}
+
+	var tombstone model.Tombstone
+	if err = json.Unmarshal(jsonByte, &tombstone); err != nil {
+		return nil, err
+	}
+
+	return &tombstone, nil
+}
+
+func (s *SmartContract) putErasureRequest(ctx contractapi.TransactionContextInterface, request *model.ErasureRequest) error {
+	key, err := ctx.GetStub().CreateCompositeKey(erasureRequestObjectType, []string{request.IdentityID})
+	if err != nil {
+		return err
+	}
+
+	jsonByte, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(key, jsonByte)
+}
@@ -0,0 +1,36 @@
+package identity
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// emitEvent sets the chaincode event of the transaction. Fabric keeps a single event
+// per transaction, so every transaction that changes an identity emits exactly one.
+func emitEvent(ctx contractapi.TransactionContextInterface, eventType string, identityID string, consentID string) error {
+	return setEvent(ctx, &model.IdentityEvent{Type: eventType, IdentityID: identityID, ConsentID: consentID})
+}
+
+// emitImportEvent sets the IdentitiesImported event listing the identities created by a batch.
+func emitImportEvent(ctx contractapi.TransactionContextInterface, identityIDs []string) error {
+	return setEvent(ctx, &model.IdentityEvent{Type: model.EventIdentitiesImported, IdentityIDs: identityIDs})
+}
+
+func setEvent(ctx contractapi.TransactionContextInterface, event *model.IdentityEvent) error {
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	event.TxID = ctx.GetStub().GetTxID()
+	event.Timestamp = now.Format(timestampLayout)
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().SetEvent(event.Type, payload)
+}
@@ -3,50 +3,52 @@ package identity
 import (
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
 )
 
+// identityCollection is the private data collection holding the identity PII.
+// The world state only keeps the identity id and owner, so that the PII can be
+// purged from every peer on erasure.
+const identityCollection = "identityPrivateCollection"
+
+// identityTransientKey is the transient map key clients use to pass identity PII
+// without recording it in the transaction proposal.
+const identityTransientKey = "identity"
+
+// ownerIndex is the composite key index used to list the identities of an owner.
+const ownerIndex = "owner~id"
+
 type SmartContract struct {
 	contractapi.Contract
 }
 
-type Identity struct {
-	Id               string `json:"id"`
-	FirstName        string `json:"firstName"`
-	LastName         string `json:"lastName"`
-	Phone            string `json:"phone"`
-	Email            string `json:"email"`
-	Dob              string `json:"dob"`
-	PresentAddress   string `json:"presentAddress"`
-	PermanentAddress string `json:"permanentAddress"`
-	Gender           string `json:"gender"`
-	NationalID       string `json:"nationalID"`
-	Owner            string `json:"owner"`
-}
-
 // CreateIdentity issues a new identity to the world state with given details.
-func (s *SmartContract) CreateIdentity(ctx contractapi.TransactionContextInterface, identity Identity) error {
-	if isEmptyField(identity.Id) {
-		return errors.New("identity id is not provided")
+func (s *SmartContract) CreateIdentity(ctx contractapi.TransactionContextInterface, identity model.Identity) error {
+	identity, err := identityFromTransient(ctx, identity)
+	if err != nil {
+		return err
 	}
 
-	if isEmptyField(identity.FirstName) {
-		return errors.New("identity firstName is not provided")
+	if isEmptyField(identity.Id) {
+		return model.NewError(model.CodeInvalidArgument, "identity id is not provided")
 	}
 
-	if isEmptyField(identity.Phone) {
-		return errors.New("identity phone is not provided")
+	validator, err := s.newValidator(ctx)
+	if err != nil {
+		return err
 	}
 
-	if isEmptyField(identity.NationalID) {
-		return errors.New("identity national id is not provided")
+	if err = validator.ValidateIdentity(&identity); err != nil {
+		return err
 	}
 
-	err := ctx.GetClientIdentity().AssertAttributeValue("identity.id", identity.Id)
+	err = ctx.GetClientIdentity().AssertAttributeValue("identity.id", identity.Id)
 	if err != nil {
-		return errors.New("submitting identity is not authorized to create, does not have identity.id or not valid identity")
+		return model.NewError(model.CodeForbidden, "submitting identity is not authorized to create, does not have identity.id or not valid identity")
 	}
 
 	exists, err := s.IdentityExists(ctx, identity.Id)
@@ -54,7 +56,7 @@ func (s *SmartContract) CreateIdentity(ctx contractapi.TransactionContextInterfa
 		return err
 	}
 	if exists {
-		return fmt.Errorf("the asset %s already exists", identity.Id)
+		return model.Errorf(model.CodeAlreadyExists, "the asset %s already exists", identity.Id)
 	}
 
 	// Get ID of submitting client identity
@@ -66,19 +68,180 @@ func (s *SmartContract) CreateIdentity(ctx contractapi.TransactionContextInterfa
 	// set clientID to Owner
 	identity.Owner = clientID
 
-	jsonByte, err := json.Marshal(identity)
-	if err != nil {
+	if err = s.putOwnerIndex(ctx, clientID, identity.Id); err != nil {
 		return err
 	}
 
 	fmt.Printf("put identity data to world state")
-	return ctx.GetStub().PutState(identity.Id, jsonByte)
+	if err = s.putIdentity(ctx, &identity); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, model.EventIdentityCreated, identity.Id, "")
 }
 
 // ReadIdentity returns the identity stored in the world state with given id.
-func (s *SmartContract) ReadIdentity(ctx contractapi.TransactionContextInterface, id string) (*Identity, error) {
+// Callers other than the owner only receive the fields covered by their active consents.
+// The read is meant to be evaluated, the use of the consents is committed by submitting
+// RecordIdentityRead so that the identity never reaches a block.
+func (s *SmartContract) ReadIdentity(ctx contractapi.TransactionContextInterface, id string) (*model.Identity, error) {
 	if isEmptyField(id) {
-		return nil, errors.New("identity id is not provided")
+		return nil, model.NewError(model.CodeInvalidArgument, "identity id is not provided")
+	}
+
+	idnty, _, _, err := s.readIdentityWithConsent(ctx, id, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return idnty, nil
+}
+
+// RecordIdentityRead adds the use of the active consents of the submitting client on the
+// identity with given id to the consent ledger, for a read evaluated with ReadIdentity.
+// It returns nothing so that the submitted transaction carries no identity data. The
+// owner's reads use no consent and record nothing.
+func (s *SmartContract) RecordIdentityRead(ctx contractapi.TransactionContextInterface, id string) error {
+	if isEmptyField(id) {
+		return model.NewError(model.CodeInvalidArgument, "identity id is not provided")
+	}
+
+	_, _, consents, err := s.readIdentityWithConsent(ctx, id, "")
+	if err != nil {
+		return err
+	}
+
+	return s.recordConsentUses(ctx, consents)
+}
+
+// ReadIdentityIncludingDeleted returns the identity with given id even when it is soft deleted.
+// Only admins can read soft deleted identities.
+func (s *SmartContract) ReadIdentityIncludingDeleted(ctx contractapi.TransactionContextInterface, id string) (*model.Identity, error) {
+	admin, err := s.isAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !admin {
+		return nil, model.NewError(model.CodeForbidden, "submitting client not authorized to read deleted identities, does not have admin role")
+	}
+
+	return s.readStoredIdentity(ctx, id)
+}
+
+// ListIdentities returns a page of identities. Admins list every identity, auditors
+// every identity with the direct identifiers redacted, other clients the identities
+// they own. Soft deleted identities are only listed for admins that ask for them.
+func (s *SmartContract) ListIdentities(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string, includeDeleted bool) (*model.IdentityPage, error) {
+	role, err := s.clientRole(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if includeDeleted && role != adminRole {
+		return nil, model.NewError(model.CodeForbidden, "submitting client not authorized to list deleted identities, does not have admin role")
+	}
+
+	page := model.IdentityPage{Records: []*model.Identity{}}
+
+	if role == adminRole || role == auditorRole {
+		iterator, metadata, err := ctx.GetStub().GetStateByRangeWithPagination("", "", pageSize, bookmark)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state: %v", err)
+		}
+		defer iterator.Close()
+
+		for iterator.HasNext() {
+			kv, err := iterator.Next()
+			if err != nil {
+				return nil, err
+			}
+			idnty, err := s.readStoredIdentity(ctx, kv.Key)
+			if err != nil {
+				return nil, err
+			}
+			if !isEmptyField(idnty.DeletedAt) && !includeDeleted {
+				continue
+			}
+			if role == auditorRole {
+				idnty = idnty.Filter(model.VisibleFields(role))
+			}
+			page.Records = append(page.Records, idnty)
+		}
+		page.Bookmark = metadata.Bookmark
+		page.FetchedCount = metadata.FetchedRecordsCount
+		return &page, nil
+	}
+
+	clientID, err := s.GetSubmittingClientIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(ownerIndex, []string{clientID}, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := ctx.GetStub().SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		idnty, err := s.readStoredIdentity(ctx, keyParts[1])
+		if model.CodeOf(err) == model.CodeNotFound {
+			// The index entry of an identity erased before its key was removed on erasure
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isEmptyField(idnty.DeletedAt) {
+			page.Records = append(page.Records, idnty)
+		}
+	}
+	page.Bookmark = metadata.Bookmark
+	page.FetchedCount = metadata.FetchedRecordsCount
+	return &page, nil
+}
+
+// putOwnerIndex adds the identity to the index of its owner.
+func (s *SmartContract) putOwnerIndex(ctx contractapi.TransactionContextInterface, owner string, id string) error {
+	ownerKey, err := ctx.GetStub().CreateCompositeKey(ownerIndex, []string{owner, id})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(ownerKey, []byte{0x00})
+}
+
+// deleteOwnerIndex removes the identity from the index of its owner.
+func (s *SmartContract) deleteOwnerIndex(ctx contractapi.TransactionContextInterface, owner string, id string) error {
+	ownerKey, err := ctx.GetStub().CreateCompositeKey(ownerIndex, []string{owner, id})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(ownerKey)
+}
+
+// readIdentity returns the unfiltered identity with given id, treating soft deleted identities as missing.
+func (s *SmartContract) readIdentity(ctx contractapi.TransactionContextInterface, id string) (*model.Identity, error) {
+	idnty, err := s.readStoredIdentity(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !isEmptyField(idnty.DeletedAt) {
+		return nil, model.Errorf(model.CodeNotFound, "the asset %s does not exist", id)
+	}
+	return idnty, nil
+}
+
+// readStoredIdentity returns the unfiltered identity stored in the world state with given id.
+func (s *SmartContract) readStoredIdentity(ctx contractapi.TransactionContextInterface, id string) (*model.Identity, error) {
+	if isEmptyField(id) {
+		return nil, model.NewError(model.CodeInvalidArgument, "identity id is not provided")
 	}
 
 	fmt.Printf("get identity data from world state")
@@ -87,25 +250,32 @@ func (s *SmartContract) ReadIdentity(ctx contractapi.TransactionContextInterface
 		return nil, fmt.Errorf("failed to read from world state: %v", err)
 	}
 	if jsonByte == nil {
-		return nil, fmt.Errorf("the asset %s does not exist", id)
+		return nil, model.Errorf(model.CodeNotFound, "the asset %s does not exist", id)
+	}
+
+	// Records created before the private collection was introduced keep their PII in the world state
+	privateJSON, err := ctx.GetStub().GetPrivateData(identityCollection, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
 	}
 
-	var idnty Identity
-	err = json.Unmarshal(jsonByte, &idnty)
+	// Records written with an older schema version are lifted to the current one
+	idnty, _, err := model.DecodeIdentity(jsonByte, privateJSON)
 	if err != nil {
 		return nil, err
 	}
 
-	return &idnty, nil
+	return idnty, nil
 }
 
-// DeleteIdentity deletes a given asset from the world state.
+// DeleteIdentity soft deletes a given asset. The identity is hidden from reads and
+// listings and can be restored by its owner until the retention period ends.
 func (s *SmartContract) DeleteIdentity(ctx contractapi.TransactionContextInterface, id string) error {
 	if isEmptyField(id) {
-		return errors.New("identity id is not provided")
+		return model.NewError(model.CodeInvalidArgument, "identity id is not provided")
 	}
 
-	idnty, err := s.ReadIdentity(ctx, id)
+	idnty, err := s.readIdentity(ctx, id)
 	if err != nil {
 		return err
 	}
@@ -116,62 +286,91 @@ func (s *SmartContract) DeleteIdentity(ctx contractapi.TransactionContextInterfa
 	}
 
 	if clientID != idnty.Owner {
-		return fmt.Errorf("submitting client not authorized to delete identity, does not own identity")
+		return model.NewError(model.CodeForbidden, "submitting client not authorized to delete identity, does not own identity")
 	}
 
-	fmt.Printf("delete identity data fron world state")
-	return ctx.GetStub().DelState(id)
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	idnty.DeletedAt = now.Format(time.RFC3339)
+
+	fmt.Printf("mark identity data deleted in world state")
+	if err = s.putIdentity(ctx, idnty); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, model.EventIdentityDeleted, idnty.Id, "")
 }
 
 // UpdateIdentity updates an existing asset in the world state with provided parameters.
-func (s *SmartContract) UpdateIdentity(ctx contractapi.TransactionContextInterface, id string, update Identity) error {
+// Identity PII passed in the transient map is applied as a JSON merge patch, so fields
+// set to null or "" are cleared.
+func (s *SmartContract) UpdateIdentity(ctx contractapi.TransactionContextInterface, id string, update model.Identity) error {
 	if isEmptyField(id) {
-		return errors.New("identity id is not provided")
+		return model.NewError(model.CodeInvalidArgument, "identity id is not provided")
 	}
 
-	idnty, err := s.ReadIdentity(ctx, id)
+	patch, err := identityPatch(ctx, update)
 	if err != nil {
 		return err
 	}
 
-	clientID, err := s.GetSubmittingClientIdentity(ctx)
+	validator, err := s.newValidator(ctx)
 	if err != nil {
 		return err
 	}
 
-	if clientID != idnty.Owner {
-		return fmt.Errorf("submitting client not authorized to update identity, does not own identity")
+	if err = validator.ValidatePatch(patch); err != nil {
+		return err
 	}
 
-	if !isEmptyField(update.LastName) {
-		idnty.LastName = update.LastName
-	}
-	if !isEmptyField(update.FirstName) {
-		idnty.FirstName = update.FirstName
+	idnty, err := s.readIdentity(ctx, id)
+	if err != nil {
+		return err
 	}
-	if !isEmptyField(update.Email) {
-		idnty.Email = update.Email
+
+	clientID, err := s.GetSubmittingClientIdentity(ctx)
+	if err != nil {
+		return err
 	}
-	if !isEmptyField(update.Phone) {
-		idnty.Phone = update.Phone
+
+	if clientID != idnty.Owner {
+		return model.NewError(model.CodeForbidden, "submitting client not authorized to update identity, does not own identity")
 	}
-	if !isEmptyField(update.Dob) {
-		idnty.Dob = update.Dob
+
+	// Only the patched fields are validated, so that records stored before a validation
+	// rule was introduced still take updates of their other fields
+	idnty.ApplyPatch(patch)
+
+	fmt.Printf("update identity data to world state")
+	if err = s.putIdentity(ctx, idnty); err != nil {
+		return err
 	}
-	if !isEmptyField(update.PresentAddress) {
-		idnty.PresentAddress = update.PresentAddress
+
+	return emitEvent(ctx, model.EventIdentityUpdated, idnty.Id, "")
+}
+
+// putIdentity writes the identity PII to the private data collection and
+// the id and owner to the world state.
+func (s *SmartContract) putIdentity(ctx contractapi.TransactionContextInterface, idnty *model.Identity) error {
+	idnty.SchemaVersion = model.SchemaVersion
+
+	privateJSON, err := json.Marshal(idnty)
+	if err != nil {
+		return err
 	}
-	if !isEmptyField(update.PermanentAddress) {
-		idnty.PermanentAddress = update.PermanentAddress
+
+	if err = ctx.GetStub().PutPrivateData(identityCollection, idnty.Id, privateJSON); err != nil {
+		return fmt.Errorf("failed to put to private data collection: %v", err)
 	}
 
-	jsonByte, err := json.Marshal(idnty)
+	publicJSON, err := json.Marshal(model.Identity{Id: idnty.Id, Owner: idnty.Owner, DeletedAt: idnty.DeletedAt, SchemaVersion: idnty.SchemaVersion})
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("update identity data to world state")
-	return ctx.GetStub().PutState(id, jsonByte)
+	return ctx.GetStub().PutState(idnty.Id, publicJSON)
 }
 
 // IdentityExists returns true when asset with given ID exists in world state
@@ -203,6 +402,44 @@ func (s *SmartContract) GetSubmittingClientIdentity(ctx contractapi.TransactionC
 	return string(decodeID), nil
 }
 
+// isAdmin returns true when the submitting client carries the admin role attribute.
+func (s *SmartContract) isAdmin(ctx contractapi.TransactionContextInterface) (bool, error) {
+	role, err := s.clientRole(ctx)
+	if err != nil {
+		return false, err
+	}
+	return role == adminRole, nil
+}
+
+// clientRole returns the role attribute of the submitting client, empty when it has none.
+func (s *SmartContract) clientRole(ctx contractapi.TransactionContextInterface) (string, error) {
+	role, _, err := ctx.GetClientIdentity().GetAttributeValue(roleAttribute)
+	if err != nil {
+		return "", fmt.Errorf("failed to read client role: %v", err)
+	}
+	return role, nil
+}
+
+// identityFromTransient returns the identity passed in the transient map, or
+// the given argument when the client did not use the transient map.
+func identityFromTransient(ctx contractapi.TransactionContextInterface, arg model.Identity) (model.Identity, error) {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return arg, fmt.Errorf("failed to read transient map: %v", err)
+	}
+
+	transientJSON, ok := transient[identityTransientKey]
+	if !ok {
+		return arg, nil
+	}
+
+	var idnty model.Identity
+	if err = json.Unmarshal(transientJSON, &idnty); err != nil {
+		return arg, fmt.Errorf("failed to unmarshal transient identity: %v", err)
+	}
+	return idnty, nil
+}
+
 func isEmptyField(f string) bool {
 	if f == "" {
 		return true
@@ -0,0 +1,122 @@
+package identity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// identitiesTransientKey is the transient map key holding the JSON array of identities
+// created by CreateIdentities.
+const identitiesTransientKey = "identities"
+
+// maxImportBatchSize bounds the identities of a CreateIdentities batch so that the
+// transaction stays within the peer message size limits.
+const maxImportBatchSize = 500
+
+// CreateIdentities creates a batch of identities passed in the transient map. A rejected
+// identity does not fail the batch, its error is reported in the result of its row.
+// Only admins can import identities, the imported identities are owned by the importing
+// client.
+func (s *SmartContract) CreateIdentities(ctx contractapi.TransactionContextInterface) ([]*model.RowResult, error) {
+	admin, err := s.isAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !admin {
+		return nil, model.NewError(model.CodeForbidden, "submitting client not authorized to import identities, does not have admin role")
+	}
+
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transient map: %v", err)
+	}
+
+	transientJSON, ok := transient[identitiesTransientKey]
+	if !ok {
+		return nil, model.NewError(model.CodeInvalidArgument, "identities are not provided in the transient map")
+	}
+
+	var identities []model.Identity
+	if err = json.Unmarshal(transientJSON, &identities); err != nil {
+		return nil, model.Errorf(model.CodeInvalidArgument, "failed to unmarshal transient identities: %v", err)
+	}
+	if len(identities) > maxImportBatchSize {
+		return nil, model.Errorf(model.CodeInvalidArgument, "batch must have at most %d identities", maxImportBatchSize)
+	}
+
+	validator, err := s.newValidator(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID, err := s.GetSubmittingClientIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*model.RowResult{}
+	created := []string{}
+	seen := make(map[string]bool)
+	for i := range identities {
+		idnty := &identities[i]
+		result := &model.RowResult{Id: idnty.Id}
+		results = append(results, result)
+
+		if err = s.importIdentity(ctx, validator, clientID, idnty, seen); err != nil {
+			var modelErr *model.Error
+			if !errors.As(err, &modelErr) {
+				return nil, err
+			}
+			result.Code = string(modelErr.Code)
+			result.Message = modelErr.Message
+			result.Fields = modelErr.Fields
+			continue
+		}
+		created = append(created, idnty.Id)
+	}
+
+	if len(created) > 0 {
+		if err = emitImportEvent(ctx, created); err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// importIdentity creates one identity of a CreateIdentities batch. Coded errors reject
+// the identity, other errors fail the whole batch.
+func (s *SmartContract) importIdentity(ctx contractapi.TransactionContextInterface, validator *model.Validator, clientID string, idnty *model.Identity, seen map[string]bool) error {
+	if isEmptyField(idnty.Id) {
+		return model.NewError(model.CodeInvalidArgument, "identity id is not provided")
+	}
+	if seen[idnty.Id] {
+		return model.Errorf(model.CodeAlreadyExists, "the asset %s is repeated in the batch", idnty.Id)
+	}
+	seen[idnty.Id] = true
+
+	if err := validator.ValidateIdentity(idnty); err != nil {
+		return err
+	}
+
+	exists, err := s.IdentityExists(ctx, idnty.Id)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return model.Errorf(model.CodeAlreadyExists, "the asset %s already exists", idnty.Id)
+	}
+
+	idnty.Owner = clientID
+	idnty.DeletedAt = ""
+
+	if err = s.putOwnerIndex(ctx, clientID, idnty.Id); err != nil {
+		return err
+	}
+
+	return s.putIdentity(ctx, idnty)
+}
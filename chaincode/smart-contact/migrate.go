@@ -0,0 +1,106 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// MigrateIdentities rewrites up to batchSize identities stored with schema version
+// fromVersion at the current schema version, starting at the bookmark returned by the
+// previous batch. Every scanned identity missing from the owner index is added to it.
+// Only admins can migrate identities.
+func (s *SmartContract) MigrateIdentities(ctx contractapi.TransactionContextInterface, fromVersion int, batchSize int32, bookmark string) (*model.MigrationResult, error) {
+	admin, err := s.isAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !admin {
+		return nil, model.NewError(model.CodeForbidden, "submitting client not authorized to migrate identities, does not have admin role")
+	}
+
+	if fromVersion < 1 || fromVersion >= model.SchemaVersion {
+		return nil, model.Errorf(model.CodeInvalidArgument, "fromVersion must be between 1 and %d", model.SchemaVersion-1)
+	}
+	if batchSize <= 0 {
+		return nil, model.NewError(model.CodeInvalidArgument, "batchSize must be positive")
+	}
+
+	result := model.MigrationResult{
+		FromVersion: fromVersion,
+		ToVersion:   model.SchemaVersion,
+	}
+
+	// Paginated queries are not allowed in update transactions, so the bookmark is the
+	// key the next batch starts from
+	iterator, err := ctx.GetStub().GetStateByRange(bookmark, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if result.Scanned == int(batchSize) {
+			result.Bookmark = kv.Key
+			return &result, nil
+		}
+		result.Scanned++
+
+		var record map[string]interface{}
+		if err = json.Unmarshal(kv.Value, &record); err != nil {
+			return nil, err
+		}
+
+		// Identities created before the owner index have no entry in it and are missing
+		// from their owner's listings
+		if owner, _ := record["owner"].(string); owner != "" {
+			indexed, err := s.backfillOwnerIndex(ctx, owner, kv.Key)
+			if err != nil {
+				return nil, err
+			}
+			if indexed {
+				result.Indexed++
+			}
+		}
+
+		if model.RecordVersion(record) != fromVersion {
+			continue
+		}
+
+		idnty, err := s.readStoredIdentity(ctx, kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.putIdentity(ctx, idnty); err != nil {
+			return nil, err
+		}
+		result.Migrated++
+	}
+
+	result.Done = true
+	return &result, nil
+}
+
+// backfillOwnerIndex adds the identity to the index of its owner when it is missing from
+// it, and reports whether it was added.
+func (s *SmartContract) backfillOwnerIndex(ctx contractapi.TransactionContextInterface, owner string, id string) (bool, error) {
+	ownerKey, err := ctx.GetStub().CreateCompositeKey(ownerIndex, []string{owner, id})
+	if err != nil {
+		return false, err
+	}
+	value, err := ctx.GetStub().GetState(ownerKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if value != nil {
+		return false, nil
+	}
+	return true, s.putOwnerIndex(ctx, owner, id)
+}
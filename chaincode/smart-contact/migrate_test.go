@@ -0,0 +1,179 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/digital-identity/model"
+)
+
+// putV1Identity stores a schema version 1 identity, written before versioning with its
+// PII in the world state and without an owner index entry.
+func putV1Identity(t *testing.T, ledger *testLedger, owner *testClient, id string) {
+	t.Helper()
+	jsonByte, err := json.Marshal(map[string]interface{}{
+		"id":         id,
+		"firstName":  " Jane  Doe",
+		"lastName":   "Smith",
+		"phone":      "+8801712345678",
+		"email":      "jane@Example.COM",
+		"gender":     "Female",
+		"nationalID": "1234567890",
+		"owner":      owner.id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger.state[id] = jsonByte
+}
+
+// assertMigrated fails the test unless the identity is stored at the current schema
+// version, with its normalised PII in the private data collection only.
+func assertMigrated(t *testing.T, ledger *testLedger, id string) *model.Identity {
+	t.Helper()
+	var public, private model.Identity
+	if err := json.Unmarshal(ledger.state[id], &public); err != nil {
+		t.Fatalf("%s world state: %v", id, err)
+	}
+	if public.SchemaVersion != model.SchemaVersion || public.FirstName != "" || public.Phone != "" || public.NationalID != "" || public.Owner == "" {
+		t.Errorf("%s world state %+v, want the id and owner at version %d", id, public, model.SchemaVersion)
+	}
+	if err := json.Unmarshal(ledger.private[identityCollection+"/"+id], &private); err != nil {
+		t.Fatalf("%s private data: %v", id, err)
+	}
+	if private.SchemaVersion != model.SchemaVersion || private.FirstName != "Jane Doe" || private.Email != "jane@example.com" ||
+		private.Gender != "female" || private.NationalID != "1234567890" {
+		t.Errorf("%s private data %+v", id, private)
+	}
+	return &private
+}
+
+func TestReadMigratesOldRecords(t *testing.T) {
+	s := &SmartContract{}
+	ledger := newTestLedger()
+	owner, bank, admin := newTestClient("owner", ""), newTestClient("bank", ""), newTestClient("admin", adminRole)
+	putV1Identity(t, ledger, owner, "id1")
+	stored := ledger.state["id1"]
+
+	idnty, err := s.ReadIdentity(ledger.tx(owner), "id1")
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	want := &model.Identity{Id: "id1", FirstName: "Jane Doe", LastName: "Smith", Phone: "+8801712345678", Email: "jane@example.com",
+		Gender: "female", NationalID: "1234567890", Owner: owner.id, SchemaVersion: model.SchemaVersion}
+	if !reflect.DeepEqual(idnty, want) {
+		t.Errorf("read %+v, want %+v", idnty, want)
+	}
+
+	deleted, err := s.ReadIdentityIncludingDeleted(ledger.tx(admin), "id1")
+	if err != nil || !reflect.DeepEqual(deleted, want) {
+		t.Errorf("admin read %+v: %v, want %+v", deleted, err, want)
+	}
+
+	// Relying parties read the upgraded fields of their consents
+	grantTestConsent(t, ledger, owner, model.ConsentRequest{IdentityID: "id1", MSPID: "Org1MSP", ClientID: bank.id,
+		Fields: []string{"firstName", "gender"}, Purpose: "kyc", ExpiresAt: "2030-01-01T00:00:00Z"})
+	filtered, err := s.ReadIdentity(ledger.tx(bank), "id1")
+	if err != nil || !reflect.DeepEqual(filtered, &model.Identity{Id: "id1", FirstName: "Jane Doe", Gender: "female"}) {
+		t.Errorf("relying party read %+v: %v", filtered, err)
+	}
+
+	// Reads are evaluated, the stored record is left as it is
+	if !bytes.Equal(ledger.state["id1"], stored) || ledger.private[identityCollection+"/id1"] != nil {
+		t.Errorf("read rewrote the record: %s", ledger.state["id1"])
+	}
+
+	ledger.state["id2"] = []byte(`{"id":"id2","owner":"` + owner.id + `","schemaVersion":3}`)
+	_, err = s.ReadIdentity(ledger.tx(owner), "id2")
+	assertCode(t, "read of a newer schema version", err, model.CodeFailedPrecondition)
+}
+
+func TestWriteMigratesOldRecords(t *testing.T) {
+	s := &SmartContract{}
+	ledger := newTestLedger()
+	owner := newTestClient("owner", "")
+	putV1Identity(t, ledger, owner, "id1")
+	putV1Identity(t, ledger, owner, "id2")
+
+	if err := s.UpdateIdentity(ledger.tx(owner), "id1", model.Identity{LastName: "Roe"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if updated := assertMigrated(t, ledger, "id1"); updated.LastName != "Roe" {
+		t.Errorf("updated last name %q, want Roe", updated.LastName)
+	}
+
+	if err := s.DeleteIdentity(ledger.tx(owner), "id2"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if deleted := assertMigrated(t, ledger, "id2"); deleted.DeletedAt == "" || deleted.LastName != "Smith" {
+		t.Errorf("deleted identity %+v", deleted)
+	}
+	if err := s.RestoreIdentity(ledger.tx(owner), "id2"); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if restored, err := s.ReadIdentity(ledger.tx(owner), "id2"); err != nil || restored.FirstName != "Jane Doe" {
+		t.Errorf("restored identity %+v: %v", restored, err)
+	}
+}
+
+func TestMigrateIdentities(t *testing.T) {
+	s := &SmartContract{}
+	ledger := newTestLedger()
+	owner, admin := newTestClient("owner", ""), newTestClient("admin", adminRole)
+	putV1Identity(t, ledger, owner, "id1")
+	putV1Identity(t, ledger, owner, "id2")
+	createTestIdentity(t, ledger, owner, "id3")
+
+	invalid := []struct {
+		name        string
+		client      *testClient
+		fromVersion int
+		batchSize   int32
+		code        model.Code
+	}{
+		{"owner", owner, 1, 10, model.CodeForbidden},
+		{"current version", admin, model.SchemaVersion, 10, model.CodeInvalidArgument},
+		{"version 0", admin, 0, 10, model.CodeInvalidArgument},
+		{"empty batch", admin, 1, 0, model.CodeInvalidArgument},
+	}
+	for _, test := range invalid {
+		_, err := s.MigrateIdentities(ledger.tx(test.client), test.fromVersion, test.batchSize, "")
+		assertCode(t, test.name, err, test.code)
+	}
+
+	// The old records are missing from the listing of their owner until migrated
+	page, err := s.ListIdentities(ledger.tx(owner), 10, "", false)
+	if err != nil || len(page.Records) != 1 {
+		t.Errorf("owner listing before migration %+v: %v, want id3", page, err)
+	}
+
+	tests := []struct {
+		batchSize int32
+		bookmark  string
+		want      model.MigrationResult
+	}{
+		{2, "", model.MigrationResult{FromVersion: 1, ToVersion: model.SchemaVersion, Scanned: 2, Migrated: 2, Indexed: 2, Bookmark: "id3"}},
+		{2, "id3", model.MigrationResult{FromVersion: 1, ToVersion: model.SchemaVersion, Scanned: 1, Done: true}},
+		// Migrating again changes nothing
+		{10, "", model.MigrationResult{FromVersion: 1, ToVersion: model.SchemaVersion, Scanned: 3, Done: true}},
+	}
+	for i, test := range tests {
+		result, err := s.MigrateIdentities(ledger.tx(admin), 1, test.batchSize, test.bookmark)
+		if err != nil {
+			t.Fatalf("batch %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(*result, test.want) {
+			t.Errorf("batch %d: %+v, want %+v", i, *result, test.want)
+		}
+	}
+
+	for _, id := range []string{"id1", "id2"} {
+		assertMigrated(t, ledger, id)
+	}
+	page, err = s.ListIdentities(ledger.tx(owner), 10, "", false)
+	if err != nil || len(page.Records) != 3 {
+		t.Errorf("owner listing after migration %+v: %v, want 3 identities", page, err)
+	}
+}
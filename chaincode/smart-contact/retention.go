@@ -0,0 +1,151 @@
+package identity
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// RestoreIdentity undoes a soft delete. Only the owner can restore an identity and
+// only within the configured retention period.
+func (s *SmartContract) RestoreIdentity(ctx contractapi.TransactionContextInterface, id string) error {
+	idnty, err := s.readStoredIdentity(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if isEmptyField(idnty.DeletedAt) {
+		return model.Errorf(model.CodeFailedPrecondition, "the asset %s is not deleted", id)
+	}
+
+	clientID, err := s.GetSubmittingClientIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	if clientID != idnty.Owner {
+		return model.NewError(model.CodeForbidden, "submitting client not authorized to restore identity, does not own identity")
+	}
+
+	expired, err := s.retentionExpired(ctx, idnty)
+	if err != nil {
+		return err
+	}
+	if expired {
+		return model.Errorf(model.CodeFailedPrecondition, "the asset %s can no longer be restored, retention period has ended", id)
+	}
+
+	idnty.DeletedAt = ""
+
+	fmt.Printf("restore identity data in world state")
+	if err = s.putIdentity(ctx, idnty); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, model.EventIdentityRestored, idnty.Id, "")
+}
+
+// PurgeIdentity permanently removes a soft deleted identity, its indexes, consents, consent
+// ledger and access log once the retention period has ended. Only admins can purge identities.
+func (s *SmartContract) PurgeIdentity(ctx contractapi.TransactionContextInterface, id string) error {
+	admin, err := s.isAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return model.NewError(model.CodeForbidden, "submitting client not authorized to purge identity, does not have admin role")
+	}
+
+	idnty, err := s.readStoredIdentity(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if isEmptyField(idnty.DeletedAt) {
+		return model.Errorf(model.CodeFailedPrecondition, "the asset %s is not deleted", id)
+	}
+
+	expired, err := s.retentionExpired(ctx, idnty)
+	if err != nil {
+		return err
+	}
+	if !expired {
+		return model.Errorf(model.CodeFailedPrecondition, "the asset %s is still within its retention period", id)
+	}
+
+	if err = s.deleteOwnerIndex(ctx, idnty.Owner, id); err != nil {
+		return err
+	}
+
+	if err = s.deleteIdentityTrail(ctx, id); err != nil {
+		return err
+	}
+	if err = s.deleteByPartialCompositeKey(ctx, erasureRequestObjectType, id); err != nil {
+		return err
+	}
+
+	fmt.Printf("purge identity data from world state")
+	if err = ctx.GetStub().PurgePrivateData(identityCollection, id); err != nil {
+		return fmt.Errorf("failed to purge private data: %v", err)
+	}
+	if err = ctx.GetStub().DelState(id); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, model.EventIdentityPurged, id, "")
+}
+
+// retentionExpired returns true when the soft deleted identity is past the retention period.
+func (s *SmartContract) retentionExpired(ctx contractapi.TransactionContextInterface, idnty *model.Identity) (bool, error) {
+	config, err := s.GetConfig(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	deletedAt, err := time.Parse(time.RFC3339, idnty.DeletedAt)
+	if err != nil {
+		return false, fmt.Errorf("invalid deletedAt of asset %s: %v", idnty.Id, err)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return now.After(deletedAt.AddDate(0, 0, config.RetentionDays)), nil
+}
+
+// deleteIdentityTrail deletes the consents, consent ledger and access log of the identity.
+// The consent ledger and access log hold the requester IDs and purposes of the identity's
+// consents and reads, and go along with the identity when it is purged or erased.
+func (s *SmartContract) deleteIdentityTrail(ctx contractapi.TransactionContextInterface, id string) error {
+	for _, objectType := range []string{consentObjectType, consentLedgerObjectType, accessLogObjectType} {
+		if err := s.deleteByPartialCompositeKey(ctx, objectType, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteByPartialCompositeKey deletes every key of the object type that belongs to the identity.
+func (s *SmartContract) deleteByPartialCompositeKey(ctx contractapi.TransactionContextInterface, objectType string, id string) error {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(objectType, []string{id})
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+		if err = ctx.GetStub().DelState(kv.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
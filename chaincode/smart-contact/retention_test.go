@@ -0,0 +1,213 @@
+package identity
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
+)
+
+func TestDeleteAndRestoreIdentity(t *testing.T) {
+	s := &SmartContract{}
+	ledger := newTestLedger()
+	owner, other, admin := newTestClient("owner", ""), newTestClient("other", ""), newTestClient("admin", adminRole)
+	createTestIdentity(t, ledger, owner, "id1")
+
+	assertCode(t, "delete by another client", s.DeleteIdentity(ledger.tx(other), "id1"), model.CodeForbidden)
+	if err := s.DeleteIdentity(ledger.tx(owner), "id1"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if event := ledger.lastEvent(); event.Type != model.EventIdentityDeleted || event.IdentityID != "id1" {
+		t.Errorf("delete event %+v", event)
+	}
+
+	// The soft-deleted identity is hidden but kept
+	_, err := s.ReadIdentity(ledger.tx(owner), "id1")
+	assertCode(t, "read of a deleted identity", err, model.CodeNotFound)
+	assertCode(t, "update of a deleted identity", s.UpdateIdentity(ledger.tx(owner), "id1", model.Identity{LastName: "Roe"}), model.CodeNotFound)
+	assertCode(t, "second delete", s.DeleteIdentity(ledger.tx(owner), "id1"), model.CodeNotFound)
+
+	_, err = s.ReadIdentityIncludingDeleted(ledger.tx(owner), "id1")
+	assertCode(t, "owner read including deleted", err, model.CodeForbidden)
+	deleted, err := s.ReadIdentityIncludingDeleted(ledger.tx(admin), "id1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.DeletedAt != "2024-05-01T10:00:00Z" || deleted.NationalID != "1234567890" {
+		t.Errorf("deleted identity %+v", deleted)
+	}
+
+	tests := []struct {
+		name           string
+		client         *testClient
+		includeDeleted bool
+		want           int
+	}{
+		{"owner", owner, false, 0},
+		{"admin", admin, false, 0},
+		{"admin including deleted", admin, true, 1},
+	}
+	for _, test := range tests {
+		page, err := s.ListIdentities(ledger.tx(test.client), 10, "", test.includeDeleted)
+		if err != nil {
+			t.Errorf("%s: list: %v", test.name, err)
+			continue
+		}
+		if len(page.Records) != test.want {
+			t.Errorf("%s: listed %d identities, want %d", test.name, len(page.Records), test.want)
+		}
+	}
+	_, err = s.ListIdentities(ledger.tx(owner), 10, "", true)
+	assertCode(t, "owner list including deleted", err, model.CodeForbidden)
+
+	assertCode(t, "restore by another client", s.RestoreIdentity(ledger.tx(other), "id1"), model.CodeForbidden)
+	ledger.now = ledger.now.AddDate(0, 0, defaultRetentionDays)
+	if err = s.RestoreIdentity(ledger.tx(owner), "id1"); err != nil {
+		t.Fatalf("restore on the last day of the retention period: %v", err)
+	}
+	if event := ledger.lastEvent(); event.Type != model.EventIdentityRestored {
+		t.Errorf("restore event %+v", event)
+	}
+	restored, err := s.ReadIdentity(ledger.tx(owner), "id1")
+	if err != nil || restored.DeletedAt != "" || restored.FirstName != "Jane" {
+		t.Errorf("restored identity %+v: %v", restored, err)
+	}
+	assertCode(t, "restore of an identity not deleted", s.RestoreIdentity(ledger.tx(owner), "id1"), model.CodeFailedPrecondition)
+
+	// Past the retention period the identity can only be purged
+	if err = s.DeleteIdentity(ledger.tx(owner), "id1"); err != nil {
+		t.Fatal(err)
+	}
+	ledger.now = ledger.now.AddDate(0, 0, defaultRetentionDays).Add(time.Second)
+	assertCode(t, "restore after the retention period", s.RestoreIdentity(ledger.tx(owner), "id1"), model.CodeFailedPrecondition)
+	assertCode(t, "restore of an unknown identity", s.RestoreIdentity(ledger.tx(owner), "id2"), model.CodeNotFound)
+}
+
+func TestPurgeIdentity(t *testing.T) {
+	tests := []struct {
+		name          string
+		retentionDays int
+		after         time.Duration
+		purged        bool
+	}{
+		{"within the default retention period", 0, 30 * 24 * time.Hour, false},
+		{"after the default retention period", 0, 30*24*time.Hour + time.Second, true},
+		{"within the configured retention period", 7, 7 * 24 * time.Hour, false},
+		{"after the configured retention period", 7, 7*24*time.Hour + time.Second, true},
+	}
+	for _, test := range tests {
+		s := &SmartContract{}
+		ledger := newTestLedger()
+		owner, admin := newTestClient("owner", ""), newTestClient("admin", adminRole)
+		if test.retentionDays != 0 {
+			if err := s.SetConfig(ledger.tx(admin), ContractConfig{RetentionDays: test.retentionDays, DefaultRegion: "BD"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		createTestIdentity(t, ledger, owner, "id1")
+		_, err := s.GrantConsent(ledger.tx(owner), model.ConsentRequest{IdentityID: "id1", MSPID: "Org2MSP", Role: "bank",
+			Fields: []string{"firstName"}, Purpose: "kyc", ExpiresAt: "2030-01-01T00:00:00Z"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertCode(t, test.name+": purge of an identity not deleted", s.PurgeIdentity(ledger.tx(admin), "id1"), model.CodeFailedPrecondition)
+		if err = s.DeleteIdentity(ledger.tx(owner), "id1"); err != nil {
+			t.Fatal(err)
+		}
+		ledger.now = ledger.now.Add(test.after)
+		assertCode(t, test.name+": purge by the owner", s.PurgeIdentity(ledger.tx(owner), "id1"), model.CodeForbidden)
+
+		err = s.PurgeIdentity(ledger.tx(admin), "id1")
+		if !test.purged {
+			assertCode(t, test.name, err, model.CodeFailedPrecondition)
+			if ledger.state["id1"] == nil || ledger.private[identityCollection+"/id1"] == nil {
+				t.Errorf("%s: identity removed", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: purge: %v", test.name, err)
+			continue
+		}
+
+		if ledger.state["id1"] != nil || ledger.private[identityCollection+"/id1"] != nil {
+			t.Errorf("%s: identity left after purge", test.name)
+		}
+		for _, objectType := range []string{consentObjectType, consentLedgerObjectType} {
+			if keys := ledger.compositeKeys(t, objectType, "id1"); len(keys) != 0 {
+				t.Errorf("%s: %d %s keys left after purge", test.name, len(keys), objectType)
+			}
+		}
+		if keys := ledger.compositeKeys(t, ownerIndex, owner.id); len(keys) != 0 {
+			t.Errorf("%s: owner index left after purge", test.name)
+		}
+		if event := ledger.lastEvent(); event.Type != model.EventIdentityPurged || event.IdentityID != "id1" {
+			t.Errorf("%s: purge event %+v", test.name, event)
+		}
+		_, err = s.ReadIdentityIncludingDeleted(ledger.tx(admin), "id1")
+		assertCode(t, test.name+": read after purge", err, model.CodeNotFound)
+	}
+}
+
+func TestOwnerIndex(t *testing.T) {
+	s := &SmartContract{}
+	ledger := newTestLedger()
+	owner, other, admin := newTestClient("owner", ""), newTestClient("other", ""), newTestClient("admin", adminRole)
+	for _, id := range []string{"id1", "id2", "id3"} {
+		createTestIdentity(t, ledger, owner, id)
+	}
+	createTestIdentity(t, ledger, other, "id4")
+
+	if keys := ledger.compositeKeys(t, ownerIndex, owner.id); len(keys) != 3 {
+		t.Errorf("owner index holds %d identities, want 3", len(keys))
+	}
+
+	tests := []struct {
+		name   string
+		client *testClient
+		want   []string
+	}{
+		{"owner", owner, []string{"id1", "id2", "id3"}},
+		{"other", other, []string{"id4"}},
+		{"admin", admin, []string{"id1", "id2", "id3", "id4"}},
+	}
+	for _, test := range tests {
+		var ids []string
+		bookmark := ""
+		// Pages of two identities
+		for page := 0; page < 3; page++ {
+			result, err := s.ListIdentities(ledger.tx(test.client), 2, bookmark, false)
+			if err != nil {
+				t.Fatalf("%s: list: %v", test.name, err)
+			}
+			for _, idnty := range result.Records {
+				ids = append(ids, idnty.Id)
+			}
+			if bookmark = result.Bookmark; bookmark == "" {
+				break
+			}
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%s: listed %v, want %v", test.name, ids, test.want)
+		}
+	}
+
+	// Deleted identities stay in the index but are not listed, entries of identities
+	// that no longer exist are skipped
+	if err := s.DeleteIdentity(ledger.tx(owner), "id2"); err != nil {
+		t.Fatal(err)
+	}
+	delete(ledger.state, "id3")
+	page, err := s.ListIdentities(ledger.tx(owner), 10, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 1 || page.Records[0].Id != "id1" || page.Records[0].NationalID != "1234567890" {
+		t.Errorf("owner listing %+v, want id1", page.Records)
+	}
+	if keys := ledger.compositeKeys(t, ownerIndex, owner.id); len(keys) != 3 {
+		t.Errorf("owner index holds %d identities, want 3", len(keys))
+	}
+}
@@ -0,0 +1,308 @@
+package identity
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-chaincode-go/v2/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/v2/shim"
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+	"github.com/hyperledger/fabric-protos-go-apiv2/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// testLedger is the world state, private data and events shared by the transactions of
+// a test. Writes are visible to the next reads, also within a transaction.
+type testLedger struct {
+	state   map[string][]byte
+	private map[string][]byte
+	events  []*model.IdentityEvent
+	now     time.Time
+	txs     int
+}
+
+func newTestLedger() *testLedger {
+	return &testLedger{
+		state:   map[string][]byte{},
+		private: map[string][]byte{},
+		now:     time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+	}
+}
+
+// tx returns the context of a new transaction submitted by client at the ledger time.
+func (l *testLedger) tx(client *testClient) contractapi.TransactionContextInterface {
+	return l.txWithTransient(client, nil)
+}
+
+// txWithTransient returns the context of a new transaction carrying the transient map.
+func (l *testLedger) txWithTransient(client *testClient, transient map[string][]byte) contractapi.TransactionContextInterface {
+	l.txs++
+	ctx := &contractapi.TransactionContext{}
+	ctx.SetStub(&testStub{ledger: l, txID: "tx" + strconv.Itoa(l.txs), transient: transient})
+	ctx.SetClientIdentity(client)
+	return ctx
+}
+
+// keys returns the sorted keys of the world state with the prefix.
+func (l *testLedger) keys(prefix string) []string {
+	var keys []string
+	for key := range l.state {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// compositeKeys returns the keys of the object type that belong to the identity.
+func (l *testLedger) compositeKeys(t *testing.T, objectType string, id string) []string {
+	t.Helper()
+	prefix, err := shim.CreateCompositeKey(objectType, []string{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.keys(prefix)
+}
+
+// lastEvent returns the event of the last transaction that set one.
+func (l *testLedger) lastEvent() *model.IdentityEvent {
+	if len(l.events) == 0 {
+		return nil
+	}
+	return l.events[len(l.events)-1]
+}
+
+// testStub is the stub of a single transaction on the test ledger.
+type testStub struct {
+	shim.ChaincodeStubInterface
+	ledger    *testLedger
+	txID      string
+	transient map[string][]byte
+}
+
+func (s *testStub) GetTxID() string {
+	return s.txID
+}
+
+func (s *testStub) GetTxTimestamp() (*timestamppb.Timestamp, error) {
+	return timestamppb.New(s.ledger.now), nil
+}
+
+func (s *testStub) GetTransient() (map[string][]byte, error) {
+	return s.transient, nil
+}
+
+func (s *testStub) GetState(key string) ([]byte, error) {
+	return s.ledger.state[key], nil
+}
+
+func (s *testStub) PutState(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("empty key")
+	}
+	s.ledger.state[key] = value
+	return nil
+}
+
+func (s *testStub) DelState(key string) error {
+	delete(s.ledger.state, key)
+	return nil
+}
+
+func (s *testStub) GetPrivateData(collection string, key string) ([]byte, error) {
+	return s.ledger.private[collection+"/"+key], nil
+}
+
+func (s *testStub) PutPrivateData(collection string, key string, value []byte) error {
+	s.ledger.private[collection+"/"+key] = value
+	return nil
+}
+
+func (s *testStub) PurgePrivateData(collection string, key string) error {
+	delete(s.ledger.private, collection+"/"+key)
+	return nil
+}
+
+func (s *testStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return shim.CreateCompositeKey(objectType, attributes)
+}
+
+func (s *testStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	parts := strings.Split(strings.TrimSuffix(compositeKey[1:], "\x00"), "\x00")
+	return parts[0], parts[1:], nil
+}
+
+// GetStateByRange iterates the simple keys from startKey to endKey excluded, composite
+// keys are out of range queries like on a peer.
+func (s *testStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	var keys []string
+	for _, key := range s.ledger.keys("") {
+		if !strings.HasPrefix(key, "\x00") && key >= startKey && (endKey == "" || key < endKey) {
+			keys = append(keys, key)
+		}
+	}
+	return s.iterator(keys), nil
+}
+
+func (s *testStub) GetStateByRangeWithPagination(startKey string, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	if bookmark != "" {
+		startKey = bookmark
+	}
+	iterator, _ := s.GetStateByRange(startKey, endKey)
+	return s.page(iterator.(*testIterator), pageSize)
+}
+
+func (s *testStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := shim.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return s.iterator(s.ledger.keys(prefix)), nil
+}
+
+func (s *testStub) GetStateByPartialCompositeKeyWithPagination(objectType string, attributes []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	iterator, err := s.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, nil, err
+	}
+	results := iterator.(*testIterator)
+	for bookmark != "" && results.HasNext() && results.kvs[0].Key < bookmark {
+		results.kvs = results.kvs[1:]
+	}
+	return s.page(results, pageSize)
+}
+
+func (s *testStub) SetEvent(name string, payload []byte) error {
+	var event model.IdentityEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+	if event.Type != name {
+		return fmt.Errorf("event %s carries a %s payload", name, event.Type)
+	}
+	s.ledger.events = append(s.ledger.events, &event)
+	return nil
+}
+
+func (s *testStub) iterator(keys []string) *testIterator {
+	iterator := &testIterator{}
+	for _, key := range keys {
+		iterator.kvs = append(iterator.kvs, &queryresult.KV{Key: key, Value: s.ledger.state[key]})
+	}
+	return iterator
+}
+
+// page cuts the results to pageSize, the bookmark is the first key of the next page.
+func (s *testStub) page(results *testIterator, pageSize int32) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	metadata := &peer.QueryResponseMetadata{}
+	if len(results.kvs) > int(pageSize) {
+		metadata.Bookmark = results.kvs[pageSize].Key
+		results.kvs = results.kvs[:pageSize]
+	}
+	metadata.FetchedRecordsCount = int32(len(results.kvs))
+	return results, metadata, nil
+}
+
+type testIterator struct {
+	kvs []*queryresult.KV
+}
+
+func (i *testIterator) HasNext() bool {
+	return len(i.kvs) > 0
+}
+
+func (i *testIterator) Next() (*queryresult.KV, error) {
+	if len(i.kvs) == 0 {
+		return nil, fmt.Errorf("no more results")
+	}
+	kv := i.kvs[0]
+	i.kvs = i.kvs[1:]
+	return kv, nil
+}
+
+func (i *testIterator) Close() error {
+	return nil
+}
+
+// testClient is the certificate identity of a client submitting transactions.
+type testClient struct {
+	cid.ClientIdentity
+	id    string
+	mspID string
+	attrs map[string]string
+}
+
+// newTestClient returns a client of Org1MSP with the role attribute, empty for none.
+func newTestClient(name string, role string) *testClient {
+	client := &testClient{
+		id:    "x509::CN=" + name + "::CN=ca.org1.example.com",
+		mspID: "Org1MSP",
+		attrs: map[string]string{},
+	}
+	if role != "" {
+		client.attrs[roleAttribute] = role
+	}
+	return client
+}
+
+func (c *testClient) GetID() (string, error) {
+	return base64.StdEncoding.EncodeToString([]byte(c.id)), nil
+}
+
+func (c *testClient) GetMSPID() (string, error) {
+	return c.mspID, nil
+}
+
+func (c *testClient) GetAttributeValue(name string) (string, bool, error) {
+	value, ok := c.attrs[name]
+	return value, ok, nil
+}
+
+func (c *testClient) AssertAttributeValue(name string, value string) error {
+	if actual, ok := c.attrs[name]; !ok || actual != value {
+		return fmt.Errorf("attribute %s is %q, not %q", name, actual, value)
+	}
+	return nil
+}
+
+// testIdentity returns a valid identity with every field set.
+func testIdentity(id string) model.Identity {
+	return model.Identity{
+		Id:               id,
+		FirstName:        "Jane",
+		LastName:         "Doe",
+		Phone:            "+8801712345678",
+		Email:            "jane@example.com",
+		Dob:              "1990-04-01",
+		PresentAddress:   "Road 5, Dhanmondi",
+		PermanentAddress: "Sylhet",
+		Gender:           "female",
+		NationalID:       "1234567890",
+	}
+}
+
+// createTestIdentity creates the identity id owned by owner.
+func createTestIdentity(t *testing.T, ledger *testLedger, owner *testClient, id string) {
+	t.Helper()
+	owner.attrs["identity.id"] = id
+	if err := (&SmartContract{}).CreateIdentity(ledger.tx(owner), testIdentity(id)); err != nil {
+		t.Fatalf("create %s: %v", id, err)
+	}
+}
+
+// assertCode fails the test unless err carries the code.
+func assertCode(t *testing.T, name string, err error, code model.Code) {
+	t.Helper()
+	if model.CodeOf(err) != code {
+		t.Errorf("%s: error %v, want code %s", name, err, code)
+	}
+}
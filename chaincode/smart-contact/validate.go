@@ -0,0 +1,55 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// newValidator returns a validator for the configured region that checks dates
+// against the transaction timestamp.
+func (s *SmartContract) newValidator(ctx contractapi.TransactionContextInterface) (*model.Validator, error) {
+	config, err := s.GetConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return model.NewValidator(config.DefaultRegion, func() time.Time { return now }), nil
+}
+
+// identityPatch returns the field changes requested by UpdateIdentity. The transient
+// identity is read as a JSON merge patch, so fields set to null or "" are cleared.
+// Without transient data the non empty fields of the argument are applied.
+func identityPatch(ctx contractapi.TransactionContextInterface, update model.Identity) (map[string]*string, error) {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transient map: %v", err)
+	}
+
+	transientJSON, ok := transient[identityTransientKey]
+	if !ok {
+		patch := make(map[string]*string)
+		fields := update.Fields()
+		for _, field := range model.UpdatableFields {
+			if !isEmptyField(*fields[field]) {
+				patch[field] = fields[field]
+			}
+		}
+		return patch, nil
+	}
+
+	var patch map[string]*string
+	if err = json.Unmarshal(transientJSON, &patch); err != nil {
+		return nil, model.Errorf(model.CodeInvalidArgument, "failed to unmarshal transient identity: %v", err)
+	}
+
+	return patch, nil
+}
@@ -0,0 +1,283 @@
+// Package channelconfig builds the channel config updates of an organization, such as
+// the update of the CRLs of its MSP, as configtxlator compute_update would, and signs
+// them into the envelopes submitted with peer channel update.
+package channelconfig
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	cb "github.com/hyperledger/fabric-protos-go-apiv2/common"
+	mb "github.com/hyperledger/fabric-protos-go-apiv2/msp"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	applicationGroup = "Application"
+	mspValue         = "MSP"
+)
+
+// ErrUnchanged is returned when the channel MSP already holds the CRL.
+var ErrUnchanged = errors.New("the channel MSP already holds the CRL")
+
+// ChannelConfig is the config of a channel, read from its last config block.
+type ChannelConfig struct {
+	ChannelID string
+	Config    *cb.Config
+}
+
+// FromBlock reads the config of a config block, as fetched with peer channel fetch config.
+func FromBlock(blockBytes []byte) (*ChannelConfig, error) {
+	block := &cb.Block{}
+	if err := proto.Unmarshal(blockBytes, block); err != nil {
+		return nil, fmt.Errorf("invalid block: %w", err)
+	}
+	if len(block.GetData().GetData()) == 0 {
+		return nil, errors.New("block has no transaction")
+	}
+
+	envelope := &cb.Envelope{}
+	if err := proto.Unmarshal(block.GetData().GetData()[0], envelope); err != nil {
+		return nil, fmt.Errorf("invalid block transaction: %w", err)
+	}
+	payload := &cb.Payload{}
+	if err := proto.Unmarshal(envelope.GetPayload(), payload); err != nil {
+		return nil, fmt.Errorf("invalid block transaction payload: %w", err)
+	}
+	channelHeader := &cb.ChannelHeader{}
+	if err := proto.Unmarshal(payload.GetHeader().GetChannelHeader(), channelHeader); err != nil {
+		return nil, fmt.Errorf("invalid channel header: %w", err)
+	}
+	if cb.HeaderType(channelHeader.GetType()) != cb.HeaderType_CONFIG {
+		return nil, fmt.Errorf("block %d is not a config block", block.GetHeader().GetNumber())
+	}
+	configEnvelope := &cb.ConfigEnvelope{}
+	if err := proto.Unmarshal(payload.GetData(), configEnvelope); err != nil {
+		return nil, fmt.Errorf("invalid config envelope: %w", err)
+	}
+	if configEnvelope.GetConfig().GetChannelGroup() == nil {
+		return nil, errors.New("config block has no channel group")
+	}
+	return &ChannelConfig{ChannelID: channelHeader.GetChannelId(), Config: configEnvelope.GetConfig()}, nil
+}
+
+// CRLUpdate is the update of the revocation list of the MSP of an application
+// organization.
+type CRLUpdate struct {
+	Update *cb.ConfigUpdate
+	Diff   Diff
+}
+
+// Diff describes a CRL update, for a dry run.
+type Diff struct {
+	ChannelID      string       `json:"channel"`
+	Org            string       `json:"org"`
+	MSPID          string       `json:"msp_id"`
+	MSPVersion     [2]uint64    `json:"msp_version"`
+	RemovedCRLs    []CRLSummary `json:"removed_crls"`
+	AddedCRLs      []CRLSummary `json:"added_crls"`
+	KeptCRLs       int          `json:"kept_crls"`
+	RevokedSerials SerialDiff   `json:"revoked_serials"`
+}
+
+// SerialDiff lists the hex serial numbers that the update revokes and the ones it no
+// longer revokes.
+type SerialDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// CRLSummary describes a CRL of the revocation list.
+type CRLSummary struct {
+	Issuer         string    `json:"issuer"`
+	AKI            string    `json:"aki,omitempty"`
+	Number         string    `json:"number,omitempty"`
+	ThisUpdate     time.Time `json:"this_update"`
+	NextUpdate     time.Time `json:"next_update"`
+	RevokedSerials []string  `json:"revoked_serials"`
+}
+
+// UpdateCRL returns the config update that puts crlPEM in the revocation list of the
+// application organization of MSP mspID. The CRL replaces the CRLs of the same issuer and
+// authority key, the CRLs of other CAs are kept.
+func (c *ChannelConfig) UpdateCRL(mspID string, crlPEM []byte) (*CRLUpdate, error) {
+	block, _ := pem.Decode(crlPEM)
+	if block == nil || block.Type != "X509 CRL" {
+		return nil, errors.New("no PEM CRL found")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRL: %w", err)
+	}
+
+	application := c.Config.GetChannelGroup().GetGroups()[applicationGroup]
+	if application == nil {
+		return nil, fmt.Errorf("channel %s has no application group", c.ChannelID)
+	}
+	orgName, org, mspConfig, fabricConfig, err := findOrg(application, mspID)
+	if err != nil {
+		return nil, err
+	}
+
+	original := org.GetValues()[mspValue]
+	diff := Diff{
+		ChannelID:  c.ChannelID,
+		Org:        orgName,
+		MSPID:      mspID,
+		MSPVersion: [2]uint64{original.GetVersion(), original.GetVersion() + 1},
+		AddedCRLs:  []CRLSummary{summarize(crl)},
+	}
+	oldSerials := map[string]bool{}
+	revocationList := make([][]byte, 0, len(fabricConfig.GetRevocationList())+1)
+	for _, existing := range fabricConfig.GetRevocationList() {
+		existingCRL, err := parseCRL(existing)
+		if err != nil || !sameAuthority(existingCRL, crl) {
+			revocationList = append(revocationList, existing)
+			diff.KeptCRLs++
+			continue
+		}
+		if bytes.Equal(existingCRL.Raw, crl.Raw) {
+			return nil, ErrUnchanged
+		}
+		summary := summarize(existingCRL)
+		for _, serial := range summary.RevokedSerials {
+			oldSerials[serial] = true
+		}
+		diff.RemovedCRLs = append(diff.RemovedCRLs, summary)
+	}
+	revocationList = append(revocationList, pem.EncodeToMemory(block))
+	diff.RevokedSerials = serialDiff(oldSerials, diff.AddedCRLs[0].RevokedSerials)
+
+	fabricConfig.RevocationList = revocationList
+	if mspConfig.Config, err = proto.Marshal(fabricConfig); err != nil {
+		return nil, err
+	}
+	value, err := proto.Marshal(mspConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	channel := c.Config.GetChannelGroup()
+	// The groups on the path to the MSP value are read at their version, unchanged, and
+	// the value is written at the next version, as compute_update does.
+	return &CRLUpdate{
+		Update: &cb.ConfigUpdate{
+			ChannelId: c.ChannelID,
+			ReadSet: path(channel, application, orgName, &cb.ConfigGroup{
+				Version: org.GetVersion(),
+			}),
+			WriteSet: path(channel, application, orgName, &cb.ConfigGroup{
+				Version: org.GetVersion(),
+				Values: map[string]*cb.ConfigValue{
+					mspValue: {
+						Version:   original.GetVersion() + 1,
+						ModPolicy: original.GetModPolicy(),
+						Value:     value,
+					},
+				},
+			}),
+		},
+		Diff: diff,
+	}, nil
+}
+
+// findOrg returns the application organization group of the Fabric MSP mspID and its MSP
+// config.
+func findOrg(application *cb.ConfigGroup, mspID string) (string, *cb.ConfigGroup, *mb.MSPConfig, *mb.FabricMSPConfig, error) {
+	for name, org := range application.GetGroups() {
+		value := org.GetValues()[mspValue]
+		if value == nil {
+			continue
+		}
+		mspConfig := &mb.MSPConfig{}
+		if err := proto.Unmarshal(value.GetValue(), mspConfig); err != nil {
+			return "", nil, nil, nil, fmt.Errorf("invalid MSP of %s: %w", name, err)
+		}
+		// Type 0 is the X.509 Fabric MSP, the others are Idemix
+		if mspConfig.GetType() != 0 {
+			continue
+		}
+		fabricConfig := &mb.FabricMSPConfig{}
+		if err := proto.Unmarshal(mspConfig.GetConfig(), fabricConfig); err != nil {
+			return "", nil, nil, nil, fmt.Errorf("invalid MSP config of %s: %w", name, err)
+		}
+		if fabricConfig.GetName() == mspID {
+			return name, org, mspConfig, fabricConfig, nil
+		}
+	}
+	return "", nil, nil, nil, fmt.Errorf("no application organization has MSP %s", mspID)
+}
+
+// path returns the channel group holding org as the only group of the application group,
+// the channel and application groups at their versions.
+func path(channel, application *cb.ConfigGroup, orgName string, org *cb.ConfigGroup) *cb.ConfigGroup {
+	return &cb.ConfigGroup{
+		Version: channel.GetVersion(),
+		Groups: map[string]*cb.ConfigGroup{
+			applicationGroup: {
+				Version: application.GetVersion(),
+				Groups:  map[string]*cb.ConfigGroup{orgName: org},
+			},
+		},
+	}
+}
+
+// parseCRL parses a CRL of an MSP revocation list, PEM as configtxgen writes them, or DER.
+func parseCRL(crl []byte) (*x509.RevocationList, error) {
+	if block, _ := pem.Decode(crl); block != nil {
+		crl = block.Bytes
+	}
+	return x509.ParseRevocationList(crl)
+}
+
+// sameAuthority reports whether two CRLs are issued by the same CA key.
+func sameAuthority(a, b *x509.RevocationList) bool {
+	if !bytes.Equal(a.RawIssuer, b.RawIssuer) {
+		return false
+	}
+	return len(a.AuthorityKeyId) == 0 || len(b.AuthorityKeyId) == 0 ||
+		bytes.Equal(a.AuthorityKeyId, b.AuthorityKeyId)
+}
+
+func summarize(crl *x509.RevocationList) CRLSummary {
+	summary := CRLSummary{
+		Issuer:         crl.Issuer.String(),
+		AKI:            hex.EncodeToString(crl.AuthorityKeyId),
+		ThisUpdate:     crl.ThisUpdate,
+		NextUpdate:     crl.NextUpdate,
+		RevokedSerials: make([]string, 0, len(crl.RevokedCertificateEntries)),
+	}
+	if crl.Number != nil {
+		summary.Number = crl.Number.String()
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		// Hex serial numbers, as the Fabric CA reports them
+		summary.RevokedSerials = append(summary.RevokedSerials, entry.SerialNumber.Text(16))
+	}
+	sort.Strings(summary.RevokedSerials)
+	return summary
+}
+
+func serialDiff(old map[string]bool, serials []string) SerialDiff {
+	diff := SerialDiff{Added: []string{}, Removed: []string{}}
+	current := map[string]bool{}
+	for _, serial := range serials {
+		current[serial] = true
+		if !old[serial] {
+			diff.Added = append(diff.Added, serial)
+		}
+	}
+	for serial := range old {
+		if !current[serial] {
+			diff.Removed = append(diff.Removed, serial)
+		}
+	}
+	sort.Strings(diff.Removed)
+	return diff
+}
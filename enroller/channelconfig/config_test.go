@@ -0,0 +1,299 @@
+package channelconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	cb "github.com/hyperledger/fabric-protos-go-apiv2/common"
+	mb "github.com/hyperledger/fabric-protos-go-apiv2/msp"
+	"google.golang.org/protobuf/proto"
+)
+
+// testCA issues CRLs with a self-signed CA certificate.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          []byte(name),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// crl returns the PEM CRL number revoking the serials.
+func (ca *testCA) crl(t *testing.T, number int64, serials ...int64) []byte {
+	t.Helper()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func mspValueOf(t *testing.T, mspID string, revocationList ...[]byte) *cb.ConfigValue {
+	t.Helper()
+	fabricConfig, err := proto.Marshal(&mb.FabricMSPConfig{Name: mspID, RevocationList: revocationList})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := proto.Marshal(&mb.MSPConfig{Config: fabricConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cb.ConfigValue{Version: 3, ModPolicy: "Admins", Value: value}
+}
+
+// testConfig returns the config of mychannel with the application organizations Org1
+// of Org1MSP, holding revocationList, and Org2 of Org2MSP.
+func testConfig(t *testing.T, revocationList ...[]byte) *ChannelConfig {
+	t.Helper()
+	return &ChannelConfig{
+		ChannelID: "mychannel",
+		Config: &cb.Config{
+			ChannelGroup: &cb.ConfigGroup{
+				Version: 7,
+				Groups: map[string]*cb.ConfigGroup{
+					applicationGroup: {
+						Version: 2,
+						Groups: map[string]*cb.ConfigGroup{
+							"Org1": {Version: 1, Values: map[string]*cb.ConfigValue{mspValue: mspValueOf(t, "Org1MSP", revocationList...)}},
+							"Org2": {Version: 4, Values: map[string]*cb.ConfigValue{mspValue: mspValueOf(t, "Org2MSP")}},
+						},
+					},
+					"Orderer": {Version: 5},
+				},
+			},
+		},
+	}
+}
+
+// writtenRevocationList returns the revocation list of the MSP value in the write set.
+func writtenRevocationList(t *testing.T, update *cb.ConfigUpdate) [][]byte {
+	t.Helper()
+	value := update.GetWriteSet().GetGroups()[applicationGroup].GetGroups()["Org1"].GetValues()[mspValue]
+	mspConfig := &mb.MSPConfig{}
+	if err := proto.Unmarshal(value.GetValue(), mspConfig); err != nil {
+		t.Fatal(err)
+	}
+	fabricConfig := &mb.FabricMSPConfig{}
+	if err := proto.Unmarshal(mspConfig.GetConfig(), fabricConfig); err != nil {
+		t.Fatal(err)
+	}
+	if fabricConfig.GetName() != "Org1MSP" {
+		t.Errorf("written MSP %s, want Org1MSP", fabricConfig.GetName())
+	}
+	return fabricConfig.GetRevocationList()
+}
+
+func TestUpdateCRLReadWriteSets(t *testing.T) {
+	ca := newTestCA(t, "org1-ca")
+	crl := ca.crl(t, 1, 0x5c)
+
+	update, err := testConfig(t).UpdateCRL("Org1MSP", crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The groups on the path are read and written at their versions, with the org
+	// as the only group, and the MSP value is written at the next version
+	for name, set := range map[string]*cb.ConfigGroup{"read set": update.Update.GetReadSet(), "write set": update.Update.GetWriteSet()} {
+		if set.GetVersion() != 7 || len(set.GetGroups()) != 1 || len(set.GetValues()) != 0 {
+			t.Errorf("%s channel group: version %d, groups %v, values %v", name, set.GetVersion(), set.GetGroups(), set.GetValues())
+		}
+		application := set.GetGroups()[applicationGroup]
+		if application.GetVersion() != 2 || len(application.GetGroups()) != 1 {
+			t.Errorf("%s application group: version %d, groups %v", name, application.GetVersion(), application.GetGroups())
+		}
+		if org := application.GetGroups()["Org1"]; org == nil || org.GetVersion() != 1 {
+			t.Errorf("%s org group: %v", name, org)
+		}
+	}
+	if values := update.Update.GetReadSet().GetGroups()[applicationGroup].GetGroups()["Org1"].GetValues(); len(values) != 0 {
+		t.Errorf("read set org values %v, want none", values)
+	}
+	value := update.Update.GetWriteSet().GetGroups()[applicationGroup].GetGroups()["Org1"].GetValues()[mspValue]
+	if value.GetVersion() != 4 || value.GetModPolicy() != "Admins" {
+		t.Errorf("written MSP value version %d, mod policy %q, want 4 and Admins", value.GetVersion(), value.GetModPolicy())
+	}
+	if update.Update.GetChannelId() != "mychannel" {
+		t.Errorf("update of channel %q, want mychannel", update.Update.GetChannelId())
+	}
+
+	if list := writtenRevocationList(t, update.Update); len(list) != 1 || string(list[0]) != string(crl) {
+		t.Errorf("written revocation list %q, want the CRL", list)
+	}
+	if update.Diff.MSPVersion != [2]uint64{3, 4} || update.Diff.Org != "Org1" {
+		t.Errorf("diff MSP version %v of org %s, want [3 4] of Org1", update.Diff.MSPVersion, update.Diff.Org)
+	}
+}
+
+func TestUpdateCRLRevocationList(t *testing.T) {
+	ca := newTestCA(t, "org1-ca")
+	otherCA := newTestCA(t, "other-ca")
+	previous := ca.crl(t, 1, 0x5c, 0x7a)
+	other := otherCA.crl(t, 1, 0x11)
+	crl := ca.crl(t, 2, 0x5c, 0x9f)
+
+	tests := []struct {
+		name     string
+		existing [][]byte
+		written  [][]byte
+		removed  int
+		kept     int
+		serials  SerialDiff
+	}{
+		{
+			name:    "empty list",
+			written: [][]byte{crl},
+			serials: SerialDiff{Added: []string{"5c", "9f"}, Removed: []string{}},
+		},
+		{
+			name:     "CRL of the same CA replaced",
+			existing: [][]byte{previous},
+			written:  [][]byte{crl},
+			removed:  1,
+			serials:  SerialDiff{Added: []string{"9f"}, Removed: []string{"7a"}},
+		},
+		{
+			name:     "CRLs of other CAs kept",
+			existing: [][]byte{other, previous},
+			written:  [][]byte{other, crl},
+			removed:  1,
+			kept:     1,
+			serials:  SerialDiff{Added: []string{"9f"}, Removed: []string{"7a"}},
+		},
+		{
+			name:     "unparsable CRL kept",
+			existing: [][]byte{[]byte("not a CRL")},
+			written:  [][]byte{[]byte("not a CRL"), crl},
+			kept:     1,
+			serials:  SerialDiff{Added: []string{"5c", "9f"}, Removed: []string{}},
+		},
+	}
+	for _, test := range tests {
+		update, err := testConfig(t, test.existing...).UpdateCRL("Org1MSP", crl)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if written := writtenRevocationList(t, update.Update); !reflect.DeepEqual(written, test.written) {
+			t.Errorf("%s: written revocation list %q, want %q", test.name, written, test.written)
+		}
+		if len(update.Diff.RemovedCRLs) != test.removed || update.Diff.KeptCRLs != test.kept {
+			t.Errorf("%s: removed %d and kept %d CRLs, want %d and %d", test.name, len(update.Diff.RemovedCRLs), update.Diff.KeptCRLs, test.removed, test.kept)
+		}
+		if !reflect.DeepEqual(update.Diff.RevokedSerials, test.serials) {
+			t.Errorf("%s: revoked serials %+v, want %+v", test.name, update.Diff.RevokedSerials, test.serials)
+		}
+	}
+}
+
+func TestUpdateCRLErrors(t *testing.T) {
+	ca := newTestCA(t, "org1-ca")
+	crl := ca.crl(t, 1, 0x5c)
+	noApplication := testConfig(t)
+	delete(noApplication.Config.ChannelGroup.Groups, applicationGroup)
+
+	tests := []struct {
+		name   string
+		config *ChannelConfig
+		mspID  string
+		crl    []byte
+	}{
+		{"CRL already held", testConfig(t, crl), "Org1MSP", crl},
+		{"unknown MSP", testConfig(t), "Org3MSP", crl},
+		{"no application group", noApplication, "Org1MSP", crl},
+		{"not a PEM CRL", testConfig(t), "Org1MSP", []byte("-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----\n")},
+	}
+	for _, test := range tests {
+		if _, err := test.config.UpdateCRL(test.mspID, test.crl); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+	if _, err := testConfig(t, crl).UpdateCRL("Org1MSP", crl); !errors.Is(err, ErrUnchanged) {
+		t.Errorf("CRL already held: error %v, want %v", err, ErrUnchanged)
+	}
+}
+
+func TestFromBlock(t *testing.T) {
+	config := testConfig(t)
+	configEnvelope, err := proto.Marshal(&cb.ConfigEnvelope{Config: config.Config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := func(headerType cb.HeaderType) []byte {
+		channelHeader, err := proto.Marshal(&cb.ChannelHeader{Type: int32(headerType), ChannelId: "mychannel"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := proto.Marshal(&cb.Payload{Header: &cb.Header{ChannelHeader: channelHeader}, Data: configEnvelope})
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope, err := proto.Marshal(&cb.Envelope{Payload: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		blockBytes, err := proto.Marshal(&cb.Block{Header: &cb.BlockHeader{Number: 3}, Data: &cb.BlockData{Data: [][]byte{envelope}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return blockBytes
+	}
+
+	read, err := FromBlock(block(cb.HeaderType_CONFIG))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.ChannelID != "mychannel" || !proto.Equal(read.Config, config.Config) {
+		t.Errorf("read config of channel %s, want the config of mychannel", read.ChannelID)
+	}
+	if _, err = FromBlock(block(cb.HeaderType_ENDORSER_TRANSACTION)); err == nil {
+		t.Error("block of a transaction: no error")
+	}
+	if _, err = FromBlock([]byte("not a block")); err == nil {
+		t.Error("invalid block: no error")
+	}
+}
@@ -0,0 +1,93 @@
+package channelconfig
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	cb "github.com/hyperledger/fabric-protos-go-apiv2/common"
+	mb "github.com/hyperledger/fabric-protos-go-apiv2/msp"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Signer signs the SHA-256 digest of a message with a low S value, as Fabric verifies
+// the signatures of config updates.
+type Signer interface {
+	Sign(message []byte) ([]byte, error)
+}
+
+// SigningIdentity is an admin identity of an organization that signs config updates.
+type SigningIdentity struct {
+	MSPID string
+	// Cert is the PEM certificate of the identity.
+	Cert   []byte
+	Signer Signer
+}
+
+func (id *SigningIdentity) signatureHeader() (*cb.SignatureHeader, error) {
+	creator, err := proto.Marshal(&mb.SerializedIdentity{Mspid: id.MSPID, IdBytes: id.Cert})
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 24)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return &cb.SignatureHeader{Creator: creator, Nonce: nonce}, nil
+}
+
+// NewSignedEnvelope returns the CONFIG_UPDATE envelope of update, with the config
+// signature of id and signed by id. Other organization admins add their signature with
+// peer channel signconfigtx, and one of them submits it with peer channel update.
+func NewSignedEnvelope(update *cb.ConfigUpdate, id *SigningIdentity) ([]byte, error) {
+	configUpdate, err := proto.Marshal(update)
+	if err != nil {
+		return nil, err
+	}
+	signatureHeader, err := id.signatureHeader()
+	if err != nil {
+		return nil, err
+	}
+	header, err := proto.Marshal(signatureHeader)
+	if err != nil {
+		return nil, err
+	}
+	// Config signatures sign the signature header followed by the config update
+	signature, err := id.Signer.Sign(append(append([]byte{}, header...), configUpdate...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign config update: %w", err)
+	}
+	configUpdateEnvelope, err := proto.Marshal(&cb.ConfigUpdateEnvelope{
+		ConfigUpdate: configUpdate,
+		Signatures:   []*cb.ConfigSignature{{SignatureHeader: header, Signature: signature}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if signatureHeader, err = id.signatureHeader(); err != nil {
+		return nil, err
+	}
+	if header, err = proto.Marshal(signatureHeader); err != nil {
+		return nil, err
+	}
+	channelHeader, err := proto.Marshal(&cb.ChannelHeader{
+		Type:      int32(cb.HeaderType_CONFIG_UPDATE),
+		ChannelId: update.GetChannelId(),
+		Timestamp: timestamppb.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := proto.Marshal(&cb.Payload{
+		Header: &cb.Header{ChannelHeader: channelHeader, SignatureHeader: header},
+		Data:   configUpdateEnvelope,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if signature, err = id.Signer.Sign(payload); err != nil {
+		return nil, fmt.Errorf("failed to sign envelope: %w", err)
+	}
+	return proto.Marshal(&cb.Envelope{Payload: payload, Signature: signature})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/hyperledger/digital-identity/enroller/channelconfig"
+	"github.com/hyperledger/digital-identity/enroller/fabricca"
+)
+
+// maxConfigBlockSize bounds the config blocks posted to /channels/{channel}/crl.
+const maxConfigBlockSize = 16 << 20
+
+// newConfigSigner loads the org admin MSP at ORG_ADMIN_MSP_PATH that signs the channel
+// config updates, nil when it is not set.
+func newConfigSigner(cfg *Config) (*channelconfig.SigningIdentity, error) {
+	if cfg.OrgAdminMSPPath == "" {
+		return nil, nil
+	}
+	admin, err := fabricca.LoadIdentity(cfg.OrgAdminMSPPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load org admin MSP: %w", err)
+	}
+	return &channelconfig.SigningIdentity{MSPID: cfg.MSPID, Cert: admin.Cert, Signer: admin}, nil
+}
+
+// handleCRLUpdate generates the CRL of the CA and returns the config update of the channel
+// that puts it in the revocation list of the org MSP, from the last config block of the
+// channel in the request body. The update is returned as an envelope signed by the org
+// admin, or as a diff with dry_run=true.
+func handleCRLUpdate(w http.ResponseWriter, r *http.Request, cfg *Config, ca *fabricca.Client, admin *channelconfig.SigningIdentity) {
+	channel := chi.URLParam(r, "channel")
+	dryRun := false
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			renderError(w, r, "Invalid dry_run parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if !dryRun && admin == nil {
+		renderError(w, r, "ORG_ADMIN_MSP_PATH is not set, only dry runs are available", http.StatusServiceUnavailable)
+		return
+	}
+
+	block, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigBlockSize))
+	if err != nil {
+		renderError(w, r, fmt.Sprintf("Failed to read config block: %v", err), http.StatusBadRequest)
+		return
+	}
+	config, err := channelconfig.FromBlock(block)
+	if err != nil {
+		renderError(w, r, fmt.Sprintf("Invalid config block: %v", err), http.StatusBadRequest)
+		return
+	}
+	if config.ChannelID != channel {
+		renderError(w, r, fmt.Sprintf("Config block is of channel %s", config.ChannelID), http.StatusBadRequest)
+		return
+	}
+
+	var crl []byte
+	err = caCall(r.Context(), "gencrl", func(ctx context.Context) (err error) {
+		crl, err = ca.GenCRL(ctx, fabricca.CRLRequest{})
+		return err
+	})
+	if err != nil {
+		renderError(w, r, fmt.Sprintf("CRL generation failed: %v", err), caErrorStatus(err))
+		return
+	}
+
+	update, err := config.UpdateCRL(cfg.MSPID, crl)
+	if errors.Is(err, channelconfig.ErrUnchanged) {
+		renderError(w, r, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		renderError(w, r, fmt.Sprintf("Failed to update channel config: %v", err), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		render.JSON(w, r, update.Diff)
+		return
+	}
+
+	envelope, err := channelconfig.NewSignedEnvelope(update.Update, admin)
+	if err != nil {
+		renderError(w, r, fmt.Sprintf("Failed to sign config update: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Signed CRL update of %s in channel %s, revoking %d new certificates",
+		cfg.MSPID, channel, len(update.Diff.RevokedSerials.Added))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", channel+"_crl_update.pb"))
+	w.Write(envelope)
+}
+
+// ChannelCRLUpdate is the CRL update of a channel built on revocation. Envelope is the
+// update signed by the org admin, missing when ORG_ADMIN_MSP_PATH is not set.
+type ChannelCRLUpdate struct {
+	Channel        string   `json:"channel"`
+	Envelope       []byte   `json:"envelope,omitempty"`
+	RevokedSerials []string `json:"revoked_serials,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// channelCRLUpdates builds the update that puts crl in the org MSP of every channel whose
+// last config block is in CHANNEL_CONFIG_DIR, as <channel>.block. The blocks must be kept
+// current, as the orderer rejects an update of an older config.
+func channelCRLUpdates(cfg *Config, admin *channelconfig.SigningIdentity, crl []byte) []ChannelCRLUpdate {
+	if cfg.ChannelConfigDir == "" || len(crl) == 0 {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(cfg.ChannelConfigDir, "*.block"))
+	if err != nil {
+		log.Printf("Failed to list channel config blocks: %v", err)
+		return nil
+	}
+
+	updates := make([]ChannelCRLUpdate, 0, len(paths))
+	for _, path := range paths {
+		update := ChannelCRLUpdate{Channel: strings.TrimSuffix(filepath.Base(path), ".block")}
+		if err := buildChannelCRLUpdate(cfg, admin, path, crl, &update); err != nil {
+			log.Printf("Failed to build CRL update of channel %s: %v", update.Channel, err)
+			update.Error = err.Error()
+		}
+		updates = append(updates, update)
+	}
+	return updates
+}
+
+func buildChannelCRLUpdate(cfg *Config, admin *channelconfig.SigningIdentity, path string, crl []byte, update *ChannelCRLUpdate) error {
+	block, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	config, err := channelconfig.FromBlock(block)
+	if err != nil {
+		return fmt.Errorf("invalid config block: %w", err)
+	}
+	if config.ChannelID != update.Channel {
+		return fmt.Errorf("config block is of channel %s", config.ChannelID)
+	}
+
+	crlUpdate, err := config.UpdateCRL(cfg.MSPID, crl)
+	if err != nil {
+		return err
+	}
+	update.RevokedSerials = crlUpdate.Diff.RevokedSerials.Added
+	if admin == nil {
+		return nil
+	}
+	if update.Envelope, err = channelconfig.NewSignedEnvelope(crlUpdate.Update, admin); err != nil {
+		return fmt.Errorf("failed to sign config update: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,521 @@
+// Package catest runs a stand-in Fabric CA server for tests. It registers, enrolls,
+// reenrolls and revokes identities and generates CRLs over the Fabric CA REST API, and
+// verifies the basic and token authentication of the requests as the CA does.
+package catest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin is the name and secret of the bootstrap registrar of the server.
+const (
+	AdminName   = "admin"
+	AdminSecret = "adminpw"
+)
+
+// Request is a request received by the server.
+type Request struct {
+	Method   string
+	Endpoint string
+	// Header is the header of the request, with its Authorization.
+	Header http.Header
+	Body   []byte
+	// Identity is the name of the authenticated identity, empty when the request is
+	// unauthenticated.
+	Identity string
+}
+
+// Failure is an error response of an endpoint, set with Fail.
+type Failure struct {
+	StatusCode int
+	Code       int
+	Message    string
+}
+
+type identity struct {
+	secret      string
+	typ         string
+	affiliation string
+	attrs       []attribute
+	serials     []*big.Int
+}
+
+type attribute struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	ECert bool   `json:"ecert,omitempty"`
+}
+
+type revocation struct {
+	serial *big.Int
+	time   time.Time
+	reason string
+}
+
+// Server is a stand-in Fabric CA server.
+type Server struct {
+	*httptest.Server
+	// CAName is the name of the CA, which requests with a caname must carry.
+	CAName string
+	// CACert is the PEM certificate of the self-signed root CA.
+	CACert []byte
+	// AdminCert and AdminKey are the PEM certificate and PKCS#8 key of the enrolled
+	// bootstrap admin, the registrar of the server.
+	AdminCert []byte
+	AdminKey  []byte
+	// Validity is the validity of the issued certificates, a day by default.
+	Validity time.Duration
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu         sync.Mutex
+	identities map[string]*identity
+	revoked    []revocation
+	failures   map[string]Failure
+	requests   []Request
+}
+
+// NewServer starts a CA named caName with an enrolled bootstrap admin. Close stops it.
+func NewServer(caName string) *Server {
+	s := &Server{
+		CAName:   caName,
+		Validity: 24 * time.Hour,
+		identities: map[string]*identity{
+			AdminName: {secret: AdminSecret, typ: "admin", attrs: []attribute{{Name: "hf.Registrar.Roles", Value: "*"}, {Name: "hf.Revoker", Value: "true"}, {Name: "hf.GenCRL", Value: "true"}}},
+		},
+		failures: map[string]Failure{},
+	}
+
+	var err error
+	if s.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: caName, Organization: []string{"Hyperledger"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		SubjectKeyId:          ski(&s.caKey.PublicKey),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &s.caKey.PublicKey, s.caKey)
+	if err != nil {
+		panic(err)
+	}
+	if s.caCert, err = x509.ParseCertificate(der); err != nil {
+		panic(err)
+	}
+	s.CACert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	adminKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(adminKey)
+	if err != nil {
+		panic(err)
+	}
+	s.AdminKey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if s.AdminCert, err = s.issue(AdminName, &adminKey.PublicKey); err != nil {
+		panic(err)
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Fail makes the endpoint, such as register, answer with the error of failure until
+// Fail is called again with a zero Failure.
+func (s *Server) Fail(endpoint string, failure Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if failure.StatusCode == 0 {
+		delete(s.failures, endpoint)
+		return
+	}
+	s.failures[endpoint] = failure
+}
+
+// Requests returns the requests received by the server.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Registered reports whether name is registered.
+func (s *Server) Registered(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.identities[name]
+	return ok
+}
+
+// Revoked reports whether the certificate with the hex serial number is revoked.
+func (s *Server) Revoked(serial string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.revoked {
+		if r.serial.Text(16) == serial {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	endpoint, _ := strings.CutPrefix(r.URL.Path, "/api/v1/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	request := Request{Method: r.Method, Endpoint: endpoint, Header: r.Header.Clone(), Body: body}
+	defer func() { s.requests = append(s.requests, request) }()
+
+	if failure, ok := s.failures[endpoint]; ok {
+		writeError(w, failure.StatusCode, failure.Code, failure.Message)
+		return
+	}
+
+	var caName struct {
+		CAName string `json:"caname"`
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &caName); err != nil {
+			writeError(w, http.StatusBadRequest, 0, "invalid request body: "+err.Error())
+			return
+		}
+	}
+	if caName.CAName == "" {
+		caName.CAName = r.URL.Query().Get("ca")
+	}
+	if caName.CAName != "" && caName.CAName != s.CAName {
+		writeError(w, http.StatusNotFound, 19, fmt.Sprintf("CA '%s' does not exist", caName.CAName))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && endpoint == "cainfo":
+		writeResult(w, s.serverInfo())
+	case r.Method == http.MethodPost && endpoint == "enroll":
+		name, secret, ok := r.BasicAuth()
+		id := s.identities[name]
+		if !ok || id == nil || id.secret != secret {
+			writeError(w, http.StatusUnauthorized, 20, "Authentication failure")
+			return
+		}
+		request.Identity = name
+		s.enroll(w, name, body)
+	case r.Method == http.MethodPost && endpoint == "reenroll":
+		if request.Identity = s.authenticate(w, r, body); request.Identity == "" {
+			return
+		}
+		s.enroll(w, request.Identity, body)
+	case r.Method == http.MethodPost && endpoint == "register":
+		if request.Identity = s.authenticateRegistrar(w, r, body); request.Identity == "" {
+			return
+		}
+		s.register(w, body)
+	case r.Method == http.MethodPost && endpoint == "revoke":
+		if request.Identity = s.authenticateRegistrar(w, r, body); request.Identity == "" {
+			return
+		}
+		s.revoke(w, body)
+	case r.Method == http.MethodPost && endpoint == "gencrl":
+		if request.Identity = s.authenticateRegistrar(w, r, body); request.Identity == "" {
+			return
+		}
+		crl, err := s.crl()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, 0, err.Error())
+			return
+		}
+		writeResult(w, map[string]string{"CRL": base64.StdEncoding.EncodeToString(crl)})
+	case r.Method == http.MethodGet && strings.HasPrefix(endpoint, "identities/"):
+		if request.Identity = s.authenticateRegistrar(w, r, body); request.Identity == "" {
+			return
+		}
+		name := strings.TrimPrefix(endpoint, "identities/")
+		id := s.identities[name]
+		if id == nil {
+			writeError(w, http.StatusNotFound, 63, fmt.Sprintf("Failed to get User: %s", name))
+			return
+		}
+		writeResult(w, map[string]interface{}{
+			"id": name, "type": id.typ, "affiliation": id.affiliation, "attrs": id.attrs, "caname": s.CAName,
+		})
+	default:
+		writeError(w, http.StatusNotFound, 0, "unknown endpoint "+endpoint)
+	}
+}
+
+// authenticate verifies the token of a request, the base64 certificate and the base64
+// low-S signature of method.b64(uri).b64(body).b64(cert), and returns the identity of
+// the certificate. It answers 401 and returns an empty name when the token is invalid.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request, body []byte) string {
+	b64Cert, b64Signature, ok := strings.Cut(r.Header.Get("Authorization"), ".")
+	if !ok {
+		writeError(w, http.StatusUnauthorized, 20, "Authorization header is not a token")
+		return ""
+	}
+	certPEM, err := base64.StdEncoding.DecodeString(b64Cert)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, 20, "invalid token certificate")
+		return ""
+	}
+	signature, err := base64.StdEncoding.DecodeString(b64Signature)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, 20, "invalid token signature")
+		return ""
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		writeError(w, http.StatusUnauthorized, 20, "invalid token certificate")
+		return ""
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || cert.CheckSignatureFrom(s.caCert) != nil {
+		writeError(w, http.StatusUnauthorized, 20, "token certificate is not issued by the CA")
+		return ""
+	}
+	for _, r := range s.revoked {
+		if r.serial.Cmp(cert.SerialNumber) == 0 {
+			writeError(w, http.StatusUnauthorized, 71, "The certificate in the authorization header is a revoked certificate")
+			return ""
+		}
+	}
+
+	payload := r.Method + "." +
+		base64.StdEncoding.EncodeToString([]byte(r.URL.RequestURI())) + "." +
+		base64.StdEncoding.EncodeToString(body) + "." + b64Cert
+	publicKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || !VerifyLowS(publicKey, []byte(payload), signature) {
+		writeError(w, http.StatusUnauthorized, 20, "Invalid token in authorization header")
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// authenticateRegistrar authenticates a request that the bootstrap admin only may send.
+func (s *Server) authenticateRegistrar(w http.ResponseWriter, r *http.Request, body []byte) string {
+	name := s.authenticate(w, r, body)
+	if name != "" && name != AdminName {
+		writeError(w, http.StatusForbidden, 42, fmt.Sprintf("'%s' is not a registrar", name))
+		return ""
+	}
+	return name
+}
+
+// VerifyLowS verifies an ECDSA signature of the SHA-256 digest of message and that its S
+// value is in the lower half of the curve order, as Fabric requires.
+func VerifyLowS(publicKey *ecdsa.PublicKey, message, signature []byte) bool {
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+		return false
+	}
+	if sig.S.Cmp(new(big.Int).Rsh(publicKey.Curve.Params().N, 1)) > 0 {
+		return false
+	}
+	digest := sha256.Sum256(message)
+	return ecdsa.VerifyASN1(publicKey, digest[:], signature)
+}
+
+func (s *Server) enroll(w http.ResponseWriter, name string, body []byte) {
+	var req struct {
+		CSR string `json:"certificate_request"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil {
+		writeError(w, http.StatusBadRequest, 0, "no certificate request")
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil || csr.CheckSignature() != nil {
+		writeError(w, http.StatusBadRequest, 0, "invalid certificate request")
+		return
+	}
+	if csr.Subject.CommonName != name {
+		writeError(w, http.StatusBadRequest, 0, "The CSR subject common name must equal the enrollment ID")
+		return
+	}
+	certPEM, err := s.issue(name, csr.PublicKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, 0, err.Error())
+		return
+	}
+	writeResult(w, map[string]interface{}{
+		"Cert":       base64.StdEncoding.EncodeToString(certPEM),
+		"ServerInfo": s.serverInfo(),
+	})
+}
+
+func (s *Server) register(w http.ResponseWriter, body []byte) {
+	var req struct {
+		Name        string      `json:"id"`
+		Type        string      `json:"type"`
+		Secret      string      `json:"secret"`
+		Affiliation string      `json:"affiliation"`
+		Attributes  []attribute `json:"attrs"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Name == "" {
+		writeError(w, http.StatusBadRequest, 0, "invalid registration request")
+		return
+	}
+	if _, ok := s.identities[req.Name]; ok {
+		writeError(w, http.StatusBadRequest, 74, fmt.Sprintf("Registration of '%s' failed: Identity '%s' is already registered", req.Name, req.Name))
+		return
+	}
+	if req.Secret == "" {
+		secret := make([]byte, 8)
+		rand.Read(secret)
+		req.Secret = hex.EncodeToString(secret)
+	}
+	s.identities[req.Name] = &identity{secret: req.Secret, typ: req.Type, affiliation: req.Affiliation, attrs: req.Attributes}
+	writeResult(w, map[string]string{"secret": req.Secret})
+}
+
+func (s *Server) revoke(w http.ResponseWriter, body []byte) {
+	var req struct {
+		Name   string `json:"id"`
+		Serial string `json:"serial"`
+		Reason string `json:"reason"`
+		GenCRL bool   `json:"gencrl"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+
+	var serials []*big.Int
+	if req.Name != "" {
+		id := s.identities[req.Name]
+		if id == nil {
+			writeError(w, http.StatusNotFound, 63, fmt.Sprintf("Identity %s was not found", req.Name))
+			return
+		}
+		serials = id.serials
+		id.serials = nil
+	} else {
+		serial, ok := new(big.Int).SetString(req.Serial, 16)
+		if !ok {
+			writeError(w, http.StatusBadRequest, 0, "invalid serial")
+			return
+		}
+		serials = []*big.Int{serial}
+	}
+
+	revokedCerts := []map[string]string{}
+	aki := hex.EncodeToString(s.caCert.SubjectKeyId)
+	for _, serial := range serials {
+		s.revoked = append(s.revoked, revocation{serial: serial, time: time.Now(), reason: req.Reason})
+		revokedCerts = append(revokedCerts, map[string]string{"Serial": serial.Text(16), "AKI": aki})
+	}
+	result := map[string]interface{}{"RevokedCerts": revokedCerts}
+	if req.GenCRL {
+		crl, err := s.crl()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, 0, err.Error())
+			return
+		}
+		result["CRL"] = base64.StdEncoding.EncodeToString(crl)
+	}
+	writeResult(w, result)
+}
+
+// issue returns a PEM certificate of name for publicKey, with the OU of the identity type
+// as the CA gives it.
+func (s *Server) issue(name string, publicKey interface{}) ([]byte, error) {
+	id := s.identities[name]
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        pkix.Name{CommonName: name, OrganizationalUnit: []string{id.typ}},
+		NotBefore:      time.Now().Add(-time.Minute),
+		NotAfter:       time.Now().Add(s.Validity),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		AuthorityKeyId: s.caCert.SubjectKeyId,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.caCert, publicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	id.serials = append(id.serials, serial)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// crl returns the PEM CRL of the revoked certificates.
+func (s *Server) crl() ([]byte, error) {
+	entries := make([]x509.RevocationListEntry, 0, len(s.revoked))
+	for _, r := range s.revoked {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: r.serial, RevocationTime: r.time})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(int64(len(s.requests) + 1)),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(24 * time.Hour),
+		RevokedCertificateEntries: entries,
+	}, s.caCert, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), nil
+}
+
+func (s *Server) serverInfo() map[string]string {
+	return map[string]string{
+		"CAName":  s.CAName,
+		"CAChain": base64.StdEncoding.EncodeToString(s.CACert),
+		"Version": "1.5.13",
+	}
+}
+
+func ski(publicKey *ecdsa.PublicKey) []byte {
+	point, _ := publicKey.ECDH()
+	digest := sha256.Sum256(point.Bytes())
+	return digest[:]
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true, "result": result, "errors": []interface{}{}, "messages": []interface{}{},
+	})
+}
+
+func writeError(w http.ResponseWriter, status, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false, "result": nil,
+		"errors":   []map[string]interface{}{{"code": code, "message": message}},
+		"messages": []interface{}{},
+	})
+}
@@ -0,0 +1,202 @@
+// Package fabricca is a client of the Hyperledger Fabric CA REST API. Identities are
+// registered, enrolled and revoked over HTTP and the enrolled MSP material is returned in
+// memory, without the fabric-ca-client binary or an MSP directory.
+package fabricca
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const maxResponseSize = 16 << 20
+
+// Client sends requests to a Fabric CA server. Requests that need a registrar, such as
+// register and revoke, are authenticated with a token signed by the registrar identity.
+type Client struct {
+	baseURL    *url.URL
+	caName     string
+	httpClient *http.Client
+	registrar  *Identity
+	tlsCACerts []byte
+}
+
+// Option configures a Client.
+type Option func(*Client) error
+
+// WithCAName selects a CA of a server that hosts several CAs.
+func WithCAName(name string) Option {
+	return func(c *Client) error {
+		c.caName = name
+		return nil
+	}
+}
+
+// WithHTTPClient sets the HTTP client, for instance with the TLS root certificates of the
+// CA.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) error {
+		if httpClient == nil {
+			return errors.New("HTTP client is nil")
+		}
+		c.httpClient = httpClient
+		return nil
+	}
+}
+
+// WithRegistrar sets the identity that authenticates the register, revoke, identity,
+// certificate and CRL requests, usually the CA admin.
+func WithRegistrar(registrar *Identity) Option {
+	return func(c *Client) error {
+		c.registrar = registrar
+		return nil
+	}
+}
+
+// WithTLSCACerts sets the PEM TLS root certificate that the MSPs of the enrolled
+// identities carry in tlscacerts. It does not configure the HTTP client.
+func WithTLSCACerts(certPEM []byte) Option {
+	return func(c *Client) error {
+		c.tlsCACerts = certPEM
+		return nil
+	}
+}
+
+// NewClient returns a client of the CA server at serverURL, such as
+// https://ca.example.com:7054.
+func NewClient(serverURL string, options ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(serverURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA URL: %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid CA URL %q, expected http(s)://host[:port]", serverURL)
+	}
+	if u.User != nil {
+		return nil, errors.New("invalid CA URL, credentials are passed to Enroll")
+	}
+
+	c := &Client{
+		baseURL:    u,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, option := range options {
+		if err := option(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// response is the envelope of every CA response.
+type response struct {
+	Success  bool            `json:"success"`
+	Result   json.RawMessage `json:"result"`
+	Errors   []Message       `json:"errors"`
+	Messages []Message       `json:"messages"`
+}
+
+// authenticator sets the authorization header of a request with the given body.
+type authenticator func(request *http.Request, body []byte) error
+
+func basicAuth(name, secret string) authenticator {
+	return func(request *http.Request, _ []byte) error {
+		request.SetBasicAuth(name, secret)
+		return nil
+	}
+}
+
+func tokenAuth(id *Identity) authenticator {
+	return func(request *http.Request, body []byte) error {
+		if id == nil {
+			return ErrNoRegistrar
+		}
+		token, err := id.token(request.Method, request.URL.RequestURI(), body)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", token)
+		return nil
+	}
+}
+
+// do sends a request to the endpoint of the CA API and decodes the result of the response
+// into result. A CA error response is returned as an *Error.
+func (c *Client) do(ctx context.Context, method string, endpoint string, query url.Values, body interface{}, auth authenticator, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("failed to marshal %s request: %w", endpoint, err)
+		}
+	}
+
+	u := c.baseURL.JoinPath("api", "v1", endpoint)
+	if c.caName != "" && body == nil {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("ca", c.caName)
+	}
+	u.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if auth != nil {
+		if err = auth(request, payload); err != nil {
+			return err
+		}
+	}
+
+	resp, err := c.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("fabric CA %s request failed: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("failed to read fabric CA %s response: %w", endpoint, err)
+	}
+
+	var envelope response
+	if err = json.Unmarshal(data, &envelope); err != nil {
+		if resp.StatusCode >= http.StatusBadRequest {
+			return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+		}
+		return fmt.Errorf("invalid fabric CA %s response: %w", endpoint, err)
+	}
+	if !envelope.Success || resp.StatusCode >= http.StatusBadRequest {
+		return newError(resp.StatusCode, envelope.Errors)
+	}
+
+	if result != nil {
+		if err = json.Unmarshal(envelope.Result, result); err != nil {
+			return fmt.Errorf("invalid fabric CA %s result: %w", endpoint, err)
+		}
+	}
+	return nil
+}
+
+// decodeBase64 decodes a base64 field of a CA response.
+func decodeBase64(field string, value string) ([]byte, error) {
+	if value == "" {
+		return nil, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s in fabric CA response: %w", field, err)
+	}
+	return decoded, nil
+}
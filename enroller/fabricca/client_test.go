@@ -0,0 +1,409 @@
+package fabricca_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/digital-identity/enroller/fabricca"
+	"github.com/hyperledger/digital-identity/enroller/fabricca/catest"
+)
+
+func newTestClient(t *testing.T, options ...fabricca.Option) (*catest.Server, *fabricca.Client) {
+	t.Helper()
+	ca := catest.NewServer("ca-org1")
+	t.Cleanup(ca.Close)
+
+	admin, err := fabricca.NewIdentity(ca.AdminCert, ca.AdminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := fabricca.NewClient(ca.URL, append([]fabricca.Option{fabricca.WithRegistrar(admin)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, client
+}
+
+// lastRequest returns the last request of the server to endpoint.
+func lastRequest(t *testing.T, ca *catest.Server, endpoint string) catest.Request {
+	t.Helper()
+	requests := ca.Requests()
+	for i := len(requests) - 1; i >= 0; i-- {
+		if requests[i].Endpoint == endpoint {
+			return requests[i]
+		}
+	}
+	t.Fatalf("no %s request", endpoint)
+	return catest.Request{}
+}
+
+// highSSigner signs with the high S value of every signature, which Fabric rejects.
+type highSSigner struct {
+	*ecdsa.PrivateKey
+}
+
+func (s highSSigner) Sign(random io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	signature, err := s.PrivateKey.Sign(random, digest, opts)
+	if err != nil {
+		return nil, err
+	}
+	var sig struct{ R, S *big.Int }
+	if _, err = asn1.Unmarshal(signature, &sig); err != nil {
+		return nil, err
+	}
+	if halfOrder := new(big.Int).Rsh(s.Curve.Params().N, 1); sig.S.Cmp(halfOrder) <= 0 {
+		sig.S.Sub(s.Curve.Params().N, sig.S)
+	}
+	return asn1.Marshal(sig)
+}
+
+func TestTokenAuth(t *testing.T) {
+	ca := catest.NewServer("ca-org1")
+	defer ca.Close()
+	admin, err := fabricca.NewIdentity(ca.AdminCert, ca.AdminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.Key = highSSigner{admin.Key.(*ecdsa.PrivateKey)}
+	client, err := fabricca.NewClient(ca.URL, fabricca.WithRegistrar(admin))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = client.Register(context.Background(), fabricca.RegistrationRequest{Name: "alice", Secret: "alicepw", Type: "client"}); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	request := lastRequest(t, ca, "register")
+	b64Cert, b64Signature, ok := strings.Cut(request.Header.Get("Authorization"), ".")
+	if !ok {
+		t.Fatalf("Authorization = %q, want b64cert.b64sig", request.Header.Get("Authorization"))
+	}
+	if b64Cert != base64.StdEncoding.EncodeToString(ca.AdminCert) {
+		t.Errorf("token certificate is not the registrar certificate")
+	}
+	signature, err := base64.StdEncoding.DecodeString(b64Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := "POST." +
+		base64.StdEncoding.EncodeToString([]byte("/api/v1/register")) + "." +
+		base64.StdEncoding.EncodeToString(request.Body) + "." + b64Cert
+	publicKey := admin.Key.Public().(*ecdsa.PublicKey)
+	if !catest.VerifyLowS(publicKey, []byte(payload), signature) {
+		t.Errorf("token signature is not a low-S signature of method.b64(uri).b64(body).b64cert")
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	ca, client := newTestClient(t)
+	ctx := context.Background()
+	if _, err := client.Register(ctx, fabricca.RegistrationRequest{Name: "alice", Secret: "alicepw", Type: "client"}); err != nil {
+		t.Fatal(err)
+	}
+
+	msp, err := client.Enroll(ctx, fabricca.EnrollmentRequest{Name: "alice", Secret: "alicepw"})
+	if err != nil {
+		t.Fatalf("Enroll() error = %v", err)
+	}
+	cert, err := fabricca.ParseCertificate(msp.SignCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "alice" {
+		t.Errorf("certificate common name = %q, want alice", cert.Subject.CommonName)
+	}
+	key, err := fabricca.ParsePrivateKey(msp.Key)
+	if err != nil {
+		t.Fatalf("MSP key: %v", err)
+	}
+	if !key.Public().(*ecdsa.PublicKey).Equal(cert.PublicKey) {
+		t.Errorf("MSP key is not the key of the certificate")
+	}
+	if string(msp.CACerts) != string(ca.CACert) {
+		t.Errorf("MSP cacerts is not the CA certificate")
+	}
+
+	files := msp.Files()
+	for _, path := range []string{"signcerts/cert.pem", "keystore/" + msp.KeyFile, "cacerts/" + msp.CAFile, "config.yaml"} {
+		if len(files[path]) == 0 {
+			t.Errorf("MSP has no %s", path)
+		}
+	}
+	if !strings.HasSuffix(msp.KeyFile, "_sk") {
+		t.Errorf("key file = %q, want <ski>_sk", msp.KeyFile)
+	}
+	if request := lastRequest(t, ca, "enroll"); request.Identity != "alice" {
+		t.Errorf("enroll authenticated as %q, want alice", request.Identity)
+	}
+}
+
+func TestEnrollWithCSR(t *testing.T) {
+	_, client := newTestClient(t)
+	ctx := context.Background()
+	if _, err := client.Register(ctx, fabricca.RegistrationRequest{Name: "bob", Secret: "bobpw", Type: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := fabricca.NewCSR("bob", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msp, err := client.Enroll(ctx, fabricca.EnrollmentRequest{Name: "bob", Secret: "bobpw", CSR: csr})
+	if err != nil {
+		t.Fatalf("Enroll() error = %v", err)
+	}
+	if len(msp.Key) != 0 || len(msp.Files()["keystore/"+msp.KeyFile]) != 0 {
+		t.Errorf("MSP of a CSR enrollment holds a key")
+	}
+	cert, err := fabricca.ParseCertificate(msp.SignCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		t.Errorf("certificate is not of the CSR key")
+	}
+
+	if _, err = client.Enroll(ctx, fabricca.EnrollmentRequest{Name: "alice", Secret: "bobpw", CSR: csr}); !errors.Is(err, fabricca.ErrBadRequest) {
+		t.Errorf("Enroll() with the CSR of another name error = %v, want ErrBadRequest", err)
+	}
+}
+
+func TestReenroll(t *testing.T) {
+	ca, client := newTestClient(t)
+	ctx := context.Background()
+	if _, err := client.Register(ctx, fabricca.RegistrationRequest{Name: "alice", Secret: "alicepw", Type: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	msp, err := client.Enroll(ctx, fabricca.EnrollmentRequest{Name: "alice", Secret: "alicepw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := msp.Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewed, err := client.Reenroll(ctx, id, fabricca.ReenrollmentRequest{})
+	if err != nil {
+		t.Fatalf("Reenroll() error = %v", err)
+	}
+	before, _ := fabricca.ParseCertificate(msp.SignCert)
+	after, err := fabricca.ParseCertificate(renewed.SignCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Subject.CommonName != "alice" || after.SerialNumber.Cmp(before.SerialNumber) == 0 {
+		t.Errorf("reenrolled certificate %s/%x, want a new certificate of alice", after.Subject.CommonName, after.SerialNumber)
+	}
+	if len(renewed.Key) == 0 || string(renewed.Key) == string(msp.Key) {
+		t.Errorf("reenrollment did not generate a new key")
+	}
+	if request := lastRequest(t, ca, "reenroll"); request.Identity != "alice" {
+		t.Errorf("reenroll authenticated as %q, want alice", request.Identity)
+	}
+}
+
+func TestCANameInBody(t *testing.T) {
+	ca, client := newTestClient(t, fabricca.WithCAName("ca-org1"))
+	ctx := context.Background()
+
+	if _, err := client.Register(ctx, fabricca.RegistrationRequest{Name: "alice", Secret: "alicepw", Type: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Enroll(ctx, fabricca.EnrollmentRequest{Name: "alice", Secret: "alicepw"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Revoke(ctx, fabricca.RevocationRequest{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, endpoint := range []string{"register", "enroll", "revoke"} {
+		var body struct {
+			CAName string `json:"caname"`
+		}
+		if err := json.Unmarshal(lastRequest(t, ca, endpoint).Body, &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.CAName != "ca-org1" {
+			t.Errorf("%s caname = %q, want ca-org1", endpoint, body.CAName)
+		}
+	}
+
+	other, err := fabricca.NewClient(ca.URL, fabricca.WithCAName("ca-org2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.Enroll(ctx, fabricca.EnrollmentRequest{Name: "alice", Secret: "alicepw"}); !errors.Is(err, fabricca.ErrNotFound) {
+		t.Errorf("Enroll() with an unknown CA error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRevokeAndGenCRL(t *testing.T) {
+	ca, client := newTestClient(t)
+	ctx := context.Background()
+	if _, err := client.Register(ctx, fabricca.RegistrationRequest{Name: "alice", Secret: "alicepw", Type: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	msp, err := client.Enroll(ctx, fabricca.EnrollmentRequest{Name: "alice", Secret: "alicepw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := fabricca.ParseCertificate(msp.SignCert)
+	serial := cert.SerialNumber.Text(16)
+
+	revoked, err := client.Revoke(ctx, fabricca.RevocationRequest{Name: "alice", Reason: fabricca.ReasonKeyCompromise, GenCRL: true})
+	if err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	if len(revoked.RevokedCerts) != 1 || revoked.RevokedCerts[0].Serial != serial {
+		t.Errorf("revoked certificates = %+v, want serial %s", revoked.RevokedCerts, serial)
+	}
+	if !ca.Revoked(serial) {
+		t.Errorf("the CA did not revoke %s", serial)
+	}
+	if serials := crlSerials(t, revoked.CRL); len(serials) != 1 || serials[0] != serial {
+		t.Errorf("revocation CRL serials = %v, want [%s]", serials, serial)
+	}
+
+	crl, err := client.GenCRL(ctx, fabricca.CRLRequest{})
+	if err != nil {
+		t.Fatalf("GenCRL() error = %v", err)
+	}
+	if serials := crlSerials(t, crl); len(serials) != 1 || serials[0] != serial {
+		t.Errorf("GenCRL serials = %v, want [%s]", serials, serial)
+	}
+
+	id, _ := msp.Identity()
+	if _, err = client.Reenroll(ctx, id, fabricca.ReenrollmentRequest{}); !errors.Is(err, fabricca.ErrUnauthorized) {
+		t.Errorf("Reenroll() with a revoked certificate error = %v, want ErrUnauthorized", err)
+	}
+}
+
+// crlSerials decodes a PEM CRL and returns its hex serial numbers.
+func crlSerials(t *testing.T, crlPEM []byte) []string {
+	t.Helper()
+	block, _ := pem.Decode(crlPEM)
+	if block == nil || block.Type != "X509 CRL" {
+		t.Fatalf("CRL %q is not a PEM CRL", crlPEM)
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serials []string
+	for _, entry := range crl.RevokedCertificateEntries {
+		serials = append(serials, entry.SerialNumber.Text(16))
+	}
+	return serials
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		failure catest.Failure
+		call    func(ctx context.Context, client *fabricca.Client) error
+		want    error
+	}{
+		{
+			name: "wrong secret",
+			call: func(ctx context.Context, client *fabricca.Client) error {
+				_, err := client.Enroll(ctx, fabricca.EnrollmentRequest{Name: catest.AdminName, Secret: "wrong"})
+				return err
+			},
+			want: fabricca.ErrUnauthorized,
+		},
+		{
+			name: "already registered",
+			call: func(ctx context.Context, client *fabricca.Client) error {
+				_, err := client.Register(ctx, fabricca.RegistrationRequest{Name: catest.AdminName})
+				return err
+			},
+			want: fabricca.ErrAlreadyRegistered,
+		},
+		{
+			name: "unknown identity",
+			call: func(ctx context.Context, client *fabricca.Client) error {
+				_, err := client.Revoke(ctx, fabricca.RevocationRequest{Name: "nobody"})
+				return err
+			},
+			want: fabricca.ErrNotFound,
+		},
+		{
+			name:    "bad request",
+			failure: catest.Failure{StatusCode: http.StatusBadRequest, Code: 0, Message: "invalid affiliation"},
+			call: func(ctx context.Context, client *fabricca.Client) error {
+				_, err := client.Register(ctx, fabricca.RegistrationRequest{Name: "alice"})
+				return err
+			},
+			want: fabricca.ErrBadRequest,
+		},
+		{
+			name:    "unauthorized",
+			failure: catest.Failure{StatusCode: http.StatusUnauthorized, Code: 20, Message: "Authentication failure"},
+			call: func(ctx context.Context, client *fabricca.Client) error {
+				_, err := client.Register(ctx, fabricca.RegistrationRequest{Name: "alice"})
+				return err
+			},
+			want: fabricca.ErrUnauthorized,
+		},
+		{
+			name:    "not found",
+			failure: catest.Failure{StatusCode: http.StatusNotFound, Code: 63, Message: "Identity alice was not found"},
+			call: func(ctx context.Context, client *fabricca.Client) error {
+				_, err := client.Register(ctx, fabricca.RegistrationRequest{Name: "alice"})
+				return err
+			},
+			want: fabricca.ErrNotFound,
+		},
+		{
+			name:    "already registered with a server error",
+			failure: catest.Failure{StatusCode: http.StatusInternalServerError, Code: 74, Message: "Identity 'alice' is already registered"},
+			call: func(ctx context.Context, client *fabricca.Client) error {
+				_, err := client.Register(ctx, fabricca.RegistrationRequest{Name: "alice"})
+				return err
+			},
+			want: fabricca.ErrAlreadyRegistered,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca, client := newTestClient(t)
+			if tt.failure.StatusCode != 0 {
+				ca.Fail("register", tt.failure)
+			}
+			err := tt.call(context.Background(), client)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error = %v, want %v", err, tt.want)
+			}
+			var caErr *fabricca.Error
+			if !errors.As(err, &caErr) {
+				t.Fatalf("error %T is not a *fabricca.Error", err)
+			}
+			for _, other := range []error{fabricca.ErrBadRequest, fabricca.ErrUnauthorized, fabricca.ErrNotFound, fabricca.ErrAlreadyRegistered} {
+				if other != tt.want && errors.Is(err, other) && !(tt.want == fabricca.ErrAlreadyRegistered && other == fabricca.ErrBadRequest) {
+					t.Errorf("error %v also matches %v", err, other)
+				}
+			}
+		})
+	}
+}
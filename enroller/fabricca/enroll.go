@@ -0,0 +1,220 @@
+package fabricca
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+)
+
+// AttributeRequest asks for an attribute of the identity in the enrollment certificate.
+type AttributeRequest struct {
+	Name     string `json:"name"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+// EnrollmentRequest enrolls a registered identity with its secret.
+type EnrollmentRequest struct {
+	Name   string
+	Secret string
+	// CSR is a PEM certificate request of a key held by the caller, the returned MSP
+	// then holds no private key. A P-256 key is generated when it is empty.
+	CSR      []byte
+	Profile  string
+	Label    string
+	AttrReqs []AttributeRequest
+}
+
+// ReenrollmentRequest renews the certificate of an enrolled identity.
+type ReenrollmentRequest struct {
+	// CSR is a PEM certificate request of a key held by the caller. A new P-256 key is
+	// generated when it is empty.
+	CSR      []byte
+	Profile  string
+	Label    string
+	AttrReqs []AttributeRequest
+}
+
+// CAInfo is the certificate chain and version of the CA.
+type CAInfo struct {
+	CAName                    string
+	CAChain                   []byte
+	IssuerPublicKey           []byte
+	IssuerRevocationPublicKey []byte
+	Version                   string
+}
+
+type enrollmentBody struct {
+	CSR      string             `json:"certificate_request"`
+	Profile  string             `json:"profile,omitempty"`
+	Label    string             `json:"label,omitempty"`
+	CAName   string             `json:"caname,omitempty"`
+	AttrReqs []AttributeRequest `json:"attr_reqs,omitempty"`
+}
+
+type serverInfo struct {
+	CAName                    string `json:"CAName"`
+	CAChain                   string `json:"CAChain"`
+	IssuerPublicKey           string `json:"IssuerPublicKey"`
+	IssuerRevocationPublicKey string `json:"IssuerRevocationPublicKey"`
+	Version                   string `json:"Version"`
+}
+
+type enrollmentResult struct {
+	Cert       string     `json:"Cert"`
+	ServerInfo serverInfo `json:"ServerInfo"`
+}
+
+// CAInfo returns the certificate chain of the CA. It needs no authentication.
+func (c *Client) CAInfo(ctx context.Context) (*CAInfo, error) {
+	var result serverInfo
+	body := map[string]string{"caname": c.caName}
+	if err := c.do(ctx, http.MethodPost, "cainfo", nil, body, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.decode()
+}
+
+func (s serverInfo) decode() (*CAInfo, error) {
+	info := &CAInfo{CAName: s.CAName, Version: s.Version}
+	var err error
+	if info.CAChain, err = decodeBase64("CAChain", s.CAChain); err != nil {
+		return nil, err
+	}
+	if info.IssuerPublicKey, err = decodeBase64("IssuerPublicKey", s.IssuerPublicKey); err != nil {
+		return nil, err
+	}
+	if info.IssuerRevocationPublicKey, err = decodeBase64("IssuerRevocationPublicKey", s.IssuerRevocationPublicKey); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Enroll enrolls an identity with its enrollment secret and returns its MSP.
+func (c *Client) Enroll(ctx context.Context, request EnrollmentRequest) (*MSP, error) {
+	if request.Name == "" || request.Secret == "" {
+		return nil, fmt.Errorf("%w: name and secret are required", ErrBadRequest)
+	}
+
+	csr, key, err := certificateRequest(request.Name, request.CSR)
+	if err != nil {
+		return nil, err
+	}
+
+	var result enrollmentResult
+	body := enrollmentBody{
+		CSR:      string(csr),
+		Profile:  request.Profile,
+		Label:    request.Label,
+		CAName:   c.caName,
+		AttrReqs: request.AttrReqs,
+	}
+	if err = c.do(ctx, http.MethodPost, "enroll", nil, body, basicAuth(request.Name, request.Secret), &result); err != nil {
+		return nil, err
+	}
+	return c.newMSP(result, key)
+}
+
+// Reenroll renews the certificate of an enrolled identity, authenticated with its
+// current certificate, and returns its new MSP.
+func (c *Client) Reenroll(ctx context.Context, id *Identity, request ReenrollmentRequest) (*MSP, error) {
+	if id == nil {
+		return nil, fmt.Errorf("%w: identity is required", ErrBadRequest)
+	}
+	cert, err := ParseCertificate(id.Cert)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, key, err := certificateRequest(cert.Subject.CommonName, request.CSR)
+	if err != nil {
+		return nil, err
+	}
+
+	var result enrollmentResult
+	body := enrollmentBody{
+		CSR:      string(csr),
+		Profile:  request.Profile,
+		Label:    request.Label,
+		CAName:   c.caName,
+		AttrReqs: request.AttrReqs,
+	}
+	if err = c.do(ctx, http.MethodPost, "reenroll", nil, body, tokenAuth(id), &result); err != nil {
+		return nil, err
+	}
+	return c.newMSP(result, key)
+}
+
+// certificateRequest returns the submitted certificate request after checking its
+// signature and subject, or generates a key and a certificate request of name.
+func certificateRequest(name string, csrPEM []byte) ([]byte, *ecdsa.PrivateKey, error) {
+	if len(csrPEM) > 0 {
+		block, _ := pem.Decode(csrPEM)
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			return nil, nil, fmt.Errorf("%w: no PEM certificate request found", ErrBadRequest)
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid certificate request: %v", ErrBadRequest, err)
+		}
+		if err = csr.CheckSignature(); err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid certificate request signature: %v", ErrBadRequest, err)
+		}
+		// The CA rejects a certificate request of another identity
+		if csr.Subject.CommonName != "" && csr.Subject.CommonName != name {
+			return nil, nil, fmt.Errorf("%w: certificate request common name %q is not %q", ErrBadRequest, csr.Subject.CommonName, name)
+		}
+		return csrPEM, nil, nil
+	}
+
+	key, err := generateKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	csr, err := NewCSR(name, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return csr, key, nil
+}
+
+// newMSP returns the MSP of an enrollment result, with key when it was generated here.
+func (c *Client) newMSP(result enrollmentResult, key *ecdsa.PrivateKey) (*MSP, error) {
+	signCert, err := decodeBase64("Cert", result.Cert)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = ParseCertificate(signCert); err != nil {
+		return nil, fmt.Errorf("invalid enrollment certificate: %w", err)
+	}
+
+	info, err := result.ServerInfo.decode()
+	if err != nil {
+		return nil, err
+	}
+	roots, intermediates, err := splitChain(info.CAChain)
+	if err != nil {
+		return nil, err
+	}
+
+	msp := &MSP{
+		SignCert:                  signCert,
+		CACerts:                   roots,
+		IntermediateCerts:         intermediates,
+		CAFile:                    caFileName(c.baseURL.Host, c.baseURL.Scheme),
+		TLSCACerts:                c.tlsCACerts,
+		IssuerPublicKey:           info.IssuerPublicKey,
+		IssuerRevocationPublicKey: info.IssuerRevocationPublicKey,
+	}
+	if key != nil {
+		if msp.Key, err = encodePrivateKey(key); err != nil {
+			return nil, fmt.Errorf("failed to encode private key: %w", err)
+		}
+		if msp.KeyFile, err = KeyFileName(&key.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	return msp, nil
+}
@@ -0,0 +1,75 @@
+package fabricca
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrUnauthorized is returned when the CA rejects the credentials or token.
+	ErrUnauthorized = errors.New("fabric CA authentication failed")
+	// ErrForbidden is returned when the registrar may not perform the request.
+	ErrForbidden = errors.New("fabric CA request not authorized")
+	// ErrNotFound is returned for unknown identities and certificates.
+	ErrNotFound = errors.New("fabric CA identity or certificate not found")
+	// ErrAlreadyRegistered is returned when registering an existing identity.
+	ErrAlreadyRegistered = errors.New("fabric CA identity already registered")
+	// ErrBadRequest is returned for requests the CA considers invalid.
+	ErrBadRequest = errors.New("invalid fabric CA request")
+
+	// ErrNoRegistrar is returned by requests that need a registrar when the client has none.
+	ErrNoRegistrar = errors.New("fabric CA client has no registrar identity")
+)
+
+// Message is an error or informational message of a CA response.
+type Message struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error is an error response of the CA. It matches ErrUnauthorized, ErrForbidden,
+// ErrNotFound, ErrAlreadyRegistered and ErrBadRequest with errors.Is.
+type Error struct {
+	StatusCode int
+	Code       int
+	Message    string
+	Errors     []Message
+}
+
+func newError(statusCode int, messages []Message) *Error {
+	e := &Error{StatusCode: statusCode, Errors: messages}
+	if len(messages) > 0 {
+		e.Code = messages[0].Code
+		e.Message = messages[0].Message
+	}
+	if e.StatusCode < http.StatusBadRequest {
+		// A failed response with a success status, reported as a server error
+		e.StatusCode = http.StatusInternalServerError
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("fabric CA error %d (HTTP %d): %s", e.Code, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("fabric CA error (HTTP %d): %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrAlreadyRegistered:
+		return strings.Contains(e.Message, "already registered")
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package fabricca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+// Identity is an enrolled identity. It authenticates CA requests with a token signed by
+// its key, which may live outside the process behind a crypto.Signer.
+type Identity struct {
+	Cert []byte
+	Key  crypto.Signer
+}
+
+// NewIdentity returns the identity of a PEM certificate and PEM private key.
+func NewIdentity(certPEM []byte, keyPEM []byte) (*Identity, error) {
+	if _, err := ParseCertificate(certPEM); err != nil {
+		return nil, err
+	}
+	key, err := ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Cert: certPEM, Key: key}, nil
+}
+
+// LoadIdentity reads the identity of an MSP directory, the first file of signcerts and of
+// keystore.
+func LoadIdentity(mspDir string) (*Identity, error) {
+	certPEM, err := firstFile(filepath.Join(mspDir, "signcerts"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing certificate: %w", err)
+	}
+	keyPEM, err := firstFile(filepath.Join(mspDir, "keystore"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	return NewIdentity(certPEM, keyPEM)
+}
+
+func firstFile(dir string) ([]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		// Kubernetes secret volumes link the files through hidden ..data directories
+		if entry.Name()[0] == '.' {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return os.ReadFile(path)
+		}
+	}
+	return nil, fmt.Errorf("no file in %s", dir)
+}
+
+// ParseCertificate parses the first certificate of a PEM block.
+func ParseCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// ParsePrivateKey parses a PKCS#8 or SEC 1 PEM ECDSA private key.
+func ParsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T, expected ECDSA", key)
+		}
+		return signer, nil
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return key, nil
+}
+
+// token returns the authorization token of a request: the base64 certificate and the
+// base64 signature of the method, URI, body and certificate, as the CA verifies it.
+func (id *Identity) token(method string, uri string, body []byte) (string, error) {
+	b64Cert := base64.StdEncoding.EncodeToString(id.Cert)
+	payload := method + "." +
+		base64.StdEncoding.EncodeToString([]byte(uri)) + "." +
+		base64.StdEncoding.EncodeToString(body) + "." +
+		b64Cert
+
+	signature, err := sign(id.Key, []byte(payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %w", err)
+	}
+	return b64Cert + "." + base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// Sign signs the SHA-256 digest of message with a low S value, as Fabric verifies the
+// signatures of its transactions and config updates.
+func (id *Identity) Sign(message []byte) ([]byte, error) {
+	return sign(id.Key, message)
+}
+
+// ecdsaSignature is the ASN.1 structure of an ECDSA signature.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// sign signs the SHA-256 digest of message. Fabric only accepts ECDSA signatures with a
+// low S value, so S is normalised when the signer did not do it.
+func sign(signer crypto.Signer, message []byte) ([]byte, error) {
+	publicKey, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T, expected ECDSA", signer.Public())
+	}
+
+	digest := sha256.Sum256(message)
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig ecdsaSignature
+	if _, err = asn1.Unmarshal(signature, &sig); err != nil {
+		return nil, fmt.Errorf("invalid ECDSA signature: %w", err)
+	}
+	halfOrder := new(big.Int).Rsh(publicKey.Curve.Params().N, 1)
+	if sig.S.Cmp(halfOrder) <= 0 {
+		return signature, nil
+	}
+	sig.S.Sub(publicKey.Curve.Params().N, sig.S)
+	return asn1.Marshal(sig)
+}
+
+// generateKey returns a new P-256 key, the curve of the Fabric CA default CSR.
+func generateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// NewCSR returns a PEM certificate request of name signed by key, which may be held
+// outside the process.
+func NewCSR(name string, key crypto.Signer) ([]byte, error) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: name},
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// encodePrivateKey returns the PKCS#8 PEM encoding of key, as fabric-ca-client writes it.
+func encodePrivateKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// KeyFileName returns the keystore file name of a key, the hex SHA-256 of its public
+// point followed by _sk, as the Fabric BCCSP names it.
+func KeyFileName(key *ecdsa.PublicKey) (string, error) {
+	publicKey, err := key.ECDH()
+	if err != nil {
+		return "", err
+	}
+	ski := sha256.Sum256(publicKey.Bytes())
+	return hex.EncodeToString(ski[:]) + "_sk", nil
+}
@@ -0,0 +1,135 @@
+package fabricca
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// MSP is the MSP material of an enrolled identity, held in memory.
+type MSP struct {
+	// SignCert is the PEM enrollment certificate.
+	SignCert []byte
+	// Key is the PKCS#8 PEM private key, empty when the caller created the key and
+	// submitted a certificate request.
+	Key []byte
+	// KeyFile is the keystore file name of Key.
+	KeyFile string
+	// CACerts and IntermediateCerts are the PEM root and intermediate certificates of
+	// the CA chain.
+	CACerts           []byte
+	IntermediateCerts []byte
+	// CAFile is the file name of the chain certificates, derived from the CA address as
+	// fabric-ca-client does.
+	CAFile string
+	// TLSCACerts is the PEM root certificate of the TLS connections, set by
+	// WithTLSCACerts.
+	TLSCACerts []byte
+
+	IssuerPublicKey           []byte
+	IssuerRevocationPublicKey []byte
+}
+
+// Files returns the files of the MSP directory by their path in the directory, such as
+// signcerts/cert.pem and keystore/<ski>_sk, with a config.yaml that enables the NodeOUs.
+func (m *MSP) Files() map[string][]byte {
+	files := map[string][]byte{
+		"signcerts/cert.pem": m.SignCert,
+	}
+	if len(m.Key) > 0 {
+		files["keystore/"+m.KeyFile] = m.Key
+	}
+	if len(m.CACerts) > 0 {
+		files["cacerts/"+m.CAFile] = m.CACerts
+	}
+	if len(m.IntermediateCerts) > 0 {
+		files["intermediatecerts/"+m.CAFile] = m.IntermediateCerts
+	}
+	if len(m.TLSCACerts) > 0 {
+		files["tlscacerts/tls-"+m.CAFile] = m.TLSCACerts
+	}
+	if len(m.CACerts) > 0 {
+		files["config.yaml"] = m.nodeOUsConfig()
+	}
+	if len(m.IssuerPublicKey) > 0 {
+		files["IssuerPublicKey"] = m.IssuerPublicKey
+	}
+	if len(m.IssuerRevocationPublicKey) > 0 {
+		files["IssuerRevocationPublicKey"] = m.IssuerRevocationPublicKey
+	}
+	return files
+}
+
+// Identity returns the identity of the MSP, to reenroll it. It fails when the MSP holds
+// no private key.
+func (m *MSP) Identity() (*Identity, error) {
+	if len(m.Key) == 0 {
+		return nil, fmt.Errorf("MSP holds no private key")
+	}
+	return NewIdentity(m.SignCert, m.Key)
+}
+
+// nodeOUsConfig returns the config.yaml that classifies the identities of the MSP by the
+// OU the CA gives them, client, peer, admin or orderer, as the test network does.
+func (m *MSP) nodeOUsConfig() []byte {
+	issuer := "cacerts/" + m.CAFile
+	if len(m.IntermediateCerts) > 0 {
+		issuer = "intermediatecerts/" + m.CAFile
+	}
+
+	var config strings.Builder
+	config.WriteString("NodeOUs:\n  Enable: true\n")
+	for _, ou := range []struct{ key, value string }{
+		{"ClientOUIdentifier", "client"},
+		{"PeerOUIdentifier", "peer"},
+		{"AdminOUIdentifier", "admin"},
+		{"OrdererOUIdentifier", "orderer"},
+	} {
+		fmt.Fprintf(&config, "  %s:\n    Certificate: %s\n    OrganizationalUnitIdentifier: %s\n", ou.key, issuer, ou.value)
+	}
+	return []byte(config.String())
+}
+
+// splitChain splits a PEM CA chain into its self-signed root certificates and its
+// intermediate certificates.
+func splitChain(chain []byte) (roots []byte, intermediates []byte, err error) {
+	var rootsBuf, intermediatesBuf bytes.Buffer
+	for rest := chain; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid certificate in CA chain: %w", err)
+		}
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+			pem.Encode(&rootsBuf, block)
+		} else {
+			pem.Encode(&intermediatesBuf, block)
+		}
+	}
+	if rootsBuf.Len() == 0 {
+		return nil, nil, fmt.Errorf("no root certificate in CA chain")
+	}
+	return rootsBuf.Bytes(), intermediatesBuf.Bytes(), nil
+}
+
+// caFileName returns the name fabric-ca-client gives to the CA certificates of host,
+// the host and port with dots and colons replaced by dashes.
+func caFileName(host string, scheme string) string {
+	if !strings.Contains(host, ":") {
+		if scheme == "http" {
+			host += ":80"
+		} else {
+			host += ":443"
+		}
+	}
+	return strings.NewReplacer(".", "-", ":", "-").Replace(host) + ".pem"
+}
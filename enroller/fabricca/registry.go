@@ -0,0 +1,202 @@
+package fabricca
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Revocation reasons accepted by the CA.
+const (
+	ReasonUnspecified          = "unspecified"
+	ReasonKeyCompromise        = "keycompromise"
+	ReasonCACompromise         = "cacompromise"
+	ReasonAffiliationChange    = "affiliationchange"
+	ReasonSuperseded           = "superseded"
+	ReasonCessationOfOperation = "cessationofoperation"
+	ReasonCertificateHold      = "certificatehold"
+	ReasonRemoveFromCRL        = "removefromcrl"
+	ReasonPrivilegeWithdrawn   = "privilegewithdrawn"
+	ReasonAACompromise         = "aacompromise"
+)
+
+// Attribute is an attribute of a registered identity. ECert attributes are added to the
+// enrollment certificate by default.
+type Attribute struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	ECert bool   `json:"ecert,omitempty"`
+}
+
+// RegistrationRequest registers an identity. The CA generates the secret when it is
+// empty.
+type RegistrationRequest struct {
+	Name           string      `json:"id"`
+	Type           string      `json:"type,omitempty"`
+	Secret         string      `json:"secret,omitempty"`
+	MaxEnrollments int         `json:"max_enrollments,omitempty"`
+	Affiliation    string      `json:"affiliation"`
+	Attributes     []Attribute `json:"attrs,omitempty"`
+}
+
+// RevocationRequest revokes every certificate of the identity Name, or the certificate
+// with Serial and AKI.
+type RevocationRequest struct {
+	Name   string `json:"id,omitempty"`
+	Serial string `json:"serial,omitempty"`
+	AKI    string `json:"aki,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// GenCRL returns the CRL of the CA in the response.
+	GenCRL bool `json:"gencrl,omitempty"`
+}
+
+// RevokedCertificate identifies a revoked certificate.
+type RevokedCertificate struct {
+	Serial string `json:"Serial"`
+	AKI    string `json:"AKI"`
+}
+
+// RevocationResponse lists the revoked certificates and the PEM CRL when it was requested.
+type RevocationResponse struct {
+	RevokedCerts []RevokedCertificate `json:"RevokedCerts"`
+	CRL          []byte               `json:"CRL"`
+}
+
+// IdentityInfo is a registered identity.
+type IdentityInfo struct {
+	Name           string      `json:"id"`
+	Type           string      `json:"type"`
+	Affiliation    string      `json:"affiliation"`
+	Attributes     []Attribute `json:"attrs"`
+	MaxEnrollments int         `json:"max_enrollments"`
+	CAName         string      `json:"caname"`
+}
+
+// CertificateFilter selects the certificates returned by Certificates.
+type CertificateFilter struct {
+	Name       string
+	Serial     string
+	AKI        string
+	NotRevoked bool
+	NotExpired bool
+}
+
+// CRLRequest limits the revoked certificates of a CRL to the ones revoked or expiring in
+// a time range, zero times are unbounded.
+type CRLRequest struct {
+	RevokedAfter  time.Time `json:"revokedafter"`
+	RevokedBefore time.Time `json:"revokedbefore"`
+	ExpireAfter   time.Time `json:"expireafter"`
+	ExpireBefore  time.Time `json:"expirebefore"`
+}
+
+// Register registers an identity with the registrar and returns its enrollment secret.
+func (c *Client) Register(ctx context.Context, request RegistrationRequest) (string, error) {
+	if request.Name == "" {
+		return "", fmt.Errorf("%w: name is required", ErrBadRequest)
+	}
+
+	body := struct {
+		RegistrationRequest
+		CAName string `json:"caname,omitempty"`
+	}{request, c.caName}
+
+	var result struct {
+		Secret string `json:"secret"`
+	}
+	if err := c.do(ctx, http.MethodPost, "register", nil, body, tokenAuth(c.registrar), &result); err != nil {
+		return "", err
+	}
+	return result.Secret, nil
+}
+
+// Revoke revokes certificates with the registrar.
+func (c *Client) Revoke(ctx context.Context, request RevocationRequest) (*RevocationResponse, error) {
+	if request.Name == "" && (request.Serial == "" || request.AKI == "") {
+		return nil, fmt.Errorf("%w: name, or serial and AKI, are required", ErrBadRequest)
+	}
+
+	body := struct {
+		RevocationRequest
+		CAName string `json:"caname,omitempty"`
+	}{request, c.caName}
+
+	var result RevocationResponse
+	if err := c.do(ctx, http.MethodPost, "revoke", nil, body, tokenAuth(c.registrar), &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetIdentity returns a registered identity.
+func (c *Client) GetIdentity(ctx context.Context, name string) (*IdentityInfo, error) {
+	var result IdentityInfo
+	if err := c.do(ctx, http.MethodGet, "identities/"+name, nil, nil, tokenAuth(c.registrar), &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ListIdentities returns the identities the registrar may see.
+func (c *Client) ListIdentities(ctx context.Context) ([]IdentityInfo, error) {
+	var result struct {
+		Identities []IdentityInfo `json:"identities"`
+	}
+	if err := c.do(ctx, http.MethodGet, "identities", nil, nil, tokenAuth(c.registrar), &result); err != nil {
+		return nil, err
+	}
+	return result.Identities, nil
+}
+
+// Certificates returns the PEM certificates selected by filter.
+func (c *Client) Certificates(ctx context.Context, filter CertificateFilter) ([][]byte, error) {
+	query := url.Values{}
+	if filter.Name != "" {
+		query.Set("id", filter.Name)
+	}
+	if filter.Serial != "" {
+		query.Set("serial", filter.Serial)
+	}
+	if filter.AKI != "" {
+		query.Set("aki", filter.AKI)
+	}
+	if filter.NotRevoked {
+		query.Set("notrevoked", "true")
+	}
+	if filter.NotExpired {
+		query.Set("notexpired", "true")
+	}
+
+	var result struct {
+		Certs []struct {
+			PEM string `json:"PEM"`
+		} `json:"certs"`
+	}
+	if err := c.do(ctx, http.MethodGet, "certificates", query, nil, tokenAuth(c.registrar), &result); err != nil {
+		return nil, err
+	}
+
+	certs := make([][]byte, 0, len(result.Certs))
+	for _, cert := range result.Certs {
+		certs = append(certs, []byte(cert.PEM))
+	}
+	return certs, nil
+}
+
+// GenCRL returns the PEM CRL of the CA.
+func (c *Client) GenCRL(ctx context.Context, request CRLRequest) ([]byte, error) {
+	body := struct {
+		CRLRequest
+		CAName string `json:"caname,omitempty"`
+	}{request, c.caName}
+
+	var result struct {
+		CRL []byte `json:"CRL"`
+	}
+	if err := c.do(ctx, http.MethodPost, "gencrl", nil, body, tokenAuth(c.registrar), &result); err != nil {
+		return nil, err
+	}
+	return result.CRL, nil
+}
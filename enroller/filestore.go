@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const fileStoreExtension = ".msp"
+
+// FileStore keeps the MSP of every user in a file of dir, encrypted with AES-256-GCM
+// under the key in a key file. The username is authenticated with the file content so
+// that the file of a user cannot be passed off as another's.
+type FileStore struct {
+	dir  string
+	aead cipher.AEAD
+	mu   sync.Mutex
+}
+
+// NewFileStore returns a store in dir, created when missing, encrypted with the base64
+// 32-byte key in keyFile, such as the output of openssl rand -base64 32.
+func NewFileStore(dir string, keyFile string) (*FileStore, error) {
+	encoded, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MSP store key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("MSP store key must be 32 bytes, base64 encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create MSP store directory: %w", err)
+	}
+	return &FileStore{dir: dir, aead: aead}, nil
+}
+
+func (s *FileStore) path(username string) string {
+	// PathEscape escapes the separators, so that a username cannot leave dir
+	return filepath.Join(s.dir, url.PathEscape(username)+fileStoreExtension)
+}
+
+func (s *FileStore) read(username string) (mspHistory, error) {
+	sealed, err := os.ReadFile(s.path(username))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errMSPNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("MSP file of %s is truncated", username)
+	}
+	plaintext, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(username))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt MSP of %s: %w", username, err)
+	}
+
+	var history mspHistory
+	if err = json.Unmarshal(plaintext, &history); err != nil {
+		return nil, fmt.Errorf("invalid MSP file of %s: %w", username, err)
+	}
+	if len(history) == 0 {
+		return nil, errMSPNotFound
+	}
+	return history, nil
+}
+
+// write replaces the file of username atomically, so that a crash leaves the previous
+// version in place.
+func (s *FileStore) write(username string, history mspHistory) error {
+	plaintext, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, []byte(username))
+
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(sealed); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(username))
+}
+
+func (s *FileStore) Store(ctx context.Context, username string, files map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, err := s.read(username)
+	if err != nil && !errors.Is(err, errMSPNotFound) {
+		return err
+	}
+	return s.write(username, history.add(files))
+}
+
+func (s *FileStore) Get(ctx context.Context, username string) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, err := s.read(username)
+	if err != nil {
+		return nil, err
+	}
+	return history.current(), nil
+}
+
+func (s *FileStore) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var usernames []string
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), fileStoreExtension)
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		if username, err := url.PathUnescape(name); err == nil {
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+	return usernames, nil
+}
+
+func (s *FileStore) Delete(ctx context.Context, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(username)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) Versions(ctx context.Context, username string) ([]MSPVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, err := s.read(username)
+	if err != nil {
+		return nil, err
+	}
+	return history.versions(), nil
+}
+
+func (s *FileStore) checks() []dependencyCheck {
+	return []dependencyCheck{{name: "mspStore", check: s.dirCheck}}
+}
+
+// dirCheck reports whether the store directory can be listed.
+func (s *FileStore) dirCheck(ctx context.Context) CheckResult {
+	_, err := os.ReadDir(s.dir)
+	return checkResult(err, s.dir)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hyperledger/digital-identity/enroller/fabricca"
+	"github.com/hyperledger/digital-identity/enroller/fabricca/catest"
+)
+
+// testEnroller serves the enroller routes with a memory store, software keys and a
+// stand-in CA.
+type testEnroller struct {
+	ca        *catest.Server
+	store     *MemoryStore
+	auditFile string
+	router    chi.Router
+}
+
+func newTestEnroller(t *testing.T) *testEnroller {
+	t.Helper()
+	ca := catest.NewServer("ca-org1")
+	t.Cleanup(ca.Close)
+
+	registrar, err := fabricca.NewIdentity(ca.AdminCert, ca.AdminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := fabricca.NewClient(ca.URL, fabricca.WithCAName(ca.CAName), fabricca.WithRegistrar(registrar))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &testEnroller{ca: ca, store: NewMemoryStore(), auditFile: filepath.Join(t.TempDir(), "revocations.jsonl")}
+	cfg := &Config{MSPID: "Org1MSP", Org: "org1", RevocationAuditFile: e.auditFile}
+	audit := newRevocationAudit(cfg)
+	keys := softwareKeys{}
+
+	r := chi.NewRouter()
+	r.Post("/register", func(w http.ResponseWriter, r *http.Request) {
+		handleRegister(w, r, cfg, client, e.store)
+	})
+	r.Post("/enroll", func(w http.ResponseWriter, r *http.Request) {
+		handleEnroll(w, r, cfg, client, e.store, keys)
+	})
+	r.Delete("/revoke/{username}", func(w http.ResponseWriter, r *http.Request) {
+		handleRevoke(w, r, cfg, client, e.store, audit, nil)
+	})
+	r.Get("/msp/{username}", func(w http.ResponseWriter, r *http.Request) {
+		handleGetMSP(w, r, cfg, e.store)
+	})
+	e.router = r
+	return e
+}
+
+// do serves a request with a JSON body and decodes the JSON response.
+func (e *testEnroller) do(t *testing.T, method, target string, body interface{}, header http.Header) (int, map[string]interface{}) {
+	t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		jsonByte, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(jsonByte)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	e.router.ServeHTTP(rec, req)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s %s: invalid response %q: %v", method, target, rec.Body.String(), err)
+	}
+	return rec.Code, response
+}
+
+// enroll registers and enrolls username and returns its certificate.
+func (e *testEnroller) enroll(t *testing.T, username string) *x509.Certificate {
+	t.Helper()
+	status, response := e.do(t, http.MethodPost, "/register", UserRequest{Username: username, Password: "pw", UserID: "id-" + username}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("register %s: %d %v", username, status, response)
+	}
+	status, response = e.do(t, http.MethodPost, "/enroll", UserRequest{Username: username, Password: "pw"}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("enroll %s: %d %v", username, status, response)
+	}
+
+	files, err := e.store.Get(context.Background(), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, _ := mspIdentity(files)
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatalf("MSP of %s has no certificate", username)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestHandleRegister(t *testing.T) {
+	e := newTestEnroller(t)
+
+	status, response := e.do(t, http.MethodPost, "/register", UserRequest{Username: "user1", UserID: "id1"}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("register: %d %v", status, response)
+	}
+	if password, _ := response["password"].(string); password == "" {
+		t.Error("register: no password generated")
+	}
+	if !e.ca.Registered("user1") {
+		t.Error("user1 not registered with the CA")
+	}
+
+	tests := []struct {
+		name   string
+		req    UserRequest
+		status int
+	}{
+		{"missing user id", UserRequest{Username: "user2"}, http.StatusBadRequest},
+		{"missing username", UserRequest{UserID: "id2"}, http.StatusBadRequest},
+		{"already registered", UserRequest{Username: "user1", UserID: "id1"}, http.StatusConflict},
+	}
+	for _, test := range tests {
+		if status, response := e.do(t, http.MethodPost, "/register", test.req, nil); status != test.status {
+			t.Errorf("%s: %d %v, want %d", test.name, status, response, test.status)
+		}
+	}
+}
+
+func TestHandleEnroll(t *testing.T) {
+	e := newTestEnroller(t)
+	cert := e.enroll(t, "user1")
+	if cert.Subject.CommonName != "user1" {
+		t.Errorf("certificate of %s, want user1", cert.Subject.CommonName)
+	}
+
+	files, err := e.store.Get(context.Background(), "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"signcerts/", "keystore/", "cacerts/"} {
+		found := false
+		for path := range files {
+			found = found || strings.HasPrefix(path, dir)
+		}
+		if !found {
+			t.Errorf("stored MSP has no %s file", dir)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		req    UserRequest
+		status int
+	}{
+		{"missing password", UserRequest{Username: "user1"}, http.StatusBadRequest},
+		{"wrong password", UserRequest{Username: "user1", Password: "wrong"}, http.StatusUnauthorized},
+		{"unknown user", UserRequest{Username: "user2", Password: "pw"}, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		if status, response := e.do(t, http.MethodPost, "/enroll", test.req, nil); status != test.status {
+			t.Errorf("%s: %d %v, want %d", test.name, status, response, test.status)
+		}
+	}
+}
+
+func TestHandleGetMSP(t *testing.T) {
+	e := newTestEnroller(t)
+	e.enroll(t, "user1")
+	stored, err := e.store.Get(context.Background(), "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, response := e.do(t, http.MethodGet, "/msp/user1", nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("get MSP: %d %v", status, response)
+	}
+	msp, _ := response["msp"].(map[string]interface{})
+	if len(msp) != len(stored) {
+		t.Errorf("get MSP returned %d files, want %d", len(msp), len(stored))
+	}
+	for path, content := range stored {
+		if encoded, _ := msp[path].(string); encoded != base64.StdEncoding.EncodeToString(content) {
+			t.Errorf("get MSP file %s = %q, want the stored content", path, encoded)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"unknown user", "/msp/user2", http.StatusNotFound},
+		{"unsupported format", "/msp/user1?format=pem", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if status, response := e.do(t, http.MethodGet, test.target, nil, nil); status != test.status {
+			t.Errorf("%s: %d %v, want %d", test.name, status, response, test.status)
+		}
+	}
+}
+
+func TestHandleRevoke(t *testing.T) {
+	e := newTestEnroller(t)
+	cert := e.enroll(t, "user1")
+	serial := cert.SerialNumber.Text(16)
+
+	status, response := e.do(t, http.MethodDelete, "/revoke/user1?reason=keycompromise", nil,
+		http.Header{"X-Forwarded-User": {"alice"}})
+	if status != http.StatusOK {
+		t.Fatalf("revoke: %d %v", status, response)
+	}
+	if !e.ca.Revoked(serial) {
+		t.Errorf("certificate %s not revoked by the CA", serial)
+	}
+	if _, err := e.store.Get(context.Background(), "user1"); err != errMSPNotFound {
+		t.Errorf("MSP of user1 after revocation: %v, want %v", err, errMSPNotFound)
+	}
+	if crl, _ := response["crl"].(string); !strings.Contains(crl, "X509 CRL") {
+		t.Errorf("revoke response CRL %q, want a PEM CRL", crl)
+	}
+	revoked, _ := response["revoked_certificates"].([]interface{})
+	if len(revoked) != 1 || revoked[0].(map[string]interface{})["serial"] != serial {
+		t.Errorf("revoked certificates %v, want %s", revoked, serial)
+	}
+
+	audit, err := os.ReadFile(e.auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record RevocationRecord
+	if err = json.Unmarshal(audit, &record); err != nil {
+		t.Fatalf("invalid audit record %q: %v", audit, err)
+	}
+	// The forwarded user is not authenticated, the requester is the client address
+	if record.Username != "user1" || record.Reason != "keycompromise" || !record.MSPRemoved ||
+		record.RevokedBy != "192.0.2.1:1234" || record.UnverifiedForwardedUser != "alice" {
+		t.Errorf("audit record %+v", record)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"unsupported reason", "/revoke/user1?reason=lost", http.StatusBadRequest},
+		{"unknown user", "/revoke/user2", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if status, response := e.do(t, http.MethodDelete, test.target, nil, nil); status != test.status {
+			t.Errorf("%s: %d %v, want %d", test.name, status, response, test.status)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/hyperledger/digital-identity/enroller/fabricca"
+)
+
+const (
+	checkOK     = "ok"
+	checkFailed = "failed"
+)
+
+// CheckResult is the state of a dependency reported by /readyz.
+type CheckResult struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+func checkResult(err error, message string) CheckResult {
+	if err != nil {
+		return CheckResult{Status: checkFailed, Message: err.Error()}
+	}
+	return CheckResult{Status: checkOK, Message: message}
+}
+
+// handleLiveness reports that the enroller process serves requests.
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, map[string]interface{}{
+		"status":  http.StatusOK,
+		"message": "alive",
+	})
+}
+
+// handleReadiness checks the dependencies of the MSP store and of the key provider, such
+// as Vault being unsealed and the enroller logged in with a valid token, and that the CA
+// answers, each within READINESS_TIMEOUT.
+func handleReadiness(w http.ResponseWriter, r *http.Request, ca *fabricca.Client, store MSPStore, keys KeyProvider) {
+	timeout, err := time.ParseDuration(getEnvWithDefault("READINESS_TIMEOUT", "5s"))
+	if err != nil || timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	// The checks are keyed by name, so that a dependency shared by the store and the key
+	// provider is reported once
+	checks := map[string]CheckResult{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	run := func(name string, check func(ctx context.Context) CheckResult) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := check(ctx)
+			mu.Lock()
+			checks[name] = result
+			mu.Unlock()
+		}()
+	}
+	for _, dependency := range []interface{}{store, keys} {
+		if checked, ok := dependency.(checked); ok {
+			for _, c := range checked.checks() {
+				run(c.name, c.check)
+			}
+		}
+	}
+	run("ca", func(ctx context.Context) CheckResult { return caCheck(ctx, ca) })
+	wg.Wait()
+
+	status := http.StatusOK
+	for _, check := range checks {
+		if check.Status != checkOK {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	render.Status(r, status)
+	render.JSON(w, r, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// sealCheck reports whether Vault is initialized and unsealed.
+func (v *vaultConnection) sealCheck(ctx context.Context) CheckResult {
+	status, err := v.client.Sys().SealStatusWithContext(ctx)
+	if err == nil && !status.Initialized {
+		err = errors.New("vault is not initialized")
+	}
+	if err == nil && status.Sealed {
+		err = errors.New("vault is sealed")
+	}
+	return checkResult(err, "unsealed")
+}
+
+// caCheck reports whether the CA answers /cainfo.
+func caCheck(ctx context.Context, ca *fabricca.Client) CheckResult {
+	info, err := ca.CAInfo(ctx)
+	if err != nil {
+		return checkResult(err, "")
+	}
+	return checkResult(nil, fmt.Sprintf("cainfo reachable, version %s", info.Version))
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/digital-identity/enroller/fabricca"
+)
+
+const (
+	keyProviderSoftware = "software"
+	keyProviderTransit  = "transit"
+	keyProviderPKCS11   = "pkcs11"
+
+	// transitKeyPrefix starts the keystore content of a Transit key, a reference such as
+	// transit:fabric-user-alice?version=2 in place of a PEM private key.
+	transitKeyPrefix = "transit:"
+	// pkcs11KeyPrefix starts the keystore content of an HSM key, a PKCS#11 URI such as
+	// pkcs11:token=fabric;object=fabric-user-alice;id=%8a%3f...
+	pkcs11KeyPrefix = "pkcs11:"
+)
+
+// KeyProvider creates the keys of the users enrolled without a certificate request and
+// signs with them.
+type KeyProvider interface {
+	// CreateKey creates a new key of username, or a new version of it, and returns it
+	// with the content of its keystore file.
+	CreateKey(ctx context.Context, username string) (crypto.Signer, []byte, error)
+	// Signer returns the key of the content of a keystore file.
+	Signer(ctx context.Context, keystore []byte) (crypto.Signer, error)
+}
+
+// newKeyProvider returns the provider selected by KEY_PROVIDER, the Transit provider
+// using vault.
+func newKeyProvider(cfg *Config, vault *vaultConnection) (KeyProvider, error) {
+	switch cfg.KeyProvider {
+	case keyProviderSoftware:
+		return softwareKeys{}, nil
+	case keyProviderTransit:
+		return &TransitKeys{vaultConnection: vault, mount: cfg.TransitMount, prefix: cfg.TransitKeyPrefix}, nil
+	case keyProviderPKCS11:
+		return newPKCS11Keys(cfg)
+	}
+	return nil, fmt.Errorf("unsupported KEY_PROVIDER %q, use software, transit or pkcs11", cfg.KeyProvider)
+}
+
+// enrollmentKey is a new key of a user and the certificate request to enroll it.
+type enrollmentKey struct {
+	csr      []byte
+	file     string
+	keystore []byte
+}
+
+// newEnrollmentKey creates a key of username with keys and signs a certificate request
+// of username with it.
+func newEnrollmentKey(ctx context.Context, keys KeyProvider, username string) (*enrollmentKey, error) {
+	signer, keystore, err := keys.CreateKey(ctx, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key: %w", err)
+	}
+	publicKey, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T, expected ECDSA", signer.Public())
+	}
+	file, err := fabricca.KeyFileName(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := fabricca.NewCSR(username, signer)
+	if err != nil {
+		return nil, err
+	}
+	return &enrollmentKey{csr: csr, file: file, keystore: keystore}, nil
+}
+
+// addTo sets the key as the keystore of msp, which the CA enrolled from its request.
+func (k *enrollmentKey) addTo(msp *fabricca.MSP) {
+	msp.Key = k.keystore
+	msp.KeyFile = k.file
+}
+
+// softwareKeys generates the keys in the enroller and stores them as PEM private keys.
+type softwareKeys struct{}
+
+func (softwareKeys) CreateKey(ctx context.Context, username string) (crypto.Signer, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func (softwareKeys) Signer(ctx context.Context, keystore []byte) (crypto.Signer, error) {
+	if strings.HasPrefix(string(keystore), transitKeyPrefix) {
+		return nil, errors.New("the key is held by Vault Transit, set KEY_PROVIDER=transit")
+	}
+	if isPKCS11KeyReference(keystore) {
+		return nil, errors.New("the key is held by an HSM, set KEY_PROVIDER=pkcs11")
+	}
+	return fabricca.ParsePrivateKey(keystore)
+}
+
+// TransitKeys holds the keys of the users in a Vault Transit engine as non-exportable
+// P-256 keys, one per user named <prefix><username>. Renewals rotate the key, and the
+// keystore holds a reference to the version of the certificate.
+type TransitKeys struct {
+	*vaultConnection
+	mount  string
+	prefix string
+}
+
+func (t *TransitKeys) CreateKey(ctx context.Context, username string) (crypto.Signer, []byte, error) {
+	name := t.prefix + username
+	path := fmt.Sprintf("%s/keys/%s", t.mount, name)
+	existing, err := t.read(ctx, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("vault read failed: %w", err)
+	}
+	if existing == nil {
+		_, err = t.write(ctx, path, map[string]interface{}{
+			"type":       "ecdsa-p256",
+			"exportable": false,
+		})
+	} else {
+		_, err = t.write(ctx, path+"/rotate", nil)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("vault write failed: %w", err)
+	}
+
+	signer, err := t.signer(ctx, name, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer, []byte(transitKeyReference(name, signer.version)), nil
+}
+
+func (t *TransitKeys) Signer(ctx context.Context, keystore []byte) (crypto.Signer, error) {
+	// Keys enrolled before KEY_PROVIDER=transit are still PEM private keys
+	if !strings.HasPrefix(string(keystore), transitKeyPrefix) {
+		return fabricca.ParsePrivateKey(keystore)
+	}
+	name, version, err := parseTransitKeyReference(string(keystore))
+	if err != nil {
+		return nil, err
+	}
+	return t.signer(ctx, name, version)
+}
+
+// signer returns the signer of version of key name, the latest version when version is 0.
+func (t *TransitKeys) signer(ctx context.Context, name string, version int) (*transitSigner, error) {
+	secret, err := t.read(ctx, fmt.Sprintf("%s/keys/%s", t.mount, name))
+	if err != nil {
+		return nil, fmt.Errorf("vault read failed: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("transit key %s not found", name)
+	}
+	if version == 0 {
+		latest, ok := secret.Data["latest_version"].(json.Number)
+		number, err := latest.Int64()
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid latest version of transit key %s", name)
+		}
+		version = int(number)
+	}
+
+	versions, _ := secret.Data["keys"].(map[string]interface{})
+	fields, _ := versions[strconv.Itoa(version)].(map[string]interface{})
+	publicKeyPEM, _ := fields["public_key"].(string)
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("transit key %s has no public key for version %d", name, version)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key of transit key %s: %w", name, err)
+	}
+	ecdsaKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("transit key %s is not an ECDSA key", name)
+	}
+
+	return &transitSigner{
+		ctx:       context.WithoutCancel(ctx),
+		keys:      t,
+		name:      name,
+		version:   version,
+		publicKey: ecdsaKey,
+	}, nil
+}
+
+// transitSigner signs digests with a version of a Transit key. crypto.Signer takes no
+// context, so the signer keeps the one it was created with, without its cancellation.
+type transitSigner struct {
+	ctx       context.Context
+	keys      *TransitKeys
+	name      string
+	version   int
+	publicKey *ecdsa.PublicKey
+}
+
+func (s *transitSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign returns the ASN.1 ECDSA signature of a SHA-256 digest.
+func (s *transitSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported hash %v, expected SHA-256", opts.HashFunc())
+	}
+	secret, err := s.keys.write(s.ctx, fmt.Sprintf("%s/sign/%s/sha2-256", s.keys.mount, s.name), map[string]interface{}{
+		"input":                base64.StdEncoding.EncodeToString(digest),
+		"prehashed":            true,
+		"key_version":          s.version,
+		"marshaling_algorithm": "asn1",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("vault sign failed: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, errors.New("vault sign returned no signature")
+	}
+	signature, _ := secret.Data["signature"].(string)
+	return decodeTransitSignature(signature)
+}
+
+// decodeTransitSignature decodes a Transit signature, vault:v<version>:<base64>.
+func decodeTransitSignature(signature string) ([]byte, error) {
+	parts := strings.SplitN(signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("invalid transit signature %q", signature)
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+func transitKeyReference(name string, version int) string {
+	return fmt.Sprintf("%s%s?version=%d", transitKeyPrefix, url.PathEscape(name), version)
+}
+
+func parseTransitKeyReference(reference string) (string, int, error) {
+	escaped, query, _ := strings.Cut(strings.TrimPrefix(reference, transitKeyPrefix), "?")
+	name, err := url.PathUnescape(escaped)
+	if err != nil || name == "" {
+		return "", 0, fmt.Errorf("invalid transit key reference %q", reference)
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid transit key reference %q", reference)
+	}
+	version, err := strconv.Atoi(values.Get("version"))
+	if err != nil || version < 1 {
+		return "", 0, fmt.Errorf("invalid transit key version in %q", reference)
+	}
+	return name, version, nil
+}
+
+func isPKCS11KeyReference(keystore []byte) bool {
+	return strings.HasPrefix(string(keystore), pkcs11KeyPrefix)
+}
+
+// pkcs11KeyReference returns the PKCS#11 URI of a key, as of RFC 7512.
+func pkcs11KeyReference(token, label string, id []byte) string {
+	var encodedID strings.Builder
+	for _, b := range id {
+		fmt.Fprintf(&encodedID, "%%%02x", b)
+	}
+	return fmt.Sprintf("%stoken=%s;object=%s;id=%s", pkcs11KeyPrefix, url.PathEscape(token), url.PathEscape(label), encodedID.String())
+}
+
+// parsePKCS11KeyReference returns the token, label and ID of the PKCS#11 URI of a key.
+// The ID is required, the other attributes are optional.
+func parsePKCS11KeyReference(reference string) (token string, label string, id []byte, err error) {
+	path, _, _ := strings.Cut(strings.TrimPrefix(reference, pkcs11KeyPrefix), "?")
+	for _, attribute := range strings.Split(path, ";") {
+		name, value, _ := strings.Cut(attribute, "=")
+		decoded, err := url.PathUnescape(value)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid PKCS#11 key reference %q", reference)
+		}
+		switch name {
+		case "token":
+			token = decoded
+		case "object":
+			label = decoded
+		case "id":
+			id = []byte(decoded)
+		}
+	}
+	if len(id) == 0 {
+		return "", "", nil, fmt.Errorf("PKCS#11 key reference %q has no id", reference)
+	}
+	return token, label, id, nil
+}
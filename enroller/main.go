@@ -1,32 +1,27 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
-	"github.com/hashicorp/vault/api"
+	"github.com/hyperledger/digital-identity/enroller/fabricca"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
-type VaultStore struct {
-	client *api.Client
-	kvPath string
-}
-
 type Config struct {
 	MSPID         string
 	Org           string
@@ -34,43 +29,125 @@ type Config struct {
 	IngressDomain string
 	Namespace     string
 	VaultAddr     string
-	VaultToken    string
 	KVPath        string
 	RCAMSPPath    string
+	CAURL         string
+	CAName        string
+
+	MSPStore        string
+	MSPStoreDir     string
+	MSPStoreKeyFile string
+
+	VaultAuthMethod   string
+	VaultAuthMount    string
+	VaultToken        string
+	VaultTokenFile    string
+	VaultRole         string
+	VaultK8sTokenPath string
+	VaultRoleID       string
+	VaultSecretIDFile string
+
+	RenewalWebhookURL   string
+	RevocationAuditFile string
+	OrgAdminMSPPath     string
+	ChannelConfigDir    string
+
+	KeyProvider      string
+	TransitMount     string
+	TransitKeyPrefix string
+
+	PKCS11Lib        string
+	PKCS11TokenLabel string
+	PKCS11Pin        string
+	PKCS11KeyPrefix  string
 }
 
 type UserRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password"`
 	UserID   string `json:"user_id" binding:"required"`
+	// CSR is a PEM PKCS#10 certificate request of a key held by the caller. The enroller
+	// then neither generates, stores nor serves the private key of the user.
+	CSR string `json:"csr,omitempty"`
 }
 
-func NewVaultStore(cfg *Config) (*VaultStore, error) {
-	config := api.DefaultConfig()
-	config.Address = cfg.VaultAddr
-	client, err := api.NewClient(config)
+// newCAClient returns a client of the CA at CA_URL, trusting the TLS certificate at
+// TLS_CERT_PATH, with the RCA admin as registrar.
+func newCAClient(cfg *Config) (*fabricca.Client, error) {
+	registrar, err := fabricca.LoadIdentity(cfg.RCAMSPPath)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to load RCA admin identity: %w", err)
 	}
-	client.SetToken(cfg.VaultToken)
 
-	return &VaultStore{
-		client: client,
-		kvPath: cfg.KVPath,
-	}, nil
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	var caCert []byte
+	if strings.HasPrefix(cfg.CAURL, "https://") {
+		caCert, err = os.ReadFile(cfg.TLSCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA TLS certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("invalid CA TLS certificate")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return fabricca.NewClient(cfg.CAURL,
+		fabricca.WithCAName(cfg.CAName),
+		fabricca.WithRegistrar(registrar),
+		fabricca.WithTLSCACerts(caCert),
+		fabricca.WithHTTPClient(&http.Client{
+			// CA requests carry the trace context of the enrollment
+			Transport: otelhttp.NewTransport(transport),
+			Timeout:   30 * time.Second,
+		}),
+	)
 }
 
 func loadConfig() *Config {
+	namespace := getEnvWithDefault("WORKSHOP_NAMESPACE", "test-network")
+	org := getEnvWithDefault("ORG", "org1")
+	domain := getEnvWithDefault("WORKSHOP_INGRESS_DOMAIN", "localho.st")
+
 	return &Config{
 		MSPID:         getEnvWithDefault("MSP_ID", "Org1MSP"),
-		Org:           getEnvWithDefault("ORG", "org1"),
+		Org:           org,
 		TLSCertPath:   getEnvWithDefault("TLS_CERT_PATH", "/etc/tls/tls-cert.pem"),
-		IngressDomain: getEnvWithDefault("WORKSHOP_INGRESS_DOMAIN", "localho.st"),
-		Namespace:     getEnvWithDefault("WORKSHOP_NAMESPACE", "test-network"),
+		IngressDomain: domain,
+		Namespace:     namespace,
 		VaultAddr:     getEnvWithDefault("VAULT_ADDR", "http://vault.vault.svc.cluster.local:8200"),
-		VaultToken:    getEnvWithDefault("VAULT_TOKEN", "<vault-token>"),
 		KVPath:        getEnvWithDefault("VAULT_KV_PATH", "fabric/msp"),
 		RCAMSPPath:    getEnvWithDefault("RCAMSP_PATH", "/etc/rcaadmin/msp"),
+		CAURL:         getEnvWithDefault("CA_URL", fmt.Sprintf("https://%s-%s-ca-ca.%s", namespace, org, domain)),
+		CAName:        getEnvWithDefault("CA_NAME", ""),
+
+		MSPStore:        getEnvWithDefault("MSP_STORE", mspStoreVault),
+		MSPStoreDir:     getEnvWithDefault("MSP_STORE_DIR", "/var/lib/enroller/msp"),
+		MSPStoreKeyFile: getEnvWithDefault("MSP_STORE_KEY_FILE", "/etc/enroller/msp-store.key"),
+
+		VaultAuthMethod:   getEnvWithDefault("VAULT_AUTH_METHOD", vaultAuthToken),
+		VaultAuthMount:    getEnvWithDefault("VAULT_AUTH_MOUNT", ""),
+		VaultToken:        getEnvWithDefault("VAULT_TOKEN", ""),
+		VaultTokenFile:    getEnvWithDefault("VAULT_TOKEN_FILE", "/var/run/secrets/vault/token"),
+		VaultRole:         getEnvWithDefault("VAULT_ROLE", "enroller"),
+		VaultK8sTokenPath: getEnvWithDefault("VAULT_K8S_TOKEN_PATH", "/var/run/secrets/kubernetes.io/serviceaccount/token"),
+		VaultRoleID:       getEnvWithDefault("VAULT_ROLE_ID", ""),
+		VaultSecretIDFile: getEnvWithDefault("VAULT_SECRET_ID_FILE", "/var/run/secrets/vault/secret-id"),
+
+		RenewalWebhookURL:   getEnvWithDefault("RENEWAL_WEBHOOK_URL", ""),
+		RevocationAuditFile: getEnvWithDefault("REVOCATION_AUDIT_FILE", ""),
+		OrgAdminMSPPath:     getEnvWithDefault("ORG_ADMIN_MSP_PATH", ""),
+		ChannelConfigDir:    getEnvWithDefault("CHANNEL_CONFIG_DIR", ""),
+
+		KeyProvider:      getEnvWithDefault("KEY_PROVIDER", keyProviderSoftware),
+		TransitMount:     getEnvWithDefault("TRANSIT_MOUNT", "transit"),
+		TransitKeyPrefix: getEnvWithDefault("TRANSIT_KEY_PREFIX", "fabric-user-"),
+
+		PKCS11Lib:        getEnvWithDefault("PKCS11_LIB", "/usr/lib/softhsm/libsofthsm2.so"),
+		PKCS11TokenLabel: getEnvWithDefault("PKCS11_TOKEN_LABEL", "fabric"),
+		PKCS11Pin:        getEnvWithDefault("PKCS11_PIN", ""),
+		PKCS11KeyPrefix:  getEnvWithDefault("PKCS11_KEY_PREFIX", "fabric-user-"),
 	}
 }
 
@@ -82,31 +159,82 @@ func getEnvWithDefault(key, defaultValue string) string {
 }
 
 func main() {
+	shutdownTracing, err := initTracing(context.Background(), "enroller")
+	if err != nil {
+		log.Fatal("Failed to initialize tracing: ", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	cfg := loadConfig()
-	vault, err := NewVaultStore(cfg)
+	var vault *vaultConnection
+	if cfg.MSPStore == mspStoreVault || cfg.KeyProvider == keyProviderTransit {
+		if vault, err = newVaultConnection(context.Background(), cfg); err != nil {
+			log.Fatal("Failed to initialize Vault client: ", err)
+		}
+	}
+	store, err := newMSPStore(cfg, vault)
+	if err != nil {
+		log.Fatal("Failed to initialize MSP store: ", err)
+	}
+	keys, err := newKeyProvider(cfg, vault)
+	if err != nil {
+		log.Fatal("Failed to initialize key provider: ", err)
+	}
+	go loadCertificateExpiry(context.Background(), store)
+
+	ca, err := newCAClient(cfg)
 	if err != nil {
-		log.Fatal("Failed to initialize Vault client: ", err)
+		log.Fatal("Failed to initialize CA client: ", err)
+	}
+
+	events := newRenewalEvents(cfg)
+	renewals, err := newRenewalScheduler(ca, store, keys, events)
+	if err != nil {
+		log.Fatal("Failed to initialize certificate renewal: ", err)
+	}
+	renewals.Run(context.Background())
+	audit := newRevocationAudit(cfg)
+	admin, err := newConfigSigner(cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize channel config signer: ", err)
 	}
 
 	r := chi.NewRouter()
+	r.Use(tracingMiddleware)
 	r.Use(middleware.Logger)
+	r.Use(metricsMiddleware)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
 
+	r.Method(http.MethodGet, "/metrics", metricsHandler())
+	r.Get("/healthz", handleLiveness)
+	r.Get("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		handleReadiness(w, r, ca, store, keys)
+	})
+
 	r.Post("/register", func(w http.ResponseWriter, r *http.Request) {
-		handleRegister(w, r, cfg, vault)
+		handleRegister(w, r, cfg, ca, store)
 	})
 	r.Post("/enroll", func(w http.ResponseWriter, r *http.Request) {
-		handleEnroll(w, r, cfg, vault)
+		handleEnroll(w, r, cfg, ca, store, keys)
 	})
 	r.Post("/register-enroll", func(w http.ResponseWriter, r *http.Request) {
-		handleRegisterAndEnroll(w, r, cfg, vault)
+		handleRegisterAndEnroll(w, r, cfg, ca, store, keys, audit)
+	})
+	r.Post("/reenroll/{username}", func(w http.ResponseWriter, r *http.Request) {
+		handleReenroll(w, r, ca, store, keys, events)
 	})
 	r.Delete("/revoke/{username}", func(w http.ResponseWriter, r *http.Request) {
-		handleRevoke(w, r, cfg, vault)
+		handleRevoke(w, r, cfg, ca, store, audit, admin)
+	})
+	r.Post("/channels/{channel}/crl", func(w http.ResponseWriter, r *http.Request) {
+		handleCRLUpdate(w, r, cfg, ca, admin)
 	})
 	r.Get("/msp/{username}", func(w http.ResponseWriter, r *http.Request) {
-		handleGetMSP(w, r, cfg, vault)
+		handleGetMSP(w, r, cfg, store)
+	})
+	r.Get("/msp/{username}/versions", func(w http.ResponseWriter, r *http.Request) {
+		handleGetMSPVersions(w, r, store)
 	})
 
 	log.Println("Server started on :8080")
@@ -115,7 +243,7 @@ func main() {
 	}
 }
 
-func handleRegister(w http.ResponseWriter, r *http.Request, cfg *Config, vault *VaultStore) {
+func handleRegister(w http.ResponseWriter, r *http.Request, cfg *Config, ca *fabricca.Client, store MSPStore) {
 	var req UserRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		renderError(w, r, "Invalid request payload", http.StatusBadRequest)
@@ -136,9 +264,9 @@ func handleRegister(w http.ResponseWriter, r *http.Request, cfg *Config, vault *
 		req.Password = password
 	}
 
-	err := registerUser(cfg, req.Username, req.Password, req.UserID)
+	err := registerUser(r.Context(), ca, cfg, req.Username, req.Password, req.UserID)
 	if err != nil {
-		renderError(w, r, fmt.Sprintf("Registration failed: %v", err), http.StatusInternalServerError)
+		renderError(w, r, fmt.Sprintf("Registration failed: %v", err), caErrorStatus(err))
 		return
 	}
 
@@ -149,7 +277,7 @@ func handleRegister(w http.ResponseWriter, r *http.Request, cfg *Config, vault *
 	})
 }
 
-func handleEnroll(w http.ResponseWriter, r *http.Request, cfg *Config, vault *VaultStore) {
+func handleEnroll(w http.ResponseWriter, r *http.Request, cfg *Config, ca *fabricca.Client, store MSPStore, keys KeyProvider) {
 	var req UserRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		renderError(w, r, "Invalid request payload", http.StatusBadRequest)
@@ -161,24 +289,27 @@ func handleEnroll(w http.ResponseWriter, r *http.Request, cfg *Config, vault *Va
 		return
 	}
 
-	mspPath, err := enrollUser(cfg, req.Username, req.Password)
+	msp, err := enrollUser(r.Context(), ca, keys, req.Username, req.Password, req.CSR)
 	if err != nil {
-		renderError(w, r, fmt.Sprintf("Enrollment failed: %v", err), http.StatusInternalServerError)
+		renderError(w, r, fmt.Sprintf("Enrollment failed: %v", err), caErrorStatus(err))
 		return
 	}
 
-	if err := vault.StoreUserMSP(req.Username, mspPath); err != nil {
+	if err := store.Store(r.Context(), req.Username, msp.Files()); err != nil {
 		renderError(w, r, fmt.Sprintf("Vault storage failed: %v", err), http.StatusInternalServerError)
 		return
 	}
+	observeCertificateExpiry(req.Username, msp.Files())
 
-	render.JSON(w, r, map[string]interface{}{
+	response := map[string]interface{}{
 		"username": req.Username,
 		"message":  "User enrolled and MSP stored successfully",
-	})
+	}
+	addCertificates(response, msp)
+	render.JSON(w, r, response)
 }
 
-func handleRegisterAndEnroll(w http.ResponseWriter, r *http.Request, cfg *Config, vault *VaultStore) {
+func handleRegisterAndEnroll(w http.ResponseWriter, r *http.Request, cfg *Config, ca *fabricca.Client, store MSPStore, keys KeyProvider, audit *revocationAudit) {
 	var req UserRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		renderError(w, r, "Invalid request payload", http.StatusBadRequest)
@@ -194,47 +325,42 @@ func handleRegisterAndEnroll(w http.ResponseWriter, r *http.Request, cfg *Config
 		req.Password = password
 	}
 
-	if err := registerUser(cfg, req.Username, req.Password, req.UserID); err != nil {
-		renderError(w, r, fmt.Sprintf("Registration failed: %v", err), http.StatusInternalServerError)
+	if err := registerUser(r.Context(), ca, cfg, req.Username, req.Password, req.UserID); err != nil {
+		renderError(w, r, fmt.Sprintf("Registration failed: %v", err), caErrorStatus(err))
 		return
 	}
 
-	mspPath, err := enrollUser(cfg, req.Username, req.Password)
+	msp, err := enrollUser(r.Context(), ca, keys, req.Username, req.Password, req.CSR)
 	if err != nil {
-		_ = revokeUser(cfg, vault, req.Username, "enrollment failed")
-		renderError(w, r, fmt.Sprintf("Enrollment failed: %v", err), http.StatusInternalServerError)
+		_, _ = revokeUser(r.Context(), ca, store, audit, revocation{
+			username:  req.Username,
+			revokedBy: revokedByEnroller,
+			reason:    fabricca.ReasonUnspecified,
+			detail:    "enrollment failed",
+		})
+		renderError(w, r, fmt.Sprintf("Enrollment failed: %v", err), caErrorStatus(err))
 		return
 	}
 
-	if err := vault.StoreUserMSP(req.Username, mspPath); err != nil {
-		_ = revokeUser(cfg, vault, req.Username, "vault storage failed")
+	if err := store.Store(r.Context(), req.Username, msp.Files()); err != nil {
+		_, _ = revokeUser(r.Context(), ca, store, audit, revocation{
+			username:  req.Username,
+			revokedBy: revokedByEnroller,
+			reason:    fabricca.ReasonUnspecified,
+			detail:    "vault storage failed",
+		})
 		renderError(w, r, fmt.Sprintf("Vault storage failed: %v", err), http.StatusInternalServerError)
 		return
 	}
+	observeCertificateExpiry(req.Username, msp.Files())
 
-	render.JSON(w, r, map[string]interface{}{
+	response := map[string]interface{}{
 		"username": req.Username,
 		"password": req.Password,
 		"message":  "User registered, enrolled and MSP stored successfully",
-	})
-}
-
-func handleRevoke(w http.ResponseWriter, r *http.Request, cfg *Config, vault *VaultStore) {
-	username := chi.URLParam(r, "username")
-	if username == "" {
-		renderError(w, r, "Username is required", http.StatusBadRequest)
-		return
 	}
-
-	if err := revokeUser(cfg, vault, username, "admin revocation"); err != nil {
-		renderError(w, r, fmt.Sprintf("Revocation failed: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	render.JSON(w, r, map[string]interface{}{
-		"username": username,
-		"message":  "User revoked and MSP removed successfully",
-	})
+	addCertificates(response, msp)
+	render.JSON(w, r, response)
 }
 
 func renderError(w http.ResponseWriter, r *http.Request, msg string, status int) {
@@ -253,248 +379,95 @@ func generatePassword() (string, error) {
 	return hex.EncodeToString(b), nil
 }
 
-func registerUser(cfg *Config, username, password, userID string) error {
-	caAddress := fmt.Sprintf("%s-%s-ca-ca.%s", cfg.Namespace, cfg.Org, cfg.IngressDomain)
-
-	cmd := exec.Command("fabric-ca-client", "register",
-		"--id.name", username,
-		"--id.secret", password,
-		"--id.type", "client",
-		"--id.affiliation", cfg.Org,
-		"--id.attrs", fmt.Sprintf("identity.id=%s:ecert", userID),
-		"--url", fmt.Sprintf("https://%s", caAddress),
-		"--tls.certfiles", cfg.TLSCertPath,
-		"--mspdir", cfg.RCAMSPPath,
-	)
-
-	output, err := cmd.CombinedOutput()
+func registerUser(ctx context.Context, ca *fabricca.Client, cfg *Config, username, password, userID string) error {
+	err := caCall(ctx, "register", func(ctx context.Context) error {
+		_, err := ca.Register(ctx, fabricca.RegistrationRequest{
+			Name:        username,
+			Secret:      password,
+			Type:        "client",
+			Affiliation: cfg.Org,
+			Attributes:  []fabricca.Attribute{{Name: "identity.id", Value: userID, ECert: true}},
+		})
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("registration failed: %v\nOutput: %s", err, string(output))
+		return fmt.Errorf("registration failed: %w", err)
 	}
 	return nil
 }
 
-func enrollUser(cfg *Config, username, password string) (string, error) {
-	tempDir, err := ioutil.TempDir("", "msp-")
-	if err != nil {
-		return "", err
+// enrollUser enrolls username from csr, or from a new key created by keys when csr is
+// empty.
+func enrollUser(ctx context.Context, ca *fabricca.Client, keys KeyProvider, username, password, csr string) (*fabricca.MSP, error) {
+	var key *enrollmentKey
+	if csr == "" {
+		var err error
+		if key, err = newEnrollmentKey(ctx, keys, username); err != nil {
+			return nil, err
+		}
+		csr = string(key.csr)
 	}
 
-	caAddress := fmt.Sprintf("%s-%s-ca-ca.%s", cfg.Namespace, cfg.Org, cfg.IngressDomain)
-	enrollURL := fmt.Sprintf("https://%s:%s@%s", username, password, caAddress)
-
-	cmd := exec.Command("fabric-ca-client", "enroll",
-		"--url", enrollURL,
-		"--tls.certfiles", cfg.TLSCertPath,
-		"--mspdir", tempDir,
-	)
-
-	if output, err := cmd.CombinedOutput(); err != nil {
-		os.RemoveAll(tempDir)
-		return "", fmt.Errorf("enrollment failed: %v\nOutput: %s", err, string(output))
+	var msp *fabricca.MSP
+	err := caCall(ctx, "enroll", func(ctx context.Context) (err error) {
+		msp, err = ca.Enroll(ctx, fabricca.EnrollmentRequest{Name: username, Secret: password, CSR: []byte(csr)})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("enrollment failed: %w", err)
 	}
-
-	return tempDir, nil
+	if key != nil {
+		key.addTo(msp)
+	}
+	return msp, nil
 }
 
-func revokeUser(cfg *Config, vault *VaultStore, username, reason string) error {
-	// Revoke using RCA admin MSP
-	cmd := exec.Command("fabric-ca-client", "revoke",
-		"--revoke.name", username,
-		"--revoke.reason", reason,
-		"--url", fmt.Sprintf("https://%s-%s-ca-ca.%s", cfg.Namespace, cfg.Org, cfg.IngressDomain),
-		"--tls.certfiles", cfg.TLSCertPath,
-		"--mspdir", cfg.RCAMSPPath,
-	)
-
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("revocation failed: %v\nOutput: %s", err, string(output))
+// addCertificates adds the signed certificate and the CA chain to the enrollment
+// response of a user enrolled with a CSR, who holds the only copy of the private key.
+func addCertificates(response map[string]interface{}, msp *fabricca.MSP) {
+	if len(msp.Key) > 0 {
+		return
 	}
+	response["certificate"] = string(msp.SignCert)
+	response["ca_chain"] = string(msp.CACerts) + string(msp.IntermediateCerts)
+}
 
-	// Delete all versions and metadata
-	path := fmt.Sprintf("%s/metadata/users/%s", vault.kvPath, username)
-	_, err := vault.client.Logical().Delete(path)
-	if err != nil {
-		return fmt.Errorf("vault deletion failed: %v", err)
+// storeErrorStatus returns the HTTP status of a failed MSP store request.
+func storeErrorStatus(err error) int {
+	if errors.Is(err, errMSPNotFound) {
+		return http.StatusNotFound
 	}
-
-	// Destroy all versions
-	destroyPath := fmt.Sprintf("%s/destroy/users/%s", vault.kvPath, username)
-	_, err = vault.client.Logical().Write(destroyPath, map[string]interface{}{
-		"versions": []int{1},
-	})
-
-	return nil
+	return http.StatusInternalServerError
 }
 
-// Add handler function
-func handleGetMSP(w http.ResponseWriter, r *http.Request, cfg *Config, vault *VaultStore) {
+func handleGetMSPVersions(w http.ResponseWriter, r *http.Request, store MSPStore) {
 	username := chi.URLParam(r, "username")
-	if username == "" {
-		renderError(w, r, "Username is required", http.StatusBadRequest)
-		return
-	}
-
-	mspData, err := vault.GetUserMSP(username)
+	versions, err := store.Versions(r.Context(), username)
 	if err != nil {
-		renderError(w, r, fmt.Sprintf("Failed to retrieve MSP: %v", err), http.StatusNotFound)
+		renderError(w, r, fmt.Sprintf("Failed to retrieve MSP versions: %v", err), storeErrorStatus(err))
 		return
 	}
 
-	// Convert []byte values to base64 for JSON serialization
-	response := make(map[string]string)
-	for path, content := range mspData {
-		response[path] = string(content)
-	}
-
 	render.JSON(w, r, map[string]interface{}{
 		"username": username,
-		"msp":      response,
+		"versions": versions,
 	})
 }
 
-func (v *VaultStore) StoreUserMSP(username, mspPath string) error {
-	// Store IssuerRevocationPublicKey if exists
-	revocationKeyPath := filepath.Join(mspPath, "IssuerRevocationPublicKey")
-	if content, err := ioutil.ReadFile(revocationKeyPath); err == nil {
-		vaultPath := fmt.Sprintf("%s/data/users/%s/IssuerRevocationPublicKey", v.kvPath, username)
-		if _, err := v.client.Logical().Write(vaultPath, map[string]interface{}{
-			"data": map[string]interface{}{
-				"content": base64.StdEncoding.EncodeToString(content),
-			},
-		}); err != nil {
-			return fmt.Errorf("failed to store revocation key: %v", err)
-		}
-	}
-	// Store signcerts
-	signcertsDir := filepath.Join(mspPath, "signcerts")
-	if err := v.storeDirectory(username, signcertsDir); err != nil {
-		return fmt.Errorf("failed to store signcerts: %v", err)
-	}
-
-	// Store keystore
-	keystoreDir := filepath.Join(mspPath, "keystore")
-	if err := v.storeDirectory(username, keystoreDir); err != nil {
-		return fmt.Errorf("failed to store keystore: %v", err)
-	}
-
-	// Store cacerts
-	cacertsDir := filepath.Join(mspPath, "cacerts")
-	if err := v.storeDirectory(username, cacertsDir); err != nil {
-		return fmt.Errorf("failed to store cacerts: %v", err)
-	}
-
-	return nil
-}
-
-func (v *VaultStore) storeDirectory(username, dirPath string) error {
-	return filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return err
-		}
-
-		content, err := ioutil.ReadFile(path)
-		if err != nil {
-			return fmt.Errorf("failed to read %s: %v", path, err)
-		}
-
-		relPath, _ := filepath.Rel(dirPath, path)
-		vaultPath := fmt.Sprintf("%s/data/users/%s/%s/%s", v.kvPath, username, filepath.Base(dirPath), relPath)
-
-		fmt.Println(vaultPath)
-
-		_, err = v.client.Logical().Write(vaultPath, map[string]interface{}{
-			"data": map[string]interface{}{
-				"content": base64.StdEncoding.EncodeToString(content),
-			},
-		})
-
-		return err
-	})
+// caErrorStatus returns the HTTP status of a failed CA request.
+func caErrorStatus(err error) int {
+	switch {
+	// Already registered identities are also bad requests of the CA
+	case errors.Is(err, fabricca.ErrAlreadyRegistered):
+		return http.StatusConflict
+	case errors.Is(err, fabricca.ErrBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, fabricca.ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, fabricca.ErrNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
 }
 
-func (v *VaultStore) GetUserMSP(username string) (map[string][]byte, error) {
-	mspData := make(map[string][]byte)
-
-	// Get IssuerRevocationPublicKey
-	if content, err := v.getVaultContent(username, "IssuerRevocationPublicKey"); err == nil {
-		mspData["IssuerRevocationPublicKey"] = content
-	}
-
-	// Get signcerts with error propagation
-	if err := v.getDirectoryContent(username, "signcerts", mspData); err != nil {
-		return nil, fmt.Errorf("signcerts error: %v", err)
-	}
-
-	// Get keystore with error propagation
-	if err := v.getDirectoryContent(username, "keystore", mspData); err != nil {
-		return nil, fmt.Errorf("keystore error: %v", err)
-	}
-
-	// Get cacerts with error propagation
-	if err := v.getDirectoryContent(username, "cacerts", mspData); err != nil {
-		return nil, fmt.Errorf("cacerts error: %v", err)
-	}
-
-	if len(mspData) == 0 {
-		return nil, errors.New("no MSP data found")
-	}
-
-	return mspData, nil
-}
-
-func (v *VaultStore) getDirectoryContent(username, dir string, mspData map[string][]byte) error {
-	// List directory contents using metadata path
-	listPath := fmt.Sprintf("%s/metadata/users/%s/%s", v.kvPath, username, dir)
-	fmt.Println(listPath)
-	secret, err := v.client.Logical().List(listPath)
-	if err != nil {
-		return fmt.Errorf("failed to list directory: %w", err)
-	}
-	if secret == nil || secret.Data == nil {
-		return fmt.Errorf("directory not found")
-	}
-
-	keys, ok := secret.Data["keys"].([]interface{})
-	if !ok {
-		return fmt.Errorf("invalid directory structure")
-	}
-
-	for _, key := range keys {
-		fileName := key.(string)
-		// Skip directory markers
-		if strings.HasSuffix(fileName, "/") {
-			continue
-		}
-
-		content, err := v.getVaultContent(username, fmt.Sprintf("%s/%s", dir, fileName))
-		if err != nil {
-			return fmt.Errorf("failed to get %s: %w", fileName, err)
-		}
-		mspData[fmt.Sprintf("%s/%s", dir, fileName)] = content
-	}
-	return nil
-}
-
-func (v *VaultStore) getVaultContent(username, path string) ([]byte, error) {
-	vaultPath := fmt.Sprintf("%s/data/users/%s/%s", v.kvPath, username, path)
-	secret, err := v.client.Logical().Read(vaultPath)
-	if err != nil {
-		return nil, fmt.Errorf("vault read failed: %w", err)
-	}
-	if secret == nil || secret.Data == nil {
-		return nil, fmt.Errorf("secret not found")
-	}
-
-	data, ok := secret.Data["data"].(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("invalid data format")
-	}
-
-	content, ok := data["content"].(string)
-	if !ok {
-		return nil, fmt.Errorf("content missing")
-	}
-
-	return []byte(content), nil
-}
+// Add handler function
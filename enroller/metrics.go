@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/hashicorp/vault/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "enroller_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "enroller_http_request_duration_seconds",
+		Help:    "HTTP request latency by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	caClientDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "enroller_ca_client_duration_seconds",
+		Help:    "Duration of the Fabric CA requests.",
+		Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"command", "result"})
+
+	caClientFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "enroller_ca_client_failures_total",
+		Help: "Failed Fabric CA requests.",
+	}, []string{"command"})
+
+	vaultRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "enroller_vault_request_duration_seconds",
+		Help:    "Latency of the Vault calls by operation.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "result"})
+
+	certificateExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enroller_certificate_expiry_timestamp_seconds",
+		Help: "Expiry of the enrolled signing certificates as a Unix timestamp.",
+	}, []string{"username"})
+
+	certificateRenewals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "enroller_certificate_renewals_total",
+		Help: "Certificate renewals by trigger (manual or scheduled) and result.",
+	}, []string{"trigger", "result"})
+
+	renewalLastScan = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "enroller_certificate_renewal_last_scan_timestamp_seconds",
+		Help: "Completion of the last scan for expiring certificates as a Unix timestamp.",
+	})
+)
+
+// metricsHandler serves the metrics in the Prometheus exposition format.
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// metricsMiddleware counts the requests and records their latency by route pattern.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		labels := prometheus.Labels{"route": route, "method": r.Method, "status": strconv.Itoa(status)}
+		httpRequests.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+func resultOf(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// caCall runs a Fabric CA request in its own span and records its latency. The request
+// is not recorded on the span since it may carry the secrets, and it is not cancelled
+// with ctx so that a registration is not left without its enrollment.
+func caCall(ctx context.Context, command string, call func(ctx context.Context) error) error {
+	ctx, span := tracer.Start(context.WithoutCancel(ctx), "fabric-ca "+command,
+		trace.WithAttributes(attribute.String("fabric_ca.command", command)))
+	start := time.Now()
+	err := call(ctx)
+	caClientDuration.WithLabelValues(command, resultOf(err)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		caClientFailures.WithLabelValues(command).Inc()
+	}
+	endSpan(span, err)
+	return err
+}
+
+// vaultCall runs a Vault call in its own span and records its latency. The call is not
+// cancelled with ctx so that an MSP is not left half written when the client goes away.
+func vaultCall(ctx context.Context, operation string, path string, call func(ctx context.Context) (*api.Secret, error)) (*api.Secret, error) {
+	ctx, span := tracer.Start(context.WithoutCancel(ctx), "vault "+operation,
+		trace.WithAttributes(attribute.String("vault.operation", operation), attribute.String("vault.path", path)))
+	start := time.Now()
+	secret, err := call(ctx)
+	vaultRequestDuration.WithLabelValues(operation, resultOf(err)).Observe(time.Since(start).Seconds())
+	endSpan(span, err)
+	return secret, err
+}
+
+func (v *vaultConnection) read(ctx context.Context, path string) (*api.Secret, error) {
+	return vaultCall(ctx, "read", path, func(ctx context.Context) (*api.Secret, error) {
+		return v.client.Logical().ReadWithContext(ctx, path)
+	})
+}
+
+func (v *vaultConnection) write(ctx context.Context, path string, data map[string]interface{}) (*api.Secret, error) {
+	return vaultCall(ctx, "write", path, func(ctx context.Context) (*api.Secret, error) {
+		return v.client.Logical().WriteWithContext(ctx, path, data)
+	})
+}
+
+func (v *vaultConnection) list(ctx context.Context, path string) (*api.Secret, error) {
+	return vaultCall(ctx, "list", path, func(ctx context.Context) (*api.Secret, error) {
+		return v.client.Logical().ListWithContext(ctx, path)
+	})
+}
+
+func (v *vaultConnection) delete(ctx context.Context, path string) (*api.Secret, error) {
+	return vaultCall(ctx, "delete", path, func(ctx context.Context) (*api.Secret, error) {
+		return v.client.Logical().DeleteWithContext(ctx, path)
+	})
+}
+
+// certificateNotAfter returns the expiry of the first certificate in certPEM.
+func certificateNotAfter(certPEM []byte) (time.Time, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return time.Time{}, errors.New("no PEM certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// observeCertificateExpiry sets the expiry gauge of username from the signcerts of its
+// MSP, keyed by their path in the MSP as returned by GetUserMSP.
+func observeCertificateExpiry(username string, mspData map[string][]byte) {
+	for path, content := range mspData {
+		if !strings.HasPrefix(path, "signcerts/") {
+			continue
+		}
+		notAfter, err := certificateNotAfter(content)
+		if err != nil {
+			log.Printf("Failed to parse signing certificate of %s: %v", username, err)
+			continue
+		}
+		certificateExpiry.WithLabelValues(username).Set(float64(notAfter.Unix()))
+		return
+	}
+}
+
+// loadCertificateExpiry sets the expiry gauges of the stored users, so that the gauges
+// survive a restart of the enroller.
+func loadCertificateExpiry(ctx context.Context, store MSPStore) {
+	usernames, err := store.List(ctx)
+	if err != nil {
+		log.Printf("Failed to list enrolled users: %v", err)
+		return
+	}
+
+	for _, username := range usernames {
+		mspData, err := store.Get(ctx, username)
+		if err != nil {
+			log.Printf("Failed to read MSP of %s: %v", username, err)
+			continue
+		}
+		observeCertificateExpiry(username, mspData)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/hyperledger/digital-identity/enroller/fabricca"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// Formats of GET /msp/{username}, selected by the format query parameter.
+const (
+	mspFormatJSON    = "json"
+	mspFormatZip     = "zip"
+	mspFormatTarGz   = "tar.gz"
+	mspFormatWallet  = "wallet"
+	mspFormatPKCS12  = "pkcs12"
+	mspFormatHeaders = "headers"
+)
+
+var (
+	errNoPrivateKey         = errors.New("MSP holds no private key, the user enrolled with a certificate request")
+	errKeyNotExportable     = errors.New("private key is held by a key provider and cannot be exported")
+	errPKCS12PasswordNeeded = errors.New("X-PKCS12-Password header is required")
+)
+
+// WalletIdentity is an X.509 identity of a fabric-gateway or Fabric SDK wallet.
+type WalletIdentity struct {
+	Credentials WalletCredentials `json:"credentials"`
+	MSPID       string            `json:"mspId"`
+	Type        string            `json:"type"`
+	Version     int               `json:"version"`
+}
+
+type WalletCredentials struct {
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"privateKey"`
+}
+
+// handleGetMSP returns the MSP of a user as JSON, the default, or in the format of the
+// format query parameter: zip or tar.gz of the MSP directory, wallet identity, PKCS#12,
+// or the headers of the gateway requests.
+func handleGetMSP(w http.ResponseWriter, r *http.Request, cfg *Config, store MSPStore) {
+	username := chi.URLParam(r, "username")
+	if username == "" {
+		renderError(w, r, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", mspFormatJSON, mspFormatZip, mspFormatTarGz, "tgz", mspFormatWallet, mspFormatPKCS12, "p12", mspFormatHeaders:
+	default:
+		renderError(w, r, fmt.Sprintf("Unsupported format %q, use json, zip, tar.gz, wallet, pkcs12 or headers", format), http.StatusBadRequest)
+		return
+	}
+
+	mspData, err := store.Get(r.Context(), username)
+	if err != nil {
+		renderError(w, r, fmt.Sprintf("Failed to retrieve MSP: %v", err), storeErrorStatus(err))
+		return
+	}
+	observeCertificateExpiry(username, mspData)
+
+	switch format {
+	case mspFormatZip:
+		writeMSPArchive(w, r, username+"-msp.zip", "application/zip", mspData, writeZip)
+	case mspFormatTarGz, "tgz":
+		writeMSPArchive(w, r, username+"-msp.tar.gz", "application/gzip", mspData, writeTarGz)
+	case mspFormatWallet:
+		handleWalletExport(w, r, cfg, mspData)
+	case mspFormatPKCS12, "p12":
+		handlePKCS12Export(w, r, username, mspData)
+	case mspFormatHeaders:
+		handleHeadersExport(w, r, cfg, mspData)
+	default:
+		// Convert []byte values to base64 for JSON serialization
+		response := make(map[string]string)
+		for path, content := range mspData {
+			response[path] = base64.StdEncoding.EncodeToString(content)
+		}
+
+		render.JSON(w, r, map[string]interface{}{
+			"username": username,
+			"msp":      response,
+		})
+	}
+}
+
+// mspIdentity returns the signing certificate and the keystore content of an MSP, empty
+// when the MSP holds no key.
+func mspIdentity(mspData map[string][]byte) (certPEM []byte, keystore []byte) {
+	for path, content := range mspData {
+		switch {
+		case strings.HasPrefix(path, "signcerts/"):
+			certPEM = content
+		case strings.HasPrefix(path, "keystore/"):
+			keystore = content
+		}
+	}
+	return certPEM, keystore
+}
+
+// exportableIdentity returns the signing certificate and the PEM private key of an MSP,
+// failing when the key is not held by the MSP.
+func exportableIdentity(mspData map[string][]byte) ([]byte, []byte, error) {
+	certPEM, keystore := mspIdentity(mspData)
+	if len(keystore) == 0 {
+		return nil, nil, errNoPrivateKey
+	}
+	if block, _ := pem.Decode(keystore); block == nil {
+		return nil, nil, errKeyNotExportable
+	}
+	return certPEM, keystore, nil
+}
+
+// exportErrorStatus returns the HTTP status of a failed MSP export.
+func exportErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNoPrivateKey), errors.Is(err, errKeyNotExportable):
+		return http.StatusConflict
+	case errors.Is(err, errPKCS12PasswordNeeded):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// sortedPaths returns the paths of the files of an MSP in order.
+func sortedPaths(mspData map[string][]byte) []string {
+	paths := make([]string, 0, len(mspData))
+	for path := range mspData {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// writeMSPArchive sends the MSP directory as an archive written by write, the files
+// under msp/.
+func writeMSPArchive(w http.ResponseWriter, r *http.Request, filename, contentType string, mspData map[string][]byte, write func(io.Writer, map[string][]byte) error) {
+	var archive bytes.Buffer
+	if err := write(&archive, mspData); err != nil {
+		renderError(w, r, fmt.Sprintf("Failed to write MSP archive: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Write(archive.Bytes())
+}
+
+// fileMode returns the mode of an MSP file, the keystore being readable by its owner only.
+func fileMode(path string) fs.FileMode {
+	if strings.HasPrefix(path, "keystore/") {
+		return 0o600
+	}
+	return 0o644
+}
+
+func writeZip(out io.Writer, mspData map[string][]byte) error {
+	archive := zip.NewWriter(out)
+	modified := time.Now().UTC()
+	for _, path := range sortedPaths(mspData) {
+		header := &zip.FileHeader{Name: "msp/" + path, Method: zip.Deflate, Modified: modified}
+		header.SetMode(fileMode(path))
+		file, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err = file.Write(mspData[path]); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func writeTarGz(out io.Writer, mspData map[string][]byte) error {
+	compressed := gzip.NewWriter(out)
+	archive := tar.NewWriter(compressed)
+	modified := time.Now().UTC()
+	directories := map[string]bool{}
+	for _, path := range sortedPaths(mspData) {
+		// The directories are listed so that they are not created with the umask of the reader
+		if dir, _, ok := strings.Cut(path, "/"); ok && !directories[dir] {
+			directories[dir] = true
+			if err := archive.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "msp/" + dir + "/", Mode: 0o755, ModTime: modified}); err != nil {
+				return err
+			}
+		}
+		if err := archive.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "msp/" + path,
+			Mode:     int64(fileMode(path)),
+			Size:     int64(len(mspData[path])),
+			ModTime:  modified,
+		}); err != nil {
+			return err
+		}
+		if _, err := archive.Write(mspData[path]); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+func handleWalletExport(w http.ResponseWriter, r *http.Request, cfg *Config, mspData map[string][]byte) {
+	certPEM, keyPEM, err := exportableIdentity(mspData)
+	if err != nil {
+		renderError(w, r, fmt.Sprintf("Failed to export wallet identity: %v", err), exportErrorStatus(err))
+		return
+	}
+	render.JSON(w, r, WalletIdentity{
+		Credentials: WalletCredentials{Certificate: string(certPEM), PrivateKey: string(keyPEM)},
+		MSPID:       cfg.MSPID,
+		Type:        "X.509",
+		Version:     1,
+	})
+}
+
+// handlePKCS12Export sends the certificate, the private key and the CA chain of the MSP
+// as a PKCS#12 file encrypted with the password of the X-PKCS12-Password header.
+func handlePKCS12Export(w http.ResponseWriter, r *http.Request, username string, mspData map[string][]byte) {
+	p12, err := encodePKCS12(mspData, r.Header.Get("X-PKCS12-Password"))
+	if err != nil {
+		renderError(w, r, fmt.Sprintf("Failed to export PKCS#12: %v", err), exportErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pkcs12")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", username+".p12"))
+	w.Write(p12)
+}
+
+func encodePKCS12(mspData map[string][]byte, password string) ([]byte, error) {
+	if password == "" {
+		return nil, errPKCS12PasswordNeeded
+	}
+	certPEM, keyPEM, err := exportableIdentity(mspData)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := fabricca.ParseCertificate(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing certificate: %w", err)
+	}
+	key, err := fabricca.ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	var chain []*x509.Certificate
+	for _, path := range sortedPaths(mspData) {
+		if !strings.HasPrefix(path, "cacerts/") && !strings.HasPrefix(path, "intermediatecerts/") {
+			continue
+		}
+		certs, err := parseCertificates(mspData[path])
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in %s: %w", path, err)
+		}
+		chain = append(chain, certs...)
+	}
+	return pkcs12.Modern.Encode(key, cert, chain, password)
+}
+
+// parseCertificates parses every PEM certificate of certPEM.
+func parseCertificates(certPEM []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for rest := certPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// handleHeadersExport returns the X-User-* headers of the gateway requests of the user.
+// The key may be a reference to a Transit or HSM key, which the gateway signs with.
+func handleHeadersExport(w http.ResponseWriter, r *http.Request, cfg *Config, mspData map[string][]byte) {
+	certPEM, keystore := mspIdentity(mspData)
+	if len(keystore) == 0 {
+		renderError(w, r, fmt.Sprintf("Failed to export gateway headers: %v", errNoPrivateKey), http.StatusConflict)
+		return
+	}
+	render.JSON(w, r, map[string]string{
+		"X-User-Cert":  base64.StdEncoding.EncodeToString(certPEM),
+		"X-User-Key":   base64.StdEncoding.EncodeToString(keystore),
+		"X-User-MSPID": cfg.MSPID,
+	})
+}
@@ -0,0 +1,265 @@
+//go:build pkcs11
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/miekg/pkcs11"
+)
+
+// oidNamedCurveP256 is the CKA_EC_PARAMS of a P-256 key.
+var oidNamedCurveP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+
+// pkcs11KeyIDLength is the length of the random CKA_ID of a key.
+const pkcs11KeyIDLength = 32
+
+// PKCS11Keys holds the keys of the users in a token of an HSM, as non-extractable P-256
+// keys labelled <prefix><username> and identified by a random CKA_ID. The keystore holds
+// a PKCS#11 URI of the key, and the ID in it is the credential the gateway signs with, so
+// it must not be derivable from the certificate as the SKI of the Fabric BCCSP is.
+type PKCS11Keys struct {
+	module *pkcs11.Ctx
+	slot   uint
+	token  string
+	prefix string
+}
+
+// newPKCS11Keys loads the PKCS#11 module at PKCS11_LIB and logs in to the token labelled
+// PKCS11_TOKEN_LABEL with PKCS11_PIN. The login lasts as long as the enroller.
+func newPKCS11Keys(cfg *Config) (KeyProvider, error) {
+	module := pkcs11.New(cfg.PKCS11Lib)
+	if module == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s", cfg.PKCS11Lib)
+	}
+	if err := module.Initialize(); err != nil {
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module: %w", err)
+	}
+	slot, err := findSlot(module, cfg.PKCS11TokenLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	// The session stays open so that the other sessions of the enroller share its login
+	session, err := module.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PKCS#11 session: %w", err)
+	}
+	if err = module.Login(session, pkcs11.CKU_USER, cfg.PKCS11Pin); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return nil, fmt.Errorf("PKCS#11 login failed: %w", err)
+	}
+	return &PKCS11Keys{module: module, slot: slot, token: cfg.PKCS11TokenLabel, prefix: cfg.PKCS11KeyPrefix}, nil
+}
+
+// findSlot returns the slot of the token labelled label.
+func findSlot(module *pkcs11.Ctx, label string) (uint, error) {
+	slots, err := module.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list PKCS#11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := module.GetTokenInfo(slot)
+		if err == nil && info.Label == label {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("PKCS#11 token %q not found", label)
+}
+
+// withSession runs call in a new session, PKCS#11 sessions not being safe for
+// concurrent use.
+func (p *PKCS11Keys) withSession(call func(session pkcs11.SessionHandle) error) error {
+	session, err := p.module.OpenSession(p.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return fmt.Errorf("failed to open PKCS#11 session: %w", err)
+	}
+	defer p.module.CloseSession(session)
+	return call(session)
+}
+
+func (p *PKCS11Keys) CreateKey(ctx context.Context, username string) (crypto.Signer, []byte, error) {
+	params, err := asn1.Marshal(oidNamedCurveP256)
+	if err != nil {
+		return nil, nil, err
+	}
+	label := p.prefix + username
+
+	var signer *pkcs11Signer
+	err = p.withSession(func(session pkcs11.SessionHandle) error {
+		id, err := p.module.GenerateRandom(session, pkcs11KeyIDLength)
+		if err != nil {
+			return fmt.Errorf("failed to generate the PKCS#11 key ID: %w", err)
+		}
+		publicHandle, _, err := p.module.GenerateKeyPair(session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)},
+			[]*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+				pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+				pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+				pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+				pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+				pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+				pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+			},
+			[]*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+				pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+				pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+				pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+				pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+				pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+				pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+				pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+				pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+			})
+		if err != nil {
+			return fmt.Errorf("PKCS#11 key generation failed: %w", err)
+		}
+
+		publicKey, err := p.publicKey(session, publicHandle)
+		if err != nil {
+			return err
+		}
+		signer = &pkcs11Signer{keys: p, id: id, label: label, publicKey: publicKey}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer, []byte(pkcs11KeyReference(p.token, signer.label, signer.id)), nil
+}
+
+func (p *PKCS11Keys) Signer(ctx context.Context, keystore []byte) (crypto.Signer, error) {
+	// Keys enrolled before KEY_PROVIDER=pkcs11 are still PEM private keys
+	if !isPKCS11KeyReference(keystore) {
+		return softwareKeys{}.Signer(ctx, keystore)
+	}
+	token, label, id, err := parsePKCS11KeyReference(string(keystore))
+	if err != nil {
+		return nil, err
+	}
+	if token != "" && token != p.token {
+		return nil, fmt.Errorf("key is held by PKCS#11 token %q, not %q", token, p.token)
+	}
+
+	var signer *pkcs11Signer
+	err = p.withSession(func(session pkcs11.SessionHandle) error {
+		handle, err := p.findKey(session, pkcs11.CKO_PUBLIC_KEY, id)
+		if err != nil {
+			return err
+		}
+		publicKey, err := p.publicKey(session, handle)
+		if err != nil {
+			return err
+		}
+		signer = &pkcs11Signer{keys: p, id: id, label: label, publicKey: publicKey}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// findKey returns the key of class with CKA_ID id.
+func (p *PKCS11Keys) findKey(session pkcs11.SessionHandle, class uint, id []byte) (pkcs11.ObjectHandle, error) {
+	if err := p.module.FindObjectsInit(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}); err != nil {
+		return 0, fmt.Errorf("PKCS#11 key lookup failed: %w", err)
+	}
+	handles, _, err := p.module.FindObjects(session, 1)
+	finalErr := p.module.FindObjectsFinal(session)
+	if err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("PKCS#11 key lookup failed: %w", err)
+	}
+	if len(handles) == 0 {
+		return 0, fmt.Errorf("PKCS#11 key %x not found", id)
+	}
+	return handles[0], nil
+}
+
+// publicKey reads the P-256 public key of handle.
+func (p *PKCS11Keys) publicKey(session pkcs11.SessionHandle, handle pkcs11.ObjectHandle) (*ecdsa.PublicKey, error) {
+	attributes, err := p.module.GetAttributeValue(session, handle, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil)})
+	if err != nil || len(attributes) == 0 {
+		return nil, fmt.Errorf("failed to read the PKCS#11 public key: %v", err)
+	}
+	// CKA_EC_POINT is the DER octet string of the uncompressed point
+	var point []byte
+	if _, err = asn1.Unmarshal(attributes[0].Value, &point); err != nil {
+		point = attributes[0].Value
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), point)
+	if x == nil {
+		return nil, errors.New("PKCS#11 key is not a P-256 key")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+func (p *PKCS11Keys) checks() []dependencyCheck {
+	return []dependencyCheck{{name: "hsm", check: p.tokenCheck}}
+}
+
+// tokenCheck reports whether the token is still present.
+func (p *PKCS11Keys) tokenCheck(ctx context.Context) CheckResult {
+	info, err := p.module.GetTokenInfo(p.slot)
+	if err != nil {
+		return checkResult(err, "")
+	}
+	return checkResult(nil, fmt.Sprintf("token %s, %s", info.Label, info.Model))
+}
+
+// pkcs11Signer signs digests with a private key of the token.
+type pkcs11Signer struct {
+	keys      *PKCS11Keys
+	id        []byte
+	label     string
+	publicKey *ecdsa.PublicKey
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign returns the ASN.1 ECDSA signature of a digest. CKM_ECDSA signs the digest as it is
+// and returns the concatenated R and S.
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var signature []byte
+	err := s.keys.withSession(func(session pkcs11.SessionHandle) error {
+		handle, err := s.keys.findKey(session, pkcs11.CKO_PRIVATE_KEY, s.id)
+		if err != nil {
+			return err
+		}
+		if err = s.keys.module.SignInit(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, handle); err != nil {
+			return fmt.Errorf("PKCS#11 sign failed: %w", err)
+		}
+		if signature, err = s.keys.module.Sign(session, digest); err != nil {
+			return fmt.Errorf("PKCS#11 sign failed: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(signature) == 0 || len(signature)%2 != 0 {
+		return nil, errors.New("invalid PKCS#11 ECDSA signature")
+	}
+	half := len(signature) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		R: new(big.Int).SetBytes(signature[:half]),
+		S: new(big.Int).SetBytes(signature[half:]),
+	})
+}
@@ -0,0 +1,10 @@
+//go:build !pkcs11
+
+package main
+
+import "errors"
+
+// newPKCS11Keys fails in an enroller built without the pkcs11 tag, PKCS#11 needing cgo.
+func newPKCS11Keys(cfg *Config) (KeyProvider, error) {
+	return nil, errors.New("the enroller was built without PKCS#11 support, build it with -tags pkcs11")
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/hyperledger/digital-identity/enroller/fabricca"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	renewalTriggerManual    = "manual"
+	renewalTriggerScheduled = "scheduled"
+
+	eventCertificateRenewed       = "certificate.renewed"
+	eventCertificateRenewalFailed = "certificate.renewal_failed"
+	eventCertificateExpiring      = "certificate.expiring"
+)
+
+var errNoKeystore = errors.New("user holds its own private key and must reenroll with a CSR")
+
+// RenewalEvent reports the renewal of the certificate of a user, or a certificate that
+// expires soon and that the enroller cannot renew.
+type RenewalEvent struct {
+	Type     string     `json:"type"`
+	Username string     `json:"username"`
+	Trigger  string     `json:"trigger,omitempty"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Time     time.Time  `json:"time"`
+}
+
+// renewalEvents logs the renewal events, adds them to the current span and posts them to
+// RENEWAL_WEBHOOK_URL when it is set.
+type renewalEvents struct {
+	webhookURL string
+	client     *http.Client
+}
+
+func newRenewalEvents(cfg *Config) *renewalEvents {
+	return &renewalEvents{
+		webhookURL: cfg.RenewalWebhookURL,
+		client: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+			Timeout:   10 * time.Second,
+		},
+	}
+}
+
+func (e *renewalEvents) emit(ctx context.Context, event RenewalEvent) {
+	event.Time = time.Now().UTC()
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode renewal event: %v", err)
+		return
+	}
+	log.Printf("Renewal event: %s", body)
+	trace.SpanFromContext(ctx).AddEvent(event.Type, trace.WithAttributes(
+		attribute.String("enroller.username", event.Username)))
+
+	if e.webhookURL == "" {
+		return
+	}
+	request, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodPost, e.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to post renewal event: %v", err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := e.client.Do(request)
+	if err != nil {
+		log.Printf("Failed to post renewal event: %v", err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode >= http.StatusMultipleChoices {
+		log.Printf("Renewal webhook answered %s", response.Status)
+	}
+}
+
+// reenrollUser renews the certificate of username with the stored certificate and key,
+// and stores the new certificate and a new key created by keys as a new version of its
+// MSP.
+func reenrollUser(ctx context.Context, ca *fabricca.Client, store MSPStore, keys KeyProvider, username string) (*fabricca.MSP, error) {
+	mspData, err := store.Get(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM, keystore := mspIdentity(mspData)
+	if len(keystore) == 0 {
+		return nil, errNoKeystore
+	}
+	if _, err = fabricca.ParseCertificate(certPEM); err != nil {
+		return nil, fmt.Errorf("invalid stored identity: %w", err)
+	}
+	signer, err := keys.Signer(ctx, keystore)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stored identity: %w", err)
+	}
+	id := &fabricca.Identity{Cert: certPEM, Key: signer}
+
+	key, err := newEnrollmentKey(ctx, keys, username)
+	if err != nil {
+		return nil, err
+	}
+	var msp *fabricca.MSP
+	err = caCall(ctx, "reenroll", func(ctx context.Context) (err error) {
+		msp, err = ca.Reenroll(ctx, id, fabricca.ReenrollmentRequest{CSR: key.csr})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reenrollment failed: %w", err)
+	}
+	key.addTo(msp)
+
+	files := msp.Files()
+	if err = store.Store(ctx, username, files); err != nil {
+		return nil, fmt.Errorf("MSP storage failed: %w", err)
+	}
+	observeCertificateExpiry(username, files)
+	return msp, nil
+}
+
+// renewCertificate reenrolls username and records the renewal.
+func renewCertificate(ctx context.Context, ca *fabricca.Client, store MSPStore, keys KeyProvider, events *renewalEvents, username, trigger string) (*fabricca.MSP, error) {
+	ctx, span := tracer.Start(ctx, "renew certificate", trace.WithAttributes(
+		attribute.String("enroller.username", username), attribute.String("enroller.renewal_trigger", trigger)))
+	msp, err := reenrollUser(ctx, ca, store, keys, username)
+	certificateRenewals.WithLabelValues(trigger, resultOf(err)).Inc()
+
+	event := RenewalEvent{Type: eventCertificateRenewed, Username: username, Trigger: trigger}
+	if err != nil {
+		event.Type = eventCertificateRenewalFailed
+		event.Error = err.Error()
+	} else if notAfter, err := certificateNotAfter(msp.SignCert); err == nil {
+		event.NotAfter = &notAfter
+	}
+	events.emit(ctx, event)
+
+	endSpan(span, err)
+	return msp, err
+}
+
+// reenrollErrorStatus returns the HTTP status of a failed reenrollment.
+func reenrollErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errMSPNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errNoKeystore):
+		return http.StatusConflict
+	}
+	return caErrorStatus(err)
+}
+
+func handleReenroll(w http.ResponseWriter, r *http.Request, ca *fabricca.Client, store MSPStore, keys KeyProvider, events *renewalEvents) {
+	username := chi.URLParam(r, "username")
+	if username == "" {
+		renderError(w, r, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	msp, err := renewCertificate(r.Context(), ca, store, keys, events, username, renewalTriggerManual)
+	if err != nil {
+		renderError(w, r, fmt.Sprintf("Reenrollment failed: %v", err), reenrollErrorStatus(err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"username": username,
+		"message":  "Certificate renewed and MSP stored successfully",
+	}
+	if notAfter, err := certificateNotAfter(msp.SignCert); err == nil {
+		response["not_after"] = notAfter
+	}
+	render.JSON(w, r, response)
+}
+
+// renewalScheduler renews every RENEWAL_INTERVAL the stored certificates that expire
+// within RENEWAL_WINDOW.
+type renewalScheduler struct {
+	ca       *fabricca.Client
+	store    MSPStore
+	keys     KeyProvider
+	events   *renewalEvents
+	interval time.Duration
+	window   time.Duration
+}
+
+func newRenewalScheduler(ca *fabricca.Client, store MSPStore, keys KeyProvider, events *renewalEvents) (*renewalScheduler, error) {
+	interval, err := time.ParseDuration(getEnvWithDefault("RENEWAL_INTERVAL", "1h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RENEWAL_INTERVAL: %w", err)
+	}
+	window, err := time.ParseDuration(getEnvWithDefault("RENEWAL_WINDOW", "720h"))
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("invalid RENEWAL_WINDOW")
+	}
+	return &renewalScheduler{ca: ca, store: store, keys: keys, events: events, interval: interval, window: window}, nil
+}
+
+// Run scans the store now and then every interval until ctx is done. A zero interval
+// disables the automatic renewal.
+func (s *renewalScheduler) Run(ctx context.Context) {
+	if s.interval <= 0 {
+		log.Println("Automatic certificate renewal disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			s.scan(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (s *renewalScheduler) scan(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "certificate renewal scan")
+
+	usernames, err := s.store.List(ctx)
+	if err != nil {
+		log.Printf("Failed to list enrolled users: %v", err)
+		endSpan(span, err)
+		return
+	}
+
+	for _, username := range usernames {
+		mspData, err := s.store.Get(ctx, username)
+		if err != nil {
+			log.Printf("Failed to read MSP of %s: %v", username, err)
+			continue
+		}
+		certPEM, keystore := mspIdentity(mspData)
+		notAfter, err := certificateNotAfter(certPEM)
+		if err != nil || time.Until(notAfter) > s.window {
+			continue
+		}
+
+		if len(keystore) == 0 {
+			// Enrolled with a CSR, only the holder of the key can renew it
+			s.events.emit(ctx, RenewalEvent{Type: eventCertificateExpiring, Username: username, NotAfter: &notAfter})
+			continue
+		}
+		renewCertificate(ctx, s.ca, s.store, s.keys, s.events, username, renewalTriggerScheduled)
+	}
+	renewalLastScan.SetToCurrentTime()
+	span.End()
+}
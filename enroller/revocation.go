@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/hyperledger/digital-identity/enroller/channelconfig"
+	"github.com/hyperledger/digital-identity/enroller/fabricca"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// revokedByEnroller is the requester of the revocations of the users whose registration
+// failed.
+const revokedByEnroller = "enroller"
+
+var revocationReasons = []string{
+	fabricca.ReasonUnspecified,
+	fabricca.ReasonKeyCompromise,
+	fabricca.ReasonCACompromise,
+	fabricca.ReasonAffiliationChange,
+	fabricca.ReasonSuperseded,
+	fabricca.ReasonCessationOfOperation,
+	fabricca.ReasonCertificateHold,
+	fabricca.ReasonRemoveFromCRL,
+	fabricca.ReasonPrivilegeWithdrawn,
+	fabricca.ReasonAACompromise,
+}
+
+// RevokedCertificate identifies a certificate revoked by the CA, its serial number and
+// authority key identifier in hex.
+type RevokedCertificate struct {
+	Serial string `json:"serial"`
+	AKI    string `json:"aki"`
+}
+
+func revokedCertificates(revoked *fabricca.RevocationResponse) []RevokedCertificate {
+	certs := make([]RevokedCertificate, 0, len(revoked.RevokedCerts))
+	for _, cert := range revoked.RevokedCerts {
+		certs = append(certs, RevokedCertificate{Serial: cert.Serial, AKI: cert.AKI})
+	}
+	return certs
+}
+
+// RevocationRecord is the audit record of the revocation of a user. RevokedBy is the
+// enroller or the address of the client of the request. The X-Forwarded-User header of the
+// request is recorded as sent, the enroller does not authenticate it.
+type RevocationRecord struct {
+	Username                string               `json:"username"`
+	RevokedBy               string               `json:"revoked_by"`
+	UnverifiedForwardedUser string               `json:"unverified_forwarded_user,omitempty"`
+	Time                    time.Time            `json:"time"`
+	Reason                  string               `json:"reason"`
+	Detail                  string               `json:"detail,omitempty"`
+	RevokedCerts            []RevokedCertificate `json:"revoked_certificates"`
+	MSPRemoved              bool                 `json:"msp_removed"`
+	Error                   string               `json:"error,omitempty"`
+}
+
+// revocationAudit logs the revocation records and appends them, one JSON object per
+// line, to the file at path when it is set.
+type revocationAudit struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newRevocationAudit(cfg *Config) *revocationAudit {
+	return &revocationAudit{path: cfg.RevocationAuditFile}
+}
+
+func (a *revocationAudit) record(ctx context.Context, record RevocationRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode revocation record: %w", err)
+	}
+	log.Printf("Revocation audit: %s", line)
+	trace.SpanFromContext(ctx).AddEvent("user.revoked", trace.WithAttributes(
+		attribute.String("enroller.username", record.Username),
+		attribute.String("enroller.revoked_by", record.RevokedBy)))
+
+	if a.path == "" {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open revocation audit file: %w", err)
+	}
+	defer file.Close()
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write revocation record: %w", err)
+	}
+	return file.Sync()
+}
+
+// revocation is a request to revoke a user.
+type revocation struct {
+	username      string
+	revokedBy     string
+	forwardedUser string
+	reason        string
+	detail        string
+}
+
+// revokeUser revokes every certificate of the user with the CA, deletes the MSP and
+// records the revocation. It returns the result of the CA, with its CRL, once the
+// certificates are revoked, even when the MSP could not be removed.
+func revokeUser(ctx context.Context, ca *fabricca.Client, store MSPStore, audit *revocationAudit, req revocation) (*fabricca.RevocationResponse, error) {
+	// Revoke using RCA admin MSP
+	log.Printf("Revoking %s: %s", req.username, req.detail)
+	var revoked *fabricca.RevocationResponse
+	err := caCall(ctx, "revoke", func(ctx context.Context) (err error) {
+		revoked, err = ca.Revoke(ctx, fabricca.RevocationRequest{Name: req.username, Reason: req.reason, GenCRL: true})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("revocation failed: %w", err)
+	}
+	certificateExpiry.DeleteLabelValues(req.username)
+
+	record := RevocationRecord{
+		Username:                req.username,
+		RevokedBy:               req.revokedBy,
+		UnverifiedForwardedUser: req.forwardedUser,
+		Time:                    time.Now().UTC(),
+		Reason:                  req.reason,
+		Detail:                  req.detail,
+		RevokedCerts:            revokedCertificates(revoked),
+		MSPRemoved:              true,
+	}
+	deleteErr := store.Delete(ctx, req.username)
+	if deleteErr != nil {
+		record.MSPRemoved = false
+		record.Error = deleteErr.Error()
+		deleteErr = fmt.Errorf("%w: %w", errMSPNotRemoved, deleteErr)
+	}
+	return revoked, errors.Join(deleteErr, audit.record(ctx, record))
+}
+
+// errMSPNotRemoved marks a revocation whose certificates were revoked but whose MSP was
+// left in the store.
+var errMSPNotRemoved = errors.New("certificates revoked but MSP not removed")
+
+// handleRevoke revokes a user for the reason of the reason query parameter, unspecified
+// by default. The requester recorded in the audit is the client address, with the
+// unverified X-Forwarded-User header of the request. The response carries the CRL update of
+// the channels of CHANNEL_CONFIG_DIR.
+func handleRevoke(w http.ResponseWriter, r *http.Request, cfg *Config, ca *fabricca.Client, store MSPStore, audit *revocationAudit, admin *channelconfig.SigningIdentity) {
+	username := chi.URLParam(r, "username")
+	if username == "" {
+		renderError(w, r, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = fabricca.ReasonUnspecified
+	}
+	if !slices.Contains(revocationReasons, reason) {
+		renderError(w, r, fmt.Sprintf("Unsupported revocation reason %q", reason), http.StatusBadRequest)
+		return
+	}
+	revoked, err := revokeUser(r.Context(), ca, store, audit, revocation{
+		username:      username,
+		revokedBy:     r.RemoteAddr,
+		forwardedUser: r.Header.Get("X-Forwarded-User"),
+		reason:        reason,
+		detail:        "admin revocation",
+	})
+	if revoked == nil {
+		renderError(w, r, fmt.Sprintf("Revocation failed: %v", err), caErrorStatus(err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"username":             username,
+		"message":              "User revoked and MSP removed successfully",
+		"revoked_certificates": revokedCertificates(revoked),
+		"crl":                  string(revoked.CRL),
+	}
+	if updates := channelCRLUpdates(cfg, admin, revoked.CRL); updates != nil {
+		response["channel_updates"] = updates
+	}
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		response["error"] = http.StatusText(http.StatusInternalServerError)
+		response["message"] = fmt.Sprintf("User revoked, but: %v", err)
+	}
+	render.JSON(w, r, response)
+}
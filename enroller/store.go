@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	mspStoreVault  = "vault"
+	mspStoreFile   = "file"
+	mspStoreMemory = "memory"
+
+	// maxMSPVersions is the number of versions kept by the file and memory stores, the
+	// default of Vault KV v2.
+	maxMSPVersions = 10
+)
+
+var errMSPNotFound = errors.New("MSP not found")
+
+// MSPStore stores the MSP of the enrolled users as files keyed by their path in the MSP
+// directory, such as signcerts/cert.pem.
+type MSPStore interface {
+	// Store stores files as the new version of the MSP of username, replacing the files
+	// of the previous version.
+	Store(ctx context.Context, username string, files map[string][]byte) error
+	// Get returns the files of the current MSP of username, or errMSPNotFound.
+	Get(ctx context.Context, username string) (map[string][]byte, error)
+	// List returns the users with an MSP.
+	List(ctx context.Context) ([]string, error)
+	// Delete deletes the MSP of username.
+	Delete(ctx context.Context, username string) error
+	// Versions returns the versions of the MSP of username, oldest first.
+	Versions(ctx context.Context, username string) ([]MSPVersion, error)
+}
+
+// MSPVersion is a stored version of an MSP.
+type MSPVersion struct {
+	Version     int       `json:"version"`
+	CreatedTime time.Time `json:"created_time"`
+}
+
+// dependencyCheck is a readiness check of a dependency of a store or key provider.
+type dependencyCheck struct {
+	name  string
+	check func(ctx context.Context) CheckResult
+}
+
+// checked is implemented by the stores and key providers with dependencies checked by
+// /readyz.
+type checked interface {
+	checks() []dependencyCheck
+}
+
+// newMSPStore returns the store selected by MSP_STORE, the Vault store using vault.
+func newMSPStore(cfg *Config, vault *vaultConnection) (MSPStore, error) {
+	switch cfg.MSPStore {
+	case mspStoreVault:
+		return NewVaultStore(vault, cfg.KVPath), nil
+	case mspStoreFile:
+		return NewFileStore(cfg.MSPStoreDir, cfg.MSPStoreKeyFile)
+	case mspStoreMemory:
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unsupported MSP_STORE %q, use vault, file or memory", cfg.MSPStore)
+}
+
+// mspVersion is a version of an MSP held by the file and memory stores.
+type mspVersion struct {
+	Version     int               `json:"version"`
+	CreatedTime time.Time         `json:"created_time"`
+	Files       map[string][]byte `json:"files"`
+}
+
+// mspHistory is the versions of an MSP, oldest first.
+type mspHistory []mspVersion
+
+func (h mspHistory) add(files map[string][]byte) mspHistory {
+	version := mspVersion{Version: 1, CreatedTime: time.Now().UTC(), Files: make(map[string][]byte, len(files))}
+	if len(h) > 0 {
+		version.Version = h[len(h)-1].Version + 1
+	}
+	for path, content := range files {
+		version.Files[path] = append([]byte(nil), content...)
+	}
+
+	h = append(h, version)
+	if len(h) > maxMSPVersions {
+		h = h[len(h)-maxMSPVersions:]
+	}
+	return h
+}
+
+func (h mspHistory) current() map[string][]byte {
+	files := make(map[string][]byte, len(h[len(h)-1].Files))
+	for path, content := range h[len(h)-1].Files {
+		files[path] = append([]byte(nil), content...)
+	}
+	return files
+}
+
+func (h mspHistory) versions() []MSPVersion {
+	versions := make([]MSPVersion, 0, len(h))
+	for _, version := range h {
+		versions = append(versions, MSPVersion{Version: version.Version, CreatedTime: version.CreatedTime})
+	}
+	return versions
+}
+
+// MemoryStore keeps the MSPs in memory until the enroller stops, for tests and local
+// development.
+type MemoryStore struct {
+	mu    sync.Mutex
+	users map[string]mspHistory
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{users: make(map[string]mspHistory)}
+}
+
+func (s *MemoryStore) Store(ctx context.Context, username string, files map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[username] = s.users[username].add(files)
+	return nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, username string) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, ok := s.users[username]
+	if !ok {
+		return nil, errMSPNotFound
+	}
+	return history.current(), nil
+}
+
+func (s *MemoryStore) List(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usernames := make([]string, 0, len(s.users))
+	for username := range s.users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, username)
+	return nil
+}
+
+func (s *MemoryStore) Versions(ctx context.Context, username string) ([]MSPVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, ok := s.users[username]
+	if !ok {
+		return nil, errMSPNotFound
+	}
+	return history.versions(), nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/api/auth/approle"
+	"github.com/hashicorp/vault/api/auth/kubernetes"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+const (
+	vaultAuthToken      = "token"
+	vaultAuthTokenFile  = "token-file"
+	vaultAuthKubernetes = "kubernetes"
+	vaultAuthAppRole    = "approle"
+
+	vaultLoginRetryDelay    = time.Second
+	maxVaultLoginRetryDelay = time.Minute
+)
+
+// vaultConnection is a Vault client logged in with VAULT_AUTH_METHOD, shared by the MSP
+// store and the Transit key provider.
+type vaultConnection struct {
+	client *api.Client
+	auth   *vaultAuth
+}
+
+// newVaultConnection logs in to VAULT_ADDR and keeps the token alive until ctx is done.
+func newVaultConnection(ctx context.Context, cfg *Config) (*vaultConnection, error) {
+	config := api.DefaultConfig()
+	config.Address = cfg.VaultAddr
+	// Vault requests carry the trace context of the enrollment
+	config.HttpClient.Transport = otelhttp.NewTransport(config.HttpClient.Transport)
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := newVaultAuth(cfg, client)
+	if err != nil {
+		return nil, err
+	}
+	auth.Start(ctx)
+
+	return &vaultConnection{client: client, auth: auth}, nil
+}
+
+func (v *vaultConnection) checks() []dependencyCheck {
+	return []dependencyCheck{
+		{name: "vaultSeal", check: v.sealCheck},
+		{name: "vaultAuth", check: v.auth.check},
+	}
+}
+
+// vaultAuth logs the enroller in to Vault with VAULT_AUTH_METHOD, renews its token in the
+// background and logs in again when the token can no longer be renewed.
+type vaultAuth struct {
+	client *api.Client
+	method string
+	// login returns the token of a new login, as the secret of the login or of the token
+	// lookup for static tokens.
+	login func(ctx context.Context) (*api.Secret, error)
+
+	mu            sync.Mutex
+	authenticated bool
+	expiresAt     time.Time
+	lastErr       error
+}
+
+func newVaultAuth(cfg *Config, client *api.Client) (*vaultAuth, error) {
+	a := &vaultAuth{client: client, method: cfg.VaultAuthMethod}
+
+	switch cfg.VaultAuthMethod {
+	case vaultAuthToken:
+		if cfg.VaultToken == "" {
+			return nil, errors.New("VAULT_TOKEN is required by the token auth method")
+		}
+		a.login = func(ctx context.Context) (*api.Secret, error) {
+			return a.lookupToken(ctx, cfg.VaultToken)
+		}
+	case vaultAuthTokenFile:
+		// The file is read on every login so that a token rotated by an agent is picked up
+		a.login = func(ctx context.Context) (*api.Secret, error) {
+			token, err := os.ReadFile(cfg.VaultTokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read token file: %w", err)
+			}
+			return a.lookupToken(ctx, strings.TrimSpace(string(token)))
+		}
+	case vaultAuthKubernetes:
+		if cfg.VaultRole == "" {
+			return nil, errors.New("VAULT_ROLE is required by the kubernetes auth method")
+		}
+		method, err := kubernetes.NewKubernetesAuth(cfg.VaultRole,
+			kubernetes.WithMountPath(vaultAuthMount(cfg)),
+			kubernetes.WithServiceAccountTokenPath(cfg.VaultK8sTokenPath))
+		if err != nil {
+			return nil, err
+		}
+		a.login = func(ctx context.Context) (*api.Secret, error) {
+			return client.Auth().Login(ctx, method)
+		}
+	case vaultAuthAppRole:
+		if cfg.VaultRoleID == "" {
+			return nil, errors.New("VAULT_ROLE_ID is required by the approle auth method")
+		}
+		method, err := approle.NewAppRoleAuth(cfg.VaultRoleID,
+			&approle.SecretID{FromFile: cfg.VaultSecretIDFile},
+			approle.WithMountPath(vaultAuthMount(cfg)))
+		if err != nil {
+			return nil, err
+		}
+		a.login = func(ctx context.Context) (*api.Secret, error) {
+			return client.Auth().Login(ctx, method)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported VAULT_AUTH_METHOD %q, use token, token-file, kubernetes or approle", cfg.VaultAuthMethod)
+	}
+	return a, nil
+}
+
+func vaultAuthMount(cfg *Config) string {
+	if cfg.VaultAuthMount != "" {
+		return cfg.VaultAuthMount
+	}
+	return cfg.VaultAuthMethod
+}
+
+// lookupToken sets a static token on the client and returns it as the secret of a login,
+// renewable when Vault says so.
+func (a *vaultAuth) lookupToken(ctx context.Context, token string) (*api.Secret, error) {
+	if token == "" {
+		return nil, errors.New("empty Vault token")
+	}
+	a.client.SetToken(token)
+
+	secret, err := a.client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("token lookup failed: %w", err)
+	}
+	renewable, _ := secret.TokenIsRenewable()
+	ttl, _ := secret.TokenTTL()
+	return &api.Secret{Auth: &api.SecretAuth{
+		ClientToken:   token,
+		Renewable:     renewable,
+		LeaseDuration: int(ttl.Seconds()),
+	}}, nil
+}
+
+// Start logs in, then keeps the token alive until ctx is done. The first login is
+// attempted before Start returns so that the enroller usually starts authenticated.
+func (a *vaultAuth) Start(ctx context.Context) {
+	secret, err := a.attemptLogin(ctx)
+
+	go func() {
+		delay := vaultLoginRetryDelay
+		for ctx.Err() == nil {
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+				delay = min(2*delay, maxVaultLoginRetryDelay)
+				secret, err = a.attemptLogin(ctx)
+				continue
+			}
+
+			delay = vaultLoginRetryDelay
+			a.keepAlive(ctx, secret)
+			secret, err = a.attemptLogin(ctx)
+		}
+	}()
+}
+
+func (a *vaultAuth) attemptLogin(ctx context.Context) (*api.Secret, error) {
+	secret, err := a.login(ctx)
+	if err == nil && (secret == nil || secret.Auth == nil) {
+		err = errors.New("login returned no token")
+	}
+	if err != nil {
+		log.Printf("Vault %s login failed: %v", a.method, err)
+		a.setState(nil, err)
+		return nil, err
+	}
+	log.Printf("Logged in to Vault with the %s auth method", a.method)
+	a.setState(secret, nil)
+	return secret, nil
+}
+
+// keepAlive renews the token of secret until it cannot be renewed any more or ctx is done.
+func (a *vaultAuth) keepAlive(ctx context.Context, secret *api.Secret) {
+	if !secret.Auth.Renewable {
+		if secret.Auth.LeaseDuration <= 0 {
+			// A token without TTL, such as a root token, never expires
+			<-ctx.Done()
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(secret.Auth.LeaseDuration) * time.Second):
+		}
+		return
+	}
+
+	watcher, err := a.client.NewLifetimeWatcher(&api.LifetimeWatcherInput{Secret: secret})
+	if err != nil {
+		log.Printf("Failed to watch the Vault token: %v", err)
+		return
+	}
+	go watcher.Start()
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				log.Printf("Vault token renewal failed, logging in again: %v", err)
+			} else {
+				log.Println("Vault token reached its max TTL, logging in again")
+			}
+			return
+		case renewal := <-watcher.RenewCh():
+			a.setState(renewal.Secret, nil)
+		}
+	}
+}
+
+func (a *vaultAuth) setState(secret *api.Secret, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.authenticated = err == nil
+	a.lastErr = err
+	a.expiresAt = time.Time{}
+	if secret != nil && secret.Auth != nil && secret.Auth.LeaseDuration > 0 {
+		a.expiresAt = time.Now().Add(time.Duration(secret.Auth.LeaseDuration) * time.Second)
+	}
+}
+
+// check reports the state of the Vault login and whether Vault still accepts the token.
+func (a *vaultAuth) check(ctx context.Context) CheckResult {
+	a.mu.Lock()
+	authenticated, lastErr, expiresAt := a.authenticated, a.lastErr, a.expiresAt
+	a.mu.Unlock()
+
+	if !authenticated {
+		err := errors.New("not logged in")
+		if lastErr != nil {
+			err = lastErr
+		}
+		return checkResult(fmt.Errorf("%s auth: %w", a.method, err), "")
+	}
+	if _, err := a.client.Auth().Token().LookupSelfWithContext(ctx); err != nil {
+		return checkResult(fmt.Errorf("%s auth: token lookup failed: %w", a.method, err), "")
+	}
+
+	message := fmt.Sprintf("%s auth, token valid", a.method)
+	if !expiresAt.IsZero() {
+		message = fmt.Sprintf("%s auth, token valid for %s", a.method, time.Until(expiresAt).Round(time.Second))
+	}
+	return checkResult(nil, message)
+}
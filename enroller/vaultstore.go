@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VaultStore keeps every file of an MSP in a secret of a KV v2 engine, at
+// users/<username>/<path>. The secrets version the files.
+type VaultStore struct {
+	*vaultConnection
+	kvPath string
+}
+
+func NewVaultStore(vault *vaultConnection, kvPath string) *VaultStore {
+	return &VaultStore{vaultConnection: vault, kvPath: kvPath}
+}
+
+// Store writes every file of the MSP of username, keyed by its path in the MSP
+// directory, then deletes the files of the previous version that files does not have.
+func (v *VaultStore) Store(ctx context.Context, username string, files map[string][]byte) error {
+	previous, err := v.files(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		vaultPath := fmt.Sprintf("%s/data/users/%s/%s", v.kvPath, username, path)
+		if _, err := v.write(ctx, vaultPath, map[string]interface{}{
+			"data": map[string]interface{}{
+				"content": base64.StdEncoding.EncodeToString(files[path]),
+			},
+		}); err != nil {
+			return fmt.Errorf("failed to store %s: %v", path, err)
+		}
+	}
+
+	for _, path := range previous {
+		if _, kept := files[path]; kept {
+			continue
+		}
+		if _, err := v.delete(ctx, fmt.Sprintf("%s/metadata/users/%s/%s", v.kvPath, username, path)); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+func (v *VaultStore) Get(ctx context.Context, username string) (map[string][]byte, error) {
+	paths, err := v.files(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, errMSPNotFound
+	}
+
+	mspData := make(map[string][]byte, len(paths))
+	for _, path := range paths {
+		content, err := v.getVaultContent(ctx, username, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s: %w", path, err)
+		}
+		mspData[path] = content
+	}
+	return mspData, nil
+}
+
+// List returns the users with an MSP in Vault.
+func (v *VaultStore) List(ctx context.Context) ([]string, error) {
+	keys, err := v.listKeys(ctx, v.kvPath+"/metadata/users")
+	if err != nil {
+		return nil, err
+	}
+
+	usernames := make([]string, 0, len(keys))
+	for _, key := range keys {
+		usernames = append(usernames, strings.TrimSuffix(key, "/"))
+	}
+	return usernames, nil
+}
+
+// Delete destroys every version of every file of the MSP of username and deletes their
+// metadata, then checks that no file is left. KV v2 keeps the nested paths of a
+// directory apart, so every file is destroyed on its own.
+func (v *VaultStore) Delete(ctx context.Context, username string) error {
+	paths, err := v.files(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := v.destroy(ctx, fmt.Sprintf("users/%s/%s", username, path)); err != nil {
+			return fmt.Errorf("failed to destroy %s: %w", path, err)
+		}
+	}
+
+	remaining, err := v.files(ctx, username)
+	if err != nil {
+		return fmt.Errorf("failed to check the deletion: %w", err)
+	}
+	if len(remaining) > 0 {
+		return fmt.Errorf("MSP files left after deletion: %s", strings.Join(remaining, ", "))
+	}
+	return nil
+}
+
+// destroy destroys every version of the secret at path, so that no version can be
+// undeleted, then deletes its metadata.
+func (v *VaultStore) destroy(ctx context.Context, path string) error {
+	metadata, err := v.read(ctx, fmt.Sprintf("%s/metadata/%s", v.kvPath, path))
+	if err != nil {
+		return fmt.Errorf("vault read failed: %w", err)
+	}
+	if metadata != nil && metadata.Data != nil {
+		versions, _ := metadata.Data["versions"].(map[string]interface{})
+		numbers := make([]int, 0, len(versions))
+		for key := range versions {
+			if number, err := strconv.Atoi(key); err == nil {
+				numbers = append(numbers, number)
+			}
+		}
+		sort.Ints(numbers)
+		if len(numbers) > 0 {
+			if _, err = v.write(ctx, fmt.Sprintf("%s/destroy/%s", v.kvPath, path), map[string]interface{}{
+				"versions": numbers,
+			}); err != nil {
+				return fmt.Errorf("vault destroy failed: %w", err)
+			}
+		}
+	}
+
+	if _, err = v.delete(ctx, fmt.Sprintf("%s/metadata/%s", v.kvPath, path)); err != nil {
+		return fmt.Errorf("vault deletion failed: %w", err)
+	}
+	return nil
+}
+
+// Versions returns the versions of the signing certificate of username, a new one being
+// written on every enrollment.
+func (v *VaultStore) Versions(ctx context.Context, username string) ([]MSPVersion, error) {
+	paths, err := v.files(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	signcert := ""
+	for _, path := range paths {
+		if strings.HasPrefix(path, "signcerts/") {
+			signcert = path
+			break
+		}
+	}
+	if signcert == "" {
+		return nil, errMSPNotFound
+	}
+
+	secret, err := v.read(ctx, fmt.Sprintf("%s/metadata/users/%s/%s", v.kvPath, username, signcert))
+	if err != nil {
+		return nil, fmt.Errorf("vault read failed: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, errMSPNotFound
+	}
+	metadata, _ := secret.Data["versions"].(map[string]interface{})
+
+	versions := make([]MSPVersion, 0, len(metadata))
+	for key, value := range metadata {
+		number, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		version := MSPVersion{Version: number}
+		if fields, ok := value.(map[string]interface{}); ok {
+			// Deleted and destroyed versions can no longer be read
+			if deleted, _ := fields["deletion_time"].(string); deleted != "" {
+				continue
+			}
+			if destroyed, _ := fields["destroyed"].(bool); destroyed {
+				continue
+			}
+			created, _ := fields["created_time"].(string)
+			version.CreatedTime, _ = time.Parse(time.RFC3339Nano, created)
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// files returns the paths of the files of the MSP of username, listing the directories
+// recursively.
+func (v *VaultStore) files(ctx context.Context, username string) ([]string, error) {
+	var paths []string
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		keys, err := v.listKeys(ctx, fmt.Sprintf("%s/metadata/users/%s/%s", v.kvPath, username, dir))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if strings.HasSuffix(key, "/") {
+				if err := walk(dir + key); err != nil {
+					return err
+				}
+				continue
+			}
+			paths = append(paths, dir+key)
+		}
+		return nil
+	}
+
+	if err := walk(""); err != nil {
+		return nil, fmt.Errorf("failed to list MSP files: %w", err)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// listKeys returns the keys under a metadata path, none when the path does not exist.
+func (v *VaultStore) listKeys(ctx context.Context, path string) ([]string, error) {
+	secret, err := v.list(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+
+	raw, ok := secret.Data["keys"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid directory structure")
+	}
+	keys := make([]string, 0, len(raw))
+	for _, key := range raw {
+		if name, ok := key.(string); ok {
+			keys = append(keys, name)
+		}
+	}
+	return keys, nil
+}
+
+func (v *VaultStore) getVaultContent(ctx context.Context, username, path string) ([]byte, error) {
+	vaultPath := fmt.Sprintf("%s/data/users/%s/%s", v.kvPath, username, path)
+	secret, err := v.read(ctx, vaultPath)
+	if err != nil {
+		return nil, fmt.Errorf("vault read failed: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("secret not found")
+	}
+
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid data format")
+	}
+
+	content, ok := data["content"].(string)
+	if !ok {
+		return nil, fmt.Errorf("content missing")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content encoding: %w", err)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"google.golang.org/grpc"
+)
+
+// authenticate returns the caller of the request as the peer sees it. GetCaller is signed
+// with the identity of the request and the peer validates the certificate against the
+// channel MSP, so the caller can be trusted for requests that are served without the
+// ledger. On failure the error response is written and ok is false.
+func authenticate(w http.ResponseWriter, r *http.Request, grpcConn *grpc.ClientConn) (*model.Caller, bool) {
+	gw, contract, ok := gatewayFromRequest(w, r, grpcConn)
+	if !ok {
+		return nil, false
+	}
+	defer gw.Close()
+
+	caller, err := callerOf(r.Context(), contract)
+	if err != nil {
+		respondChaincodeError(w, err)
+		return nil, false
+	}
+	return caller, true
+}
+
+// callerOf evaluates GetCaller with the identity of contract.
+func callerOf(ctx context.Context, contract *client.Contract) (*model.Caller, error) {
+	result, err := evaluateTransaction(ctx, contract, "GetCaller")
+	if err != nil {
+		return nil, err
+	}
+
+	var caller model.Caller
+	if err = json.Unmarshal(result, &caller); err != nil {
+		return nil, fmt.Errorf("error parsing caller: %w", err)
+	}
+	return &caller, nil
+}
+
+// authorizeRole checks that the caller has one of roles, read by the peer with the
+// GetCaller transaction.
+func authorizeRole(w http.ResponseWriter, r *http.Request, grpcConn *grpc.ClientConn, roles ...string) (*model.Caller, bool) {
+	caller, ok := authenticate(w, r, grpcConn)
+	if !ok {
+		return nil, false
+	}
+
+	for _, role := range roles {
+		if caller.Role == role {
+			return caller, true
+		}
+	}
+
+	respondJSON(w, http.StatusForbidden, map[string]interface{}{
+		"status":  http.StatusForbidden,
+		"code":    model.CodeForbidden,
+		"message": "submitting client not authorized, requires role " + strings.Join(roles, " or "),
+	})
+	return nil, false
+}
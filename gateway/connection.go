@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/elliptic"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
 	"fmt"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
 	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	_ "google.golang.org/grpc/keepalive"
+	"math/big"
 	"os"
+	"strings"
 )
 
 func newGrpcConnection() (*grpc.ClientConn, error) {
@@ -26,7 +34,10 @@ func newGrpcConnection() (*grpc.ClientConn, error) {
 	certPool.AddCert(certificate)
 	transportCredentials := credentials.NewClientTLSFromCert(certPool, gatewayPeer)
 
-	connection, err := grpc.NewClient(peerEndpoint, grpc.WithTransportCredentials(transportCredentials))
+	// The stats handler traces every gateway call and carries the trace context to the peer
+	connection, err := grpc.NewClient(peerEndpoint,
+		grpc.WithTransportCredentials(transportCredentials),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gRPC connection: %w", err)
 	}
@@ -34,7 +45,42 @@ func newGrpcConnection() (*grpc.ClientConn, error) {
 	return connection, nil
 }
 
-func newGatewayFromIdentity(grpcConn *grpc.ClientConn, certPEM, keyPEM, mspID string) (*client.Gateway, *client.Contract, error) {
+// newSign returns the signing function of the keystore content of a user: a PEM private
+// key, a reference to a Vault Transit key or the PKCS#11 URI of an HSM key of the user of
+// certificate.
+func newSign(ctx context.Context, keyBytes []byte, certificate *x509.Certificate) (identity.Sign, error) {
+	switch {
+	case strings.HasPrefix(string(keyBytes), transitKeyPrefix):
+		return newTransitSign(ctx, string(keyBytes))
+	case strings.HasPrefix(string(keyBytes), pkcs11KeyPrefix):
+		return newPKCS11Sign(string(keyBytes), certificate)
+	}
+
+	privateKey, err := identity.PrivateKeyFromPEM(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return identity.NewPrivateKeySign(privateKey)
+}
+
+// ecdsaSignature is the ASN.1 structure of an ECDSA signature.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// marshalLowS returns the ASN.1 signature of r and s with a low S value, the only one
+// Fabric accepts, as identity.NewPrivateKeySign does for the keys it holds.
+func marshalLowS(r, s *big.Int) ([]byte, error) {
+	order := elliptic.P256().Params().N
+	if s.Cmp(new(big.Int).Rsh(order, 1)) > 0 {
+		s = new(big.Int).Sub(order, s)
+	}
+	return asn1.Marshal(ecdsaSignature{R: r, S: s})
+}
+
+func newGatewayFromIdentity(ctx context.Context, grpcConn *grpc.ClientConn, certPEM, keyPEM, mspID string) (gw *client.Gateway, contract *client.Contract, err error) {
+	_, span := tracer.Start(ctx, "newGatewayFromIdentity", trace.WithAttributes(attribute.String("fabric.msp_id", mspID)))
+	defer func() { endSpan(span, err) }()
 
 	certBytes, err := base64.StdEncoding.DecodeString(certPEM)
 	if err != nil {
@@ -56,17 +102,12 @@ func newGatewayFromIdentity(grpcConn *grpc.ClientConn, certPEM, keyPEM, mspID st
 		return nil, nil, fmt.Errorf("failed to create identity: %w", err)
 	}
 
-	privateKey, err := identity.PrivateKeyFromPEM(keyBytes)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse private key: %w", err)
-	}
-
-	sign, err := identity.NewPrivateKeySign(privateKey)
+	sign, err := newSign(ctx, keyBytes, certificate)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create signer: %w", err)
 	}
 
-	gw, err := client.Connect(
+	gw, err = client.Connect(
 		id,
 		client.WithSign(sign),
 		client.WithClientConnection(grpcConn))
@@ -78,11 +119,48 @@ func newGatewayFromIdentity(grpcConn *grpc.ClientConn, certPEM, keyPEM, mspID st
 	chaincodeName := envOrDefault("CHAINCODE_NAME", "identity")
 
 	network := gw.GetNetwork(channelName)
-	contract := network.GetContract(chaincodeName)
+	contract = network.GetContract(chaincodeName)
 
 	return gw, contract, nil
 }
 
+// newServiceGateway connects with the gateway service identity mounted at CERT_PATH and
+// KEY_PATH. It is used to listen to the chaincode events and ping the peer, which need
+// no role.
+func newServiceGateway(grpcConn *grpc.ClientConn, options ...client.ConnectOption) (*client.Gateway, error) {
+	certPath := envOrDefault("CERT_PATH", "/etc/secret-volume/certPath")
+	keyPath := envOrDefault("KEY_PATH", "/etc/secret-volume/keyPath")
+	mspID := envOrDefault("MSP_ID", "Org1MSP")
+
+	certificate, err := loadCertificate(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := identity.NewX509Identity(mspID, certificate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create identity: %w", err)
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key file: %w", err)
+	}
+
+	privateKey, err := identity.PrivateKeyFromPEM(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	sign, err := identity.NewPrivateKeySign(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signer: %w", err)
+	}
+
+	options = append([]client.ConnectOption{client.WithSign(sign), client.WithClientConnection(grpcConn)}, options...)
+	return client.Connect(id, options...)
+}
+
 func loadCertificate(filename string) (*x509.Certificate, error) {
 	certificatePEM, err := os.ReadFile(filename)
 	if err != nil {
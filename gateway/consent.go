@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hyperledger/digital-identity/model"
+	"google.golang.org/grpc"
+)
+
+func grantConsentHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gw, contract, ok := gatewayFromRequest(w, r, grpcConn)
+		if !ok {
+			return
+		}
+		defer gw.Close()
+
+		// Parse request body
+		var request model.ConsentRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request body: " + err.Error(),
+			})
+			return
+		}
+
+		if isEmptyField(request.IdentityID) {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Identity ID is required",
+			})
+			return
+		}
+
+		if isEmptyField(request.MSPID) || (isEmptyField(request.ClientID) && isEmptyField(request.Role)) {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Relying party mspID and clientID or role are required",
+			})
+			return
+		}
+
+		if isEmptyField(request.Purpose) || isEmptyField(request.ExpiresAt) || len(request.Fields) == 0 {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Consent fields, purpose and expiresAt are required",
+			})
+			return
+		}
+
+		requestJSON, err := json.Marshal(request)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": "Error marshaling consent: " + err.Error(),
+			})
+			return
+		}
+
+		// Submit transaction
+		result, err := submitTransaction(r.Context(), contract, "GrantConsent", string(requestJSON))
+		if err != nil {
+			respondChaincodeError(w, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  http.StatusOK,
+			"message": "Consent granted successfully",
+			"consent": json.RawMessage(result),
+		})
+	}
+}
+
+func revokeConsentHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gw, contract, ok := gatewayFromRequest(w, r, grpcConn)
+		if !ok {
+			return
+		}
+		defer gw.Close()
+
+		// Parse request body
+		var request struct {
+			IdentityID string `json:"identityID"`
+			ConsentID  string `json:"consentID"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request body: " + err.Error(),
+			})
+			return
+		}
+
+		if isEmptyField(request.IdentityID) || isEmptyField(request.ConsentID) {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Identity ID and consent ID are required",
+			})
+			return
+		}
+
+		// Submit transaction
+		if _, err := submitTransaction(r.Context(), contract, "RevokeConsent", request.IdentityID, request.ConsentID); err != nil {
+			respondChaincodeError(w, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":    http.StatusOK,
+			"message":   "Consent revoked successfully",
+			"consentId": request.ConsentID,
+		})
+	}
+}
+
+func listConsentsHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+	return evaluateByIDHandler(grpcConn, "ListConsents", "consents")
+}
+
+func consentLedgerHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+	return evaluateByIDHandler(grpcConn, "GetConsentLedger", "events")
+}
+
+func accessLogHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+	return evaluateByIDHandler(grpcConn, "ListAccessLog", "accessLog")
+}
+
+// evaluateByIDHandler evaluates a chaincode query taking the identity id from the URL
+// and returns its JSON result under the given response key.
+func evaluateByIDHandler(grpcConn *grpc.ClientConn, transaction string, key string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gw, contract, ok := gatewayFromRequest(w, r, grpcConn)
+		if !ok {
+			return
+		}
+		defer gw.Close()
+
+		// Get ID from URL
+		id := chi.URLParam(r, "id")
+		if isEmptyField(id) {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Identity ID is required",
+			})
+			return
+		}
+
+		// Evaluate transaction
+		result, err := evaluateTransaction(r.Context(), contract, transaction, id)
+		if err != nil {
+			respondChaincodeError(w, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status": http.StatusOK,
+			key:      json.RawMessage(result),
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"google.golang.org/grpc"
+)
+
+// ErasureCertificate proves that an identity's PII was purged by the given committed transaction.
+type ErasureCertificate struct {
+	IdentityID  string          `json:"identityID"`
+	TxID        string          `json:"txID"`
+	BlockNumber uint64          `json:"blockNumber"`
+	Tombstone   json.RawMessage `json:"tombstone"`
+}
+
+func requestErasureHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gw, contract, ok := gatewayFromRequest(w, r, grpcConn)
+		if !ok {
+			return
+		}
+		defer gw.Close()
+
+		// Parse request body
+		var request struct {
+			ID     string `json:"id"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request body: " + err.Error(),
+			})
+			return
+		}
+
+		if isEmptyField(request.ID) || isEmptyField(request.Reason) {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Identity ID and reason are required",
+			})
+			return
+		}
+
+		// Submit transaction
+		if _, err := submitTransaction(r.Context(), contract, "RequestErasure", request.ID, request.Reason); err != nil {
+			respondChaincodeError(w, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  http.StatusOK,
+			"message": "Erasure requested, awaiting admin approval",
+			"assetId": request.ID,
+		})
+	}
+}
+
+// approveErasureHandler lets an admin approve a pending erasure request. The response carries
+// an erasure certificate with the transaction id and block number of the committed purge.
+func approveErasureHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gw, contract, ok := gatewayFromRequest(w, r, grpcConn)
+		if !ok {
+			return
+		}
+		defer gw.Close()
+
+		// Parse request body
+		var request struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request body: " + err.Error(),
+			})
+			return
+		}
+
+		if isEmptyField(request.ID) {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Identity ID is required",
+			})
+			return
+		}
+
+		// Submit transaction and wait for its commit to learn the block number
+		result, status, err := submitWithStatus(r.Context(), contract, "EraseIdentity", client.WithArguments(request.ID))
+		if err != nil {
+			respondChaincodeError(w, err)
+			return
+		}
+		if !status.Successful {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": fmt.Sprintf("Transaction %s failed to commit with status code %d", status.TransactionID, int32(status.Code)),
+			})
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  http.StatusOK,
+			"message": "Identity erased successfully",
+			"certificate": ErasureCertificate{
+				IdentityID:  request.ID,
+				TxID:        status.TransactionID,
+				BlockNumber: status.BlockNumber,
+				Tombstone:   json.RawMessage(result),
+			},
+		})
+	}
+}
+
+func tombstoneHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+	return evaluateByIDHandler(grpcConn, "GetTombstone", "tombstone")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"google.golang.org/grpc"
+)
+
+const (
+	checkpointStoreFile   = "file"
+	checkpointStoreMemory = "memory"
+
+	eventRetryDelay    = time.Second
+	maxEventRetryDelay = time.Minute
+)
+
+var consumerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// eventHandler processes a chaincode event. An event is checkpointed once its handler
+// returns nil, a failed event is delivered again.
+type eventHandler func(ctx context.Context, event *client.ChaincodeEvent) error
+
+// eventCheckpointer persists the position of an event consumer, the block in which the
+// next event is expected and the last processed transaction of that block.
+type eventCheckpointer interface {
+	client.Checkpoint
+	CheckpointChaincodeEvent(event *client.ChaincodeEvent) error
+	Close() error
+}
+
+// newCheckpointer returns the checkpointer of the consumer name in the store selected by
+// EVENT_CHECKPOINT_STORE.
+func newCheckpointer(store string, dir string, name string) (eventCheckpointer, error) {
+	switch store {
+	case checkpointStoreMemory:
+		return &memoryCheckpointer{InMemoryCheckpointer: new(client.InMemoryCheckpointer)}, nil
+	case checkpointStoreFile:
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create checkpoint directory: %w", err)
+		}
+		checkpointer, err := client.NewFileCheckpointer(filepath.Join(dir, name+".json"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open checkpoint of %s: %w", name, err)
+		}
+		return &fileCheckpointer{FileCheckpointer: checkpointer}, nil
+	}
+	return nil, fmt.Errorf("unsupported EVENT_CHECKPOINT_STORE %q, use file or memory", store)
+}
+
+// fileCheckpointer syncs every checkpoint to disk so that it survives a node failure.
+type fileCheckpointer struct {
+	*client.FileCheckpointer
+}
+
+func (c *fileCheckpointer) CheckpointChaincodeEvent(event *client.ChaincodeEvent) error {
+	if err := c.FileCheckpointer.CheckpointChaincodeEvent(event); err != nil {
+		return err
+	}
+	return c.Sync()
+}
+
+// memoryCheckpointer keeps the checkpoint until the gateway restarts, for development.
+type memoryCheckpointer struct {
+	*client.InMemoryCheckpointer
+}
+
+func (c *memoryCheckpointer) CheckpointChaincodeEvent(event *client.ChaincodeEvent) error {
+	c.InMemoryCheckpointer.CheckpointChaincodeEvent(event)
+	return nil
+}
+
+func (c *memoryCheckpointer) Close() error {
+	return nil
+}
+
+// eventConsumer is a registered event handler with its own checkpoint.
+type eventConsumer struct {
+	name         string
+	handle       eventHandler
+	checkpointer eventCheckpointer
+
+	mu          sync.Mutex
+	running     bool
+	lastEventAt time.Time
+	lastError   string
+}
+
+// ConsumerState is the checkpoint and status of an event consumer.
+type ConsumerState struct {
+	Name          string     `json:"name"`
+	Store         string     `json:"store"`
+	BlockNumber   uint64     `json:"blockNumber"`
+	TransactionID string     `json:"transactionID"`
+	Running       bool       `json:"running"`
+	LastEventAt   *time.Time `json:"lastEventAt,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+}
+
+// eventHub delivers the identity chaincode events to the registered consumers at least
+// once. Every consumer reads its own event stream from its checkpoint, so a restart or
+// a failing consumer resumes after the last event it processed.
+type eventHub struct {
+	grpcConn   *grpc.ClientConn
+	store      string
+	dir        string
+	startBlock *uint64
+
+	mu        sync.Mutex
+	consumers []*eventConsumer
+}
+
+func newEventHub(grpcConn *grpc.ClientConn) (*eventHub, error) {
+	hub := &eventHub{
+		grpcConn: grpcConn,
+		store:    envOrDefault("EVENT_CHECKPOINT_STORE", checkpointStoreFile),
+		dir:      envOrDefault("EVENT_CHECKPOINT_DIR", "/var/lib/gateway/checkpoints"),
+	}
+
+	// EVENT_START_BLOCK is where consumers without a checkpoint start, the next block
+	// committed when it is not set
+	if value, ok := os.LookupEnv("EVENT_START_BLOCK"); ok {
+		block, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EVENT_START_BLOCK: %w", err)
+		}
+		hub.startBlock = &block
+	}
+
+	return hub, nil
+}
+
+// register adds a consumer, resuming from its stored checkpoint.
+func (h *eventHub) register(name string, handle eventHandler) error {
+	if !consumerNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid event consumer name %q", name)
+	}
+
+	checkpointer, err := newCheckpointer(h.store, h.dir, name)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.consumers = append(h.consumers, &eventConsumer{name: name, handle: handle, checkpointer: checkpointer})
+	return nil
+}
+
+// Run delivers the events to the consumers until ctx is done. The events are read with
+// the gateway service identity.
+func (h *eventHub) Run(ctx context.Context) error {
+	h.mu.Lock()
+	consumers := append([]*eventConsumer(nil), h.consumers...)
+	h.mu.Unlock()
+	if len(consumers) == 0 {
+		return nil
+	}
+
+	gw, err := newServiceGateway(h.grpcConn)
+	if err != nil {
+		return fmt.Errorf("failed to connect the event listener: %w", err)
+	}
+
+	network := gw.GetNetwork(envOrDefault("CHANNEL_NAME", "mychannel"))
+	chaincodeName := envOrDefault("CHAINCODE_NAME", "identity")
+
+	var wg sync.WaitGroup
+	for _, consumer := range consumers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.consume(ctx, network, chaincodeName, consumer)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		for _, consumer := range consumers {
+			consumer.checkpointer.Close()
+		}
+		gw.Close()
+	}()
+	return nil
+}
+
+// consume delivers the events to a consumer, reading them again from its checkpoint
+// with a growing delay when the stream or the consumer fails.
+func (h *eventHub) consume(ctx context.Context, network *client.Network, chaincodeName string, consumer *eventConsumer) {
+	delay := eventRetryDelay
+	for ctx.Err() == nil {
+		delivered, err := h.deliver(ctx, network, chaincodeName, consumer)
+		if ctx.Err() != nil {
+			return
+		}
+		if delivered {
+			delay = eventRetryDelay
+		}
+
+		consumer.mu.Lock()
+		consumer.running = false
+		consumer.lastError = err.Error()
+		block := consumer.checkpointer.BlockNumber()
+		consumer.mu.Unlock()
+		log.Printf("Event consumer %s failed, resuming from block %d in %s: %v", consumer.name, block, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxEventRetryDelay)
+	}
+}
+
+// deliver reads the event stream from the consumer checkpoint until it fails and
+// reports whether any event was delivered.
+func (h *eventHub) deliver(ctx context.Context, network *client.Network, chaincodeName string, consumer *eventConsumer) (bool, error) {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var options []client.ChaincodeEventsOption
+	if h.startBlock != nil {
+		options = append(options, client.WithStartBlock(*h.startBlock))
+	}
+	// The checkpoint takes precedence over the start block once the consumer processed an event
+	options = append(options, client.WithCheckpoint(consumer.checkpointer))
+
+	consumer.mu.Lock()
+	events, err := network.ChaincodeEvents(streamCtx, chaincodeName, options...)
+	consumer.mu.Unlock()
+	if err != nil {
+		return false, fmt.Errorf("failed to start chaincode event listening: %w", err)
+	}
+
+	consumer.mu.Lock()
+	consumer.running = true
+	consumer.mu.Unlock()
+
+	delivered := false
+	for event := range events {
+		if err = consumer.handle(ctx, event); err != nil {
+			return delivered, fmt.Errorf("failed to process event %s of transaction %s: %w", event.EventName, event.TransactionID, err)
+		}
+		if err = consumer.checkpoint(event); err != nil {
+			return delivered, fmt.Errorf("failed to store checkpoint: %w", err)
+		}
+		delivered = true
+	}
+	return delivered, fmt.Errorf("event stream closed")
+}
+
+// checkpoint records the event as processed.
+func (c *eventConsumer) checkpoint(event *client.ChaincodeEvent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.checkpointer.CheckpointChaincodeEvent(event); err != nil {
+		return err
+	}
+	c.lastEventAt = time.Now().UTC()
+	c.lastError = ""
+	return nil
+}
+
+// states returns the checkpoint and status of every consumer.
+func (h *eventHub) states() []ConsumerState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	states := []ConsumerState{}
+	for _, consumer := range h.consumers {
+		consumer.mu.Lock()
+		state := ConsumerState{
+			Name:          consumer.name,
+			Store:         h.store,
+			BlockNumber:   consumer.checkpointer.BlockNumber(),
+			TransactionID: consumer.checkpointer.TransactionID(),
+			Running:       consumer.running,
+			LastError:     consumer.lastError,
+		}
+		if !consumer.lastEventAt.IsZero() {
+			lastEventAt := consumer.lastEventAt
+			state.LastEventAt = &lastEventAt
+		}
+		consumer.mu.Unlock()
+		states = append(states, state)
+	}
+	return states
+}
+
+// checkpointsHandler reports the checkpoint of every event consumer to admins.
+func (h *eventHub) checkpointsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorizeRole(w, r, h.grpcConn, model.RoleAdmin); !ok {
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":    http.StatusOK,
+			"consumers": h.states(),
+		})
+	}
+}
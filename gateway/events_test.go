@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+func TestCheckpointerResume(t *testing.T) {
+	events := []*client.ChaincodeEvent{
+		{BlockNumber: 4, TransactionID: "tx1", EventName: "IdentityCreated"},
+		{BlockNumber: 4, TransactionID: "tx2", EventName: "IdentityUpdated"},
+		{BlockNumber: 9, TransactionID: "tx3", EventName: "IdentityDeleted"},
+	}
+
+	tests := []struct {
+		store string
+		// persisted checkpoints are read again by a new checkpointer
+		persisted bool
+	}{
+		{checkpointStoreFile, true},
+		{checkpointStoreMemory, false},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		checkpointer, err := newCheckpointer(test.store, dir, "webhooks")
+		if err != nil {
+			t.Fatalf("%s checkpointer: %v", test.store, err)
+		}
+		if checkpointer.BlockNumber() != 0 || checkpointer.TransactionID() != "" {
+			t.Errorf("%s checkpointer starts at block %d transaction %q, want none", test.store, checkpointer.BlockNumber(), checkpointer.TransactionID())
+		}
+
+		for _, event := range events {
+			if err = checkpointer.CheckpointChaincodeEvent(event); err != nil {
+				t.Fatalf("%s checkpoint: %v", test.store, err)
+			}
+		}
+		// The next event is expected in the block of the last one, after its transaction
+		if checkpointer.BlockNumber() != 9 || checkpointer.TransactionID() != "tx3" {
+			t.Errorf("%s checkpoint at block %d transaction %q, want 9 tx3", test.store, checkpointer.BlockNumber(), checkpointer.TransactionID())
+		}
+		if err = checkpointer.Close(); err != nil {
+			t.Errorf("%s close: %v", test.store, err)
+		}
+
+		reopened, err := newCheckpointer(test.store, dir, "webhooks")
+		if err != nil {
+			t.Fatalf("%s reopen: %v", test.store, err)
+		}
+		wantBlock, wantTx := uint64(0), ""
+		if test.persisted {
+			wantBlock, wantTx = 9, "tx3"
+		}
+		if reopened.BlockNumber() != wantBlock || reopened.TransactionID() != wantTx {
+			t.Errorf("reopened %s checkpoint at block %d transaction %q, want %d %q", test.store, reopened.BlockNumber(), reopened.TransactionID(), wantBlock, wantTx)
+		}
+		reopened.Close()
+
+		// Every consumer has its own checkpoint
+		other, err := newCheckpointer(test.store, dir, "indexer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other.BlockNumber() != 0 {
+			t.Errorf("%s checkpoint of another consumer at block %d, want 0", test.store, other.BlockNumber())
+		}
+		other.Close()
+	}
+
+	if _, err := newCheckpointer("redis", t.TempDir(), "webhooks"); err == nil {
+		t.Error("unsupported store: no error")
+	}
+}
+
+func TestEventHubRegister(t *testing.T) {
+	dir := t.TempDir()
+	hub := &eventHub{store: checkpointStoreFile, dir: dir}
+
+	for _, name := range []string{"", "../webhooks", "web hooks"} {
+		if err := hub.register(name, nil); err == nil {
+			t.Errorf("register %q: no error", name)
+		}
+	}
+
+	// A consumer resumes from the checkpoint stored before a restart
+	checkpointer, err := newCheckpointer(checkpointStoreFile, dir, "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkpointer.CheckpointChaincodeEvent(&client.ChaincodeEvent{BlockNumber: 12, TransactionID: "tx5"}); err != nil {
+		t.Fatal(err)
+	}
+	checkpointer.Close()
+
+	handled := errors.New("handled")
+	if err = hub.register("webhooks", func(ctx context.Context, event *client.ChaincodeEvent) error { return handled }); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	states := hub.states()
+	if len(states) != 1 || states[0].Name != "webhooks" || states[0].Store != checkpointStoreFile ||
+		states[0].BlockNumber != 12 || states[0].TransactionID != "tx5" || states[0].Running || states[0].LastEventAt != nil {
+		t.Errorf("consumer states %+v", states)
+	}
+
+	// Checkpointing an event records it in the state and the file
+	consumer := hub.consumers[0]
+	if err = consumer.handle(context.Background(), nil); err != handled {
+		t.Errorf("registered handler returned %v", err)
+	}
+	consumer.lastError = "event stream closed"
+	if err = consumer.checkpoint(&client.ChaincodeEvent{BlockNumber: 13, TransactionID: "tx6"}); err != nil {
+		t.Fatal(err)
+	}
+	state := hub.states()[0]
+	if state.BlockNumber != 13 || state.TransactionID != "tx6" || state.LastEventAt == nil || state.LastError != "" {
+		t.Errorf("state after checkpoint %+v", state)
+	}
+	consumer.checkpointer.Close()
+
+	reopened, err := client.NewFileCheckpointer(filepath.Join(dir, "webhooks.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.BlockNumber() != 13 || reopened.TransactionID() != "tx6" {
+		t.Errorf("checkpoint file at block %d transaction %q, want 13 tx6", reopened.BlockNumber(), reopened.TransactionID())
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/common"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	exportStatusRunning   = "running"
+	exportStatusCompleted = "completed"
+	exportStatusFailed    = "failed"
+
+	exportPageSize = 500
+)
+
+// ExportManifest describes a completed export. The export is consistent with the ledger
+// at BlockHeight when Consistent is true, i.e. no block was committed while it was read.
+type ExportManifest struct {
+	JobID            string    `json:"jobId"`
+	Format           string    `json:"format"`
+	Location         string    `json:"location"`
+	Fields           []string  `json:"fields"`
+	Role             string    `json:"role"`
+	IncludeDeleted   bool      `json:"includeDeleted"`
+	Records          int       `json:"records"`
+	SHA256           string    `json:"sha256"`
+	Channel          string    `json:"channel"`
+	BlockHeight      uint64    `json:"blockHeight"`
+	StartBlockHeight uint64    `json:"startBlockHeight"`
+	Consistent       bool      `json:"consistent"`
+	Attempts         int       `json:"attempts"`
+	StartedAt        time.Time `json:"startedAt"`
+	CompletedAt      time.Time `json:"completedAt"`
+}
+
+// ExportJob is an export started by an admin or auditor.
+type ExportJob struct {
+	ID          string          `json:"id"`
+	Status      string          `json:"status"`
+	Format      string          `json:"format"`
+	Destination string          `json:"destination"`
+	Submitter   string          `json:"-"`
+	Records     int             `json:"records"`
+	Error       string          `json:"error,omitempty"`
+	Manifest    *ExportManifest `json:"manifest,omitempty"`
+}
+
+// exporter runs the export jobs. Jobs are kept in memory, an export interrupted by a
+// restart is started again.
+type exporter struct {
+	grpcConn    *grpc.ClientConn
+	maxAttempts int
+
+	mu   sync.Mutex
+	jobs map[string]*ExportJob
+}
+
+func newExporter(grpcConn *grpc.ClientConn) (*exporter, error) {
+	maxAttempts, err := strconv.Atoi(envOrDefault("EXPORT_MAX_ATTEMPTS", "3"))
+	if err != nil || maxAttempts <= 0 {
+		return nil, fmt.Errorf("invalid EXPORT_MAX_ATTEMPTS")
+	}
+
+	return &exporter{
+		grpcConn:    grpcConn,
+		maxAttempts: maxAttempts,
+		jobs:        make(map[string]*ExportJob),
+	}, nil
+}
+
+// exportHandler starts an export of the identities visible to the caller role. Admins
+// export every field, auditors the fields of model.AuditorFields.
+func (e *exporter) exportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Parse request body
+		var request struct {
+			Format         string   `json:"format"`
+			Destination    string   `json:"destination"`
+			Fields         []string `json:"fields"`
+			IncludeDeleted bool     `json:"includeDeleted"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request body: " + err.Error(),
+			})
+			return
+		}
+
+		if request.Format == "" {
+			request.Format = exportFormatNDJSON
+		}
+		if !isExportFormat(request.Format) {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Format must be one of ndjson, csv or parquet",
+			})
+			return
+		}
+
+		if request.Destination == "" {
+			request.Destination = exportDestinationLocal
+		}
+		if request.Destination != exportDestinationLocal && request.Destination != exportDestinationS3 {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Destination must be local or s3",
+			})
+			return
+		}
+
+		role, err := certRole(r.Header.Get("X-User-Cert"))
+		if err != nil {
+			respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"status":  http.StatusUnauthorized,
+				"message": "Invalid identity credentials: " + err.Error(),
+			})
+			return
+		}
+
+		fields, err := exportFields(role, request.Fields)
+		if err != nil {
+			respondJSON(w, http.StatusForbidden, map[string]interface{}{
+				"status":  http.StatusForbidden,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		if request.IncludeDeleted && role != model.RoleAdmin {
+			respondJSON(w, http.StatusForbidden, map[string]interface{}{
+				"status":  http.StatusForbidden,
+				"message": "Only admins can export deleted identities",
+			})
+			return
+		}
+
+		sink, err := newExportSink(request.Destination)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		gw, contract, ok := gatewayFromRequest(w, r, e.grpcConn)
+		if !ok {
+			return
+		}
+
+		caller, err := callerOf(r.Context(), contract)
+		if err != nil {
+			gw.Close()
+			respondChaincodeError(w, err)
+			return
+		}
+
+		id := make([]byte, 16)
+		if _, err = rand.Read(id); err != nil {
+			gw.Close()
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": "Error creating export job: " + err.Error(),
+			})
+			return
+		}
+
+		job := &ExportJob{
+			ID:          hex.EncodeToString(id),
+			Status:      exportStatusRunning,
+			Format:      request.Format,
+			Destination: request.Destination,
+			Submitter:   caller.ClientID,
+		}
+		e.mu.Lock()
+		e.jobs[job.ID] = job
+		e.mu.Unlock()
+
+		manifest := &ExportManifest{
+			JobID:          job.ID,
+			Format:         request.Format,
+			Fields:         fields,
+			Role:           role,
+			IncludeDeleted: request.IncludeDeleted,
+			Channel:        envOrDefault("CHANNEL_NAME", "mychannel"),
+		}
+		go e.run(job, manifest, sink, gw, contract)
+
+		respondJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status":  http.StatusAccepted,
+			"message": "Export started",
+			"job":     e.snapshot(job),
+		})
+	}
+}
+
+// exportJobHandler reports the progress of an export job and its manifest once completed,
+// to the client that started it as the peer authenticates it.
+func (e *exporter) exportJobHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := authenticate(w, r, e.grpcConn)
+		if !ok {
+			return
+		}
+
+		e.mu.Lock()
+		job, ok := e.jobs[chi.URLParam(r, "id")]
+		e.mu.Unlock()
+		if !ok || job.Submitter != caller.ClientID {
+			respondJSON(w, http.StatusNotFound, map[string]interface{}{
+				"status":  http.StatusNotFound,
+				"message": "export job not found",
+			})
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status": http.StatusOK,
+			"job":    e.snapshot(job),
+		})
+	}
+}
+
+func (e *exporter) snapshot(job *ExportJob) ExportJob {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return *job
+}
+
+// identityPager evaluates the page of ListIdentities that starts at bookmark.
+type identityPager func(bookmark string) ([]byte, error)
+
+// run writes the export with the identities and block height read by contract.
+func (e *exporter) run(job *ExportJob, manifest *ExportManifest, sink exportSink, gw *client.Gateway, contract *client.Contract) {
+	defer gw.Close()
+
+	network := gw.GetNetwork(manifest.Channel)
+	height := func() (uint64, error) {
+		return chainHeight(network, manifest.Channel)
+	}
+	pages := func(bookmark string) ([]byte, error) {
+		return evaluateTransaction(context.Background(), contract, "ListIdentities",
+			strconv.Itoa(exportPageSize), bookmark, strconv.FormatBool(manifest.IncludeDeleted))
+	}
+	e.export(job, manifest, sink, height, pages)
+}
+
+// export writes the export, starting again while blocks are committed during the export
+// so that the output matches the ledger at a single block height.
+func (e *exporter) export(job *ExportJob, manifest *ExportManifest, sink exportSink, height func() (uint64, error), pages identityPager) {
+	manifest.StartedAt = time.Now().UTC()
+
+	err := func() error {
+		for attempt := 1; ; attempt++ {
+			startHeight, err := height()
+			if err != nil {
+				return err
+			}
+
+			location, records, sum, err := e.write(job, manifest, sink, pages)
+			if err != nil {
+				return err
+			}
+
+			endHeight, err := height()
+			if err != nil {
+				return err
+			}
+
+			manifest.Location = location
+			manifest.Records = records
+			manifest.SHA256 = sum
+			manifest.StartBlockHeight = startHeight
+			manifest.BlockHeight = endHeight
+			manifest.Consistent = startHeight == endHeight
+			manifest.Attempts = attempt
+			if manifest.Consistent || attempt == e.maxAttempts {
+				break
+			}
+			log.Printf("Export %s read while blocks %d to %d were committed, exporting again", job.ID, startHeight, endHeight-1)
+		}
+
+		manifest.CompletedAt = time.Now().UTC()
+		return sink.writeManifest(job.ID, manifest)
+	}()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		job.Status = exportStatusFailed
+		job.Error = err.Error()
+		log.Printf("Export %s failed: %v", job.ID, err)
+		return
+	}
+	job.Status = exportStatusCompleted
+	job.Manifest = manifest
+}
+
+// write pages through ListIdentities and streams the redacted records to the sink.
+func (e *exporter) write(job *ExportJob, manifest *ExportManifest, sink exportSink, pages identityPager) (string, int, string, error) {
+	output, err := sink.create(job.ID, manifest.Format)
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	writer, err := newExportWriter(manifest.Format, output, manifest.Fields)
+	if err != nil {
+		output.Abort(err)
+		return "", 0, "", err
+	}
+
+	allowed := make(map[string]bool)
+	for _, field := range manifest.Fields {
+		allowed[field] = true
+	}
+
+	records := 0
+	bookmark := ""
+	for {
+		result, err := pages(bookmark)
+		if err != nil {
+			output.Abort(err)
+			return "", 0, "", fmt.Errorf("failed to list identities: %w", err)
+		}
+
+		var page model.IdentityPage
+		if err = json.Unmarshal(result, &page); err != nil {
+			output.Abort(err)
+			return "", 0, "", fmt.Errorf("failed to parse identities: %w", err)
+		}
+
+		for _, idnty := range page.Records {
+			redacted := idnty.Filter(allowed)
+			redacted.DeletedAt = idnty.DeletedAt
+			if err = writer.Write(redacted); err != nil {
+				output.Abort(err)
+				return "", 0, "", err
+			}
+			records++
+		}
+
+		e.mu.Lock()
+		job.Records = records
+		e.mu.Unlock()
+
+		if page.Bookmark == "" || page.Bookmark == bookmark || page.FetchedCount < exportPageSize {
+			break
+		}
+		bookmark = page.Bookmark
+	}
+
+	if err = writer.Close(); err != nil {
+		output.Abort(err)
+		return "", 0, "", err
+	}
+
+	location, sum, err := output.Commit()
+	if err != nil {
+		return "", 0, "", err
+	}
+	return location, records, sum, nil
+}
+
+// chainHeight returns the number of blocks of the channel ledger of the gateway peer.
+func chainHeight(network *client.Network, channel string) (uint64, error) {
+	result, err := network.GetContract("qscc").EvaluateTransaction("GetChainInfo", channel)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query chain info: %w", err)
+	}
+
+	var info common.BlockchainInfo
+	if err = proto.Unmarshal(result, &info); err != nil {
+		return 0, fmt.Errorf("failed to parse chain info: %w", err)
+	}
+	return info.GetHeight(), nil
+}
+
+// exportFields returns the fields the role exports, restricted to the requested ones.
+func exportFields(role string, requested []string) ([]string, error) {
+	visible := model.VisibleFields(role)
+	if len(visible) == 0 {
+		return nil, errors.New("submitting client not authorized to export identities, does not have admin or auditor role")
+	}
+
+	if len(requested) == 0 {
+		var fields []string
+		for _, field := range model.PIIFields {
+			if visible[field] {
+				fields = append(fields, field)
+			}
+		}
+		return fields, nil
+	}
+
+	for _, field := range requested {
+		if !visible[field] {
+			return nil, fmt.Errorf("field %s can not be exported with role %q", field, role)
+		}
+	}
+	return requested, nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	exportFormatNDJSON  = "ndjson"
+	exportFormatCSV     = "csv"
+	exportFormatParquet = "parquet"
+
+	exportDestinationLocal = "local"
+	exportDestinationS3    = "s3"
+)
+
+// attributesOID is the certificate extension holding the Fabric CA attributes.
+var attributesOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+var exportContentTypes = map[string]string{
+	exportFormatNDJSON:  "application/x-ndjson",
+	exportFormatCSV:     "text/csv",
+	exportFormatParquet: "application/vnd.apache.parquet",
+}
+
+func isExportFormat(format string) bool {
+	_, ok := exportContentTypes[format]
+	return ok
+}
+
+// exportSink stores the export files, on the local disk or in an S3 compatible bucket.
+type exportSink interface {
+	create(jobID string, format string) (exportOutput, error)
+	writeManifest(jobID string, manifest *ExportManifest) error
+}
+
+// exportOutput is an export file being written. Commit makes it visible under its final
+// name and returns its location and SHA-256, Abort discards it.
+type exportOutput interface {
+	io.Writer
+	Commit() (location string, sum string, err error)
+	Abort(err error)
+}
+
+func newExportSink(destination string) (exportSink, error) {
+	if destination == exportDestinationS3 {
+		return newS3Sink()
+	}
+	return newLocalSink()
+}
+
+func exportName(jobID string, format string) string {
+	return "identities-" + jobID + "." + format
+}
+
+func manifestName(jobID string) string {
+	return "identities-" + jobID + ".manifest.json"
+}
+
+// localSink writes the exports to EXPORT_DIR.
+type localSink struct {
+	dir string
+}
+
+func newLocalSink() (*localSink, error) {
+	dir := envOrDefault("EXPORT_DIR", "/var/lib/gateway/exports")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create export directory: %w", err)
+	}
+	return &localSink{dir: dir}, nil
+}
+
+func (s *localSink) create(jobID string, format string) (exportOutput, error) {
+	target := filepath.Join(s.dir, exportName(jobID, format))
+	file, err := os.OpenFile(target+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create export file: %w", err)
+	}
+	return &localOutput{file: file, target: target, hash: sha256.New()}, nil
+}
+
+func (s *localSink) writeManifest(jobID string, manifest *ExportManifest) error {
+	jsonByte, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir, manifestName(jobID)), jsonByte, 0o600)
+}
+
+type localOutput struct {
+	file   *os.File
+	target string
+	hash   hash.Hash
+}
+
+func (o *localOutput) Write(p []byte) (int, error) {
+	o.hash.Write(p)
+	return o.file.Write(p)
+}
+
+func (o *localOutput) Commit() (string, string, error) {
+	if err := o.file.Sync(); err != nil {
+		o.Abort(err)
+		return "", "", err
+	}
+	if err := o.file.Close(); err != nil {
+		os.Remove(o.file.Name())
+		return "", "", err
+	}
+	if err := os.Rename(o.file.Name(), o.target); err != nil {
+		return "", "", err
+	}
+	return o.target, hex.EncodeToString(o.hash.Sum(nil)), nil
+}
+
+func (o *localOutput) Abort(error) {
+	o.file.Close()
+	os.Remove(o.file.Name())
+}
+
+// s3Sink uploads the exports to an S3 compatible bucket such as MinIO.
+type s3Sink struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3Sink() (*s3Sink, error) {
+	endpoint := os.Getenv("EXPORT_S3_ENDPOINT")
+	bucket := os.Getenv("EXPORT_S3_BUCKET")
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("s3 exports are not configured, set EXPORT_S3_ENDPOINT and EXPORT_S3_BUCKET")
+	}
+
+	useSSL, err := strconv.ParseBool(envOrDefault("EXPORT_S3_USE_SSL", "true"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid EXPORT_S3_USE_SSL: %w", err)
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("EXPORT_S3_ACCESS_KEY"), os.Getenv("EXPORT_S3_SECRET_KEY"), ""),
+		Secure: useSSL,
+		Region: os.Getenv("EXPORT_S3_REGION"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+
+	return &s3Sink{client: client, bucket: bucket, prefix: envOrDefault("EXPORT_S3_PREFIX", "exports/")}, nil
+}
+
+func (s *s3Sink) create(jobID string, format string) (exportOutput, error) {
+	key := path.Join(s.prefix, exportName(jobID, format))
+	reader, writer := io.Pipe()
+	output := &s3Output{
+		writer:   writer,
+		hash:     sha256.New(),
+		location: "s3://" + s.bucket + "/" + key,
+		done:     make(chan error, 1),
+	}
+
+	// The object is streamed with a multipart upload while the export is written
+	go func() {
+		_, err := s.client.PutObject(context.Background(), s.bucket, key, reader, -1,
+			minio.PutObjectOptions{ContentType: exportContentTypes[format]})
+		reader.CloseWithError(err)
+		output.done <- err
+	}()
+
+	return output, nil
+}
+
+func (s *s3Sink) writeManifest(jobID string, manifest *ExportManifest) error {
+	jsonByte, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	key := path.Join(s.prefix, manifestName(jobID))
+	_, err = s.client.PutObject(context.Background(), s.bucket, key, bytes.NewReader(jsonByte), int64(len(jsonByte)),
+		minio.PutObjectOptions{ContentType: "application/json"})
+	if err != nil {
+		return fmt.Errorf("failed to upload export manifest: %w", err)
+	}
+	return nil
+}
+
+type s3Output struct {
+	writer   *io.PipeWriter
+	hash     hash.Hash
+	location string
+	done     chan error
+}
+
+func (o *s3Output) Write(p []byte) (int, error) {
+	o.hash.Write(p)
+	return o.writer.Write(p)
+}
+
+func (o *s3Output) Commit() (string, string, error) {
+	o.writer.Close()
+	if err := <-o.done; err != nil {
+		return "", "", fmt.Errorf("failed to upload export: %w", err)
+	}
+	return o.location, hex.EncodeToString(o.hash.Sum(nil)), nil
+}
+
+func (o *s3Output) Abort(err error) {
+	o.writer.CloseWithError(err)
+	<-o.done
+}
+
+// exportWriter encodes the redacted identities in the export format.
+type exportWriter interface {
+	Write(idnty *model.Identity) error
+	Close() error
+}
+
+func newExportWriter(format string, output io.Writer, fields []string) (exportWriter, error) {
+	switch format {
+	case exportFormatCSV:
+		writer := csv.NewWriter(output)
+		header := append(append([]string{"id"}, fields...), "deletedAt")
+		if err := writer.Write(header); err != nil {
+			return nil, err
+		}
+		return &csvExportWriter{writer: writer, fields: fields}, nil
+	case exportFormatParquet:
+		group := parquet.Group{
+			"id":        parquet.String(),
+			"deletedAt": parquet.Optional(parquet.String()),
+		}
+		for _, field := range fields {
+			group[field] = parquet.Optional(parquet.String())
+		}
+		schema := parquet.NewSchema("identity", group)
+		return &parquetExportWriter{writer: parquet.NewWriter(output, schema), fields: fields}, nil
+	}
+	return &ndjsonExportWriter{encoder: json.NewEncoder(output), fields: fields}, nil
+}
+
+// exportRecord returns the id, the exported fields and the deletion marker of the identity.
+func exportRecord(idnty *model.Identity, fields []string) map[string]interface{} {
+	values := idnty.Fields()
+	record := map[string]interface{}{"id": idnty.Id}
+	for _, field := range fields {
+		if *values[field] != "" {
+			record[field] = *values[field]
+		}
+	}
+	if idnty.DeletedAt != "" {
+		record["deletedAt"] = idnty.DeletedAt
+	}
+	return record
+}
+
+type ndjsonExportWriter struct {
+	encoder *json.Encoder
+	fields  []string
+}
+
+func (w *ndjsonExportWriter) Write(idnty *model.Identity) error {
+	return w.encoder.Encode(exportRecord(idnty, w.fields))
+}
+
+func (w *ndjsonExportWriter) Close() error {
+	return nil
+}
+
+type csvExportWriter struct {
+	writer *csv.Writer
+	fields []string
+}
+
+func (w *csvExportWriter) Write(idnty *model.Identity) error {
+	values := idnty.Fields()
+	row := []string{idnty.Id}
+	for _, field := range w.fields {
+		row = append(row, *values[field])
+	}
+	return w.writer.Write(append(row, idnty.DeletedAt))
+}
+
+func (w *csvExportWriter) Close() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+type parquetExportWriter struct {
+	writer *parquet.Writer
+	fields []string
+}
+
+func (w *parquetExportWriter) Write(idnty *model.Identity) error {
+	return w.writer.Write(exportRecord(idnty, w.fields))
+}
+
+func (w *parquetExportWriter) Close() error {
+	return w.writer.Close()
+}
+
+// certRole returns the identity.role attribute of the base64 encoded PEM certificate,
+// empty when the certificate carries no attributes.
+func certRole(certPEM string) (string, error) {
+	certBytes, err := base64.StdEncoding.DecodeString(certPEM)
+	if err != nil {
+		return "", err
+	}
+
+	block, _ := pem.Decode(certBytes)
+	if block == nil {
+		return "", errors.New("failed to decode certificate PEM")
+	}
+
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	for _, extension := range certificate.Extensions {
+		if !extension.Id.Equal(attributesOID) {
+			continue
+		}
+		var attributes struct {
+			Attrs map[string]string `json:"attrs"`
+		}
+		if err = json.Unmarshal(extension.Value, &attributes); err != nil {
+			return "", fmt.Errorf("failed to parse certificate attributes: %w", err)
+		}
+		return attributes.Attrs["identity.role"], nil
+	}
+	return "", nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/hyperledger/digital-identity/model"
+)
+
+// testPager serves the identities in pages of exportPageSize and counts the pages read.
+type testPager struct {
+	identities []*model.Identity
+	reads      int
+}
+
+func (p *testPager) page(bookmark string) ([]byte, error) {
+	p.reads++
+	start := 0
+	if bookmark != "" {
+		var err error
+		if start, err = strconv.Atoi(bookmark); err != nil {
+			return nil, err
+		}
+	}
+	end := start + exportPageSize
+	if end > len(p.identities) {
+		end = len(p.identities)
+	}
+	page := model.IdentityPage{Records: p.identities[start:end], FetchedCount: int32(end - start)}
+	if end < len(p.identities) {
+		page.Bookmark = strconv.Itoa(end)
+	}
+	return json.Marshal(page)
+}
+
+// testHeights returns the block heights in order, repeating the last one.
+func testHeights(heights ...uint64) func() (uint64, error) {
+	return func() (uint64, error) {
+		height := heights[0]
+		if len(heights) > 1 {
+			heights = heights[1:]
+		}
+		return height, nil
+	}
+}
+
+func testIdentities(count int) []*model.Identity {
+	var identities []*model.Identity
+	for i := 0; i < count; i++ {
+		identities = append(identities, &model.Identity{
+			Id:             "id" + strconv.Itoa(i),
+			FirstName:      "Jane Doe",
+			Phone:          "0123456789",
+			NationalID:     "1234567890",
+			Dob:            "1990-01-01",
+			Gender:         "female",
+			PresentAddress: "Dhaka",
+		})
+	}
+	return identities
+}
+
+// readExport decodes the ndjson export of the job.
+func readExport(t *testing.T, dir string, jobID string) []map[string]interface{} {
+	t.Helper()
+	file, err := os.ReadFile(filepath.Join(dir, exportName(jobID, exportFormatNDJSON)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid export record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestExportFields(t *testing.T) {
+	tests := []struct {
+		name      string
+		role      string
+		requested []string
+		want      []string
+		err       bool
+	}{
+		{"auditor", model.RoleAuditor, nil, []string{"dob", "presentAddress", "permanentAddress", "gender"}, false},
+		{"admin", model.RoleAdmin, nil, model.PIIFields, false},
+		{"requested", model.RoleAuditor, []string{"gender"}, []string{"gender"}, false},
+		{"auditor requests a name", model.RoleAuditor, []string{"dob", "firstName"}, nil, true},
+		{"unknown field", model.RoleAdmin, []string{"password"}, nil, true},
+		{"no role", "", nil, nil, true},
+	}
+	for _, test := range tests {
+		fields, err := exportFields(test.role, test.requested)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v, want error %v", test.name, err, test.err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(fields, test.want) {
+			t.Errorf("%s: fields = %v, want %v", test.name, fields, test.want)
+		}
+	}
+}
+
+func TestExportRedaction(t *testing.T) {
+	fields, err := exportFields(model.RoleAuditor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities := testIdentities(exportPageSize + 2)
+	identities[1].DeletedAt = "2024-05-01T10:00:00Z"
+	pager := &testPager{identities: identities}
+
+	dir := t.TempDir()
+	e := &exporter{maxAttempts: 1, jobs: map[string]*ExportJob{}}
+	job := &ExportJob{ID: "0a1b", Status: exportStatusRunning}
+	manifest := &ExportManifest{JobID: job.ID, Format: exportFormatNDJSON, Fields: fields, Role: model.RoleAuditor, IncludeDeleted: true}
+	e.export(job, manifest, &localSink{dir: dir}, testHeights(10), pager.page)
+
+	if job.Status != exportStatusCompleted || job.Records != len(identities) {
+		t.Fatalf("export job %+v", job)
+	}
+	if pager.reads != 2 {
+		t.Errorf("export read %d pages, want 2", pager.reads)
+	}
+
+	records := readExport(t, dir, job.ID)
+	if len(records) != len(identities) {
+		t.Fatalf("export holds %d records, want %d", len(records), len(identities))
+	}
+	for _, record := range records {
+		for _, field := range []string{"firstName", "phone", "nationalID"} {
+			if _, ok := record[field]; ok {
+				t.Errorf("auditor export of %v holds %s", record["id"], field)
+			}
+		}
+		if record["dob"] != "1990-01-01" || record["gender"] != "female" || record["presentAddress"] != "Dhaka" {
+			t.Errorf("auditor export record %v", record)
+		}
+	}
+	// The deletion marker of the soft-deleted identities is kept
+	if records[1]["deletedAt"] != "2024-05-01T10:00:00Z" {
+		t.Errorf("deleted record %v has no deletedAt", records[1])
+	}
+	if _, ok := records[0]["deletedAt"]; ok {
+		t.Errorf("record %v has a deletedAt", records[0])
+	}
+
+	file, err := os.ReadFile(filepath.Join(dir, exportName(job.ID, exportFormatNDJSON)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"Jane Doe", "0123456789", "1234567890"} {
+		if bytes.Contains(file, []byte(plain)) {
+			t.Errorf("auditor export holds %q", plain)
+		}
+	}
+}
+
+func TestExportConsistencyRetry(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxAttempts    int
+		heights        []uint64
+		wantAttempts   int
+		wantConsistent bool
+		wantStart      uint64
+		wantHeight     uint64
+	}{
+		{"stable", 3, []uint64{10}, 1, true, 10, 10},
+		{"block committed once", 3, []uint64{10, 11, 11, 11}, 2, true, 11, 11},
+		{"blocks always committed", 2, []uint64{10, 11, 12, 13}, 2, false, 12, 13},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		pager := &testPager{identities: testIdentities(3)}
+		e := &exporter{maxAttempts: test.maxAttempts, jobs: map[string]*ExportJob{}}
+		job := &ExportJob{ID: "0a1b", Status: exportStatusRunning}
+		manifest := &ExportManifest{JobID: job.ID, Format: exportFormatNDJSON, Fields: []string{"dob"}, Role: model.RoleAdmin}
+		e.export(job, manifest, &localSink{dir: dir}, testHeights(test.heights...), pager.page)
+
+		if job.Status != exportStatusCompleted {
+			t.Errorf("%s: job %s: %s", test.name, job.Status, job.Error)
+			continue
+		}
+		if manifest.Attempts != test.wantAttempts || manifest.Consistent != test.wantConsistent ||
+			manifest.StartBlockHeight != test.wantStart || manifest.BlockHeight != test.wantHeight {
+			t.Errorf("%s: manifest attempts %d consistent %v blocks %d to %d, want %d %v %d to %d", test.name,
+				manifest.Attempts, manifest.Consistent, manifest.StartBlockHeight, manifest.BlockHeight,
+				test.wantAttempts, test.wantConsistent, test.wantStart, test.wantHeight)
+		}
+		// Each attempt writes the export again
+		if pager.reads != test.wantAttempts {
+			t.Errorf("%s: %d pages read, want %d", test.name, pager.reads, test.wantAttempts)
+		}
+		if records := readExport(t, dir, job.ID); len(records) != 3 || manifest.Records != 3 {
+			t.Errorf("%s: export holds %d records, manifest %d, want 3", test.name, len(records), manifest.Records)
+		}
+
+		jsonByte, err := os.ReadFile(filepath.Join(dir, manifestName(job.ID)))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var written ExportManifest
+		if err = json.Unmarshal(jsonByte, &written); err != nil {
+			t.Fatalf("%s: invalid manifest: %v", test.name, err)
+		}
+		if written.Attempts != manifest.Attempts || written.Consistent != manifest.Consistent ||
+			written.BlockHeight != manifest.BlockHeight || written.SHA256 == "" || written.CompletedAt.IsZero() {
+			t.Errorf("%s: written manifest %+v", test.name, written)
+		}
+	}
+
+	// A failure reading the ledger fails the job
+	e := &exporter{maxAttempts: 3, jobs: map[string]*ExportJob{}}
+	job := &ExportJob{ID: "0c1d", Status: exportStatusRunning}
+	manifest := &ExportManifest{JobID: job.ID, Format: exportFormatNDJSON, Fields: []string{"dob"}}
+	failing := func(string) ([]byte, error) { return nil, errors.New("peer unavailable") }
+	e.export(job, manifest, &localSink{dir: t.TempDir()}, testHeights(10), failing)
+	if job.Status != exportStatusFailed || job.Error == "" || job.Manifest != nil {
+		t.Errorf("failed export job %+v", job)
+	}
+}
@@ -9,8 +9,15 @@ function launch_rest() {
 
     local tls_pem=$CHANNEL_MSP_DIR/peerOrganizations/$ORG/msp/tlscacerts/tlsca-signcert.pem
 
+    # identity used by the gateway to listen to the chaincode events
+    local identity_files=()
+    if [ -n "$GATEWAY_MSP_DIR" ]; then
+      identity_files=(--from-file=certPath="$GATEWAY_MSP_DIR/signcerts/cert.pem" \
+        --from-file=keyPath="$(ls $GATEWAY_MSP_DIR/keystore/*_sk | head -1)")
+    fi
+
     echo "creating rest secret gateway-tls-cert"
-    kubectl create secret generic gateway-tls-cert --from-file=tlsCertPath="$tls_pem" -n $WORKSHOP_NAMESPACE
+    kubectl create secret generic gateway-tls-cert --from-file=tlsCertPath="$tls_pem" "${identity_files[@]}" -n $WORKSHOP_NAMESPACE
     #build docker image and push to local registry
     echo "building restapi docker image"
     docker build -t localhost:5000/rest-api .
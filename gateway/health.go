@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	checkOK     = "ok"
+	checkFailed = "failed"
+)
+
+// CheckResult is the state of a dependency reported by /readyz.
+type CheckResult struct {
+	Status    string     `json:"status"`
+	Message   string     `json:"message,omitempty"`
+	CheckedAt *time.Time `json:"checkedAt,omitempty"`
+}
+
+// healthChecker reports the readiness of the gateway. The peer is pinged periodically
+// rather than on every probe, so that probes do not load the peer.
+type healthChecker struct {
+	grpcConn *grpc.ClientConn
+	interval time.Duration
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	ping CheckResult
+}
+
+func newHealthChecker(grpcConn *grpc.ClientConn) (*healthChecker, error) {
+	interval, err := time.ParseDuration(envOrDefault("READINESS_PING_INTERVAL", "30s"))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid READINESS_PING_INTERVAL")
+	}
+	timeout, err := time.ParseDuration(envOrDefault("READINESS_PING_TIMEOUT", "5s"))
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid READINESS_PING_TIMEOUT")
+	}
+
+	return &healthChecker{
+		grpcConn: grpcConn,
+		interval: interval,
+		timeout:  timeout,
+		ping:     CheckResult{Status: checkFailed, Message: "peer not pinged yet"},
+	}, nil
+}
+
+// Run pings the peer every interval until ctx is done.
+func (h *healthChecker) Run(ctx context.Context) {
+	go func() {
+		var gw *client.Gateway
+		defer func() {
+			if gw != nil {
+				gw.Close()
+			}
+		}()
+
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			gw = h.pingPeer(gw)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// pingPeer evaluates the chain info of the channel with the gateway service identity and
+// records the result. The gateway connection is kept for the next ping.
+func (h *healthChecker) pingPeer(gw *client.Gateway) *client.Gateway {
+	var err error
+	if gw == nil {
+		gw, err = newServiceGateway(h.grpcConn, client.WithEvaluateTimeout(h.timeout))
+		if err != nil {
+			h.record(CheckResult{Status: checkFailed, Message: "failed to connect the service identity: " + err.Error()})
+			return nil
+		}
+	}
+
+	channelName := envOrDefault("CHANNEL_NAME", "mychannel")
+	height, err := chainHeight(gw.GetNetwork(channelName), channelName)
+	if err != nil {
+		h.record(CheckResult{Status: checkFailed, Message: err.Error()})
+		return gw
+	}
+	h.record(CheckResult{Status: checkOK, Message: fmt.Sprintf("channel %s at height %d", channelName, height)})
+	return gw
+}
+
+func (h *healthChecker) record(result CheckResult) {
+	checkedAt := time.Now().UTC()
+	result.CheckedAt = &checkedAt
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if result.Status != checkOK && h.ping.Status == checkOK {
+		log.Printf("Peer ping failed: %s", result.Message)
+	}
+	h.ping = result
+}
+
+// grpcCheck reports the state of the gRPC connection to the peer. An idle connection is
+// ready to be used, it connects on the next call.
+func (h *healthChecker) grpcCheck() CheckResult {
+	state := h.grpcConn.GetState()
+	switch state {
+	case connectivity.Ready, connectivity.Idle:
+		return CheckResult{Status: checkOK, Message: state.String()}
+	}
+	return CheckResult{Status: checkFailed, Message: state.String()}
+}
+
+// livenessHandler reports that the gateway process serves requests.
+func (h *healthChecker) livenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  http.StatusOK,
+			"message": "alive",
+		})
+	}
+}
+
+// readinessHandler reports the gRPC connection state and the last peer ping, the gateway
+// is ready when both are ok. The ping fails when it is older than three intervals, for
+// instance when the ping itself hangs.
+func (h *healthChecker) readinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		ping := h.ping
+		h.mu.Unlock()
+		if ping.Status == checkOK && time.Since(*ping.CheckedAt) > 3*h.interval {
+			ping.Status = checkFailed
+			ping.Message = "last successful ping is stale"
+		}
+
+		checks := map[string]CheckResult{
+			"grpc": h.grpcCheck(),
+			"peer": ping,
+		}
+
+		status := http.StatusOK
+		for _, check := range checks {
+			if check.Status != checkOK {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		respondJSON(w, status, map[string]interface{}{
+			"status": status,
+			"checks": checks,
+		})
+	}
+}
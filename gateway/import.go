@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"google.golang.org/grpc"
+)
+
+const (
+	importFormatCSV    = "csv"
+	importFormatNDJSON = "ndjson"
+
+	maxImportBodySize = 64 << 20
+)
+
+// importer runs the bulk import jobs. Rows are submitted to CreateIdentities in batches
+// by a bounded number of concurrent workers.
+type importer struct {
+	grpcConn    *grpc.ClientConn
+	regions     *regionCache
+	store       *jobStore
+	batchSize   int
+	concurrency int
+}
+
+func newImporter(grpcConn *grpc.ClientConn, regions *regionCache) (*importer, error) {
+	store, err := newJobStore(envOrDefault("IMPORT_JOBS_DIR", "/var/lib/gateway/imports"),
+		envOrDefault("IMPORT_JOBS_KEY_FILE", "/etc/gateway/import-jobs.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	batchSize, err := strconv.Atoi(envOrDefault("IMPORT_BATCH_SIZE", "100"))
+	if err != nil || batchSize <= 0 {
+		return nil, fmt.Errorf("invalid IMPORT_BATCH_SIZE")
+	}
+
+	concurrency, err := strconv.Atoi(envOrDefault("IMPORT_CONCURRENCY", "4"))
+	if err != nil || concurrency <= 0 {
+		return nil, fmt.Errorf("invalid IMPORT_CONCURRENCY")
+	}
+
+	return &importer{
+		grpcConn:    grpcConn,
+		regions:     regions,
+		store:       store,
+		batchSize:   batchSize,
+		concurrency: concurrency,
+	}, nil
+}
+
+// batchImportHandler starts an import of the CSV or NDJSON identities in the request body.
+// Every row is validated before the job starts, invalid rows are reported without being submitted.
+func (i *importer) batchImportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gw, contract, ok := gatewayFromRequest(w, r, i.grpcConn)
+		if !ok {
+			return
+		}
+
+		format, err := importFormat(r)
+		if err != nil {
+			gw.Close()
+			respondJSON(w, http.StatusUnsupportedMediaType, map[string]interface{}{
+				"status":  http.StatusUnsupportedMediaType,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		identities, err := parseImport(format, http.MaxBytesReader(w, r.Body, maxImportBodySize))
+		if err != nil {
+			gw.Close()
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request body: " + err.Error(),
+			})
+			return
+		}
+
+		if len(identities) == 0 {
+			gw.Close()
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "No identities to import",
+			})
+			return
+		}
+
+		validator, err := i.regions.newValidator(r.Context(), contract)
+		if err != nil {
+			gw.Close()
+			respondChaincodeError(w, err)
+			return
+		}
+
+		caller, err := callerOf(r.Context(), contract)
+		if err != nil {
+			gw.Close()
+			respondChaincodeError(w, err)
+			return
+		}
+
+		job := &ImportJob{
+			Format:    format,
+			Submitter: caller.ClientID,
+			Rows:      validateImport(validator, identities),
+		}
+		if err = i.store.create(job); err != nil {
+			gw.Close()
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": "Error creating import job: " + err.Error(),
+			})
+			return
+		}
+
+		go i.run(job.ID, gw, contract)
+
+		summary, _ := i.store.get(job.ID)
+		respondJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status":  http.StatusAccepted,
+			"message": "Import started",
+			"job":     summary,
+		})
+	}
+}
+
+// jobHandler reports the progress of an import job.
+func (i *importer) jobHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := i.authorizedJob(w, r)
+		if !ok {
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status": http.StatusOK,
+			"job":    job,
+		})
+	}
+}
+
+// reportHandler lists the outcome of every row of an import job. The status query
+// parameter filters the rows, e.g. status=failed.
+func (i *importer) reportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := i.authorizedJob(w, r)
+		if !ok {
+			return
+		}
+
+		rows, err := i.store.report(job.ID, r.URL.Query().Get("status"))
+		if err != nil {
+			respondJSON(w, http.StatusNotFound, map[string]interface{}{
+				"status":  http.StatusNotFound,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status": http.StatusOK,
+			"job":    job,
+			"rows":   rows,
+		})
+	}
+}
+
+// resumeHandler continues an interrupted import job with the credentials of the request.
+func (i *importer) resumeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := i.authorizedJob(w, r)
+		if !ok {
+			return
+		}
+
+		gw, contract, ok := gatewayFromRequest(w, r, i.grpcConn)
+		if !ok {
+			return
+		}
+
+		if err := i.store.resume(job.ID); err != nil {
+			gw.Close()
+			respondJSON(w, http.StatusConflict, map[string]interface{}{
+				"status":  http.StatusConflict,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		go i.run(job.ID, gw, contract)
+
+		summary, _ := i.store.get(job.ID)
+		respondJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status":  http.StatusAccepted,
+			"message": "Import resumed",
+			"job":     summary,
+		})
+	}
+}
+
+// authorizedJob returns the job of the URL when it was started by the client of the request,
+// as the peer authenticates it.
+func (i *importer) authorizedJob(w http.ResponseWriter, r *http.Request) (*ImportJob, bool) {
+	caller, ok := authenticate(w, r, i.grpcConn)
+	if !ok {
+		return nil, false
+	}
+
+	job, err := i.store.get(chi.URLParam(r, "id"))
+	if err != nil || job.Submitter != caller.ClientID {
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{
+			"status":  http.StatusNotFound,
+			"message": errJobNotFound.Error(),
+		})
+		return nil, false
+	}
+
+	return job, true
+}
+
+// run submits the pending rows of the job until every row is processed or a batch
+// fails for a reason other than the rejection of its identities.
+func (i *importer) run(jobID string, gw *client.Gateway, contract *client.Contract) {
+	defer gw.Close()
+
+	var batches [][]*ImportRow
+	err := i.store.update(jobID, func(job *ImportJob) error {
+		var batch []*ImportRow
+		for _, row := range job.Rows {
+			if row.Status != rowStatusPending {
+				continue
+			}
+			batch = append(batch, row)
+			if len(batch) == i.batchSize {
+				batches = append(batches, batch)
+				batch = nil
+			}
+		}
+		if len(batch) > 0 {
+			batches = append(batches, batch)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to start import job %s: %v", jobID, err)
+		return
+	}
+
+	queue := make(chan []*ImportRow)
+	var wg sync.WaitGroup
+	var failOnce sync.Once
+	var failure error
+	stop := make(chan struct{})
+
+	for worker := 0; worker < i.concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range queue {
+				if err := i.submitBatch(jobID, contract, batch); err != nil {
+					failOnce.Do(func() {
+						failure = err
+						close(stop)
+					})
+				}
+			}
+		}()
+	}
+
+enqueue:
+	for _, batch := range batches {
+		select {
+		case queue <- batch:
+		case <-stop:
+			break enqueue
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	err = i.store.update(jobID, func(job *ImportJob) error {
+		if failure != nil {
+			job.Status = jobStatusInterrupted
+			job.Error = failure.Error()
+			return nil
+		}
+		job.Status = jobStatusCompleted
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to finish import job %s: %v", jobID, err)
+	}
+}
+
+// submitBatch creates the identities of a batch with CreateIdentities and records the
+// outcome of every row. An error is returned when the batch could not be processed.
+func (i *importer) submitBatch(jobID string, contract *client.Contract, batch []*ImportRow) error {
+	identities := make([]*model.Identity, len(batch))
+	err := i.store.update(jobID, func(job *ImportJob) error {
+		for n, row := range batch {
+			row.Status = rowStatusSubmitting
+			identities[n] = row.Identity
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	identitiesJSON, err := json.Marshal(identities)
+	if err != nil {
+		return err
+	}
+
+	// PII travels in the transient map so it is not recorded in the block
+	result, err := submit(context.Background(), contract, "CreateIdentities",
+		client.WithTransient(map[string][]byte{"identities": identitiesJSON}))
+	if err != nil {
+		modelErr, ok := chaincodeError(err)
+		if !ok {
+			return fmt.Errorf("batch starting at row %d failed: %w", batch[0].Row, err)
+		}
+		// The whole batch was rejected, e.g. the client is not an admin
+		return i.store.update(jobID, func(job *ImportJob) error {
+			for _, row := range batch {
+				failRow(row, string(modelErr.Code), modelErr.Message, modelErr.Fields)
+			}
+			return nil
+		})
+	}
+
+	var results []model.RowResult
+	if err = json.Unmarshal(result, &results); err != nil {
+		return fmt.Errorf("failed to parse import result: %w", err)
+	}
+	if len(results) != len(batch) {
+		return fmt.Errorf("import result has %d rows, expected %d", len(results), len(batch))
+	}
+
+	return i.store.update(jobID, func(job *ImportJob) error {
+		for n, row := range batch {
+			outcome := results[n]
+			switch {
+			case outcome.Code == "":
+				row.Status = rowStatusCreated
+				row.Identity = nil
+			case row.Retried && outcome.Code == string(model.CodeAlreadyExists):
+				// The identity was created by the batch that was interrupted
+				row.Status = rowStatusCreated
+				row.Identity = nil
+			default:
+				failRow(row, outcome.Code, outcome.Message, outcome.Fields)
+			}
+		}
+		return nil
+	})
+}
+
+func failRow(row *ImportRow, code string, message string, fieldErrs []model.FieldError) {
+	row.Status = rowStatusFailed
+	row.Code = code
+	row.Message = message
+	row.Errors = fieldErrs
+	row.Identity = nil
+}
+
+// validateImport validates the identities with validator and returns the
+// import rows. Rows are numbered from 1 in the order of the request body.
+func validateImport(validator *model.Validator, identities []*model.Identity) []*ImportRow {
+	seen := make(map[string]bool)
+
+	rows := make([]*ImportRow, len(identities))
+	for n, idnty := range identities {
+		row := &ImportRow{Row: n + 1, ID: idnty.Id, Status: rowStatusPending, Identity: idnty}
+		rows[n] = row
+
+		if isEmptyField(idnty.Id) {
+			failRow(row, string(model.CodeInvalidArgument), "identity id is not provided", nil)
+			continue
+		}
+		if seen[idnty.Id] {
+			failRow(row, string(model.CodeAlreadyExists), "identity id is repeated in the import", nil)
+			continue
+		}
+		seen[idnty.Id] = true
+
+		if err := validator.ValidateIdentity(idnty); err != nil {
+			var modelErr *model.Error
+			if errors.As(err, &modelErr) {
+				failRow(row, string(modelErr.Code), modelErr.Message, modelErr.Fields)
+			} else {
+				failRow(row, string(model.CodeValidationFailed), err.Error(), nil)
+			}
+		}
+	}
+	return rows
+}
+
+// importFormat returns the import format from the format query parameter or the
+// request content type.
+func importFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		switch format {
+		case importFormatCSV, importFormatNDJSON:
+			return format, nil
+		}
+		return "", fmt.Errorf("unsupported import format %s, use csv or ndjson", format)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return importFormatCSV, nil
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return importFormatNDJSON, nil
+	}
+	return "", fmt.Errorf("unsupported content type %q, use text/csv or application/x-ndjson", mediaType)
+}
+
+// parseImport decodes the identities of a CSV or NDJSON import.
+func parseImport(format string, body io.Reader) ([]*model.Identity, error) {
+	if format == importFormatCSV {
+		return parseCSV(body)
+	}
+	return parseNDJSON(body)
+}
+
+// parseCSV decodes a CSV import. The header row names the identity fields with their
+// JSON names, e.g. id,firstName,lastName,phone,nationalID.
+func parseCSV(body io.Reader) ([]*model.Identity, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+
+	for n, column := range header {
+		column = strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))
+		if column != "id" && !model.IsPIIField(column) {
+			return nil, fmt.Errorf("unknown CSV column %q", column)
+		}
+		header[n] = column
+	}
+
+	var identities []*model.Identity
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		idnty := &model.Identity{}
+		fields := idnty.Fields()
+		for n, column := range header {
+			if column == "id" {
+				idnty.Id = strings.TrimSpace(record[n])
+				continue
+			}
+			*fields[column] = record[n]
+		}
+		identities = append(identities, idnty)
+	}
+	return identities, nil
+}
+
+// parseNDJSON decodes an NDJSON import with one identity object per line.
+func parseNDJSON(body io.Reader) ([]*model.Identity, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var identities []*model.Identity
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var idnty model.Identity
+		if err := json.Unmarshal([]byte(text), &idnty); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		identities = append(identities, &idnty)
+	}
+	return identities, scanner.Err()
+}
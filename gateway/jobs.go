@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
+)
+
+const (
+	jobStatusRunning     = "running"
+	jobStatusInterrupted = "interrupted"
+	jobStatusCompleted   = "completed"
+
+	rowStatusPending    = "pending"
+	rowStatusSubmitting = "submitting"
+	rowStatusCreated    = "created"
+	rowStatusFailed     = "failed"
+)
+
+var errJobNotFound = errors.New("import job not found")
+
+// ImportJob is a bulk import job. Jobs are persisted so that an import interrupted by a
+// gateway restart can be resumed.
+type ImportJob struct {
+	ID        string       `json:"id"`
+	Status    string       `json:"status"`
+	Format    string       `json:"format"`
+	Submitter string       `json:"submitter"`
+	CreatedAt time.Time    `json:"createdAt"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+	Total     int          `json:"total"`
+	Processed int          `json:"processed"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Error     string       `json:"error,omitempty"`
+	Rows      []*ImportRow `json:"rows,omitempty"`
+}
+
+// ImportRow is the outcome of one row of an import. The identity is only kept until
+// the row is processed, so that no PII stays on disk once the import is done.
+type ImportRow struct {
+	Row      int                `json:"row"`
+	ID       string             `json:"id"`
+	Status   string             `json:"status"`
+	Code     string             `json:"code,omitempty"`
+	Message  string             `json:"message,omitempty"`
+	Errors   []model.FieldError `json:"errors,omitempty"`
+	Identity *model.Identity    `json:"identity,omitempty"`
+	// Retried is set when the row was being submitted when the job was interrupted,
+	// so the identity may already have been created.
+	Retried bool `json:"retried,omitempty"`
+}
+
+// jobFileExtension is the extension of the encrypted job files. Jobs written in plain
+// JSON by older gateways are encrypted when they are loaded.
+const jobFileExtension = ".job"
+
+// jobStore keeps the import jobs in memory and writes every change to a file per job,
+// encrypted with AES-256-GCM as it holds the PII of the pending rows.
+type jobStore struct {
+	mu   sync.Mutex
+	dir  string
+	aead cipher.AEAD
+	jobs map[string]*ImportJob
+}
+
+// newJobStore loads the jobs persisted in dir with the base64 key in keyFile. Jobs that
+// were running when the gateway stopped are marked interrupted until they are resumed.
+func newJobStore(dir string, keyFile string) (*jobStore, error) {
+	encoded, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read import job key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("import job key must be 32 bytes, base64 encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create import job directory: %w", err)
+	}
+
+	store := &jobStore{dir: dir, aead: aead, jobs: make(map[string]*ImportJob)}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+jobFileExtension))
+	if err != nil {
+		return nil, err
+	}
+	plainFiles, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range append(files, plainFiles...) {
+		job, err := store.load(file)
+		if err != nil {
+			return nil, err
+		}
+
+		plain := filepath.Ext(file) != jobFileExtension
+		if job.Status == jobStatusRunning || plain {
+			if job.Status == jobStatusRunning {
+				job.Status = jobStatusInterrupted
+				job.Error = "gateway restarted, resume the job to continue"
+			}
+			if err = store.save(job); err != nil {
+				return nil, err
+			}
+		}
+		if plain {
+			if err = os.Remove(file); err != nil {
+				return nil, fmt.Errorf("failed to remove plain import job %s: %w", file, err)
+			}
+		}
+		store.jobs[job.ID] = job
+	}
+
+	return store, nil
+}
+
+// load reads a job file, decrypting it unless it is a plain JSON file of an older gateway.
+func (s *jobStore) load(file string) (*ImportJob, error) {
+	jsonByte, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read import job %s: %w", file, err)
+	}
+
+	if filepath.Ext(file) == jobFileExtension {
+		nonceSize := s.aead.NonceSize()
+		if len(jsonByte) < nonceSize {
+			return nil, fmt.Errorf("import job %s is truncated", file)
+		}
+		id := strings.TrimSuffix(filepath.Base(file), jobFileExtension)
+		jsonByte, err = s.aead.Open(nil, jsonByte[:nonceSize], jsonByte[nonceSize:], []byte(id))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt import job %s: %w", file, err)
+		}
+	}
+
+	var job ImportJob
+	if err = json.Unmarshal(jsonByte, &job); err != nil {
+		return nil, fmt.Errorf("failed to parse import job %s: %w", file, err)
+	}
+	return &job, nil
+}
+
+// create persists a new running job.
+func (s *jobStore) create(job *ImportJob) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.ID = hex.EncodeToString(id)
+	job.Status = jobStatusRunning
+	job.CreatedAt = time.Now().UTC()
+	job.count()
+	s.jobs[job.ID] = job
+	return s.save(job)
+}
+
+// get returns a copy of the job without its rows.
+func (s *jobStore) get(id string) (*ImportJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+	summary := *job
+	summary.Rows = nil
+	return &summary, nil
+}
+
+// report returns the outcome of the job rows with the given status, or of every row
+// when status is empty.
+func (s *jobStore) report(id string, status string) ([]ImportRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+
+	rows := []ImportRow{}
+	for _, row := range job.Rows {
+		if status != "" && row.Status != status {
+			continue
+		}
+		report := *row
+		report.Identity = nil
+		rows = append(rows, report)
+	}
+	return rows, nil
+}
+
+// update applies fn to the job under the store lock and persists the result.
+func (s *jobStore) update(id string, fn func(job *ImportJob) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return errJobNotFound
+	}
+	if err := fn(job); err != nil {
+		return err
+	}
+	job.count()
+	return s.save(job)
+}
+
+// resume marks an interrupted job running again. The rows that were being submitted when
+// it was interrupted are submitted again, flagged as retried.
+func (s *jobStore) resume(id string) error {
+	return s.update(id, func(job *ImportJob) error {
+		if job.Status != jobStatusInterrupted {
+			return fmt.Errorf("import job is %s, only interrupted jobs can be resumed", job.Status)
+		}
+		job.Status = jobStatusRunning
+		job.Error = ""
+		for _, row := range job.Rows {
+			if row.Status == rowStatusSubmitting {
+				row.Status = rowStatusPending
+				row.Retried = true
+			}
+		}
+		return nil
+	})
+}
+
+// save encrypts and writes the job file atomically, bound to the job id. The caller holds
+// the store lock.
+func (s *jobStore) save(job *ImportJob) error {
+	job.UpdatedAt = time.Now().UTC()
+
+	jsonByte, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := s.aead.Seal(nonce, nonce, jsonByte, []byte(job.ID))
+
+	path := filepath.Join(s.dir, job.ID+jobFileExtension)
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, sealed, 0o600); err != nil {
+		return fmt.Errorf("failed to write import job: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// count recomputes the progress counters from the rows.
+func (job *ImportJob) count() {
+	job.Total = len(job.Rows)
+	job.Processed, job.Succeeded, job.Failed = 0, 0, 0
+	for _, row := range job.Rows {
+		switch row.Status {
+		case rowStatusCreated:
+			job.Processed++
+			job.Succeeded++
+		case rowStatusFailed:
+			job.Processed++
+			job.Failed++
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/digital-identity/model"
+)
+
+// writeJobKey writes a random base64 job key and returns its file.
+func writeJobKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "import-jobs.key")
+	if err := os.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func testImportJob() *ImportJob {
+	return &ImportJob{
+		Format:    "csv",
+		Submitter: "x509::CN=admin::CN=ca",
+		Rows: []*ImportRow{
+			{Row: 1, ID: "id1", Status: rowStatusCreated},
+			{Row: 2, ID: "id2", Status: rowStatusSubmitting, Identity: &model.Identity{Id: "id2", FirstName: "Jane Doe", NationalID: "1234567890"}},
+			{Row: 3, ID: "id3", Status: rowStatusPending, Identity: &model.Identity{Id: "id3", FirstName: "John Roe", NationalID: "9876543210"}},
+			{Row: 4, ID: "id4", Status: rowStatusFailed, Code: string(model.CodeValidationFailed)},
+		},
+	}
+}
+
+func TestJobStoreEncryption(t *testing.T) {
+	dir, keyFile := t.TempDir(), writeJobKey(t)
+	store, err := newJobStore(dir, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := testImportJob()
+	if err = store.create(job); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, job.ID+jobFileExtension)
+	sealed, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"Jane Doe", "1234567890", "John Roe", job.Submitter, `"rows"`} {
+		if bytes.Contains(sealed, []byte(plain)) {
+			t.Errorf("job file holds %q in clear", plain)
+		}
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("job file mode %v, want 0600: %v", info.Mode().Perm(), err)
+	}
+
+	reloaded, err := newJobStore(dir, keyFile)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	rows, err := reloaded.report(job.ID, "")
+	if err != nil || len(rows) != 4 {
+		t.Fatalf("reloaded rows %v: %v", rows, err)
+	}
+	if reloaded.jobs[job.ID].Rows[1].Identity.FirstName != "Jane Doe" {
+		t.Errorf("reloaded identity %+v", reloaded.jobs[job.ID].Rows[1].Identity)
+	}
+
+	// The report never carries the identities
+	for _, row := range rows {
+		if row.Identity != nil {
+			t.Errorf("report row %d carries its identity", row.Row)
+		}
+	}
+
+	if _, err = newJobStore(dir, writeJobKey(t)); err == nil {
+		t.Error("reload with another key: no error")
+	}
+
+	// The job id is authenticated, a file cannot be swapped for another job
+	if err = os.Rename(file, filepath.Join(dir, "0123"+jobFileExtension)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newJobStore(dir, keyFile); err == nil {
+		t.Error("renamed job file: no error")
+	}
+
+	invalidKey := filepath.Join(t.TempDir(), "short.key")
+	os.WriteFile(invalidKey, []byte(base64.StdEncoding.EncodeToString([]byte("short"))), 0o600)
+	if _, err = newJobStore(t.TempDir(), invalidKey); err == nil {
+		t.Error("short key: no error")
+	}
+}
+
+func TestJobStoreEncryptsPlainJobs(t *testing.T) {
+	dir, keyFile := t.TempDir(), writeJobKey(t)
+	job := testImportJob()
+	job.ID = "0a1b"
+	job.Status = jobStatusCompleted
+	job.count()
+	jsonByte, err := json.Marshal(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, job.ID+".json"), jsonByte, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newJobStore(dir, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := store.get(job.ID); err != nil || loaded.Status != jobStatusCompleted || loaded.Total != 4 {
+		t.Errorf("loaded plain job %+v: %v", loaded, err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, job.ID+".json")); !os.IsNotExist(err) {
+		t.Errorf("plain job file left: %v", err)
+	}
+	sealed, err := os.ReadFile(filepath.Join(dir, job.ID+jobFileExtension))
+	if err != nil || bytes.Contains(sealed, []byte("Jane Doe")) {
+		t.Errorf("plain job not encrypted: %v", err)
+	}
+}
+
+func TestJobStoreResumeAfterRestart(t *testing.T) {
+	dir, keyFile := t.TempDir(), writeJobKey(t)
+	store, err := newJobStore(dir, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := testImportJob()
+	if err = store.create(job); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.resume(job.ID); err == nil {
+		t.Error("resume of a running job: no error")
+	}
+
+	// The gateway stops while the job runs
+	restarted, err := newJobStore(dir, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted, err := restarted.get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interrupted.Status != jobStatusInterrupted || interrupted.Error == "" ||
+		interrupted.Total != 4 || interrupted.Processed != 2 || interrupted.Succeeded != 1 || interrupted.Failed != 1 {
+		t.Errorf("job after restart %+v", interrupted)
+	}
+
+	if err = restarted.resume(job.ID); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	resumed := restarted.jobs[job.ID]
+	if resumed.Status != jobStatusRunning || resumed.Error != "" {
+		t.Errorf("resumed job %s: %s", resumed.Status, resumed.Error)
+	}
+	// The row being submitted may have been created, it is submitted again as retried
+	wantRows := []struct {
+		status  string
+		retried bool
+	}{
+		{rowStatusCreated, false},
+		{rowStatusPending, true},
+		{rowStatusPending, false},
+		{rowStatusFailed, false},
+	}
+	for i, want := range wantRows {
+		if row := resumed.Rows[i]; row.Status != want.status || row.Retried != want.retried {
+			t.Errorf("row %d %s retried %v, want %s retried %v", row.Row, row.Status, row.Retried, want.status, want.retried)
+		}
+	}
+
+	// The resumed state is persisted
+	reloaded, err := newJobStore(dir, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row := reloaded.jobs[job.ID].Rows[1]; row.Status != rowStatusPending || !row.Retried || row.Identity == nil {
+		t.Errorf("reloaded retried row %+v", row)
+	}
+	if err = reloaded.resume("unknown"); err != errJobNotFound {
+		t.Errorf("resume of an unknown job: %v, want %v", err, errJobNotFound)
+	}
+}
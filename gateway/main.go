@@ -1,31 +1,27 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
 	"google.golang.org/grpc"
 	"log"
 	"net/http"
 )
 
-type Identity struct {
-	Id               string `json:"id"`
-	FirstName        string `json:"firstName"`
-	LastName         string `json:"lastName"`
-	Phone            string `json:"phone"`
-	Email            string `json:"email"`
-	Dob              string `json:"dob"`
-	PresentAddress   string `json:"presentAddress"`
-	PermanentAddress string `json:"permanentAddress"`
-	Gender           string `json:"gender"`
-	NationalID       string `json:"nationalID"`
-	Owner            string `json:"owner"`
-}
-
 func main() {
+	// Spans are exported when an OTLP endpoint is configured
+	shutdownTracing, err := initTracing(context.Background(), "gateway")
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	// new grpc connection to fabric peer
 	grpcConn, err := newGrpcConnection()
 	if err != nil {
@@ -36,25 +32,101 @@ func main() {
 		log.Fatalf("Failed to close GRPC connection: %v", err)
 	}()
 
+	// Identities are validated for the region of the chaincode configuration
+	regions, err := newRegionCache()
+	if err != nil {
+		log.Fatalf("Failed to initialize validation: %v", err)
+	}
+
+	// Bulk import jobs are resumed from the job directory after a restart
+	imports, err := newImporter(grpcConn, regions)
+	if err != nil {
+		log.Fatalf("Failed to initialize import jobs: %v", err)
+	}
+
+	exports, err := newExporter(grpcConn)
+	if err != nil {
+		log.Fatalf("Failed to initialize export jobs: %v", err)
+	}
+
+	indexer := newIndexerClient(grpcConn)
+
+	// Event consumers resume from their checkpoints in EVENT_CHECKPOINT_DIR
+	events, err := newEventHub(grpcConn)
+	if err != nil {
+		log.Fatalf("Failed to initialize event consumers: %v", err)
+	}
+	webhooks, err := newWebhookDispatcher(grpcConn, events)
+	if err != nil {
+		log.Fatalf("Failed to initialize webhooks: %v", err)
+	}
+	webhooks.Run(context.Background())
+	if err = events.Run(context.Background()); err != nil {
+		log.Fatalf("Failed to start event consumers: %v", err)
+	}
+
+	// Readiness pings the peer in the background
+	health, err := newHealthChecker(grpcConn)
+	if err != nil {
+		log.Fatalf("Failed to initialize health checks: %v", err)
+	}
+	health.Run(context.Background())
+
 	// Create router
 	r := chi.NewRouter()
 
 	// Set up middleware
+	r.Use(tracingMiddleware)
 	r.Use(middleware.Logger)
+	r.Use(metricsMiddleware)
 	r.Use(middleware.Recoverer)
+	r.Use(vaultTokenMiddleware)
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-User-Cert", "X-User-Key", "X-User-MSPID"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-User-Cert", "X-User-Key", "X-User-MSPID", "X-Vault-Token"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
 	// Set up routes
-	r.Post("/create", createIdentityHandler(grpcConn))
-	r.Post("/update", updateIdentityHandler(grpcConn))
+	r.Method(http.MethodGet, "/metrics", metricsHandler())
+	r.Get("/healthz", health.livenessHandler())
+	r.Get("/readyz", health.readinessHandler())
+	r.Post("/create", createIdentityHandler(grpcConn, regions))
+	r.Post("/update", updateIdentityHandler(grpcConn, regions))
 	r.Post("/delete", deleteIdentityHandler(grpcConn))
 	r.Get("/get/{id}", getIdentityHandler(grpcConn))
+	r.Get("/list", listIdentitiesHandler(grpcConn))
+	r.Post("/restore", restoreIdentityHandler(grpcConn))
+	r.Post("/purge", purgeIdentityHandler(grpcConn))
+	r.Post("/consent/grant", grantConsentHandler(grpcConn))
+	r.Post("/consent/revoke", revokeConsentHandler(grpcConn))
+	r.Get("/consent/{id}", listConsentsHandler(grpcConn))
+	r.Get("/consent/{id}/ledger", consentLedgerHandler(grpcConn))
+	r.Get("/access-log/{id}", accessLogHandler(grpcConn))
+	r.Post("/erasure/request", requestErasureHandler(grpcConn))
+	r.Post("/erasure/approve", approveErasureHandler(grpcConn))
+	r.Get("/erasure/{id}", tombstoneHandler(grpcConn))
+	r.Post("/migrate", migrateIdentitiesHandler(grpcConn))
+	r.Post("/v1/identities:batchImport", imports.batchImportHandler())
+	r.Get("/v1/importJobs/{id}", imports.jobHandler())
+	r.Get("/v1/importJobs/{id}/report", imports.reportHandler())
+	r.Post("/v1/importJobs/{id}:resume", imports.resumeHandler())
+	r.Post("/v1/identities:export", exports.exportHandler())
+	r.Get("/v1/exportJobs/{id}", exports.exportJobHandler())
+	r.Get("/v1/search/identities", indexer.searchHandler())
+	r.Get("/v1/stats/identities/gender", indexer.genderStatsHandler())
+	r.Get("/v1/stats/identities/dob", indexer.dobStatsHandler())
+	r.Get("/v1/admin/events/checkpoints", events.checkpointsHandler())
+	r.Post("/v1/admin/webhooks", webhooks.createWebhookHandler())
+	r.Get("/v1/admin/webhooks", webhooks.listWebhooksHandler())
+	r.Get("/v1/admin/webhooks/{id}", webhooks.getWebhookHandler())
+	r.Delete("/v1/admin/webhooks/{id}", webhooks.deleteWebhookHandler())
+	r.Get("/v1/admin/webhooks/{id}/deadLetters", webhooks.deadLettersHandler())
+	r.Post("/v1/admin/webhooks/{id}/deadLetters/{letterId}:retry", webhooks.retryDeadLetterHandler())
+	r.Post("/v1/admin/webhooks/{id}:replay", webhooks.replayHandler())
+	r.Get("/v1/admin/webhooks/{id}/replays/{replayId}", webhooks.replayJobHandler())
 
 	// Start server
 	port := envOrDefault("PORT", "8080")
@@ -62,7 +134,7 @@ func main() {
 	log.Fatal(http.ListenAndServe(":"+port, r))
 }
 
-func createIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+func createIdentityHandler(grpcConn *grpc.ClientConn, regions *regionCache) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Extract identity headers
 		certPEM := r.Header.Get("X-User-Cert")
@@ -78,7 +150,7 @@ func createIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 		}
 
 		// Create gateway connection for this identity
-		gw, contract, err := newGatewayFromIdentity(grpcConn, certPEM, keyPEM, mspID)
+		gw, contract, err := newGatewayFromIdentity(r.Context(), grpcConn, certPEM, keyPEM, mspID)
 		if err != nil {
 			respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
 				"status":  http.StatusUnauthorized,
@@ -89,7 +161,7 @@ func createIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 		defer gw.Close()
 
 		// Parse request body
-		var idnty Identity
+		var idnty model.Identity
 		if err := json.NewDecoder(r.Body).Decode(&idnty); err != nil {
 			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
 				"status":  http.StatusBadRequest,
@@ -107,20 +179,14 @@ func createIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 			return
 		}
 
-		requiredFields := map[string]string{
-			"firstName":  idnty.FirstName,
-			"phone":      idnty.Phone,
-			"nationalID": idnty.NationalID,
+		validator, err := regions.newValidator(r.Context(), contract)
+		if err != nil {
+			respondChaincodeError(w, err)
+			return
 		}
-
-		for field, value := range requiredFields {
-			if isEmptyField(value) {
-				respondJSON(w, http.StatusBadRequest, map[string]interface{}{
-					"status":  http.StatusBadRequest,
-					"message": fmt.Sprintf("Field %s is required", field),
-				})
-				return
-			}
+		if err := validator.ValidateIdentity(&idnty); err != nil {
+			respondValidationError(w, err)
+			return
 		}
 
 		// Submit transaction
@@ -133,14 +199,23 @@ func createIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 			return
 		}
 
-		if _, err := contract.SubmitTransaction("CreateIdentity", string(assetJSON)); err != nil {
+		// PII travels in the transient map so it is not recorded in the block
+		stubJSON, err := json.Marshal(model.Identity{Id: idnty.Id})
+		if err != nil {
 			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
 				"status":  http.StatusInternalServerError,
-				"message": "Chaincode error: " + err.Error(),
+				"message": "Error marshaling identity: " + err.Error(),
 			})
 			return
 		}
 
+		if _, err := submit(r.Context(), contract, "CreateIdentity",
+			client.WithArguments(string(stubJSON)),
+			client.WithTransient(map[string][]byte{"identity": assetJSON})); err != nil {
+			respondChaincodeError(w, err)
+			return
+		}
+
 		respondJSON(w, http.StatusOK, map[string]interface{}{
 			"status":  http.StatusOK,
 			"message": "Identity created successfully",
@@ -149,7 +224,7 @@ func createIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 	}
 }
 
-func updateIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+func updateIdentityHandler(grpcConn *grpc.ClientConn, regions *regionCache) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Extract identity headers
 		certPEM := r.Header.Get("X-User-Cert")
@@ -165,7 +240,7 @@ func updateIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 		}
 
 		// Create gateway connection
-		gw, contract, err := newGatewayFromIdentity(grpcConn, certPEM, keyPEM, mspID)
+		gw, contract, err := newGatewayFromIdentity(r.Context(), grpcConn, certPEM, keyPEM, mspID)
 		if err != nil {
 			respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
 				"status":  http.StatusUnauthorized,
@@ -175,9 +250,9 @@ func updateIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 		}
 		defer gw.Close()
 
-		// Parse request
-		var idnty Identity
-		if err = json.NewDecoder(r.Body).Decode(&idnty); err != nil {
+		// Parse request as a JSON merge patch, fields set to null or "" are cleared
+		var patch map[string]*string
+		if err = json.NewDecoder(r.Body).Decode(&patch); err != nil {
 			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
 				"status":  http.StatusBadRequest,
 				"message": "Invalid request body:  " + err.Error(),
@@ -185,6 +260,10 @@ func updateIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 			return
 		}
 
+		var idnty model.Identity
+		if id := patch["id"]; id != nil {
+			idnty.Id = *id
+		}
 		if isEmptyField(idnty.Id) {
 			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
 				"status":  http.StatusBadRequest,
@@ -193,8 +272,18 @@ func updateIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 			return
 		}
 
+		validator, err := regions.newValidator(r.Context(), contract)
+		if err != nil {
+			respondChaincodeError(w, err)
+			return
+		}
+		if err = validator.ValidatePatch(patch); err != nil {
+			respondValidationError(w, err)
+			return
+		}
+
 		// Submit transaction
-		assetJSON, err := json.Marshal(idnty)
+		assetJSON, err := json.Marshal(patch)
 		if err != nil {
 			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
 				"status":  http.StatusInternalServerError,
@@ -203,14 +292,23 @@ func updateIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 			return
 		}
 
-		if _, err = contract.SubmitTransaction("UpdateIdentity", idnty.Id, string(assetJSON)); err != nil {
+		// PII travels in the transient map so it is not recorded in the block
+		stubJSON, err := json.Marshal(model.Identity{Id: idnty.Id})
+		if err != nil {
 			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
 				"status":  http.StatusInternalServerError,
-				"message": "Chaincode error: " + err.Error(),
+				"message": "Error marshaling identity:  " + err.Error(),
 			})
 			return
 		}
 
+		if _, err = submit(r.Context(), contract, "UpdateIdentity",
+			client.WithArguments(idnty.Id, string(stubJSON)),
+			client.WithTransient(map[string][]byte{"identity": assetJSON})); err != nil {
+			respondChaincodeError(w, err)
+			return
+		}
+
 		respondJSON(w, http.StatusOK, map[string]interface{}{
 			"status":  http.StatusOK,
 			"message": "Identity updated successfully",
@@ -235,7 +333,7 @@ func deleteIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 		}
 
 		// Create gateway connection
-		gw, contract, err := newGatewayFromIdentity(grpcConn, certPEM, keyPEM, mspID)
+		gw, contract, err := newGatewayFromIdentity(r.Context(), grpcConn, certPEM, keyPEM, mspID)
 		if err != nil {
 			respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
 				"status":  http.StatusUnauthorized,
@@ -266,11 +364,8 @@ func deleteIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 		}
 
 		// Submit transaction
-		if _, err = contract.SubmitTransaction("DeleteIdentity", request.ID); err != nil {
-			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"status":  http.StatusInternalServerError,
-				"message": "Chaincode error: " + err.Error(),
-			})
+		if _, err = submitTransaction(r.Context(), contract, "DeleteIdentity", request.ID); err != nil {
+			respondChaincodeError(w, err)
 			return
 		}
 
@@ -298,7 +393,7 @@ func getIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 		}
 
 		// Create gateway connection
-		gw, contract, err := newGatewayFromIdentity(grpcConn, certPEM, keyPEM, mspID)
+		gw, contract, err := newGatewayFromIdentity(r.Context(), grpcConn, certPEM, keyPEM, mspID)
 		if err != nil {
 			respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
 				"status":  http.StatusUnauthorized,
@@ -318,17 +413,32 @@ func getIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 			return
 		}
 
-		// Evaluate transaction
-		result, err := contract.EvaluateTransaction("ReadIdentity", id)
+		// Audited reads submit the access log entry, then evaluate the identity so that it
+		// never reaches a block
+		var result []byte
+		if r.URL.Query().Get("audited") == "true" {
+			purpose := r.URL.Query().Get("purpose")
+			if isEmptyField(purpose) {
+				respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+					"status":  http.StatusBadRequest,
+					"message": "Purpose is required for audited reads",
+				})
+				return
+			}
+			if _, err = submitTransaction(r.Context(), contract, "ReadIdentityAudited", id, purpose); err == nil {
+				result, err = evaluateTransaction(r.Context(), contract, "ReadIdentityForPurpose", id, purpose)
+			}
+		} else if r.URL.Query().Get("includeDeleted") == "true" {
+			result, err = evaluateTransaction(r.Context(), contract, "ReadIdentityIncludingDeleted", id)
+		} else {
+			result, err = readIdentity(r.Context(), contract, id)
+		}
 		if err != nil {
-			respondJSON(w, http.StatusNotFound, map[string]interface{}{
-				"status":  http.StatusNotFound,
-				"message": "Identity not found: " + err.Error(),
-			})
+			respondChaincodeError(w, err)
 			return
 		}
 
-		var identity Identity
+		var identity model.Identity
 		if err = json.Unmarshal(result, &identity); err != nil {
 			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
 				"status":  http.StatusInternalServerError,
@@ -344,6 +454,53 @@ func getIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
 	}
 }
 
+// readIdentity evaluates ReadIdentity. When the caller is not the owner the record is
+// filtered down to the fields of the consents of the caller, and is only returned once
+// RecordIdentityRead committed the use of the consents, a transaction that carries no
+// identity data. Reads without consent fail on evaluation, without reaching the orderer.
+func readIdentity(ctx context.Context, contract *client.Contract, id string) ([]byte, error) {
+	result, err := evaluateTransaction(ctx, contract, "ReadIdentity", id)
+	if err != nil {
+		return nil, err
+	}
+
+	var identity model.Identity
+	if err = json.Unmarshal(result, &identity); err != nil || identity.Owner != "" {
+		return result, nil
+	}
+	if _, err = submitTransaction(ctx, contract, "RecordIdentityRead", id); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// gatewayFromRequest connects to the gateway with the identity carried in the request headers.
+// On failure the error response is written and ok is false.
+func gatewayFromRequest(w http.ResponseWriter, r *http.Request, grpcConn *grpc.ClientConn) (gw *client.Gateway, contract *client.Contract, ok bool) {
+	certPEM := r.Header.Get("X-User-Cert")
+	keyPEM := r.Header.Get("X-User-Key")
+	mspID := r.Header.Get("X-User-MSPID")
+
+	if certPEM == "" || keyPEM == "" || mspID == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"status":  http.StatusBadRequest,
+			"message": "Missing required identity headers (X-User-Cert, X-User-Key, X-User-MSPID)",
+		})
+		return nil, nil, false
+	}
+
+	gw, contract, err := newGatewayFromIdentity(r.Context(), grpcConn, certPEM, keyPEM, mspID)
+	if err != nil {
+		respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"status":  http.StatusUnauthorized,
+			"message": "Invalid identity credentials: " + err.Error(),
+		})
+		return nil, nil, false
+	}
+
+	return gw, contract, true
+}
+
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
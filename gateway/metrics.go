@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_http_request_duration_seconds",
+		Help:    "HTTP request latency by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	transactionPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_transaction_phase_duration_seconds",
+		Help:    "Latency of the evaluate, endorse, submit and commit phases of chaincode transactions.",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"transaction", "phase", "result"})
+
+	commitStatuses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_transaction_commit_status_total",
+		Help: "Committed transactions by validation code, VALID for successful transactions.",
+	}, []string{"transaction", "code"})
+)
+
+// metricsHandler serves the metrics in the Prometheus exposition format.
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// metricsMiddleware counts the requests and records their latency by route pattern,
+// so that identity ids in the path do not create a series per identity.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		labels := prometheus.Labels{"route": route, "method": r.Method, "status": strconv.Itoa(status)}
+		httpRequests.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// observePhase records the latency of a transaction phase that started at start.
+func observePhase(transaction string, phase string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	transactionPhaseDuration.WithLabelValues(transaction, phase, result).Observe(time.Since(start).Seconds())
+}
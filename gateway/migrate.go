@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/hyperledger/digital-identity/model"
+	"google.golang.org/grpc"
+)
+
+const defaultMigrationBatchSize = 100
+
+// migrateIdentitiesHandler lets an admin migrate every identity stored with an older
+// schema version. It submits MigrateIdentities batch after batch until the migration
+// is done and streams the progress of every batch as a line of NDJSON.
+func migrateIdentitiesHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gw, contract, ok := gatewayFromRequest(w, r, grpcConn)
+		if !ok {
+			return
+		}
+		defer gw.Close()
+
+		// Parse request body
+		var request struct {
+			FromVersion int    `json:"fromVersion"`
+			BatchSize   int    `json:"batchSize"`
+			Bookmark    string `json:"bookmark"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request body: " + err.Error(),
+			})
+			return
+		}
+
+		if request.FromVersion < 1 || request.FromVersion >= model.SchemaVersion {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "fromVersion must be between 1 and " + strconv.Itoa(model.SchemaVersion-1),
+			})
+			return
+		}
+
+		if request.BatchSize <= 0 {
+			request.BatchSize = defaultMigrationBatchSize
+		}
+
+		// The first batch reports chaincode errors with the matching status, later
+		// batches can only report them in the stream
+		bookmark := request.Bookmark
+		encoder := json.NewEncoder(w)
+		var scanned, migrated, indexed int
+		for batch := 1; ; batch++ {
+			result, err := submitTransaction(r.Context(), contract, "MigrateIdentities",
+				strconv.Itoa(request.FromVersion), strconv.Itoa(request.BatchSize), bookmark)
+			if err != nil {
+				if batch == 1 {
+					respondChaincodeError(w, err)
+					return
+				}
+				encoder.Encode(map[string]interface{}{
+					"status":   http.StatusInternalServerError,
+					"message":  "Chaincode error: " + err.Error(),
+					"bookmark": bookmark,
+				})
+				return
+			}
+
+			var progress model.MigrationResult
+			if err = json.Unmarshal(result, &progress); err != nil {
+				response := map[string]interface{}{
+					"status":  http.StatusInternalServerError,
+					"message": "Error parsing migration result: " + err.Error(),
+				}
+				if batch == 1 {
+					respondJSON(w, http.StatusInternalServerError, response)
+				} else {
+					encoder.Encode(response)
+				}
+				return
+			}
+
+			if batch == 1 {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				w.WriteHeader(http.StatusOK)
+			}
+
+			scanned += progress.Scanned
+			migrated += progress.Migrated
+			indexed += progress.Indexed
+			bookmark = progress.Bookmark
+			encoder.Encode(map[string]interface{}{
+				"batch":    batch,
+				"scanned":  scanned,
+				"migrated": migrated,
+				"indexed":  indexed,
+				"bookmark": bookmark,
+				"done":     progress.Done,
+			})
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+
+			if progress.Done || r.Context().Err() != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+//go:build pkcs11
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11MinKeyIDLength is the length under which the ID of a key could be guessed.
+const pkcs11MinKeyIDLength = 16
+
+// hsm is the PKCS#11 module at PKCS11_LIB, logged in to the token labelled
+// PKCS11_TOKEN_LABEL with PKCS11_PIN on first use. The keys of the users are labelled
+// PKCS11_KEY_PREFIX followed by their username, as the enroller labels them.
+type hsm struct {
+	module    *pkcs11.Ctx
+	slot      uint
+	token     string
+	keyPrefix string
+}
+
+var loadHSM = sync.OnceValues(func() (*hsm, error) {
+	library := envOrDefault("PKCS11_LIB", "/usr/lib/softhsm/libsofthsm2.so")
+	module := pkcs11.New(library)
+	if module == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s", library)
+	}
+	if err := module.Initialize(); err != nil {
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module: %w", err)
+	}
+
+	token := envOrDefault("PKCS11_TOKEN_LABEL", "fabric")
+	slots, err := module.GetSlotList(true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PKCS#11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := module.GetTokenInfo(slot)
+		if err != nil || info.Label != token {
+			continue
+		}
+		// The session stays open so that the signing sessions share its login
+		session, err := module.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open PKCS#11 session: %w", err)
+		}
+		err = module.Login(session, pkcs11.CKU_USER, envOrDefault("PKCS11_PIN", ""))
+		if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			return nil, fmt.Errorf("PKCS#11 login failed: %w", err)
+		}
+		return &hsm{module: module, slot: slot, token: token, keyPrefix: envOrDefault("PKCS11_KEY_PREFIX", "fabric-user-")}, nil
+	}
+	return nil, fmt.Errorf("PKCS#11 token %q not found", token)
+})
+
+// newPKCS11Sign returns a signing function of the HSM key of a PKCS#11 URI. The key never
+// leaves the HSM. Every signature opens its own session, PKCS#11 sessions not being safe
+// for concurrent use.
+//
+// The gateway is logged in to the whole token, so the random ID of the key is the
+// credential of the user: keys whose ID is the SKI of certificate, as the Fabric BCCSP
+// sets it, are refused since anyone can derive it. The key must also be labelled
+// PKCS11_KEY_PREFIX followed by the common name of certificate and hold its public key.
+func newPKCS11Sign(reference string, certificate *x509.Certificate) (identity.Sign, error) {
+	token, id, err := parsePKCS11KeyReference(reference)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := certificate.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("certificate of a PKCS#11 key is not an ECDSA certificate")
+	}
+	if len(id) < pkcs11MinKeyIDLength {
+		return nil, fmt.Errorf("PKCS#11 key ID is shorter than %d bytes", pkcs11MinKeyIDLength)
+	}
+	if ski := sha256.Sum256(elliptic.Marshal(publicKey.Curve, publicKey.X, publicKey.Y)); bytes.Equal(id, ski[:]) {
+		return nil, errors.New("PKCS#11 key ID is derived from the certificate, re-enroll the user")
+	}
+	h, err := loadHSM()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" && token != h.token {
+		return nil, fmt.Errorf("key is held by PKCS#11 token %q, not %q", token, h.token)
+	}
+	if err = h.checkKeyOwner(id, certificate.Subject.CommonName, publicKey); err != nil {
+		return nil, err
+	}
+
+	return func(digest []byte) ([]byte, error) {
+		session, err := h.module.OpenSession(h.slot, pkcs11.CKF_SERIAL_SESSION)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open PKCS#11 session: %w", err)
+		}
+		defer h.module.CloseSession(session)
+
+		handle, err := h.findKey(session, pkcs11.CKO_PRIVATE_KEY, id)
+		if err != nil {
+			return nil, err
+		}
+		if err = h.module.SignInit(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, handle); err != nil {
+			return nil, fmt.Errorf("PKCS#11 sign failed: %w", err)
+		}
+		signature, err := h.module.Sign(session, digest)
+		if err != nil {
+			return nil, fmt.Errorf("PKCS#11 sign failed: %w", err)
+		}
+		// CKM_ECDSA returns the concatenated R and S
+		if len(signature) == 0 || len(signature)%2 != 0 {
+			return nil, errors.New("invalid PKCS#11 ECDSA signature")
+		}
+		half := len(signature) / 2
+		return marshalLowS(new(big.Int).SetBytes(signature[:half]), new(big.Int).SetBytes(signature[half:]))
+	}, nil
+}
+
+// checkKeyOwner returns an error unless the private key with CKA_ID id is labelled with
+// the key prefix followed by user, and its public key is publicKey.
+func (h *hsm) checkKeyOwner(id []byte, user string, publicKey *ecdsa.PublicKey) error {
+	session, err := h.module.OpenSession(h.slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("failed to open PKCS#11 session: %w", err)
+	}
+	defer h.module.CloseSession(session)
+
+	privateHandle, err := h.findKey(session, pkcs11.CKO_PRIVATE_KEY, id)
+	if err != nil {
+		return err
+	}
+	attributes, err := h.module.GetAttributeValue(session, privateHandle, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil)})
+	if err != nil || len(attributes) == 0 {
+		return fmt.Errorf("failed to read the PKCS#11 key label: %v", err)
+	}
+	if label := string(attributes[0].Value); label != h.keyPrefix+user {
+		return fmt.Errorf("PKCS#11 key %q is not a key of %s", label, user)
+	}
+
+	publicHandle, err := h.findKey(session, pkcs11.CKO_PUBLIC_KEY, id)
+	if err != nil {
+		return err
+	}
+	attributes, err = h.module.GetAttributeValue(session, publicHandle, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil)})
+	if err != nil || len(attributes) == 0 {
+		return fmt.Errorf("failed to read the PKCS#11 public key: %v", err)
+	}
+	// CKA_EC_POINT is the DER octet string of the uncompressed point
+	var point []byte
+	if _, err = asn1.Unmarshal(attributes[0].Value, &point); err != nil {
+		point = attributes[0].Value
+	}
+	if !bytes.Equal(point, elliptic.Marshal(publicKey.Curve, publicKey.X, publicKey.Y)) {
+		return fmt.Errorf("PKCS#11 key of %s does not match its certificate", user)
+	}
+	return nil
+}
+
+// findKey returns the key of class with CKA_ID id.
+func (h *hsm) findKey(session pkcs11.SessionHandle, class uint, id []byte) (pkcs11.ObjectHandle, error) {
+	if err := h.module.FindObjectsInit(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}); err != nil {
+		return 0, fmt.Errorf("PKCS#11 key lookup failed: %w", err)
+	}
+	handles, _, err := h.module.FindObjects(session, 1)
+	if finalErr := h.module.FindObjectsFinal(session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("PKCS#11 key lookup failed: %w", err)
+	}
+	if len(handles) == 0 {
+		return 0, fmt.Errorf("PKCS#11 key %x not found", id)
+	}
+	return handles[0], nil
+}
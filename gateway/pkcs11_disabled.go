@@ -0,0 +1,15 @@
+//go:build !pkcs11
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+)
+
+// newPKCS11Sign fails in a gateway built without the pkcs11 tag, PKCS#11 needing cgo.
+func newPKCS11Sign(reference string, certificate *x509.Certificate) (identity.Sign, error) {
+	return nil, errors.New("the gateway was built without PKCS#11 support, build it with -tags pkcs11")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// pkcs11KeyPrefix starts the keystore content of a user key held by an HSM, a PKCS#11 URI
+// such as pkcs11:token=fabric;object=fabric-user-alice;id=%8a%3f...
+const pkcs11KeyPrefix = "pkcs11:"
+
+// parsePKCS11KeyReference returns the token and ID of the PKCS#11 URI of a key. The ID is
+// required, the token is optional.
+func parsePKCS11KeyReference(reference string) (token string, id []byte, err error) {
+	path, _, _ := strings.Cut(strings.TrimPrefix(reference, pkcs11KeyPrefix), "?")
+	for _, attribute := range strings.Split(path, ";") {
+		name, value, _ := strings.Cut(attribute, "=")
+		decoded, err := url.PathUnescape(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid PKCS#11 key reference %q", reference)
+		}
+		switch name {
+		case "token":
+			token = decoded
+		case "id":
+			id = []byte(decoded)
+		}
+	}
+	if len(id) == 0 {
+		return "", nil, fmt.Errorf("PKCS#11 key reference %q has no id", reference)
+	}
+	return token, id, nil
+}
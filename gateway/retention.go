@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/hyperledger/digital-identity/model"
+	"google.golang.org/grpc"
+)
+
+const defaultPageSize = 50
+
+func listIdentitiesHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gw, contract, ok := gatewayFromRequest(w, r, grpcConn)
+		if !ok {
+			return
+		}
+		defer gw.Close()
+
+		pageSize := defaultPageSize
+		if value := r.URL.Query().Get("pageSize"); value != "" {
+			size, err := strconv.Atoi(value)
+			if err != nil || size <= 0 {
+				respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+					"status":  http.StatusBadRequest,
+					"message": "pageSize must be a positive number",
+				})
+				return
+			}
+			pageSize = size
+		}
+		bookmark := r.URL.Query().Get("bookmark")
+		includeDeleted := r.URL.Query().Get("includeDeleted") == "true"
+
+		// Evaluate transaction
+		result, err := evaluateTransaction(r.Context(), contract, "ListIdentities",
+			strconv.Itoa(pageSize), bookmark, strconv.FormatBool(includeDeleted))
+		if err != nil {
+			respondChaincodeError(w, err)
+			return
+		}
+
+		var page model.IdentityPage
+		if err = json.Unmarshal(result, &page); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": "Error parsing identity data:  " + err.Error(),
+			})
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":     http.StatusOK,
+			"identities": page.Records,
+			"bookmark":   page.Bookmark,
+		})
+	}
+}
+
+func restoreIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+	return submitByIDHandler(grpcConn, "RestoreIdentity", "Identity restored successfully")
+}
+
+func purgeIdentityHandler(grpcConn *grpc.ClientConn) http.HandlerFunc {
+	return submitByIDHandler(grpcConn, "PurgeIdentity", "Identity purged successfully")
+}
+
+// submitByIDHandler submits a chaincode transaction taking the identity id from the request body.
+func submitByIDHandler(grpcConn *grpc.ClientConn, transaction string, message string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gw, contract, ok := gatewayFromRequest(w, r, grpcConn)
+		if !ok {
+			return
+		}
+		defer gw.Close()
+
+		// Parse request
+		var request struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request body",
+			})
+			return
+		}
+
+		if isEmptyField(request.ID) {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Identity ID is required",
+			})
+			return
+		}
+
+		// Submit transaction
+		if _, err := submitTransaction(r.Context(), contract, transaction, request.ID); err != nil {
+			respondChaincodeError(w, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  http.StatusOK,
+			"message": message,
+			"assetId": request.ID,
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
+	"google.golang.org/grpc"
+)
+
+// indexerClient forwards the read-only search and statistics requests to the indexer
+// service. The indexer only serves the holders of its API token, so the gateway
+// authorizes the callers.
+type indexerClient struct {
+	grpcConn *grpc.ClientConn
+	baseURL  string
+	token    string
+	client   *http.Client
+}
+
+func newIndexerClient(grpcConn *grpc.ClientConn) *indexerClient {
+	return &indexerClient{
+		grpcConn: grpcConn,
+		baseURL:  strings.TrimSuffix(envOrDefault("INDEXER_URL", "http://indexer:8080"), "/"),
+		token:    os.Getenv("INDEXER_API_TOKEN"),
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// searchHandler searches the names and addresses of the identities. Search results
+// carry every field, so only admins can search.
+func (c *indexerClient) searchHandler() http.HandlerFunc {
+	return c.forward("/search", model.RoleAdmin)
+}
+
+// genderStatsHandler counts the identities by gender.
+func (c *indexerClient) genderStatsHandler() http.HandlerFunc {
+	return c.forward("/stats/gender", model.RoleAdmin, model.RoleAuditor)
+}
+
+// dobStatsHandler counts the identities by year or month of birth.
+func (c *indexerClient) dobStatsHandler() http.HandlerFunc {
+	return c.forward("/stats/dob", model.RoleAdmin, model.RoleAuditor)
+}
+
+// forward authorizes the caller with one of roles and relays the request to the indexer.
+func (c *indexerClient) forward(path string, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorizeRole(w, r, c.grpcConn, roles...); !ok {
+			return
+		}
+
+		target := c.baseURL + path + "?" + r.URL.RawQuery
+		request, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target, nil)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": "Error querying indexer: " + err.Error(),
+			})
+			return
+		}
+		request.Header.Set("Authorization", "Bearer "+c.token)
+
+		response, err := c.client.Do(request)
+		if err != nil {
+			respondJSON(w, http.StatusBadGateway, map[string]interface{}{
+				"status":  http.StatusBadGateway,
+				"message": "Error querying indexer: " + err.Error(),
+			})
+			return
+		}
+		defer response.Body.Close()
+
+		// The caller was authorized, a rejection is a gateway configuration error
+		if response.StatusCode == http.StatusUnauthorized {
+			respondJSON(w, http.StatusBadGateway, map[string]interface{}{
+				"status":  http.StatusBadGateway,
+				"message": "Error querying indexer: INDEXER_API_TOKEN rejected by the indexer",
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(response.StatusCode)
+		io.Copy(w, response.Body)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	phaseEvaluate = "evaluate"
+	phaseEndorse  = "endorse"
+	phaseSubmit   = "submit"
+	phaseCommit   = "commit"
+)
+
+// commitError is returned when a transaction is ordered but fails validation.
+type commitError struct {
+	TransactionID string
+	Code          peer.TxValidationCode
+}
+
+func (e *commitError) Error() string {
+	return fmt.Sprintf("transaction %s failed to commit with status code %d (%s)", e.TransactionID, int32(e.Code), e.Code)
+}
+
+// evaluateTransaction evaluates a transaction on a peer, like Contract.EvaluateTransaction.
+func evaluateTransaction(ctx context.Context, contract *client.Contract, name string, args ...string) ([]byte, error) {
+	var result []byte
+	err := runPhase(context.WithoutCancel(ctx), name, phaseEvaluate, func(ctx context.Context) (err error) {
+		result, err = contract.EvaluateWithContext(ctx, name, client.WithArguments(args...))
+		return err
+	})
+	return result, err
+}
+
+// submitTransaction submits a transaction with string arguments, like Contract.SubmitTransaction.
+func submitTransaction(ctx context.Context, contract *client.Contract, name string, args ...string) ([]byte, error) {
+	return submit(ctx, contract, name, client.WithArguments(args...))
+}
+
+// submit submits a transaction and waits for it to commit, like Contract.Submit. A
+// transaction that fails validation returns a commitError.
+func submit(ctx context.Context, contract *client.Contract, name string, options ...client.ProposalOption) ([]byte, error) {
+	result, status, err := submitWithStatus(ctx, contract, name, options...)
+	if err != nil {
+		return nil, err
+	}
+	if !status.Successful {
+		return nil, &commitError{TransactionID: status.TransactionID, Code: status.Code}
+	}
+	return result, nil
+}
+
+// submitWithStatus endorses a transaction, submits it to the orderer and waits for its
+// commit status, tracing and timing every phase. The status is returned whether or not
+// the transaction is valid. The phases are not cancelled with ctx, a transaction that
+// was sent to the orderer commits even when the caller went away.
+func submitWithStatus(ctx context.Context, contract *client.Contract, name string, options ...client.ProposalOption) (result []byte, status *client.Status, err error) {
+	ctx, span := tracer.Start(context.WithoutCancel(ctx), "transaction "+name,
+		trace.WithAttributes(attribute.String("fabric.transaction", name)))
+	defer func() { endSpan(span, err) }()
+
+	proposal, err := contract.NewProposal(name, options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	span.SetAttributes(attribute.String("fabric.transaction_id", proposal.TransactionID()))
+
+	var transaction *client.Transaction
+	if err = runPhase(ctx, name, phaseEndorse, func(ctx context.Context) (err error) {
+		transaction, err = proposal.EndorseWithContext(ctx)
+		return err
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	var commit *client.Commit
+	if err = runPhase(ctx, name, phaseSubmit, func(ctx context.Context) (err error) {
+		commit, err = transaction.SubmitWithContext(ctx)
+		return err
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	if err = runPhase(ctx, name, phaseCommit, func(ctx context.Context) (err error) {
+		status, err = commit.StatusWithContext(ctx)
+		if err == nil {
+			span := trace.SpanFromContext(ctx)
+			span.SetAttributes(
+				attribute.String("fabric.validation_code", status.Code.String()),
+				attribute.Int64("fabric.block_number", int64(status.BlockNumber)))
+			if !status.Successful {
+				span.SetStatus(codes.Error, "transaction failed validation")
+			}
+		}
+		return err
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	commitStatuses.WithLabelValues(name, status.Code.String()).Inc()
+	return transaction.Result(), status, nil
+}
+
+// runPhase runs a phase of a transaction in its own span and records its latency.
+func runPhase(ctx context.Context, transaction string, phase string, run func(ctx context.Context) error) error {
+	ctx, span := tracer.Start(ctx, phase+" "+transaction,
+		trace.WithAttributes(attribute.String("fabric.transaction", transaction)))
+	start := time.Now()
+	err := run(ctx)
+	observePhase(transaction, phase, start, err)
+	endSpan(span, err)
+	return err
+}
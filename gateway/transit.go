@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// transitKeyPrefix starts the keystore content of a user key held by Vault Transit, a
+// reference such as transit:fabric-user-alice?version=2 in place of a PEM private key.
+const transitKeyPrefix = "transit:"
+
+type vaultTokenKey struct{}
+
+// vaultTokenMiddleware keeps the X-Vault-Token header of the request in its context, to
+// sign with the Transit key of the user.
+func vaultTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get("X-Vault-Token"); token != "" {
+			r = r.WithContext(context.WithValue(r.Context(), vaultTokenKey{}, token))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var transitClient = sync.OnceValues(func() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caPath := envOrDefault("VAULT_CACERT", ""); caPath != "" {
+		caCert, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("invalid Vault CA certificate")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	// Sign requests carry the trace context of the transaction
+	return &http.Client{Transport: otelhttp.NewTransport(transport), Timeout: 10 * time.Second}, nil
+})
+
+// newTransitSign returns a signing function of the Transit key version in reference,
+// authenticated with the Vault token of the request. The key never leaves Vault. The
+// signing function may outlive the request in an async job, so it does not stop when the
+// request is cancelled.
+func newTransitSign(ctx context.Context, reference string) (identity.Sign, error) {
+	token, _ := ctx.Value(vaultTokenKey{}).(string)
+	if token == "" {
+		return nil, errors.New("X-Vault-Token header is required to sign with a Transit key")
+	}
+	name, version, err := parseTransitKeyReference(reference)
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := transitClient()
+	if err != nil {
+		return nil, err
+	}
+
+	signURL := fmt.Sprintf("%s/v1/%s/sign/%s/sha2-256",
+		strings.TrimSuffix(envOrDefault("VAULT_ADDR", "http://vault.vault.svc.cluster.local:8200"), "/"),
+		envOrDefault("TRANSIT_MOUNT", "transit"), url.PathEscape(name))
+	ctx = context.WithoutCancel(ctx)
+
+	return func(digest []byte) ([]byte, error) {
+		body, err := json.Marshal(map[string]interface{}{
+			"input":                base64.StdEncoding.EncodeToString(digest),
+			"prehashed":            true,
+			"key_version":          version,
+			"marshaling_algorithm": "asn1",
+		})
+		if err != nil {
+			return nil, err
+		}
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, signURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("X-Vault-Token", token)
+		request.Header.Set("Content-Type", "application/json")
+
+		response, err := httpClient.Do(request)
+		if err != nil {
+			return nil, fmt.Errorf("vault sign failed: %w", err)
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("vault sign failed: %s", response.Status)
+		}
+
+		var result struct {
+			Data struct {
+				Signature string `json:"signature"`
+			} `json:"data"`
+		}
+		if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+			return nil, fmt.Errorf("invalid vault sign response: %w", err)
+		}
+		return decodeTransitSignature(result.Data.Signature)
+	}, nil
+}
+
+func parseTransitKeyReference(reference string) (string, int, error) {
+	escaped, query, _ := strings.Cut(strings.TrimPrefix(reference, transitKeyPrefix), "?")
+	name, err := url.PathUnescape(escaped)
+	if err != nil || name == "" {
+		return "", 0, fmt.Errorf("invalid transit key reference %q", reference)
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid transit key reference %q", reference)
+	}
+	version, err := strconv.Atoi(values.Get("version"))
+	if err != nil || version < 1 {
+		return "", 0, fmt.Errorf("invalid transit key version in %q", reference)
+	}
+	return name, version, nil
+}
+
+// decodeTransitSignature decodes a Transit signature, vault:v<version>:<base64>, and
+// normalises it to a low S value, the only one Fabric accepts.
+func decodeTransitSignature(signature string) ([]byte, error) {
+	parts := strings.SplitN(signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("invalid transit signature %q", signature)
+	}
+	der, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid transit signature: %w", err)
+	}
+
+	var sig ecdsaSignature
+	if _, err = asn1.Unmarshal(der, &sig); err != nil {
+		return nil, fmt.Errorf("invalid ECDSA signature: %w", err)
+	}
+	return marshalLowS(sig.R, sig.S)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"google.golang.org/grpc/status"
+)
+
+// regionCache caches the defaultRegion of the chaincode configuration, read with an
+// evaluated GetConfig at most once per CONFIG_CACHE_TTL.
+type regionCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	current   string
+	expiresAt time.Time
+}
+
+func newRegionCache() (*regionCache, error) {
+	ttl, err := time.ParseDuration(envOrDefault("CONFIG_CACHE_TTL", "5m"))
+	if err != nil || ttl < 0 {
+		return nil, fmt.Errorf("invalid CONFIG_CACHE_TTL")
+	}
+	return &regionCache{ttl: ttl}, nil
+}
+
+// region returns the cached region, evaluating GetConfig with contract once it has
+// expired. The last region read is kept while the chaincode cannot be reached. The lock
+// is not held during the evaluation, so a slow peer only delays the requests that found
+// the cache expired.
+func (c *regionCache) region(ctx context.Context, contract *client.Contract) (string, error) {
+	c.mu.Lock()
+	current, expiresAt := c.current, c.expiresAt
+	c.mu.Unlock()
+	if current != "" && time.Now().Before(expiresAt) {
+		return current, nil
+	}
+
+	region, err := contractRegion(ctx, contract)
+	if err != nil {
+		if current == "" {
+			return "", err
+		}
+		log.Printf("Failed to read the chaincode configuration, keeping region %s: %v", current, err)
+		return current, nil
+	}
+
+	c.mu.Lock()
+	c.current, c.expiresAt = region, time.Now().Add(c.ttl)
+	c.mu.Unlock()
+	return region, nil
+}
+
+// contractRegion evaluates the defaultRegion of the chaincode configuration.
+func contractRegion(ctx context.Context, contract *client.Contract) (string, error) {
+	result, err := evaluateTransaction(ctx, contract, "GetConfig")
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		DefaultRegion string `json:"defaultRegion"`
+	}
+	if err = json.Unmarshal(result, &config); err != nil {
+		return "", fmt.Errorf("invalid chaincode configuration: %w", err)
+	}
+	if config.DefaultRegion == "" {
+		return model.DefaultRegion, nil
+	}
+	return config.DefaultRegion, nil
+}
+
+// newValidator returns a validator applying the same rules as the chaincode, for the
+// defaultRegion of the chaincode configuration.
+func (c *regionCache) newValidator(ctx context.Context, contract *client.Contract) (*model.Validator, error) {
+	region, err := c.region(ctx, contract)
+	if err != nil {
+		return nil, err
+	}
+	return model.NewValidator(region, time.Now), nil
+}
+
+// respondValidationError reports the field errors of a rejected identity.
+func respondValidationError(w http.ResponseWriter, err error) {
+	var modelErr *model.Error
+	if !errors.As(err, &modelErr) {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"status":  http.StatusBadRequest,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+		"status":  http.StatusBadRequest,
+		"message": "Identity validation failed",
+		"errors":  modelErr.Fields,
+	})
+}
+
+// respondChaincodeError reports a failed transaction. Coded chaincode errors are mapped
+// to the matching HTTP status, any other failure is reported as an internal error.
+func respondChaincodeError(w http.ResponseWriter, err error) {
+	modelErr, ok := chaincodeError(err)
+	if !ok {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"status":  http.StatusInternalServerError,
+			"message": "Chaincode error: " + err.Error(),
+		})
+		return
+	}
+
+	httpStatus := httpStatusOf(modelErr.Code)
+	response := map[string]interface{}{
+		"status":  httpStatus,
+		"code":    modelErr.Code,
+		"message": "Chaincode error: " + modelErr.Message,
+	}
+	if len(modelErr.Fields) > 0 {
+		response["errors"] = modelErr.Fields
+	}
+	respondJSON(w, httpStatus, response)
+}
+
+// chaincodeError extracts the coded error returned by the chaincode. The chaincode message
+// is carried in the details of the gRPC status returned by the gateway peer.
+func chaincodeError(err error) (*model.Error, bool) {
+	if grpcStatus, ok := status.FromError(err); ok {
+		for _, detail := range grpcStatus.Details() {
+			if errDetail, ok := detail.(*gateway.ErrorDetail); ok {
+				if modelErr, ok := model.ParseError(errDetail.GetMessage()); ok {
+					return modelErr, true
+				}
+			}
+		}
+	}
+	return model.ParseError(err.Error())
+}
+
+func httpStatusOf(code model.Code) int {
+	switch code {
+	case model.CodeInvalidArgument, model.CodeValidationFailed:
+		return http.StatusBadRequest
+	case model.CodeForbidden:
+		return http.StatusForbidden
+	case model.CodeNotFound:
+		return http.StatusNotFound
+	case model.CodeAlreadyExists, model.CodeFailedPrecondition:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
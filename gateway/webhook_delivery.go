@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/common"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	replayStatusRunning   = "running"
+	replayStatusCompleted = "completed"
+	replayStatusFailed    = "failed"
+)
+
+// WebhookDelivery is the body posted to the webhooks. ID is the same for every attempt
+// and replay of an event to a webhook, so that receivers can drop duplicates.
+type WebhookDelivery struct {
+	ID          string `json:"id"`
+	BlockNumber uint64 `json:"blockNumber"`
+	model.IdentityEvent
+}
+
+// WebhookReplay is the progress of a replay of the events of a block range to a webhook.
+type WebhookReplay struct {
+	ID        string `json:"id"`
+	WebhookID string `json:"webhookId"`
+	FromBlock uint64 `json:"fromBlock"`
+	ToBlock   uint64 `json:"toBlock"`
+	Status    string `json:"status"`
+	Delivered int    `json:"delivered"`
+	Failed    int    `json:"failed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// webhookDispatcher signs and posts the identity events to the webhooks. Every delivery
+// is queued in the store and posted by the worker of its webhook, oldest first, so that a
+// slow or failing webhook neither holds the event stream nor delays the other webhooks. A
+// delivery is attempted WEBHOOK_MAX_ATTEMPTS times with an exponential delay starting at
+// WEBHOOK_RETRY_DELAY, then stored as a dead letter.
+type webhookDispatcher struct {
+	grpcConn    *grpc.ClientConn
+	store       *webhookStore
+	client      *http.Client
+	maxAttempts int
+	retryDelay  time.Duration
+
+	mu      sync.Mutex
+	replays map[string]*WebhookReplay
+	ctx     context.Context
+	workers map[string]chan struct{}
+}
+
+// newWebhookDispatcher loads the webhooks from WEBHOOK_DIR and registers the dispatcher
+// as the "webhooks" event consumer.
+func newWebhookDispatcher(grpcConn *grpc.ClientConn, events *eventHub) (*webhookDispatcher, error) {
+	maxAttempts, err := strconv.Atoi(envOrDefault("WEBHOOK_MAX_ATTEMPTS", "5"))
+	if err != nil || maxAttempts <= 0 {
+		return nil, fmt.Errorf("invalid WEBHOOK_MAX_ATTEMPTS")
+	}
+	retryDelay, err := time.ParseDuration(envOrDefault("WEBHOOK_RETRY_DELAY", "1s"))
+	if err != nil || retryDelay <= 0 {
+		return nil, fmt.Errorf("invalid WEBHOOK_RETRY_DELAY")
+	}
+	timeout, err := time.ParseDuration(envOrDefault("WEBHOOK_TIMEOUT", "10s"))
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid WEBHOOK_TIMEOUT")
+	}
+
+	store, err := newWebhookStore(envOrDefault("WEBHOOK_DIR", "/var/lib/gateway/webhooks"))
+	if err != nil {
+		return nil, err
+	}
+
+	dispatcher := &webhookDispatcher{
+		grpcConn:    grpcConn,
+		store:       store,
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: maxAttempts,
+		retryDelay:  retryDelay,
+		replays:     make(map[string]*WebhookReplay),
+		workers:     make(map[string]chan struct{}),
+	}
+	if err = events.register("webhooks", dispatcher.handleEvent); err != nil {
+		return nil, err
+	}
+	return dispatcher, nil
+}
+
+// handleEvent queues the event for every webhook that subscribed to its type. It returns
+// once the deliveries are stored, so that the event stream does not wait for the webhooks
+// and the event is only checkpointed when no delivery can be lost.
+func (d *webhookDispatcher) handleEvent(ctx context.Context, event *client.ChaincodeEvent) error {
+	var payload model.IdentityEvent
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		log.Printf("Skipping event %s of transaction %s: %v", event.EventName, event.TransactionID, err)
+		return nil
+	}
+
+	for _, webhook := range d.store.list() {
+		if !webhook.accepts(payload.Type) {
+			continue
+		}
+		if err := d.store.enqueue(webhook.ID, newDelivery(webhook, event, payload)); err != nil {
+			return fmt.Errorf("failed to queue delivery to webhook %s: %w", webhook.ID, err)
+		}
+		d.wake(webhook.ID)
+	}
+	return nil
+}
+
+// Run starts the workers of the webhooks, which post the queued deliveries until ctx is
+// done. The deliveries queued before a restart are posted first.
+func (d *webhookDispatcher) Run(ctx context.Context) {
+	d.mu.Lock()
+	d.ctx = ctx
+	d.mu.Unlock()
+
+	for _, webhook := range d.store.list() {
+		d.wake(webhook.ID)
+	}
+}
+
+// wake signals the worker of the webhook that a delivery is queued, starting the worker
+// when the webhook has none. Deliveries queued before Run wait for it.
+func (d *webhookDispatcher) wake(webhookID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ctx == nil {
+		return
+	}
+
+	signal, ok := d.workers[webhookID]
+	if !ok {
+		signal = make(chan struct{}, 1)
+		d.workers[webhookID] = signal
+		go d.work(d.ctx, webhookID, signal)
+	}
+	select {
+	case signal <- struct{}{}:
+	default:
+	}
+}
+
+// work posts the queued deliveries of the webhook one at a time until ctx is done or the
+// webhook is deleted. A delivery is dequeued once it was posted or stored as a dead letter.
+func (d *webhookDispatcher) work(ctx context.Context, webhookID string, signal chan struct{}) {
+	defer func() {
+		d.mu.Lock()
+		delete(d.workers, webhookID)
+		d.mu.Unlock()
+	}()
+
+	for ctx.Err() == nil {
+		webhook, err := d.store.get(webhookID)
+		if err != nil {
+			return
+		}
+
+		queued := d.store.nextQueued(webhookID)
+		if queued == nil {
+			select {
+			case <-ctx.Done():
+			case <-signal:
+			}
+			continue
+		}
+
+		if _, err = d.deliver(ctx, webhook, &queued.Delivery); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Webhook %s delivery %s stays queued, retrying in %s: %v", webhookID, queued.Delivery.ID, d.retryDelay, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(d.retryDelay):
+			}
+			continue
+		}
+		if err = d.store.dequeue(webhookID, queued.Delivery.ID); err != nil {
+			log.Printf("Failed to dequeue webhook %s delivery %s: %v", webhookID, queued.Delivery.ID, err)
+		}
+	}
+}
+
+func newDelivery(webhook *Webhook, event *client.ChaincodeEvent, payload model.IdentityEvent) *WebhookDelivery {
+	sum := sha256.Sum256([]byte(webhook.ID + "/" + event.TransactionID + "/" + event.EventName))
+	return &WebhookDelivery{
+		ID:            hex.EncodeToString(sum[:16]),
+		BlockNumber:   event.BlockNumber,
+		IdentityEvent: payload,
+	}
+}
+
+// deliver posts the delivery with retries and stores it as a dead letter when every
+// attempt failed. It reports whether the delivery succeeded, the error is only set when
+// the dead letter could not be stored.
+func (d *webhookDispatcher) deliver(ctx context.Context, webhook *Webhook, delivery *WebhookDelivery) (bool, error) {
+	delay := d.retryDelay
+	var status int
+	var err error
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		if status, err = d.post(ctx, webhook, delivery); err == nil {
+			return true, nil
+		}
+		if attempt == d.maxAttempts {
+			break
+		}
+		log.Printf("Webhook %s delivery %s attempt %d failed, retrying in %s: %v", webhook.ID, delivery.ID, attempt, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+
+	log.Printf("Webhook %s delivery %s failed after %d attempts: %v", webhook.ID, delivery.ID, d.maxAttempts, err)
+	return false, d.store.addDeadLetter(&DeadLetter{
+		WebhookID:  webhook.ID,
+		Delivery:   *delivery,
+		Attempts:   d.maxAttempts,
+		LastStatus: status,
+		LastError:  err.Error(),
+		FailedAt:   time.Now().UTC(),
+	})
+}
+
+// post sends one signed delivery attempt. The X-Webhook-Signature header carries the
+// timestamp and the HMAC-SHA256 of "<timestamp>.<body>" with the webhook secret.
+func (d *webhookDispatcher) post(ctx context.Context, webhook *Webhook, delivery *WebhookDelivery) (int, error) {
+	body, err := json.Marshal(delivery)
+	if err != nil {
+		return 0, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-ID", webhook.ID)
+	request.Header.Set("X-Webhook-Delivery", delivery.ID)
+	request.Header.Set("X-Webhook-Event", delivery.Type)
+	request.Header.Set("X-Webhook-Signature", "t="+timestamp+",v1="+signDelivery(webhook.Secret, timestamp, body))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+func signDelivery(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// replayHandler delivers again the events of the blocks fromBlock to toBlock to a webhook.
+// toBlock defaults to the last committed block.
+func (d *webhookDispatcher) replayHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorizeRole(w, r, d.grpcConn, model.RoleAdmin); !ok {
+			return
+		}
+
+		webhook, err := d.store.get(chi.URLParam(r, "id"))
+		if err != nil {
+			respondWebhookError(w, err)
+			return
+		}
+
+		// Parse request body
+		var request struct {
+			FromBlock uint64  `json:"fromBlock"`
+			ToBlock   *uint64 `json:"toBlock"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&request); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request body: " + err.Error(),
+			})
+			return
+		}
+
+		gw, err := newServiceGateway(d.grpcConn)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": "Error connecting the event listener: " + err.Error(),
+			})
+			return
+		}
+
+		channelName := envOrDefault("CHANNEL_NAME", "mychannel")
+		network := gw.GetNetwork(channelName)
+		height, err := chainHeight(network, channelName)
+		if err != nil {
+			gw.Close()
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		toBlock := height - 1
+		if request.ToBlock != nil && *request.ToBlock < toBlock {
+			toBlock = *request.ToBlock
+		}
+		if request.FromBlock > toBlock {
+			gw.Close()
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": fmt.Sprintf("fromBlock must not be after toBlock %d", toBlock),
+			})
+			return
+		}
+
+		id, err := newRecordID()
+		if err != nil {
+			gw.Close()
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": "Error creating replay: " + err.Error(),
+			})
+			return
+		}
+
+		replay := &WebhookReplay{
+			ID:        id,
+			WebhookID: webhook.ID,
+			FromBlock: request.FromBlock,
+			ToBlock:   toBlock,
+			Status:    replayStatusRunning,
+		}
+		d.mu.Lock()
+		d.replays[replay.ID] = replay
+		d.mu.Unlock()
+
+		go func() {
+			defer gw.Close()
+			d.replay(context.Background(), network, webhook, replay)
+		}()
+
+		respondJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status":  http.StatusAccepted,
+			"message": "Replay started",
+			"replay":  d.replaySnapshot(replay),
+		})
+	}
+}
+
+// replayJobHandler reports the progress of a replay.
+func (d *webhookDispatcher) replayJobHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorizeRole(w, r, d.grpcConn, model.RoleAdmin); !ok {
+			return
+		}
+
+		d.mu.Lock()
+		replay, ok := d.replays[chi.URLParam(r, "replayId")]
+		d.mu.Unlock()
+		if !ok || replay.WebhookID != chi.URLParam(r, "id") {
+			respondJSON(w, http.StatusNotFound, map[string]interface{}{
+				"status":  http.StatusNotFound,
+				"message": "replay not found",
+			})
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status": http.StatusOK,
+			"replay": d.replaySnapshot(replay),
+		})
+	}
+}
+
+func (d *webhookDispatcher) replaySnapshot(replay *WebhookReplay) WebhookReplay {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return *replay
+}
+
+// replay reads the blocks of the range and delivers their identity events. Blocks are
+// read rather than chaincode events so that the replay ends at toBlock even when the
+// last blocks of the range hold no identity event.
+func (d *webhookDispatcher) replay(ctx context.Context, network *client.Network, webhook *Webhook, replay *WebhookReplay) {
+	chaincodeName := envOrDefault("CHAINCODE_NAME", "identity")
+
+	err := func() error {
+		streamCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		blocks, err := network.BlockEvents(streamCtx, client.WithStartBlock(replay.FromBlock))
+		if err != nil {
+			return fmt.Errorf("failed to read blocks: %w", err)
+		}
+
+		for block := range blocks {
+			for _, event := range blockChaincodeEvents(block, chaincodeName) {
+				var payload model.IdentityEvent
+				if err = json.Unmarshal(event.Payload, &payload); err != nil || !webhook.accepts(payload.Type) {
+					continue
+				}
+
+				delivered, err := d.deliver(ctx, webhook, newDelivery(webhook, event, payload))
+				if err != nil {
+					return err
+				}
+				d.mu.Lock()
+				if delivered {
+					replay.Delivered++
+				} else {
+					replay.Failed++
+				}
+				d.mu.Unlock()
+			}
+
+			if block.GetHeader().GetNumber() >= replay.ToBlock {
+				return nil
+			}
+		}
+		return fmt.Errorf("block stream closed")
+	}()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		replay.Status = replayStatusFailed
+		replay.Error = err.Error()
+		log.Printf("Webhook %s replay %s failed: %v", webhook.ID, replay.ID, err)
+		return
+	}
+	replay.Status = replayStatusCompleted
+}
+
+// blockChaincodeEvents returns the events of the chaincode set by the valid transactions
+// of the block.
+func blockChaincodeEvents(block *common.Block, chaincodeName string) []*client.ChaincodeEvent {
+	var events []*client.ChaincodeEvent
+
+	validationCodes := block.GetMetadata().GetMetadata()[common.BlockMetadataIndex_TRANSACTIONS_FILTER]
+	for i, envelopeBytes := range block.GetData().GetData() {
+		if i < len(validationCodes) && peer.TxValidationCode(validationCodes[i]) != peer.TxValidationCode_VALID {
+			continue
+		}
+
+		envelope := &common.Envelope{}
+		payload := &common.Payload{}
+		channelHeader := &common.ChannelHeader{}
+		transaction := &peer.Transaction{}
+		if proto.Unmarshal(envelopeBytes, envelope) != nil ||
+			proto.Unmarshal(envelope.GetPayload(), payload) != nil ||
+			proto.Unmarshal(payload.GetHeader().GetChannelHeader(), channelHeader) != nil ||
+			common.HeaderType(channelHeader.GetType()) != common.HeaderType_ENDORSER_TRANSACTION ||
+			proto.Unmarshal(payload.GetData(), transaction) != nil {
+			continue
+		}
+
+		for _, action := range transaction.GetActions() {
+			actionPayload := &peer.ChaincodeActionPayload{}
+			responsePayload := &peer.ProposalResponsePayload{}
+			chaincodeAction := &peer.ChaincodeAction{}
+			chaincodeEvent := &peer.ChaincodeEvent{}
+			if proto.Unmarshal(action.GetPayload(), actionPayload) != nil ||
+				proto.Unmarshal(actionPayload.GetAction().GetProposalResponsePayload(), responsePayload) != nil ||
+				proto.Unmarshal(responsePayload.GetExtension(), chaincodeAction) != nil ||
+				proto.Unmarshal(chaincodeAction.GetEvents(), chaincodeEvent) != nil {
+				continue
+			}
+			if chaincodeEvent.GetChaincodeId() != chaincodeName || chaincodeEvent.GetEventName() == "" {
+				continue
+			}
+
+			events = append(events, &client.ChaincodeEvent{
+				BlockNumber:   block.GetHeader().GetNumber(),
+				TransactionID: channelHeader.GetTxId(),
+				ChaincodeName: chaincodeEvent.GetChaincodeId(),
+				EventName:     chaincodeEvent.GetEventName(),
+				Payload:       chaincodeEvent.GetPayload(),
+			})
+		}
+	}
+	return events
+}
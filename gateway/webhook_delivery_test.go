@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// webhookReceiver is a webhook endpoint answering the statuses in turn, then 200.
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+	times    []time.Time
+	received chan struct{}
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	t.Helper()
+	receiver := &webhookReceiver{statuses: statuses, received: make(chan struct{}, 100)}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		receiver.mu.Lock()
+		receiver.requests = append(receiver.requests, r)
+		receiver.bodies = append(receiver.bodies, body)
+		receiver.times = append(receiver.times, time.Now())
+		status := http.StatusOK
+		if len(receiver.statuses) > 0 {
+			status, receiver.statuses = receiver.statuses[0], receiver.statuses[1:]
+		}
+		receiver.mu.Unlock()
+
+		w.WriteHeader(status)
+		receiver.received <- struct{}{}
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (r *webhookReceiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+// newTestDispatcher returns a dispatcher storing its webhooks in a temporary directory.
+func newTestDispatcher(t *testing.T, dir string, maxAttempts int, retryDelay time.Duration) *webhookDispatcher {
+	t.Helper()
+	store, err := newWebhookStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &webhookDispatcher{
+		store:       store,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		maxAttempts: maxAttempts,
+		retryDelay:  retryDelay,
+		replays:     make(map[string]*WebhookReplay),
+		workers:     make(map[string]chan struct{}),
+	}
+}
+
+func createTestWebhook(t *testing.T, d *webhookDispatcher, url string, eventTypes ...string) *Webhook {
+	t.Helper()
+	webhook := &Webhook{URL: url, EventTypes: eventTypes}
+	if err := d.store.create(webhook); err != nil {
+		t.Fatal(err)
+	}
+	return webhook
+}
+
+func testChaincodeEvent(t *testing.T, eventType string, txID string) *client.ChaincodeEvent {
+	t.Helper()
+	payload, err := json.Marshal(model.IdentityEvent{Type: eventType, IdentityID: "id1", TxID: txID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client.ChaincodeEvent{BlockNumber: 7, TransactionID: txID, ChaincodeName: "identity", EventName: eventType, Payload: payload}
+}
+
+func TestPostSignature(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	d := newTestDispatcher(t, t.TempDir(), 1, time.Millisecond)
+	webhook := createTestWebhook(t, d, receiver.URL)
+	delivery := newDelivery(webhook, testChaincodeEvent(t, model.EventIdentityCreated, "tx1"), model.IdentityEvent{Type: model.EventIdentityCreated, IdentityID: "id1"})
+
+	if _, err := d.post(context.Background(), webhook, delivery); err != nil {
+		t.Fatalf("post: %v", err)
+	}
+
+	request, body := receiver.requests[0], receiver.bodies[0]
+	headers := map[string]string{
+		"X-Webhook-ID":       webhook.ID,
+		"X-Webhook-Delivery": delivery.ID,
+		"X-Webhook-Event":    model.EventIdentityCreated,
+		"Content-Type":       "application/json",
+	}
+	for name, want := range headers {
+		if got := request.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	timestamp, signature, ok := strings.Cut(request.Header.Get("X-Webhook-Signature"), ",")
+	if !ok || !strings.HasPrefix(timestamp, "t=") || !strings.HasPrefix(signature, "v1=") {
+		t.Fatalf("X-Webhook-Signature = %q, want t=<timestamp>,v1=<signature>", request.Header.Get("X-Webhook-Signature"))
+	}
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write([]byte(strings.TrimPrefix(timestamp, "t=") + "." + string(body)))
+	if want := hex.EncodeToString(mac.Sum(nil)); strings.TrimPrefix(signature, "v1=") != want {
+		t.Errorf("signature %s, want the HMAC-SHA256 %s of the timestamp and body", signature, want)
+	}
+
+	var posted WebhookDelivery
+	if err := json.Unmarshal(body, &posted); err != nil || posted.ID != delivery.ID || posted.BlockNumber != 7 || posted.IdentityID != "id1" {
+		t.Errorf("posted delivery %s: %v", body, err)
+	}
+
+	// Another secret gives another signature
+	if signDelivery("other", "1", body) == signDelivery(webhook.Secret, "1", body) {
+		t.Error("signature does not depend on the secret")
+	}
+}
+
+func TestDeliverRetryBackoff(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError, http.StatusBadGateway)
+	retryDelay := 20 * time.Millisecond
+	d := newTestDispatcher(t, t.TempDir(), 5, retryDelay)
+	webhook := createTestWebhook(t, d, receiver.URL)
+	delivery := newDelivery(webhook, testChaincodeEvent(t, model.EventIdentityCreated, "tx1"), model.IdentityEvent{Type: model.EventIdentityCreated})
+
+	delivered, err := d.deliver(context.Background(), webhook, delivery)
+	if !delivered || err != nil {
+		t.Fatalf("deliver = %v, %v, want delivered", delivered, err)
+	}
+	if receiver.count() != 3 {
+		t.Fatalf("%d attempts, want 3", receiver.count())
+	}
+	// The delay doubles after every failed attempt
+	for i, want := range []time.Duration{retryDelay, 2 * retryDelay} {
+		if gap := receiver.times[i+1].Sub(receiver.times[i]); gap < want {
+			t.Errorf("delay before attempt %d = %s, want at least %s", i+2, gap, want)
+		}
+	}
+	for _, body := range receiver.bodies[1:] {
+		if string(body) != string(receiver.bodies[0]) {
+			t.Errorf("retried body %s, want %s", body, receiver.bodies[0])
+		}
+	}
+	if letters := d.store.listDeadLetters(webhook.ID); len(letters) != 0 {
+		t.Errorf("%d dead letters after a delivery, want none", len(letters))
+	}
+}
+
+func TestDeliverDeadLetter(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	dir := t.TempDir()
+	d := newTestDispatcher(t, dir, 3, time.Millisecond)
+	webhook := createTestWebhook(t, d, receiver.URL)
+	delivery := newDelivery(webhook, testChaincodeEvent(t, model.EventIdentityDeleted, "tx1"), model.IdentityEvent{Type: model.EventIdentityDeleted})
+
+	delivered, err := d.deliver(context.Background(), webhook, delivery)
+	if delivered || err != nil {
+		t.Fatalf("deliver = %v, %v, want a dead letter", delivered, err)
+	}
+	if receiver.count() != 3 {
+		t.Errorf("%d attempts, want 3", receiver.count())
+	}
+
+	letters := d.store.listDeadLetters(webhook.ID)
+	if len(letters) != 1 {
+		t.Fatalf("%d dead letters, want 1", len(letters))
+	}
+	letter := letters[0]
+	if letter.Delivery.ID != delivery.ID || letter.Attempts != 3 || letter.LastStatus != http.StatusServiceUnavailable || letter.LastError == "" {
+		t.Errorf("dead letter %+v", letter)
+	}
+
+	// Dead letters survive a restart
+	reloaded, err := newWebhookStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reloaded.deadLetter(webhook.ID, letter.ID); err != nil {
+		t.Errorf("reloaded dead letter: %v", err)
+	}
+}
+
+func TestHandleEventQueuesDeliveries(t *testing.T) {
+	// The first webhook holds its requests until release is closed
+	release := make(chan struct{})
+	var slowRequests sync.WaitGroup
+	slowRequests.Add(1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowRequests.Done()
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := newWebhookReceiver(t)
+
+	dir := t.TempDir()
+	d := newTestDispatcher(t, dir, 1, time.Millisecond)
+	slowHook := createTestWebhook(t, d, slow.URL)
+	fastHook := createTestWebhook(t, d, fast.URL, model.EventIdentityCreated)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.Run(ctx)
+
+	done := make(chan error)
+	go func() {
+		if err := d.handleEvent(ctx, testChaincodeEvent(t, model.EventIdentityCreated, "tx1")); err != nil {
+			done <- err
+			return
+		}
+		done <- d.handleEvent(ctx, testChaincodeEvent(t, model.EventIdentityUpdated, "tx2"))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("handleEvent: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleEvent waits for the webhooks")
+	}
+
+	// The slow webhook does not delay the other one, which only subscribed to IdentityCreated
+	select {
+	case <-fast.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery to the fast webhook not posted")
+	}
+	slowRequests.Wait()
+	if fast.count() != 1 {
+		t.Errorf("fast webhook received %d deliveries, want 1", fast.count())
+	}
+	waitFor(t, func() bool { return d.store.nextQueued(fastHook.ID) == nil })
+
+	// The deliveries of the slow webhook stay queued, on disk, in order
+	queued := d.store.nextQueued(slowHook.ID)
+	if queued == nil || queued.Delivery.TxID != "tx1" {
+		t.Fatalf("next queued delivery of the slow webhook %+v, want tx1", queued)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "queue", "*.json"))
+	if len(files) != 2 {
+		t.Errorf("%d queued delivery files, want 2", len(files))
+	}
+
+	// An event read again before its checkpoint is not queued twice
+	if err := d.handleEvent(ctx, testChaincodeEvent(t, model.EventIdentityUpdated, "tx2")); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := newWebhookStore(dir); err != nil || len(reloaded.queues[slowHook.ID]) != 2 {
+		t.Errorf("reloaded queue of the slow webhook: %v, want 2 deliveries", err)
+	}
+}
+
+func TestQueuedDeliveriesResumeAfterRestart(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	dir := t.TempDir()
+
+	d := newTestDispatcher(t, dir, 1, time.Millisecond)
+	webhook := createTestWebhook(t, d, receiver.URL)
+	// Events are queued while the dispatcher is not running, as before a crash
+	for _, txID := range []string{"tx1", "tx2"} {
+		if err := d.handleEvent(context.Background(), testChaincodeEvent(t, model.EventIdentityCreated, txID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if receiver.count() != 0 {
+		t.Fatalf("%d deliveries posted before Run, want none", receiver.count())
+	}
+
+	restarted := newTestDispatcher(t, dir, 1, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restarted.Run(ctx)
+
+	waitFor(t, func() bool { return receiver.count() == 2 })
+	waitFor(t, func() bool { return restarted.store.nextQueued(webhook.ID) == nil })
+	var first WebhookDelivery
+	if err := json.Unmarshal(receiver.bodies[0], &first); err != nil || first.TxID != "tx1" {
+		t.Errorf("first delivery %s, want tx1", receiver.bodies[0])
+	}
+	if files, _ := os.ReadDir(filepath.Join(dir, "queue")); len(files) != 0 {
+		t.Errorf("%d queued delivery files left, want none", len(files))
+	}
+}
+
+// waitFor fails the test unless condition becomes true within 5 seconds.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatal("condition not met after 5s")
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hyperledger/digital-identity/model"
+)
+
+var (
+	errWebhookNotFound    = errors.New("webhook not found")
+	errDeadLetterNotFound = errors.New("dead letter not found")
+)
+
+// Webhook is a partner callback receiving the identity events. The secret signs the
+// deliveries and is only returned when the webhook is created.
+type Webhook struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	EventTypes  []string  `json:"eventTypes"`
+	Description string    `json:"description,omitempty"`
+	Secret      string    `json:"secret,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// accepts returns true when the webhook subscribed to the event type. Webhooks without
+// event types receive every event.
+func (h *Webhook) accepts(eventType string) bool {
+	if len(h.EventTypes) == 0 {
+		return true
+	}
+	for _, accepted := range h.EventTypes {
+		if accepted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// DeadLetter is a delivery that failed after every attempt. It is kept until it is
+// retried successfully.
+type DeadLetter struct {
+	ID         string          `json:"id"`
+	WebhookID  string          `json:"webhookId"`
+	Delivery   WebhookDelivery `json:"delivery"`
+	Attempts   int             `json:"attempts"`
+	LastStatus int             `json:"lastStatus,omitempty"`
+	LastError  string          `json:"lastError"`
+	FailedAt   time.Time       `json:"failedAt"`
+}
+
+// queuedDelivery is a delivery waiting for the worker of its webhook. It is stored before
+// the event is checkpointed, so that it is posted after a restart.
+type queuedDelivery struct {
+	WebhookID string          `json:"webhookId"`
+	Delivery  WebhookDelivery `json:"delivery"`
+	QueuedAt  time.Time       `json:"queuedAt"`
+}
+
+// webhookStore keeps the webhooks, queued deliveries and dead letters in memory and writes
+// every change to a JSON file per record in WEBHOOK_DIR.
+type webhookStore struct {
+	mu          sync.Mutex
+	dir         string
+	webhooks    map[string]*Webhook
+	queues      map[string][]*queuedDelivery
+	deadLetters map[string]*DeadLetter
+}
+
+func newWebhookStore(dir string) (*webhookStore, error) {
+	store := &webhookStore{
+		dir:         dir,
+		webhooks:    make(map[string]*Webhook),
+		queues:      make(map[string][]*queuedDelivery),
+		deadLetters: make(map[string]*DeadLetter),
+	}
+
+	for _, sub := range []string{"hooks", "queue", "deadletters"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create webhook directory: %w", err)
+		}
+	}
+
+	if err := loadRecords(filepath.Join(dir, "hooks"), func(jsonByte []byte) error {
+		var webhook Webhook
+		if err := json.Unmarshal(jsonByte, &webhook); err != nil {
+			return err
+		}
+		store.webhooks[webhook.ID] = &webhook
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := loadRecords(filepath.Join(dir, "queue"), func(jsonByte []byte) error {
+		var queued queuedDelivery
+		if err := json.Unmarshal(jsonByte, &queued); err != nil {
+			return err
+		}
+		store.queues[queued.WebhookID] = append(store.queues[queued.WebhookID], &queued)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for _, queue := range store.queues {
+		sort.Slice(queue, func(i, j int) bool {
+			return queue[i].QueuedAt.Before(queue[j].QueuedAt)
+		})
+	}
+
+	if err := loadRecords(filepath.Join(dir, "deadletters"), func(jsonByte []byte) error {
+		var letter DeadLetter
+		if err := json.Unmarshal(jsonByte, &letter); err != nil {
+			return err
+		}
+		store.deadLetters[letter.ID] = &letter
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func loadRecords(dir string, load func(jsonByte []byte) error) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		jsonByte, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		if err = load(jsonByte); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// writeRecord writes the record file atomically. The caller holds the store lock.
+func (s *webhookStore) writeRecord(sub string, id string, record interface{}) error {
+	jsonByte, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, sub, id+".json")
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, jsonByte, 0o600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", sub, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func newRecordID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// create persists a new webhook with a random signing secret.
+func (s *webhookStore) create(webhook *Webhook) error {
+	id, err := newRecordID()
+	if err != nil {
+		return err
+	}
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	webhook.ID = id
+	webhook.Secret = hex.EncodeToString(secret)
+	webhook.CreatedAt = time.Now().UTC()
+	if err = s.writeRecord("hooks", webhook.ID, webhook); err != nil {
+		return err
+	}
+	s.webhooks[webhook.ID] = webhook
+	return nil
+}
+
+// get returns the webhook with its secret, for deliveries.
+func (s *webhookStore) get(id string) (*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	webhook, ok := s.webhooks[id]
+	if !ok {
+		return nil, errWebhookNotFound
+	}
+	copied := *webhook
+	return &copied, nil
+}
+
+// list returns the webhooks with their secrets, ordered by creation.
+func (s *webhookStore) list() []*Webhook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	webhooks := []*Webhook{}
+	for _, webhook := range s.webhooks {
+		copied := *webhook
+		webhooks = append(webhooks, &copied)
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+	})
+	return webhooks
+}
+
+// delete removes the webhook and its dead letters.
+func (s *webhookStore) delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webhooks[id]; !ok {
+		return errWebhookNotFound
+	}
+	if err := os.Remove(filepath.Join(s.dir, "hooks", id+".json")); err != nil {
+		return err
+	}
+	delete(s.webhooks, id)
+
+	for _, queued := range s.queues[id] {
+		os.Remove(filepath.Join(s.dir, "queue", queued.Delivery.ID+".json"))
+	}
+	delete(s.queues, id)
+
+	for letterID, letter := range s.deadLetters {
+		if letter.WebhookID == id {
+			os.Remove(filepath.Join(s.dir, "deadletters", letterID+".json"))
+			delete(s.deadLetters, letterID)
+		}
+	}
+	return nil
+}
+
+// enqueue persists a delivery at the end of the queue of the webhook. A delivery already
+// queued, for an event read again before its checkpoint, is not queued twice.
+func (s *webhookStore) enqueue(webhookID string, delivery *WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, queued := range s.queues[webhookID] {
+		if queued.Delivery.ID == delivery.ID {
+			return nil
+		}
+	}
+
+	queued := &queuedDelivery{WebhookID: webhookID, Delivery: *delivery, QueuedAt: time.Now().UTC()}
+	if err := s.writeRecord("queue", delivery.ID, queued); err != nil {
+		return err
+	}
+	s.queues[webhookID] = append(s.queues[webhookID], queued)
+	return nil
+}
+
+// nextQueued returns the oldest queued delivery of the webhook, nil when its queue is empty.
+func (s *webhookStore) nextQueued(webhookID string) *queuedDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue := s.queues[webhookID]
+	if len(queue) == 0 {
+		return nil
+	}
+	copied := *queue[0]
+	return &copied
+}
+
+// dequeue removes a delivery from the queue of the webhook once it was posted or stored
+// as a dead letter. The delivery leaves the queue in memory even when its file cannot be
+// removed, it is then posted again after a restart.
+func (s *webhookStore) dequeue(webhookID string, deliveryID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue := s.queues[webhookID]
+	for i, queued := range queue {
+		if queued.Delivery.ID == deliveryID {
+			s.queues[webhookID] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(s.queues[webhookID]) == 0 {
+		delete(s.queues, webhookID)
+	}
+
+	if err := os.Remove(filepath.Join(s.dir, "queue", deliveryID+".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// addDeadLetter persists a failed delivery.
+func (s *webhookStore) addDeadLetter(letter *DeadLetter) error {
+	id, err := newRecordID()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letter.ID = id
+	if err = s.writeRecord("deadletters", letter.ID, letter); err != nil {
+		return err
+	}
+	s.deadLetters[letter.ID] = letter
+	return nil
+}
+
+// deadLetter returns a dead letter of the webhook.
+func (s *webhookStore) deadLetter(webhookID string, id string) (*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letter, ok := s.deadLetters[id]
+	if !ok || letter.WebhookID != webhookID {
+		return nil, errDeadLetterNotFound
+	}
+	copied := *letter
+	return &copied, nil
+}
+
+// listDeadLetters returns the dead letters of the webhook, oldest first.
+func (s *webhookStore) listDeadLetters(webhookID string) []*DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters := []*DeadLetter{}
+	for _, letter := range s.deadLetters {
+		if letter.WebhookID == webhookID {
+			copied := *letter
+			letters = append(letters, &copied)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].FailedAt.Before(letters[j].FailedAt)
+	})
+	return letters
+}
+
+// removeDeadLetter deletes a dead letter once it was delivered.
+func (s *webhookStore) removeDeadLetter(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(filepath.Join(s.dir, "deadletters", id+".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(s.deadLetters, id)
+	return nil
+}
+
+// redacted returns the webhook without its secret.
+func redacted(webhook *Webhook) *Webhook {
+	copied := *webhook
+	copied.Secret = ""
+	return &copied
+}
+
+// createWebhookHandler registers a partner callback. The response carries the signing
+// secret, which is not returned again.
+func (d *webhookDispatcher) createWebhookHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorizeRole(w, r, d.grpcConn, model.RoleAdmin); !ok {
+			return
+		}
+
+		// Parse request body
+		var request struct {
+			URL         string   `json:"url"`
+			EventTypes  []string `json:"eventTypes"`
+			Description string   `json:"description"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request body: " + err.Error(),
+			})
+			return
+		}
+
+		target, err := url.Parse(request.URL)
+		if err != nil || (target.Scheme != "https" && target.Scheme != "http") || target.Host == "" {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "url must be an absolute http or https URL",
+			})
+			return
+		}
+
+		for _, eventType := range request.EventTypes {
+			if !model.IsEventType(eventType) {
+				respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+					"status":  http.StatusBadRequest,
+					"message": fmt.Sprintf("unknown event type %s", eventType),
+				})
+				return
+			}
+		}
+		if request.EventTypes == nil {
+			request.EventTypes = []string{}
+		}
+
+		webhook := &Webhook{URL: request.URL, EventTypes: request.EventTypes, Description: request.Description}
+		if err = d.store.create(webhook); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": "Error creating webhook: " + err.Error(),
+			})
+			return
+		}
+
+		respondJSON(w, http.StatusCreated, map[string]interface{}{
+			"status":  http.StatusCreated,
+			"message": "Webhook created, store the secret to verify the deliveries",
+			"webhook": webhook,
+		})
+	}
+}
+
+func (d *webhookDispatcher) listWebhooksHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorizeRole(w, r, d.grpcConn, model.RoleAdmin); !ok {
+			return
+		}
+
+		webhooks := d.store.list()
+		for i, webhook := range webhooks {
+			webhooks[i] = redacted(webhook)
+		}
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":   http.StatusOK,
+			"webhooks": webhooks,
+		})
+	}
+}
+
+func (d *webhookDispatcher) getWebhookHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorizeRole(w, r, d.grpcConn, model.RoleAdmin); !ok {
+			return
+		}
+
+		webhook, err := d.store.get(chi.URLParam(r, "id"))
+		if err != nil {
+			respondWebhookError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  http.StatusOK,
+			"webhook": redacted(webhook),
+		})
+	}
+}
+
+func (d *webhookDispatcher) deleteWebhookHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorizeRole(w, r, d.grpcConn, model.RoleAdmin); !ok {
+			return
+		}
+
+		if err := d.store.delete(chi.URLParam(r, "id")); err != nil {
+			respondWebhookError(w, err)
+			return
+		}
+		// The worker of the webhook stops once it finds the webhook deleted
+		d.wake(chi.URLParam(r, "id"))
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  http.StatusOK,
+			"message": "Webhook deleted",
+		})
+	}
+}
+
+func (d *webhookDispatcher) deadLettersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorizeRole(w, r, d.grpcConn, model.RoleAdmin); !ok {
+			return
+		}
+
+		id := chi.URLParam(r, "id")
+		if _, err := d.store.get(id); err != nil {
+			respondWebhookError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":      http.StatusOK,
+			"deadLetters": d.store.listDeadLetters(id),
+		})
+	}
+}
+
+// retryDeadLetterHandler delivers a dead letter again and removes it once delivered.
+func (d *webhookDispatcher) retryDeadLetterHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorizeRole(w, r, d.grpcConn, model.RoleAdmin); !ok {
+			return
+		}
+
+		webhook, err := d.store.get(chi.URLParam(r, "id"))
+		if err != nil {
+			respondWebhookError(w, err)
+			return
+		}
+		letter, err := d.store.deadLetter(webhook.ID, chi.URLParam(r, "letterId"))
+		if err != nil {
+			respondWebhookError(w, err)
+			return
+		}
+
+		if status, err := d.post(r.Context(), webhook, &letter.Delivery); err != nil {
+			respondJSON(w, http.StatusBadGateway, map[string]interface{}{
+				"status":         http.StatusBadGateway,
+				"message":        "Delivery failed: " + err.Error(),
+				"responseStatus": status,
+			})
+			return
+		}
+
+		if err = d.store.removeDeadLetter(letter.ID); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": "Error removing dead letter: " + err.Error(),
+			})
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  http.StatusOK,
+			"message": "Dead letter delivered",
+		})
+	}
+}
+
+func respondWebhookError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errWebhookNotFound) || errors.Is(err, errDeadLetterNotFound) {
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{
+			"status":  http.StatusNotFound,
+			"message": err.Error(),
+		})
+		return
+	}
+	respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+		"status":  http.StatusInternalServerError,
+		"message": err.Error(),
+	})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+)
+
+// requireToken rejects the requests that do not carry the shared API token as a bearer
+// token. The gateway, which authorizes the clients, is the only caller holding it.
+func requireToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				respondJSON(w, http.StatusUnauthorized, map[string]interface{}{
+					"status":  http.StatusUnauthorized,
+					"message": "missing or invalid API token",
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// searchHandler serves full-text search on the names and addresses of the identities.
+func searchHandler(s *store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		limit, ok := intParam(w, query.Get("limit"), defaultSearchLimit)
+		if !ok {
+			return
+		}
+		offset, ok := intParam(w, query.Get("offset"), 0)
+		if !ok {
+			return
+		}
+		limit = min(limit, maxSearchLimit)
+
+		includeDeleted := false
+		if value := query.Get("includeDeleted"); value != "" {
+			var err error
+			if includeDeleted, err = strconv.ParseBool(value); err != nil {
+				respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+					"status":  http.StatusBadRequest,
+					"message": "includeDeleted must be true or false",
+				})
+				return
+			}
+		}
+
+		result, err := s.Search(r.Context(), query.Get("q"), includeDeleted, limit, offset)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  http.StatusOK,
+			"total":   result.Total,
+			"records": result.Records,
+		})
+	}
+}
+
+// genderStatsHandler counts the identities by gender.
+func genderStatsHandler(s *store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buckets, err := s.CountByGender(r.Context())
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  http.StatusOK,
+			"buckets": buckets,
+		})
+	}
+}
+
+// dobStatsHandler counts the identities by year or month of birth between the optional
+// from and to dates.
+func dobStatsHandler(s *store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		interval := query.Get("interval")
+		if interval == "" {
+			interval = "year"
+		}
+		if interval != "year" && interval != "month" {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "interval must be year or month",
+			})
+			return
+		}
+
+		from, to := query.Get("from"), query.Get("to")
+		for _, date := range []string{from, to} {
+			if date == "" {
+				continue
+			}
+			if _, err := time.Parse("2006-01-02", date); err != nil {
+				respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+					"status":  http.StatusBadRequest,
+					"message": "from and to must be dates in the 2006-01-02 format",
+				})
+				return
+			}
+		}
+
+		buckets, err := s.CountByBirthDate(r.Context(), interval, from, to)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":   http.StatusOK,
+			"interval": interval,
+			"buckets":  buckets,
+		})
+	}
+}
+
+// checkpointHandler reports the position of the last indexed event.
+func checkpointHandler(s *store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checkpoint, err := s.Checkpoint(r.Context())
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":     http.StatusOK,
+			"checkpoint": checkpoint,
+		})
+	}
+}
+
+// replayHandler restarts the indexing from the fromBlock block.
+func replayHandler(l *listener) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		block, err := strconv.ParseUint(r.URL.Query().Get("fromBlock"), 10, 64)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"status":  http.StatusBadRequest,
+				"message": "fromBlock must be a block number",
+			})
+			return
+		}
+
+		if err = l.Replay(r.Context(), block); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		respondJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status":  http.StatusAccepted,
+			"message": "Replaying identity events from block " + strconv.FormatUint(block, 10),
+		})
+	}
+}
+
+func intParam(w http.ResponseWriter, value string, defaultValue int) (int, bool) {
+	if value == "" {
+		return defaultValue, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"status":  http.StatusBadRequest,
+			"message": "limit and offset must be positive numbers",
+		})
+		return 0, false
+	}
+	return n, true
+}
+
+func respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
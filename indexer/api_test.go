@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	handler := requireToken("s3cret")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"token", "Bearer s3cret", http.StatusNoContent},
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer s3cre", http.StatusUnauthorized},
+		{"not a bearer token", "Basic s3cret", http.StatusUnauthorized},
+		{"token prefix", "Bearer s3cret2", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		for _, target := range []string{"/search?q=jane", "/stats/gender", "/replay?fromBlock=0"} {
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Errorf("%s: %s = %d, want %d", test.name, target, rec.Code, test.status)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+#!/bin/bash
+
+function launch_indexer() {
+    export ORG=org1
+    export WORKSHOP_INGRESS_DOMAIN=localho.st
+    export WORKSHOP_NAMESPACE=test-network
+    export WORKSHOP_CRYPTO=/root/digital-identity/network/temp
+    export CHANNEL_MSP_DIR=${WORKSHOP_CRYPTO}/channel-msp
+    # admin identity enrolled with the enroller service
+    export INDEXER_MSP_DIR=${INDEXER_MSP_DIR:-${WORKSHOP_CRYPTO}/enrollments/${ORG}/users/indexer/msp}
+
+    local tls_pem=$CHANNEL_MSP_DIR/peerOrganizations/$ORG/msp/tlscacerts/tlsca-signcert.pem
+
+    echo "creating indexer secret indexer-identity"
+    kubectl create secret generic indexer-identity \
+      --from-file=tlsCertPath="$tls_pem" \
+      --from-file=certPath="$INDEXER_MSP_DIR/signcerts/cert.pem" \
+      --from-file=keyPath="$(ls $INDEXER_MSP_DIR/keystore/*_sk | head -1)" \
+      -n $WORKSHOP_NAMESPACE
+    # shared with the gateway, kept across redeployments
+    if ! kubectl get secret indexer-api-token -n $WORKSHOP_NAMESPACE >/dev/null 2>&1; then
+      echo "creating indexer secret indexer-api-token"
+      kubectl create secret generic indexer-api-token \
+        --from-literal=token="$(openssl rand -hex 32)" \
+        -n $WORKSHOP_NAMESPACE
+    fi
+    #build docker image and push to local registry
+    echo "building indexer docker image"
+    docker build -t localhost:5000/indexer .
+    echo "pushing indexer docker image to local registry"
+    docker push localhost:5000/indexer
+    #deploy indexer image to k8s
+    echo "deploying indexer to k8s"
+    kubectl -n $WORKSHOP_NAMESPACE apply -f ./deployment.yaml
+}
+
+function delete_indexer() {
+  export WORKSHOP_NAMESPACE=test-network
+  echo "deleting secret indexer-identity"
+  kubectl delete secret indexer-identity -n $WORKSHOP_NAMESPACE
+  echo "deleting indexer deploy"
+  kubectl -n $WORKSHOP_NAMESPACE delete -f ./deployment.yaml
+}
+
+delete_indexer
+launch_indexer
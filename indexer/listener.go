@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	reconnectDelay    = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// listener projects the identity chaincode events into the store. Events carry no PII,
+// so the listener reads the current state of every identity an event names. Applying
+// an event is idempotent: replaying events from any block converges on the current
+// ledger state, and the listener resumes right after its stored checkpoint.
+type listener struct {
+	network    *client.Network
+	evaluate   func(name string, args ...string) ([]byte, error)
+	chaincode  string
+	store      *store
+	startBlock uint64
+
+	mu      sync.Mutex
+	restart context.CancelFunc
+}
+
+func newListener(gw *client.Gateway, store *store, startBlock uint64) *listener {
+	channelName := envOrDefault("CHANNEL_NAME", "mychannel")
+	chaincodeName := envOrDefault("CHAINCODE_NAME", "identity")
+
+	network := gw.GetNetwork(channelName)
+	return &listener{
+		network:    network,
+		evaluate:   network.GetContract(chaincodeName).EvaluateTransaction,
+		chaincode:  chaincodeName,
+		store:      store,
+		startBlock: startBlock,
+	}
+}
+
+// Run reads the events until ctx is done, reconnecting with a growing delay when the
+// event stream fails.
+func (l *listener) Run(ctx context.Context) {
+	delay := reconnectDelay
+	for ctx.Err() == nil {
+		streamCtx, cancel := context.WithCancel(ctx)
+		l.mu.Lock()
+		l.restart = cancel
+		l.mu.Unlock()
+
+		applied, err := l.listen(streamCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if applied {
+			delay = reconnectDelay
+		}
+		if err != nil {
+			log.Printf("Identity event stream failed, reconnecting in %s: %v", delay, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, maxReconnectDelay)
+		}
+	}
+}
+
+// Replay moves the checkpoint to the start of block and restarts the event stream from it.
+func (l *listener) Replay(ctx context.Context, block uint64) error {
+	if err := l.store.SetCheckpoint(ctx, &Checkpoint{Block: block}); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.restart != nil {
+		l.restart()
+	}
+	log.Printf("Replaying identity events from block %d", block)
+	return nil
+}
+
+// listen opens the event stream at the checkpoint and applies the events until the
+// stream ends. It reports whether any event was applied.
+func (l *listener) listen(ctx context.Context) (bool, error) {
+	checkpoint, err := l.store.Checkpoint(ctx)
+	if err != nil {
+		return false, err
+	}
+	if checkpoint == nil {
+		checkpoint = &Checkpoint{Block: l.startBlock}
+	}
+
+	options := []client.ChaincodeEventsOption{client.WithStartBlock(checkpoint.Block)}
+	if checkpoint.TxID != "" {
+		options = append(options, client.WithCheckpoint(checkpoint))
+	}
+
+	events, err := l.network.ChaincodeEvents(ctx, l.chaincode, options...)
+	if err != nil {
+		return false, fmt.Errorf("failed to start chaincode event listening: %w", err)
+	}
+	log.Printf("Indexing identity events from block %d", checkpoint.Block)
+
+	applied := false
+	for event := range events {
+		if err = l.apply(ctx, event); err != nil {
+			return applied, err
+		}
+		applied = true
+	}
+	if ctx.Err() != nil {
+		return applied, nil
+	}
+	return applied, fmt.Errorf("event stream closed")
+}
+
+// apply projects a single event and stores its position as the checkpoint.
+func (l *listener) apply(ctx context.Context, event *client.ChaincodeEvent) error {
+	var payload model.IdentityEvent
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		log.Printf("Skipping event %s of transaction %s: %v", event.EventName, event.TransactionID, err)
+		payload = model.IdentityEvent{}
+	}
+
+	var changes []change
+	switch payload.Type {
+	case model.EventIdentityPurged, model.EventIdentityErased:
+		changes = append(changes, change{deleteID: payload.IdentityID})
+	case model.EventIdentityCreated, model.EventIdentityUpdated, model.EventIdentityDeleted,
+		model.EventIdentityRestored, model.EventIdentitiesImported:
+		ids := payload.IdentityIDs
+		if payload.IdentityID != "" {
+			ids = append(ids, payload.IdentityID)
+		}
+		for _, id := range ids {
+			c, err := l.read(id)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, c)
+		}
+	}
+
+	return l.store.Apply(ctx, changes, &Checkpoint{Block: event.BlockNumber, TxID: event.TransactionID})
+}
+
+// read returns the change bringing the index to the current state of the identity.
+func (l *listener) read(id string) (change, error) {
+	result, err := l.evaluate("ReadIdentityIncludingDeleted", id)
+	if err != nil {
+		if modelErr, ok := chaincodeError(err); ok && modelErr.Code == model.CodeNotFound {
+			// Purged or erased by a later transaction
+			return change{deleteID: id}, nil
+		}
+		return change{}, fmt.Errorf("failed to read identity %s: %w", id, err)
+	}
+
+	var idnty model.Identity
+	if err = json.Unmarshal(result, &idnty); err != nil {
+		return change{}, fmt.Errorf("failed to parse identity %s: %w", id, err)
+	}
+	return change{identity: &idnty}, nil
+}
+
+// chaincodeError extracts the coded error returned by the chaincode from the details of
+// the gRPC status returned by the gateway peer.
+func chaincodeError(err error) (*model.Error, bool) {
+	if grpcStatus, ok := status.FromError(err); ok {
+		for _, detail := range grpcStatus.Details() {
+			if errDetail, ok := detail.(*gateway.ErrorDetail); ok {
+				if modelErr, ok := model.ParseError(errDetail.GetMessage()); ok {
+					return modelErr, true
+				}
+			}
+		}
+	}
+	return model.ParseError(err.Error())
+}
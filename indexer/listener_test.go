@@ -0,0 +1,234 @@
+//go:build sqlite_fts5
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/digital-identity/model"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// testLedger answers ReadIdentityIncludingDeleted with its current identities.
+type testLedger struct {
+	identities map[string]*model.Identity
+	err        error
+}
+
+func (l *testLedger) evaluate(name string, args ...string) ([]byte, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	idnty, ok := l.identities[args[0]]
+	if !ok {
+		return nil, model.Errorf(model.CodeNotFound, "the identity %s does not exist", args[0])
+	}
+	return json.Marshal(idnty)
+}
+
+func openTestStore(t *testing.T, file string) *store {
+	t.Helper()
+	s, err := openStore(driverSQLite, "file:"+file+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestListener(t *testing.T) (*listener, *testLedger) {
+	t.Helper()
+	s := openTestStore(t, filepath.Join(t.TempDir(), "identities.db"))
+	t.Cleanup(func() { s.Close() })
+	ledger := &testLedger{identities: map[string]*model.Identity{}}
+	return &listener{evaluate: ledger.evaluate, store: s}, ledger
+}
+
+func testEvent(block uint64, txID string, eventType string, ids ...string) *client.ChaincodeEvent {
+	payload := model.IdentityEvent{Type: eventType, TxID: txID}
+	if len(ids) == 1 {
+		payload.IdentityID = ids[0]
+	} else {
+		payload.IdentityIDs = ids
+	}
+	jsonByte, _ := json.Marshal(payload)
+	return &client.ChaincodeEvent{BlockNumber: block, TransactionID: txID, EventName: eventType, Payload: jsonByte}
+}
+
+// search returns the ids of the identities matching the query.
+func search(t *testing.T, s *store, query string, includeDeleted bool) []string {
+	t.Helper()
+	result, err := s.Search(context.Background(), query, includeDeleted, maxSearchLimit, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(result.Total) != len(result.Records) {
+		t.Errorf("search %q total %d, %d records", query, result.Total, len(result.Records))
+	}
+	ids := []string{}
+	for _, idnty := range result.Records {
+		ids = append(ids, idnty.Id)
+	}
+	return ids
+}
+
+func assertCheckpoint(t *testing.T, s *store, block uint64, txID string) {
+	t.Helper()
+	checkpoint, err := s.Checkpoint(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint == nil || checkpoint.Block != block || checkpoint.TxID != txID {
+		t.Errorf("checkpoint %+v, want block %d transaction %s", checkpoint, block, txID)
+	}
+}
+
+func TestApplyIdempotent(t *testing.T) {
+	ctx := context.Background()
+	l, ledger := newTestListener(t)
+
+	ledger.identities["id1"] = &model.Identity{Id: "id1", FirstName: "Jane", LastName: "Doe", Gender: "female", Dob: "1990-04-01"}
+	ledger.identities["id2"] = &model.Identity{Id: "id2", FirstName: "John", LastName: "Roe", Gender: "male", Dob: "1985-12-31"}
+	events := []*client.ChaincodeEvent{
+		testEvent(3, "tx1", model.EventIdentityCreated, "id1"),
+		testEvent(4, "tx2", model.EventIdentitiesImported, "id1", "id2"),
+		testEvent(5, "tx3", model.EventIdentityUpdated, "id1"),
+	}
+	ledger.identities["id1"].LastName = "Smith"
+
+	// Replaying the events, or any of them, converges on the current ledger state
+	for round := 0; round < 2; round++ {
+		for _, event := range events {
+			if err := l.apply(ctx, event); err != nil {
+				t.Fatalf("apply %s: %v", event.TransactionID, err)
+			}
+		}
+		if err := l.apply(ctx, events[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ids := search(t, l.store, "jane", false); len(ids) != 1 || ids[0] != "id1" {
+		t.Errorf("search jane = %v, want [id1]", ids)
+	}
+	if ids := search(t, l.store, "smith", false); len(ids) != 1 {
+		t.Errorf("search smith = %v, want the updated id1", ids)
+	}
+	if ids := search(t, l.store, "doe", false); len(ids) != 0 {
+		t.Errorf("search doe = %v, want no stale name", ids)
+	}
+
+	buckets, err := l.store.CountByGender(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 || buckets[0].Count != 1 || buckets[1].Count != 1 {
+		t.Errorf("gender buckets %v, want one female and one male", buckets)
+	}
+	assertCheckpoint(t, l.store, 3, "tx1")
+
+	// A soft-deleted identity is kept, out of the default search and statistics
+	ledger.identities["id2"].DeletedAt = "2024-05-01T10:00:00Z"
+	if err = l.apply(ctx, testEvent(6, "tx4", model.EventIdentityDeleted, "id2")); err != nil {
+		t.Fatal(err)
+	}
+	if ids := search(t, l.store, "john", false); len(ids) != 0 {
+		t.Errorf("search john = %v, want no deleted identity", ids)
+	}
+	if ids := search(t, l.store, "john", true); len(ids) != 1 {
+		t.Errorf("search john including deleted = %v, want [id2]", ids)
+	}
+	if buckets, err = l.store.CountByBirthDate(ctx, "year", "", ""); err != nil || len(buckets) != 1 || buckets[0].Key != "1990" {
+		t.Errorf("year buckets %v: %v, want 1990 only", buckets, err)
+	}
+}
+
+func TestApplyErase(t *testing.T) {
+	ctx := context.Background()
+	l, ledger := newTestListener(t)
+
+	ledger.identities["id1"] = &model.Identity{Id: "id1", FirstName: "Jane", PresentAddress: "Dhanmondi"}
+	ledger.identities["id2"] = &model.Identity{Id: "id2", FirstName: "Jane", PresentAddress: "Gulshan"}
+	if err := l.apply(ctx, testEvent(3, "tx1", model.EventIdentitiesImported, "id1", "id2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The erase event removes the identity and its full-text entry
+	delete(ledger.identities, "id1")
+	if err := l.apply(ctx, testEvent(4, "tx2", model.EventIdentityErased, "id1")); err != nil {
+		t.Fatal(err)
+	}
+	if ids := search(t, l.store, "dhanmondi", true); len(ids) != 0 {
+		t.Errorf("search of an erased address = %v, want none", ids)
+	}
+	if ids := search(t, l.store, "jane", true); len(ids) != 1 || ids[0] != "id2" {
+		t.Errorf("search jane = %v, want [id2]", ids)
+	}
+
+	// Replaying the events of an identity erased since then does not restore it
+	if err := l.apply(ctx, testEvent(3, "tx1", model.EventIdentitiesImported, "id1", "id2")); err != nil {
+		t.Fatal(err)
+	}
+	if ids := search(t, l.store, "dhanmondi", true); len(ids) != 0 {
+		t.Errorf("search after replay = %v, want none", ids)
+	}
+
+	// Purged identities are removed the same way
+	delete(ledger.identities, "id2")
+	if err := l.apply(ctx, testEvent(5, "tx3", model.EventIdentityPurged, "id2")); err != nil {
+		t.Fatal(err)
+	}
+	if ids := search(t, l.store, "jane", true); len(ids) != 0 {
+		t.Errorf("search after purge = %v, want none", ids)
+	}
+	assertCheckpoint(t, l.store, 5, "tx3")
+}
+
+func TestCheckpointResume(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "identities.db")
+	s := openTestStore(t, file)
+	ledger := &testLedger{identities: map[string]*model.Identity{"id1": {Id: "id1", FirstName: "Jane"}}}
+	l := &listener{evaluate: ledger.evaluate, store: s}
+
+	if checkpoint, err := s.Checkpoint(ctx); err != nil || checkpoint != nil {
+		t.Fatalf("empty index checkpoint %+v: %v, want none", checkpoint, err)
+	}
+	if err := l.apply(ctx, testEvent(7, "tx1", model.EventIdentityCreated, "id1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed read applies nothing, the event is read again after the checkpoint
+	ledger.identities["id1"].FirstName = "Janet"
+	ledger.err = errors.New("peer unavailable")
+	if err := l.apply(ctx, testEvent(8, "tx2", model.EventIdentityUpdated, "id1")); err == nil {
+		t.Error("apply with the peer unavailable: no error")
+	}
+	assertCheckpoint(t, s, 7, "tx1")
+	if ids := search(t, s, "janet", false); len(ids) != 0 {
+		t.Errorf("search janet = %v, want the update not applied", ids)
+	}
+	s.Close()
+
+	// The index and its checkpoint survive a restart
+	s = openTestStore(t, file)
+	defer s.Close()
+	assertCheckpoint(t, s, 7, "tx1")
+	if ids := search(t, s, "jane", false); len(ids) != 1 {
+		t.Errorf("search jane after restart = %v, want [id1]", ids)
+	}
+
+	// Replay moves the checkpoint to the start of the block and restarts the stream
+	restarted := false
+	l = &listener{evaluate: ledger.evaluate, store: s, restart: func() { restarted = true }}
+	if err := l.Replay(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	assertCheckpoint(t, s, 2, "")
+	if !restarted {
+		t.Error("replay did not restart the event stream")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	store, err := openStore(
+		envOrDefault("INDEXER_DB_DRIVER", driverSQLite),
+		envOrDefault("INDEXER_DB_DSN", "file:/var/lib/indexer/identities.db?_journal_mode=WAL&_busy_timeout=5000"))
+	if err != nil {
+		log.Fatalf("Failed to open index database: %v", err)
+	}
+	defer store.Close()
+
+	// The gateway authenticates to the API with the shared token
+	token := os.Getenv("INDEXER_API_TOKEN")
+	if token == "" {
+		log.Fatal("INDEXER_API_TOKEN is required")
+	}
+
+	startBlock, err := strconv.ParseUint(envOrDefault("INDEXER_START_BLOCK", "0"), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid INDEXER_START_BLOCK: %v", err)
+	}
+
+	// new grpc connection to fabric peer
+	grpcConn, err := newGrpcConnection()
+	if err != nil {
+		log.Fatalf("Failed to initialize gRPC connection: %v", err)
+	}
+	defer grpcConn.Close()
+
+	gw, err := newGateway(grpcConn)
+	if err != nil {
+		log.Fatalf("Failed to connect to gateway: %v", err)
+	}
+	defer gw.Close()
+
+	events := newListener(gw, store, startBlock)
+
+	// INDEXER_REPLAY_FROM_BLOCK rebuilds the index from a block on startup
+	if value, ok := os.LookupEnv("INDEXER_REPLAY_FROM_BLOCK"); ok {
+		block, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid INDEXER_REPLAY_FROM_BLOCK: %v", err)
+		}
+		if err = events.Replay(ctx, block); err != nil {
+			log.Fatalf("Failed to replay identity events: %v", err)
+		}
+	}
+
+	go events.Run(ctx)
+
+	// The API is internal to the cluster, the gateway authorizes the clients
+	r := chi.NewRouter()
+	r.Use(middleware.Logger)
+	r.Use(middleware.Recoverer)
+	r.Use(requireToken(token))
+
+	r.Get("/search", searchHandler(store))
+	r.Get("/stats/gender", genderStatsHandler(store))
+	r.Get("/stats/dob", dobStatsHandler(store))
+	r.Get("/checkpoint", checkpointHandler(store))
+	r.Post("/replay", replayHandler(events))
+
+	port := envOrDefault("PORT", "8080")
+	server := &http.Server{Addr: ":" + port, Handler: r}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	log.Printf("Starting indexer on :%s", port)
+	if err = server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/hyperledger/digital-identity/model"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	driverSQLite   = "sqlite"
+	driverPostgres = "postgres"
+
+	// checkpointName is the row of the checkpoints table holding the listener position.
+	checkpointName = "identity-events"
+)
+
+// dialect holds the statements that differ between SQLite and Postgres. Both dialects
+// use $n placeholders.
+type dialect struct {
+	driverName string
+	schema     []string
+	// indexText refreshes the full-text index of an identity, empty when the index is
+	// maintained by the database.
+	indexText   string
+	unindexText string
+	search      string
+	searchCount string
+	searchQuery func(tokens []string) string
+}
+
+var sqliteDialect = dialect{
+	driverName: "sqlite3",
+	schema: []string{
+		`CREATE TABLE IF NOT EXISTS identities (
+			id TEXT PRIMARY KEY,
+			first_name TEXT NOT NULL DEFAULT '',
+			last_name TEXT NOT NULL DEFAULT '',
+			phone TEXT NOT NULL DEFAULT '',
+			email TEXT NOT NULL DEFAULT '',
+			dob TEXT NOT NULL DEFAULT '',
+			present_address TEXT NOT NULL DEFAULT '',
+			permanent_address TEXT NOT NULL DEFAULT '',
+			gender TEXT NOT NULL DEFAULT '',
+			national_id TEXT NOT NULL DEFAULT '',
+			owner TEXT NOT NULL DEFAULT '',
+			deleted_at TEXT NOT NULL DEFAULT '',
+			schema_version INTEGER NOT NULL DEFAULT 0,
+			block_number INTEGER NOT NULL DEFAULT 0,
+			tx_id TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS identities_gender ON identities (gender)`,
+		`CREATE INDEX IF NOT EXISTS identities_dob ON identities (dob)`,
+		`CREATE VIRTUAL TABLE IF NOT EXISTS identities_fts USING fts5(
+			id UNINDEXED, first_name, last_name, present_address, permanent_address
+		)`,
+		`CREATE TABLE IF NOT EXISTS checkpoints (
+			name TEXT PRIMARY KEY,
+			block_number INTEGER NOT NULL,
+			tx_id TEXT NOT NULL
+		)`,
+	},
+	indexText: `INSERT INTO identities_fts (id, first_name, last_name, present_address, permanent_address)
+		VALUES ($1, $2, $3, $4, $5)`,
+	unindexText: `DELETE FROM identities_fts WHERE id = $1`,
+	search: `SELECT ` + identityColumns("i.") + ` FROM identities_fts f JOIN identities i ON i.id = f.id
+		WHERE identities_fts MATCH $1 AND ($2 OR i.deleted_at = '')
+		ORDER BY bm25(identities_fts), i.id LIMIT $3 OFFSET $4`,
+	searchCount: `SELECT COUNT(*) FROM identities_fts f JOIN identities i ON i.id = f.id
+		WHERE identities_fts MATCH $1 AND ($2 OR i.deleted_at = '')`,
+	searchQuery: func(tokens []string) string {
+		terms := make([]string, len(tokens))
+		for i, token := range tokens {
+			terms[i] = `"` + token + `"*`
+		}
+		return strings.Join(terms, " ")
+	},
+}
+
+var postgresDialect = dialect{
+	driverName: "pgx",
+	schema: []string{
+		`CREATE TABLE IF NOT EXISTS identities (
+			id TEXT PRIMARY KEY,
+			first_name TEXT NOT NULL DEFAULT '',
+			last_name TEXT NOT NULL DEFAULT '',
+			phone TEXT NOT NULL DEFAULT '',
+			email TEXT NOT NULL DEFAULT '',
+			dob TEXT NOT NULL DEFAULT '',
+			present_address TEXT NOT NULL DEFAULT '',
+			permanent_address TEXT NOT NULL DEFAULT '',
+			gender TEXT NOT NULL DEFAULT '',
+			national_id TEXT NOT NULL DEFAULT '',
+			owner TEXT NOT NULL DEFAULT '',
+			deleted_at TEXT NOT NULL DEFAULT '',
+			schema_version INTEGER NOT NULL DEFAULT 0,
+			block_number BIGINT NOT NULL DEFAULT 0,
+			tx_id TEXT NOT NULL DEFAULT '',
+			search TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple',
+				first_name || ' ' || last_name || ' ' || present_address || ' ' || permanent_address)) STORED
+		)`,
+		`CREATE INDEX IF NOT EXISTS identities_gender ON identities (gender)`,
+		`CREATE INDEX IF NOT EXISTS identities_dob ON identities (dob)`,
+		`CREATE INDEX IF NOT EXISTS identities_search ON identities USING GIN (search)`,
+		`CREATE TABLE IF NOT EXISTS checkpoints (
+			name TEXT PRIMARY KEY,
+			block_number BIGINT NOT NULL,
+			tx_id TEXT NOT NULL
+		)`,
+	},
+	search: `SELECT ` + identityColumns("") + ` FROM identities
+		WHERE search @@ to_tsquery('simple', $1) AND ($2 OR deleted_at = '')
+		ORDER BY ts_rank(search, to_tsquery('simple', $1)) DESC, id LIMIT $3 OFFSET $4`,
+	searchCount: `SELECT COUNT(*) FROM identities
+		WHERE search @@ to_tsquery('simple', $1) AND ($2 OR deleted_at = '')`,
+	searchQuery: func(tokens []string) string {
+		terms := make([]string, len(tokens))
+		for i, token := range tokens {
+			terms[i] = token + ":*"
+		}
+		return strings.Join(terms, " & ")
+	},
+}
+
+func identityColumns(prefix string) string {
+	columns := []string{"id", "first_name", "last_name", "phone", "email", "dob", "present_address",
+		"permanent_address", "gender", "national_id", "owner", "deleted_at", "schema_version"}
+	for i, column := range columns {
+		columns[i] = prefix + column
+	}
+	return strings.Join(columns, ", ")
+}
+
+// Checkpoint is the position of the last identity event applied to the index. It
+// implements client.Checkpoint so that the listener resumes right after it.
+type Checkpoint struct {
+	Block uint64 `json:"blockNumber"`
+	TxID  string `json:"transactionID"`
+}
+
+func (c *Checkpoint) BlockNumber() uint64 {
+	return c.Block
+}
+
+func (c *Checkpoint) TransactionID() string {
+	return c.TxID
+}
+
+// change is the projection of an identity event: the identity to upsert, or the id of
+// the identity to remove from the index.
+type change struct {
+	identity *model.Identity
+	deleteID string
+}
+
+// CountBucket is a row of an aggregate.
+type CountBucket struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// SearchResult is a page of search results.
+type SearchResult struct {
+	Total   int64             `json:"total"`
+	Records []*model.Identity `json:"records"`
+}
+
+// store is the relational projection of the identities.
+type store struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+// openStore opens the database selected by INDEXER_DB_DRIVER and INDEXER_DB_DSN and
+// creates the schema.
+func openStore(driver string, dsn string) (*store, error) {
+	var d dialect
+	switch driver {
+	case driverSQLite:
+		d = sqliteDialect
+	case driverPostgres:
+		d = postgresDialect
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q, use sqlite or postgres", driver)
+	}
+
+	db, err := sql.Open(d.driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if driver == driverSQLite {
+		// SQLite allows a single writer
+		db.SetMaxOpenConns(1)
+	}
+
+	for _, statement := range d.schema {
+		if _, err = db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create schema: %w", err)
+		}
+	}
+
+	return &store{db: db, dialect: d}, nil
+}
+
+func (s *store) Close() error {
+	return s.db.Close()
+}
+
+// Checkpoint returns the stored listener position, nil when nothing was indexed yet.
+func (s *store) Checkpoint(ctx context.Context) (*Checkpoint, error) {
+	var checkpoint Checkpoint
+	err := s.db.QueryRowContext(ctx, `SELECT block_number, tx_id FROM checkpoints WHERE name = $1`,
+		checkpointName).Scan(&checkpoint.Block, &checkpoint.TxID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	return &checkpoint, nil
+}
+
+// SetCheckpoint moves the listener position, to replay the events from a block.
+func (s *store) SetCheckpoint(ctx context.Context, checkpoint *Checkpoint) error {
+	return s.setCheckpoint(ctx, s.db, checkpoint)
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *store) setCheckpoint(ctx context.Context, db execer, checkpoint *Checkpoint) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO checkpoints (name, block_number, tx_id) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE SET block_number = excluded.block_number, tx_id = excluded.tx_id`,
+		checkpointName, int64(checkpoint.Block), checkpoint.TxID)
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Apply writes the changes of an event and moves the checkpoint past it in a single
+// database transaction, so that the index never runs ahead of or behind its checkpoint.
+func (s *store) Apply(ctx context.Context, changes []change, checkpoint *Checkpoint) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, c := range changes {
+		if c.identity == nil {
+			err = s.delete(ctx, tx, c.deleteID)
+		} else {
+			err = s.upsert(ctx, tx, c.identity, checkpoint)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = s.setCheckpoint(ctx, tx, checkpoint); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *store) upsert(ctx context.Context, tx *sql.Tx, idnty *model.Identity, checkpoint *Checkpoint) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO identities (`+identityColumns("")+`, block_number, tx_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		ON CONFLICT (id) DO UPDATE SET
+			first_name = excluded.first_name, last_name = excluded.last_name, phone = excluded.phone,
+			email = excluded.email, dob = excluded.dob, present_address = excluded.present_address,
+			permanent_address = excluded.permanent_address, gender = excluded.gender,
+			national_id = excluded.national_id, owner = excluded.owner, deleted_at = excluded.deleted_at,
+			schema_version = excluded.schema_version, block_number = excluded.block_number, tx_id = excluded.tx_id`,
+		idnty.Id, idnty.FirstName, idnty.LastName, idnty.Phone, idnty.Email, idnty.Dob, idnty.PresentAddress,
+		idnty.PermanentAddress, idnty.Gender, idnty.NationalID, idnty.Owner, idnty.DeletedAt, idnty.SchemaVersion,
+		int64(checkpoint.Block), checkpoint.TxID)
+	if err != nil {
+		return fmt.Errorf("failed to index identity %s: %w", idnty.Id, err)
+	}
+
+	if s.dialect.indexText == "" {
+		return nil
+	}
+	if _, err = tx.ExecContext(ctx, s.dialect.unindexText, idnty.Id); err != nil {
+		return fmt.Errorf("failed to index identity %s: %w", idnty.Id, err)
+	}
+	if _, err = tx.ExecContext(ctx, s.dialect.indexText, idnty.Id, idnty.FirstName, idnty.LastName,
+		idnty.PresentAddress, idnty.PermanentAddress); err != nil {
+		return fmt.Errorf("failed to index identity %s: %w", idnty.Id, err)
+	}
+	return nil
+}
+
+func (s *store) delete(ctx context.Context, tx *sql.Tx, id string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM identities WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("failed to remove identity %s: %w", id, err)
+	}
+	if s.dialect.unindexText != "" {
+		if _, err := tx.ExecContext(ctx, s.dialect.unindexText, id); err != nil {
+			return fmt.Errorf("failed to remove identity %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// Search returns the identities whose names or addresses contain words starting with
+// every word of the query.
+func (s *store) Search(ctx context.Context, query string, includeDeleted bool, limit int, offset int) (*SearchResult, error) {
+	result := &SearchResult{Records: []*model.Identity{}}
+
+	tokens := searchTokens(query)
+	if len(tokens) == 0 {
+		return result, nil
+	}
+	match := s.dialect.searchQuery(tokens)
+
+	if err := s.db.QueryRowContext(ctx, s.dialect.searchCount, match, includeDeleted).Scan(&result.Total); err != nil {
+		return nil, fmt.Errorf("failed to search identities: %w", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.search, match, includeDeleted, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search identities: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var idnty model.Identity
+		if err = rows.Scan(&idnty.Id, &idnty.FirstName, &idnty.LastName, &idnty.Phone, &idnty.Email, &idnty.Dob,
+			&idnty.PresentAddress, &idnty.PermanentAddress, &idnty.Gender, &idnty.NationalID, &idnty.Owner,
+			&idnty.DeletedAt, &idnty.SchemaVersion); err != nil {
+			return nil, fmt.Errorf("failed to read identity: %w", err)
+		}
+		result.Records = append(result.Records, &idnty)
+	}
+	return result, rows.Err()
+}
+
+// searchTokens splits the query in lower case words of letters and digits, dropping the
+// characters that have a meaning in the full-text query syntax.
+func searchTokens(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// CountByGender counts the identities that are not deleted by gender.
+func (s *store) CountByGender(ctx context.Context) ([]CountBucket, error) {
+	return s.count(ctx, `SELECT gender, COUNT(*) FROM identities WHERE deleted_at = ''
+		GROUP BY gender ORDER BY gender`)
+}
+
+// CountByBirthDate counts the identities that are not deleted by year or month of birth,
+// for the dates of birth between from and to inclusive. Empty bounds are open.
+func (s *store) CountByBirthDate(ctx context.Context, interval string, from string, to string) ([]CountBucket, error) {
+	length := 4
+	if interval == "month" {
+		length = 7
+	}
+	if to == "" {
+		to = "9999-12-31"
+	}
+	return s.count(ctx, `SELECT substr(dob, 1, $1) AS bucket, COUNT(*) FROM identities
+		WHERE deleted_at = '' AND dob <> '' AND dob >= $2 AND dob <= $3
+		GROUP BY bucket ORDER BY bucket`, length, from, to)
+}
+
+func (s *store) count(ctx context.Context, query string, args ...interface{}) ([]CountBucket, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate identities: %w", err)
+	}
+	defer rows.Close()
+
+	buckets := []CountBucket{}
+	for rows.Next() {
+		var bucket CountBucket
+		if err = rows.Scan(&bucket.Key, &bucket.Count); err != nil {
+			return nil, fmt.Errorf("failed to aggregate identities: %w", err)
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, rows.Err()
+}